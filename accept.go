@@ -0,0 +1,20 @@
+package imgserver
+
+import "golang.org/x/net/context"
+
+// Accept header of image fetches by default. CDNs negotiating image formats
+// return smaller modern ones then, instead of format of image URL.
+const DefaultImageAccept = "image/avif,image/webp,image/*"
+
+func setImageAccept(ctx context.Context, accept string) context.Context {
+	return context.WithValue(ctx, ctxImageAcceptKey, accept)
+}
+
+// returns Accept header of image fetches set for request, or DefaultImageAccept
+func getImageAccept(ctx context.Context) string {
+	accept, ok := ctx.Value(ctxImageAcceptKey).(string)
+	if !ok {
+		return DefaultImageAccept
+	}
+	return accept
+}
@@ -0,0 +1,42 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+var _ = Describe("image Accept header", func() {
+	var (
+		origin *httptest.Server
+		accept chan string
+	)
+	BeforeEach(func() {
+		accept = make(chan string, 1)
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			accept <- req.Header.Get("Accept")
+			w.Header().Set("Content-Type", "image/webp")
+			w.Write([]byte("RIFF"))
+		}))
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	fetch := func(ctx context.Context) string {
+		ctx = context.WithValue(setLogger(ctx, log.StandardLogger()), CtxHTTPClientKey, http.DefaultClient)
+		Eventually(startFetch(ctx, imageFetcherFunc(fetchImage), imgTag{0, []html.Attribute{{Key: "src", Val: "a"}}, nil}, origin.URL+"/a")).Should(Receive())
+		return <-accept
+	}
+	It("then modern formats accepted by default", func() {
+		Expect(fetch(context.Background())).To(Equal(DefaultImageAccept))
+	})
+	It("then configured header sent", func() {
+		Expect(fetch(setImageAccept(context.Background(), "image/png"))).To(Equal("image/png"))
+		Expect(fetch(setImageAccept(context.Background(), ""))).To(BeEmpty())
+	})
+})
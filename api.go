@@ -0,0 +1,63 @@
+package imgserver
+
+import (
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// API routes. Breaking changes should be shipped under new version prefix,
+// old versions stay served as is.
+const (
+	APIVersion = "v1"
+	RootPath   = "/"
+	InlinePath = "/" + APIVersion + "/inline"
+)
+
+// Routes service API requests. Root path is an alias of current version
+// inline endpoint for backward compatibility.
+// Returned mux can be extended by caller with other handlers.
+func NewAPIMux(inline http.Handler) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle(InlinePath, inline)
+	mux.HandleFunc(OpenAPIPath, OpenAPIHandler)
+	mux.Handle(RootPath, exactPathHandler{RootPath, inline})
+	return mux
+}
+
+// Serves only requests on exact path, responds 404 on others.
+// http.ServeMux treats subtree patterns like "/" as prefix.
+type exactPathHandler struct {
+	path string
+	h    http.Handler
+}
+
+func (h exactPathHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != h.path {
+		http.NotFound(w, r)
+		return
+	}
+	h.h.ServeHTTP(w, r)
+}
+
+// Routes requests to LogicHandler by exact URL path, responds 404 on others.
+// Paths ending in slash, like http.ServeMux subtree patterns, route all paths under them,
+// longest one is chosen. Root path is routed exactly, as by API mux.
+type LogicMux map[string]LogicHandler
+
+func (m LogicMux) HandleLogic(ctx context.Context, req *http.Request) (*Response, error) {
+	h, ok := m[req.URL.Path]
+	if !ok {
+		longest := ""
+		for pattern, handler := range m {
+			if pattern != RootPath && strings.HasSuffix(pattern, "/") && strings.HasPrefix(req.URL.Path, pattern) && len(pattern) > len(longest) {
+				longest, h = pattern, handler
+			}
+		}
+		if h == nil {
+			return nil, NewHandlerError(http.StatusNotFound, "not found")
+		}
+	}
+	return h.HandleLogic(ctx, req)
+}
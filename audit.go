@@ -0,0 +1,215 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Outbound request audit record.
+type AuditRecord struct {
+	Time     time.Time    `json:"time"`
+	Client   string       `json:"client"`           // requester IP
+	APIKey   string       `json:"apikey,omitempty"` // requester API key ID
+	URL      string       `json:"url"`
+	Status   int          `json:"status,omitempty"` // 0 if request failed
+	Bytes    int64        `json:"bytes"`            // response body bytes read
+	Duration float64      `json:"duration_ms"`
+	Error    string       `json:"error,omitempty"`
+	Timing   *FetchTiming `json:"timing,omitempty"`
+}
+
+type AuditSink interface {
+	Record(rec AuditRecord)
+}
+
+type AuditSinkFunc func(rec AuditRecord)
+
+func (f AuditSinkFunc) Record(rec AuditRecord) {
+	f(rec)
+}
+
+// Records to every sink.
+type MultiAuditSink []AuditSink
+
+func (sinks MultiAuditSink) Record(rec AuditRecord) {
+	for _, sink := range sinks {
+		sink.Record(rec)
+	}
+}
+
+// Writes records as JSON lines, for example to stdout consumed by external collector.
+type WriterAuditSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewWriterAuditSink(w io.Writer) *WriterAuditSink {
+	return &WriterAuditSink{w: w}
+}
+
+func (s *WriterAuditSink) Record(rec AuditRecord) {
+	data, _ := json.Marshal(rec)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(append(data, '\n'))
+}
+
+// Writes records as JSON lines to file, rotated on MaxSize to path.1 ... path.<MaxBackups>.
+type FileAuditSink struct {
+	Log        Logger
+	Path       string
+	MaxSize    int64 // bytes, no rotation if 0
+	MaxBackups int
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+func NewFileAuditSink(log Logger, path string, maxSize int64, maxBackups int) (*FileAuditSink, error) {
+	s := &FileAuditSink{Log: log, Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *FileAuditSink) open() error {
+	file, err := os.OpenFile(s.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	s.file, s.size = file, info.Size()
+	return nil
+}
+
+func (s *FileAuditSink) Record(rec AuditRecord) {
+	data, _ := json.Marshal(rec)
+	data = append(data, '\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.MaxSize > 0 && s.size+int64(len(data)) > s.MaxSize && s.size > 0 {
+		if err := s.rotate(); err != nil {
+			SetEmitter(s.Log, "FileAuditSink").Error("audit log rotate error: ", err)
+		}
+	}
+	if s.file == nil {
+		return
+	}
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+	if err != nil {
+		SetEmitter(s.Log, "FileAuditSink").Error("audit log write error: ", err)
+	}
+}
+
+func (s *FileAuditSink) rotate() error {
+	s.file.Close()
+	s.file = nil
+	for i := s.MaxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprint(s.Path, ".", i), fmt.Sprint(s.Path, ".", i+1))
+	}
+	if s.MaxBackups > 0 {
+		if err := os.Rename(s.Path, s.Path+".1"); err != nil {
+			return err
+		}
+	} else if err := os.Remove(s.Path); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+func (s *FileAuditSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// requester of outbound requests
+type auditor struct {
+	sink   AuditSink
+	client string
+	apiKey string
+}
+
+// Handler decorator, that makes all outbound page and image requests recorded to Sink.
+// Should be wrapped by AuthHandler, to record API key.
+type AuditHandler struct {
+	Handler
+	Sink AuditSink
+}
+
+func (h AuditHandler) ServeHTTPC(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	ctx = context.WithValue(ctx, ctxAuditorKey, &auditor{h.Sink, clientIP(req), getAPIKeyID(ctx)})
+	h.Handler.ServeHTTPC(ctx, w, req)
+}
+
+// returns nil if requests are not audited
+func getAuditor(ctx context.Context) *auditor {
+	a, _ := ctx.Value(ctxAuditorKey).(*auditor)
+	return a
+}
+
+// records request result, or makes response body record it on close
+func (a *auditor) audit(url string, trace *fetchTrace, resp *http.Response, err error) {
+	if a == nil {
+		return
+	}
+	rec := AuditRecord{Time: trace.start, Client: a.client, APIKey: a.apiKey, URL: url}
+	if err != nil {
+		rec.Error = err.Error()
+		rec.Duration = msSince(trace.start)
+		timing := trace.timing()
+		rec.Timing = &timing
+		a.sink.Record(rec)
+		return
+	}
+	rec.Status = resp.StatusCode
+	resp.Body = &auditBody{ReadCloser: resp.Body, sink: a.sink, rec: rec, trace: trace}
+}
+
+type auditBody struct {
+	io.ReadCloser
+	sink   AuditSink
+	rec    AuditRecord
+	trace  *fetchTrace
+	closed bool
+}
+
+func (b *auditBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.rec.Bytes += int64(n)
+	return n, err
+}
+
+func (b *auditBody) Close() error {
+	if !b.closed {
+		b.closed = true
+		b.rec.Duration = msSince(b.rec.Time)
+		timing := b.trace.timing()
+		b.rec.Timing = &timing
+		b.sink.Record(b.rec)
+	}
+	return b.ReadCloser.Close()
+}
+
+func msSince(t time.Time) float64 {
+	return float64(time.Since(t)) / float64(time.Millisecond)
+}
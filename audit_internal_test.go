@@ -0,0 +1,79 @@
+package imgserver
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("audit", func() {
+	var (
+		records []AuditRecord
+		origin  *httptest.Server
+	)
+	BeforeEach(func() {
+		records = nil
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Write([]byte("12345"))
+		}))
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+
+	It("then outbound request recorded with requester", func() {
+		sink := AuditSinkFunc(func(rec AuditRecord) { records = append(records, rec) })
+		handler := AuditHandler{handlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+			ctx = context.WithValue(ctx, CtxHTTPClientKey, http.DefaultClient)
+			resp, err := cxtAwareGet(ctx, origin.URL+"/img.png")
+			Expect(err).NotTo(HaveOccurred())
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}), sink}
+		req, err := http.NewRequest("GET", "http://localhost:8888/?url=x", nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.RemoteAddr = "192.0.2.1:1000"
+		ctx := context.WithValue(context.Background(), CtxAPIKeyIDKey, "team")
+		handler.ServeHTTPC(ctx, httptest.NewRecorder(), req)
+
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].URL).To(Equal(origin.URL + "/img.png"))
+		Expect(records[0].Client).To(Equal("192.0.2.1"))
+		Expect(records[0].APIKey).To(Equal("team"))
+		Expect(records[0].Status).To(Equal(200))
+		Expect(records[0].Bytes).To(BeEquivalentTo(5))
+	})
+
+	It("then file sink rotates", func() {
+		dir, err := ioutil.TempDir("", "audit")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "audit.log")
+		sink, err := NewFileAuditSink(logger.StandardLogger(), path, 100, 1)
+		Expect(err).NotTo(HaveOccurred())
+		for i := 0; i < 3; i++ {
+			sink.Record(AuditRecord{URL: "http://example.com/image.png", Client: "192.0.2.1"})
+		}
+		Expect(sink.Close()).To(Succeed())
+
+		file, err := os.Open(path)
+		Expect(err).NotTo(HaveOccurred())
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		Expect(scanner.Scan()).To(BeTrue())
+		var rec AuditRecord
+		Expect(json.Unmarshal(scanner.Bytes(), &rec)).To(Succeed())
+		Expect(rec.URL).To(Equal("http://example.com/image.png"))
+		_, err = os.Stat(path + ".1")
+		Expect(err).NotTo(HaveOccurred())
+	})
+})
@@ -0,0 +1,339 @@
+package imgserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const APIKeyHeader = "X-Api-Key"
+
+type APIKey struct {
+	ID        string
+	Secret    string  // static key passed by client, empty for JWT only identities
+	RateLimit float64 // requests per second, no limit if 0
+	Burst     int
+	Quota     Quota
+}
+
+type KeyUsage struct {
+	ID       string
+	Requests uint64 // authenticated requests
+	Limited  uint64 // requests rejected by rate limit
+}
+
+type apiKeyState struct {
+	APIKey
+	requests uint64 // use atomically
+	limited  uint64 // use atomically
+	usage    usageWindow
+	seen     time.Time // last authentication of JWT subject without configured key, guarded by AuthHandler.mu
+}
+
+// Max JWT subjects without configured key, after which least recently seen ones are dropped.
+const maxJWTSubjects = 10000
+
+func newAPIKeyState(key APIKey) *apiKeyState {
+	return &apiKeyState{APIKey: key}
+}
+
+// Handler decorator, that authenticates requests by static API key or JWT bearer token,
+// applies per key rate limits and quotas, and accounts usage.
+// Static key passed in X-Api-Key header or as bearer token.
+// JWT should be signed by HS256, 'sub' claim is key ID. Keys with ID not configured
+// are served with JWTKey limits, and their usage is kept for recently seen subjects only.
+// Authenticated key ID is set in context by CtxAPIKeyIDKey.
+// Requests on UsagePath are answered with usage of requesting key.
+type AuthHandler struct {
+	Handler
+	Log       Logger
+	JWTSecret []byte      // JWT are not accepted if empty
+	JWTKey    APIKey      // limits of JWT subjects without configured key
+	Limiter   RateLimiter // of key rate limits, requests are not limited if it fails
+
+	mu       sync.Mutex
+	secrets  map[string]*apiKeyState
+	ids      map[string]*apiKeyState // configured keys
+	subjects map[string]*apiKeyState // JWT subjects without configured key
+}
+
+func NewAuthHandler(h Handler, log Logger, keys []APIKey, jwtSecret []byte) *AuthHandler {
+	res := &AuthHandler{
+		Handler:   h,
+		Log:       log,
+		JWTSecret: jwtSecret,
+		Limiter:   NewLocalRateLimiter(),
+		secrets:   make(map[string]*apiKeyState),
+		ids:       make(map[string]*apiKeyState),
+		subjects:  make(map[string]*apiKeyState),
+	}
+	for _, key := range keys {
+		state := newAPIKeyState(key)
+		res.ids[key.ID] = state
+		if key.Secret != "" {
+			res.secrets[key.Secret] = state
+		}
+	}
+	return res
+}
+
+// Parses API key in "id:secret[:rate[:burst]]" form.
+func ParseAPIKey(s string) (APIKey, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 4 || parts[0] == "" || parts[1] == "" {
+		return APIKey{}, errors.New("API key should be in id:secret[:rate[:burst]] form")
+	}
+	key := APIKey{ID: parts[0], Secret: parts[1]}
+	var err error
+	if len(parts) > 2 {
+		if key.RateLimit, err = strconv.ParseFloat(parts[2], 64); err != nil || key.RateLimit < 0 {
+			return APIKey{}, errors.New("invalid API key rate: " + parts[2])
+		}
+		key.Burst = int(key.RateLimit)
+	}
+	if len(parts) > 3 {
+		if key.Burst, err = strconv.Atoi(parts[3]); err != nil || key.Burst < 0 {
+			return APIKey{}, errors.New("invalid API key burst: " + parts[3])
+		}
+	}
+	return key, nil
+}
+
+func (h *AuthHandler) ServeHTTPC(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	log := SetEmitter(h.Log, "AuthHandler")
+	key, err := h.authenticate(req)
+	if err != nil {
+		log.WithField("remote", req.RemoteAddr).Info("authentication failed: ", err)
+		resp := NewErrorResponse(http.StatusUnauthorized, err.Error())
+		resp.Header.Set("WWW-Authenticate", `Bearer realm="imgserver"`)
+		writeResponse(log, w, req, resp)
+		return
+	}
+	log = log.WithField("apikey", key.ID)
+	if key.RateLimit > 0 && !h.allow(log, key) {
+		atomic.AddUint64(&key.limited, 1)
+		log.Info("rate limit exceeded")
+		resp := NewErrorResponse(http.StatusTooManyRequests, "rate limit exceeded")
+		resp.Header.Set("Retry-After", "1")
+		writeResponse(log, w, req, resp)
+		return
+	}
+	if req.URL.Path == UsagePath {
+		writeQuotaUsage(log, w, req, key.quotaUsage(time.Now()))
+		return
+	}
+	if usage := key.quotaUsage(time.Now()); usage.exceeded() {
+		atomic.AddUint64(&key.limited, 1)
+		log.Info("quota exceeded")
+		resp := NewErrorResponse(http.StatusTooManyRequests, "quota exceeded")
+		usage.setHeaders(resp.Header)
+		resp.Header.Set("Retry-After", strconv.FormatInt(usage.Reset, 10))
+		writeResponse(log, w, req, resp)
+		return
+	}
+	key.usage.add(time.Now(), 1, 0)
+	if !key.Quota.isZero() {
+		key.quotaUsage(time.Now()).setHeaders(w.Header())
+	}
+	atomic.AddUint64(&key.requests, 1)
+	ctx = context.WithValue(ctx, CtxAPIKeyIDKey, key.ID)
+	counter := &countingResponseWriter{ResponseWriter: w}
+	h.Handler.ServeHTTPC(ctx, counter, req)
+	key.usage.add(time.Now(), 0, counter.written)
+}
+
+// Takes token of key rate limit. Key is allowed, if limiter fails, so its outage does not fail requests.
+func (h *AuthHandler) allow(log Logger, key *apiKeyState) bool {
+	allowed, err := h.Limiter.Allow("apikey:"+key.ID, key.RateLimit, key.Burst)
+	if err != nil {
+		log.Warn("rate limiter error: ", err)
+		return true
+	}
+	return allowed
+}
+
+// Returns usage of every configured key, and of recently seen JWT subjects.
+func (h *AuthHandler) Usage() []KeyUsage {
+	keys := h.keys()
+	res := make([]KeyUsage, 0, len(keys))
+	for _, key := range keys {
+		res = append(res, KeyUsage{
+			ID:       key.ID,
+			Requests: atomic.LoadUint64(&key.requests),
+			Limited:  atomic.LoadUint64(&key.limited),
+		})
+	}
+	return res
+}
+
+func (h *AuthHandler) authenticate(req *http.Request) (*apiKeyState, error) {
+	token := req.Header.Get(APIKeyHeader)
+	if auth := req.Header.Get("Authorization"); token == "" && auth != "" {
+		const prefix = "Bearer "
+		if !strings.HasPrefix(auth, prefix) {
+			return nil, errors.New("unsupported authorization scheme")
+		}
+		token = strings.TrimSpace(auth[len(prefix):])
+	}
+	if token == "" {
+		return nil, errors.New("no API key or bearer token")
+	}
+	if key := h.lookupSecret(token); key != nil {
+		return key, nil
+	}
+	if len(h.JWTSecret) == 0 || strings.Count(token, ".") != 2 {
+		return nil, errors.New("invalid API key")
+	}
+	subject, err := verifyJWT(token, h.JWTSecret, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return h.lookupID(subject), nil
+}
+
+func (h *AuthHandler) lookupSecret(secret string) *apiKeyState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for keySecret, key := range h.secrets {
+		// constant time compare, not to leak key prefix by timing
+		if subtle.ConstantTimeCompare([]byte(keySecret), []byte(secret)) == 1 {
+			return key
+		}
+	}
+	return nil
+}
+
+// returns configured key, or state of JWT subject, created with JWTKey limits if it is not seen yet
+func (h *AuthHandler) lookupID(id string) *apiKeyState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if key, ok := h.ids[id]; ok {
+		return key
+	}
+	now := time.Now()
+	key, ok := h.subjects[id]
+	if !ok {
+		if len(h.subjects) >= maxJWTSubjects {
+			h.dropSubjects(now)
+		}
+		key = newAPIKey(h.JWTKey, id)
+		h.subjects[id] = key
+	}
+	key.seen = now
+	return key
+}
+
+// Drops subjects not seen within QuotaWindow, as they have no usage counted, then least recently
+// seen ones, until there is room for new one. Called with mu locked.
+func (h *AuthHandler) dropSubjects(now time.Time) {
+	for id, key := range h.subjects {
+		if now.Sub(key.seen) > QuotaWindow {
+			delete(h.subjects, id)
+		}
+	}
+	for len(h.subjects) >= maxJWTSubjects {
+		var oldest *apiKeyState
+		for _, key := range h.subjects {
+			if oldest == nil || key.seen.Before(oldest.seen) {
+				oldest = key
+			}
+		}
+		delete(h.subjects, oldest.ID)
+	}
+}
+
+// returns configured keys and JWT subjects
+func (h *AuthHandler) keys() []*apiKeyState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res := make([]*apiKeyState, 0, len(h.ids)+len(h.subjects))
+	for _, key := range h.ids {
+		res = append(res, key)
+	}
+	for _, key := range h.subjects {
+		res = append(res, key)
+	}
+	return res
+}
+
+func newAPIKey(template APIKey, id string) *apiKeyState {
+	template.ID = id
+	template.Secret = ""
+	return newAPIKeyState(template)
+}
+
+// verifies HS256 signed JWT and returns its subject
+func verifyJWT(token string, secret []byte, now time.Time) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return "", err
+	}
+	if header.Alg != "HS256" {
+		return "", errors.New("unsupported token algorithm")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("malformed token signature")
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", errors.New("invalid token signature")
+	}
+	var claims struct {
+		Sub string `json:"sub"`
+		Exp *int64 `json:"exp"`
+		Nbf *int64 `json:"nbf"`
+	}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return "", err
+	}
+	if claims.Exp != nil && now.Unix() >= *claims.Exp {
+		return "", errors.New("token expired")
+	}
+	if claims.Nbf != nil && now.Unix() < *claims.Nbf {
+		return "", errors.New("token not valid yet")
+	}
+	if claims.Sub == "" {
+		return "", errors.New("no token subject")
+	}
+	return claims.Sub, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return errors.New("malformed token")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("malformed token")
+	}
+	return nil
+}
+
+// checks "Authorization: Bearer <token>" header in constant time
+func checkBearerToken(req *http.Request, token string) bool {
+	const prefix = "Bearer "
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(strings.TrimSpace(auth[len(prefix):])), []byte(token)) == 1
+}
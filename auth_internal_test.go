@@ -0,0 +1,165 @@
+package imgserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+type handlerFunc func(ctx context.Context, w http.ResponseWriter, req *http.Request)
+
+func (f handlerFunc) ServeHTTPC(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	f(ctx, w, req)
+}
+
+func signTestJWT(secret []byte, claims string) string {
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
+
+var _ = Describe("auth handler", func() {
+	var (
+		jwtSecret = []byte("jwtsecret")
+		handler   *AuthHandler
+		req       *http.Request
+		rec       *httptest.ResponseRecorder
+		gotKeyID  string
+	)
+	BeforeEach(func() {
+		gotKeyID = ""
+		inner := handlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+			gotKeyID = getAPIKeyID(ctx)
+			w.WriteHeader(200)
+		})
+		handler = NewAuthHandler(inner, logger.StandardLogger(), []APIKey{
+			{ID: "team", Secret: "teamsecret"},
+			{ID: "limited", Secret: "limitedsecret", RateLimit: 0.001, Burst: 1},
+		}, jwtSecret)
+		var err error
+		req, err = http.NewRequest("GET", "http://localhost:8888/?url=https%3A%2F%2Fgolang.org%2Fdoc%2F", nil)
+		Expect(err).NotTo(HaveOccurred())
+		rec = httptest.NewRecorder()
+	})
+	JustBeforeEach(func() {
+		handler.ServeHTTPC(context.Background(), rec, req)
+	})
+
+	Context("when no credentials", func() {
+		It("then unauthorized", func() {
+			Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+			Expect(rec.Header().Get("WWW-Authenticate")).NotTo(BeEmpty())
+		})
+	})
+	Context("when static key in header", func() {
+		BeforeEach(func() {
+			req.Header.Set(APIKeyHeader, "teamsecret")
+		})
+		It("then passed with key ID in context", func() {
+			Expect(rec.Code).To(Equal(200))
+			Expect(gotKeyID).To(Equal("team"))
+		})
+	})
+	Context("when wrong static key", func() {
+		BeforeEach(func() {
+			req.Header.Set("Authorization", "Bearer wrong")
+		})
+		It("then unauthorized", func() {
+			Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+	Context("when rate limit exceeded", func() {
+		BeforeEach(func() {
+			req.Header.Set(APIKeyHeader, "limitedsecret")
+			handler.ServeHTTPC(context.Background(), httptest.NewRecorder(), req)
+		})
+		It("then too many requests", func() {
+			Expect(rec.Code).To(Equal(http.StatusTooManyRequests))
+			Expect(handler.Usage()).To(ContainElement(KeyUsage{ID: "limited", Requests: 1, Limited: 1}))
+		})
+	})
+	Context("when valid JWT", func() {
+		BeforeEach(func() {
+			req.Header.Set("Authorization", "Bearer "+signTestJWT(jwtSecret, `{"sub":"service"}`))
+		})
+		It("then passed with subject as key ID", func() {
+			Expect(rec.Code).To(Equal(200))
+			Expect(gotKeyID).To(Equal("service"))
+		})
+	})
+	Context("when JWT signed by another secret", func() {
+		BeforeEach(func() {
+			req.Header.Set("Authorization", "Bearer "+signTestJWT([]byte("another"), `{"sub":"service"}`))
+		})
+		It("then unauthorized", func() {
+			Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+		})
+	})
+})
+
+var _ = Describe("JWT subjects", func() {
+	It("then stale and least recently seen subjects dropped, when there are too many", func() {
+		handler := NewAuthHandler(nil, logger.StandardLogger(), []APIKey{{ID: "service", Secret: "s"}}, []byte("jwt"))
+		for i := 0; i < maxJWTSubjects; i++ {
+			handler.lookupID("subject" + strconv.Itoa(i))
+		}
+		recent := time.Now().Add(-time.Hour)
+		for _, key := range handler.subjects {
+			key.seen = recent
+		}
+		handler.subjects["subject1"].seen = time.Now().Add(-2 * QuotaWindow)
+		handler.subjects["subject2"].seen = recent.Add(-time.Minute)
+		handler.lookupID("service")
+		handler.lookupID("new")
+		Expect(len(handler.subjects)).To(Equal(maxJWTSubjects))
+		Expect(handler.subjects).NotTo(HaveKey("subject1"))
+		Expect(handler.subjects).To(HaveKey("subject2"))
+		handler.lookupID("newer")
+		Expect(len(handler.subjects)).To(Equal(maxJWTSubjects))
+		Expect(handler.subjects).NotTo(HaveKey("subject2"))
+		Expect(handler.subjects).To(HaveKey("new"))
+		Expect(handler.subjects).NotTo(HaveKey("service"))
+		Expect(handler.ids).To(HaveKey("service"))
+	})
+})
+
+var _ = Describe("JWT verification", func() {
+	secret := []byte("secret")
+	now := time.Unix(1000, 0)
+	It("then expired token rejected", func() {
+		_, err := verifyJWT(signTestJWT(secret, `{"sub":"a","exp":1000}`), secret, now)
+		Expect(err).To(HaveOccurred())
+	})
+	It("then not yet valid token rejected", func() {
+		_, err := verifyJWT(signTestJWT(secret, `{"sub":"a","nbf":1001}`), secret, now)
+		Expect(err).To(HaveOccurred())
+	})
+	It("then valid token subject returned", func() {
+		sub, err := verifyJWT(signTestJWT(secret, `{"sub":"a","exp":1001,"nbf":1000}`), secret, now)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(sub).To(Equal("a"))
+	})
+})
+
+var _ = Describe("API key parse", func() {
+	It("then parses key with limits", func() {
+		key, err := ParseAPIKey("team:secret:2.5:10")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(key).To(Equal(APIKey{ID: "team", Secret: "secret", RateLimit: 2.5, Burst: 10}))
+	})
+	It("then fails without secret", func() {
+		_, err := ParseAPIKey("team")
+		Expect(err).To(HaveOccurred())
+	})
+})
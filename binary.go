@@ -0,0 +1,70 @@
+package imgserver
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+
+	"golang.org/x/net/context"
+)
+
+// Fetched image data, kept as is for outputs returning images in binary,
+// so they are never base64 encoded.
+type rawImage struct {
+	contentType string
+	data        []byte
+}
+
+// returns copy of img with src replaced by image URL, and raw data
+func (img imgTag) withRaw(imgURL string, contentType string, data []byte) imgTag {
+	res := img.withSrc(imgURL)
+	res.raw = &rawImage{contentType, data}
+	return res
+}
+
+// Makes fetchers keep inlined images raw, instead of data URLs.
+// Should be set only for outputs that don't need data URLs.
+func setRawImages(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxRawImagesKey, true)
+}
+
+func isRawImages(ctx context.Context) bool {
+	raw, _ := ctx.Value(ctxRawImagesKey).(bool)
+	return raw
+}
+
+// writes multipart/mixed body with HTML page of images, and inlined images as binary parts, to buf,
+// and returns its content type
+func formImagesMultipart(ctx context.Context, images []imgTag, buf *bytes.Buffer) (string, error) {
+	mw := multipart.NewWriter(buf)
+	if err := writeCIDPage(ctx, mw, images); err != nil {
+		return "", err
+	}
+	for i, img := range images {
+		if !img.isInlined() {
+			continue
+		}
+		contentType, data, err := img.inlineData()
+		if err != nil {
+			return "", err
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", contentType)
+		header.Set("Content-ID", fmt.Sprintf("<image%03d@imgserver>", i))
+		if img.raw != nil {
+			header.Set("Content-Location", img.src())
+		}
+		w, err := mw.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		if _, err = w.Write(data); err != nil {
+			return "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`multipart/mixed; boundary="%s"`, mw.Boundary()), nil
+}
@@ -0,0 +1,59 @@
+package imgserver
+
+import (
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("multipart format", func() {
+	var origin *httptest.Server
+	BeforeEach(func() {
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/":
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte(`<img src="/1.gif" alt="one"><img src="/big.gif">`))
+			default:
+				w.Header().Set("Content-Type", "image/gif")
+				w.Write([]byte("GIF89a\x00\xff" + r.URL.Path))
+			}
+		}))
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	It("then images returned as binary parts", func() {
+		req := httptest.NewRequest("GET", "/?format=multipart&inline_threshold=15&url="+url.QueryEscape(origin.URL+"/"), nil)
+		resp, err := NewImgLogicHandler(http.DefaultClient).HandleLogic(setLogger(context.Background(), logger.StandardLogger()), req)
+		Expect(err).NotTo(HaveOccurred())
+		mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(mediaType).To(Equal("multipart/mixed"))
+		Expect(resp.Header.Get(ImagesBytesHeader)).To(Equal("14"))
+
+		mr := multipart.NewReader(resp.Body, params["boundary"])
+		part, err := mr.NextPart()
+		Expect(err).NotTo(HaveOccurred())
+		page, _ := ioutil.ReadAll(part)
+		Expect(string(page)).To(ContainSubstring(`<img src="cid:image000@imgserver" alt="one">` + "\n" + `<img src="` + origin.URL + `/big.gif">`))
+
+		part, err = mr.NextPart()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(part.Header.Get("Content-Type")).To(Equal("image/gif"))
+		Expect(part.Header.Get("Content-ID")).To(Equal("<image000@imgserver>"))
+		Expect(part.Header.Get("Content-Location")).To(Equal(origin.URL + "/1.gif"))
+		data, _ := ioutil.ReadAll(part)
+		Expect(string(data)).To(Equal("GIF89a\x00\xff/1.gif"))
+		_, err = mr.NextPart()
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,246 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const AdminBlocklistPath = "/admin/blocklist"
+
+// Abuse blocklist. Clients, that got too many error responses within window,
+// or sent too long requests, are banned for BanDuration.
+// Clients are identified by remote IP.
+type Blocklist struct {
+	Log          Logger
+	MaxErrors    int // error responses within Window to ban client
+	Window       time.Duration
+	BanDuration  time.Duration
+	MaxURILength int    // longer requests are rejected with 414 and counted as error, no limit if 0
+	Path         string // file bans are persisted to, not persisted if empty
+
+	mu     sync.Mutex
+	bans   map[string]time.Time // client -> ban expiry
+	errors map[string]*errorWindow
+}
+
+type errorWindow struct {
+	start time.Time
+	count int
+}
+
+// Returns blocklist with bans loaded from path, if it is not empty and file exists.
+func NewBlocklist(log Logger, maxErrors int, window, banDuration time.Duration, path string) (*Blocklist, error) {
+	b := &Blocklist{
+		Log:         log,
+		MaxErrors:   maxErrors,
+		Window:      window,
+		BanDuration: banDuration,
+		Path:        path,
+		bans:        make(map[string]time.Time),
+		errors:      make(map[string]*errorWindow),
+	}
+	if path == "" {
+		return b, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &b.bans); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// returns ban expiry, or false if client is not banned
+func (b *Blocklist) Banned(client string) (time.Time, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	expiry, ok := b.bans[client]
+	if ok && time.Now().After(expiry) {
+		delete(b.bans, client)
+		return time.Time{}, false
+	}
+	return expiry, ok
+}
+
+func (b *Blocklist) Ban(client string, duration time.Duration) {
+	b.mu.Lock()
+	b.bans[client] = time.Now().Add(duration)
+	delete(b.errors, client)
+	b.mu.Unlock()
+	b.persist()
+}
+
+func (b *Blocklist) Unban(client string) {
+	b.mu.Lock()
+	delete(b.bans, client)
+	delete(b.errors, client)
+	b.mu.Unlock()
+	b.persist()
+}
+
+// returns not expired bans
+func (b *Blocklist) Bans() map[string]time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	res := make(map[string]time.Time, len(b.bans))
+	for client, expiry := range b.bans {
+		if now.Before(expiry) {
+			res[client] = expiry
+		}
+	}
+	return res
+}
+
+// counts client error, and bans client on too many errors
+func (b *Blocklist) recordError(client string) {
+	b.mu.Lock()
+	now := time.Now()
+	window, ok := b.errors[client]
+	if !ok || now.Sub(window.start) > b.Window {
+		window = &errorWindow{start: now}
+		b.errors[client] = window
+	}
+	window.count++
+	ban := b.MaxErrors > 0 && window.count >= b.MaxErrors
+	b.mu.Unlock()
+	if ban {
+		SetEmitter(b.Log, "Blocklist").WithField("client", client).Warn("client banned for too many errors")
+		b.Ban(client, b.BanDuration)
+	}
+}
+
+func (b *Blocklist) persist() {
+	if b.Path == "" {
+		return
+	}
+	data, err := json.Marshal(b.Bans())
+	if err == nil {
+		// rename is atomic, so file is never partially written
+		tmp := b.Path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, b.Path)
+		}
+	}
+	if err != nil {
+		SetEmitter(b.Log, "Blocklist").Error("blocklist persist error: ", err)
+	}
+}
+
+// Handler decorator, that rejects requests of banned clients with 403,
+// and records error responses to blocklist.
+type BlocklistHandler struct {
+	Handler
+	Blocklist *Blocklist
+}
+
+func (h BlocklistHandler) ServeHTTPC(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	log := SetEmitter(h.Blocklist.Log, "BlocklistHandler")
+	client := clientIP(req)
+	if expiry, banned := h.Blocklist.Banned(client); banned {
+		log.WithField("client", client).Debug("banned client request")
+		resp := NewErrorResponse(http.StatusForbidden, "client is banned")
+		resp.Header.Set("Retry-After", strconv.Itoa(int(expiry.Sub(time.Now()).Seconds())+1))
+		writeResponse(log, w, req, resp)
+		return
+	}
+	if h.Blocklist.MaxURILength > 0 && len(req.RequestURI) > h.Blocklist.MaxURILength {
+		h.Blocklist.recordError(client)
+		writeResponse(log, w, req, NewErrorResponse(http.StatusRequestURITooLong, "request URI is too long"))
+		return
+	}
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	h.Handler.ServeHTTPC(ctx, rec, req)
+	if rec.status >= 400 {
+		h.Blocklist.recordError(client)
+	}
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// Admin API of blocklist:
+// GET lists bans, POST ?client=&duration= bans client, DELETE ?client= unbans client.
+// Requests should have "Authorization: Bearer <Token>" header.
+type BlocklistAdminHandler struct {
+	Blocklist *Blocklist
+	Token     string
+}
+
+func (h BlocklistAdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	log := SetEmitter(h.Blocklist.Log, "BlocklistAdminHandler")
+	if h.Token == "" || !checkBearerToken(req, h.Token) {
+		writeResponse(log, w, req, NewErrorResponse(http.StatusUnauthorized, "invalid admin token"))
+		return
+	}
+	client := req.URL.Query().Get("client")
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost:
+		duration := h.Blocklist.BanDuration
+		if param := req.URL.Query().Get("duration"); param != "" {
+			var err error
+			if duration, err = time.ParseDuration(param); err != nil || duration <= 0 {
+				writeResponse(log, w, req, NewErrorResponse(400, "invalid duration: "+param))
+				return
+			}
+		}
+		if client == "" {
+			writeResponse(log, w, req, NewErrorResponse(400, "no client query parameter"))
+			return
+		}
+		log.WithField("client", client).Info("client banned by admin")
+		h.Blocklist.Ban(client, duration)
+	case http.MethodDelete:
+		if client == "" {
+			writeResponse(log, w, req, NewErrorResponse(400, "no client query parameter"))
+			return
+		}
+		log.WithField("client", client).Info("client unbanned by admin")
+		h.Blocklist.Unban(client)
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := NewResponse()
+	resp.StatusCode = http.StatusOK
+	resp.Header.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp.Body).Encode(h.Blocklist.Bans()); err != nil {
+		resp = NewInternalErrorResponse()
+	}
+	writeResponse(log, w, req, resp)
+}
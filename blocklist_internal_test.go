@@ -0,0 +1,87 @@
+package imgserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("blocklist", func() {
+	var (
+		blocklist *Blocklist
+		handler   BlocklistHandler
+		status    int
+	)
+	serve := func(remoteAddr string) int {
+		req, err := http.NewRequest("GET", "http://localhost:8888/?url=https%3A%2F%2Fgolang.org%2F", nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTPC(context.Background(), rec, req)
+		return rec.Code
+	}
+	BeforeEach(func() {
+		status = http.StatusBadRequest
+		var err error
+		blocklist, err = NewBlocklist(logger.StandardLogger(), 2, time.Minute, time.Minute, "")
+		Expect(err).NotTo(HaveOccurred())
+		handler = BlocklistHandler{handlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(status)
+		}), blocklist}
+	})
+
+	It("then client banned after too many errors", func() {
+		Expect(serve("192.0.2.1:1000")).To(Equal(http.StatusBadRequest))
+		Expect(serve("192.0.2.1:1001")).To(Equal(http.StatusBadRequest))
+		status = http.StatusOK
+		Expect(serve("192.0.2.1:1002")).To(Equal(http.StatusForbidden))
+		Expect(serve("192.0.2.2:1000")).To(Equal(http.StatusOK))
+	})
+	It("then unbanned client served", func() {
+		blocklist.Ban("192.0.2.1", time.Hour)
+		status = http.StatusOK
+		Expect(serve("192.0.2.1:1000")).To(Equal(http.StatusForbidden))
+		blocklist.Unban("192.0.2.1")
+		Expect(serve("192.0.2.1:1000")).To(Equal(http.StatusOK))
+	})
+	It("then bans persisted", func() {
+		dir, err := ioutil.TempDir("", "blocklist")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "bans.json")
+		blocklist.Path = path
+		blocklist.Ban("192.0.2.1", time.Hour)
+		loaded, err := NewBlocklist(logger.StandardLogger(), 2, time.Minute, time.Minute, path)
+		Expect(err).NotTo(HaveOccurred())
+		_, banned := loaded.Banned("192.0.2.1")
+		Expect(banned).To(BeTrue())
+	})
+
+	Describe("admin handler", func() {
+		admin := func(method, query, token string) int {
+			req, err := http.NewRequest(method, "http://localhost:8888"+AdminBlocklistPath+query, nil)
+			Expect(err).NotTo(HaveOccurred())
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			BlocklistAdminHandler{blocklist, "admintoken"}.ServeHTTP(rec, req)
+			return rec.Code
+		}
+		It("then bans and unbans client", func() {
+			Expect(admin("POST", "?client=192.0.2.1&duration=1h", "admintoken")).To(Equal(200))
+			Expect(blocklist.Bans()).To(HaveKey("192.0.2.1"))
+			Expect(admin("DELETE", "?client=192.0.2.1", "admintoken")).To(Equal(200))
+			Expect(blocklist.Bans()).To(BeEmpty())
+		})
+		It("then rejects invalid token", func() {
+			Expect(admin("GET", "", "wrong")).To(Equal(http.StatusUnauthorized))
+		})
+	})
+})
@@ -0,0 +1,39 @@
+package imgserver
+
+import (
+	"bytes"
+	"sync"
+)
+
+// Bigger buffers are not pooled, so rare huge pages and images don't stay in memory.
+const maxPooledBufferSize = 4 << 20
+
+// Buffers for page bodies, image data and intermediate renderings, reused across requests.
+// Buffer should be put back only when nothing references its bytes anymore;
+// buffers that are not put back are just collected.
+var buffers = newBufferPool(maxPooledBufferSize)
+
+type bufferPool struct {
+	pool    sync.Pool
+	maxSize int
+}
+
+func newBufferPool(maxSize int) *bufferPool {
+	return &bufferPool{
+		pool:    sync.Pool{New: func() interface{} { return &bytes.Buffer{} }},
+		maxSize: maxSize,
+	}
+}
+
+// returns empty buffer
+func (p *bufferPool) get() *bytes.Buffer {
+	return p.pool.Get().(*bytes.Buffer)
+}
+
+func (p *bufferPool) put(buf *bytes.Buffer) {
+	if buf == nil || buf.Cap() > p.maxSize {
+		return
+	}
+	buf.Reset()
+	p.pool.Put(buf)
+}
@@ -0,0 +1,66 @@
+package imgserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("buffer pool", func() {
+	It("then reused buffer is empty", func() {
+		pool := newBufferPool(1 << 10)
+		buf := pool.get()
+		buf.WriteString("data")
+		pool.put(buf)
+		Expect(pool.get().Len()).To(BeZero())
+	})
+	It("then data URL encoded", func() {
+		data := []byte("GIF89a\x00\xff\x01")
+		Expect(encodeDataURL("image/gif", data)).To(Equal("data:image/gif;base64," + base64.StdEncoding.EncodeToString(data)))
+	})
+	It("then image body read to buffer", func() {
+		resp := &http.Response{Body: ioutil.NopCloser(bytes.NewReader([]byte("image"))), ContentLength: 5}
+		buf, err := readImageBuffer(resp, "http://example.com/a.png", 5)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(buf.String()).To(Equal("image"))
+	})
+})
+
+var benchImage = bytes.Repeat([]byte{0x47, 0x49, 0x46, 0xff}, 64<<10)
+
+func benchImageResponse() *http.Response {
+	return &http.Response{Body: ioutil.NopCloser(bytes.NewReader(benchImage)), ContentLength: int64(len(benchImage))}
+}
+
+// Inlining of fetched image, as fetcher did before buffer pooling.
+func BenchmarkInlineImageAllocating(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			data, err := ioutil.ReadAll(benchImageResponse().Body)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_ = "data:image/gif;base64," + base64.StdEncoding.EncodeToString(data)
+		}
+	})
+}
+
+func BenchmarkInlineImagePooled(b *testing.B) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			buf, err := readImageBuffer(benchImageResponse(), "http://example.com/a.gif", 0)
+			if err != nil {
+				b.Fatal(err)
+			}
+			_ = encodeDataURL("image/gif", buf.Bytes())
+			buffers.put(buf)
+		}
+	})
+}
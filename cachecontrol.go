@@ -0,0 +1,91 @@
+package imgserver
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Returns Cache-Control directives, with lower case names and unquoted values.
+func parseCacheControl(header http.Header) map[string]string {
+	directives := make(map[string]string)
+	for _, value := range header["Cache-Control"] {
+		for _, directive := range strings.Split(value, ",") {
+			directive = strings.TrimSpace(directive)
+			if directive == "" {
+				continue
+			}
+			name, arg := directive, ""
+			if eq := strings.IndexByte(directive, '='); eq >= 0 {
+				name, arg = directive[:eq], strings.Trim(strings.TrimSpace(directive[eq+1:]), `"`)
+			}
+			directives[strings.ToLower(strings.TrimSpace(name))] = arg
+		}
+	}
+	return directives
+}
+
+// Returns remaining freshness lifetime of origin response, from Cache-Control max-age,
+// or Expires and Date headers, minus Age. Returns false if origin response has no freshness info.
+func originFreshness(header http.Header, now time.Time) (time.Duration, bool) {
+	directives := parseCacheControl(header)
+	var lifetime time.Duration
+	if arg, ok := directives["max-age"]; ok {
+		seconds, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || seconds < 0 {
+			// invalid max-age should be treated as stale
+			return 0, true
+		}
+		lifetime = time.Duration(seconds) * time.Second
+	} else if expires := header.Get("Expires"); expires != "" {
+		expiresTime, err := http.ParseTime(expires)
+		if err != nil {
+			// invalid dates, like "0", are in the past
+			return 0, true
+		}
+		date := now
+		if parsed, err := http.ParseTime(header.Get("Date")); err == nil {
+			date = parsed
+		}
+		lifetime = expiresTime.Sub(date)
+	} else {
+		return 0, false
+	}
+	if age, err := strconv.ParseInt(strings.TrimSpace(header.Get("Age")), 10, 64); err == nil && age > 0 {
+		lifetime -= time.Duration(age) * time.Second
+	}
+	if lifetime < 0 {
+		lifetime = 0
+	}
+	return lifetime, true
+}
+
+// Returns Cache-Control of response rendered from origin page with header:
+// page restrictions are kept, and max-age is remaining page freshness bounded by maxAge.
+// Responses of protected pages are private. Returns empty string if page has no caching headers.
+func renderedCacheControl(header http.Header, now time.Time, maxAge time.Duration, protected bool) string {
+	directives := parseCacheControl(header)
+	if _, ok := directives["no-store"]; ok {
+		return "no-store"
+	}
+	var res []string
+	if _, ok := directives["private"]; ok || protected {
+		res = append(res, "private")
+	}
+	if _, ok := directives["must-revalidate"]; ok {
+		res = append(res, "must-revalidate")
+	}
+	freshness, ok := originFreshness(header, now)
+	if _, noCache := directives["no-cache"]; noCache {
+		res = append(res, "no-cache")
+	} else if ok {
+		if freshness > maxAge {
+			freshness = maxAge
+		}
+		res = append(res, "max-age="+strconv.FormatInt(int64(freshness/time.Second), 10))
+	} else if !protected {
+		return ""
+	}
+	return strings.Join(res, ", ")
+}
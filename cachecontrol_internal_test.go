@@ -0,0 +1,43 @@
+package imgserver
+
+import (
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("origin cache headers", func() {
+	now := time.Date(2017, 1, 1, 12, 0, 0, 0, time.UTC)
+	cacheControl := func(protected bool, kv ...string) string {
+		header := http.Header{}
+		for i := 0; i < len(kv); i += 2 {
+			header.Add(kv[i], kv[i+1])
+		}
+		return renderedCacheControl(header, now, time.Hour, protected)
+	}
+
+	It("then max-age bounded by policy", func() {
+		Expect(cacheControl(false, "Cache-Control", "public, max-age=60")).To(Equal("max-age=60"))
+		Expect(cacheControl(false, "Cache-Control", "max-age=86400")).To(Equal("max-age=3600"))
+		Expect(cacheControl(false, "Cache-Control", "max-age=600", "Age", "100")).To(Equal("max-age=500"))
+	})
+	It("then Expires used without max-age", func() {
+		Expect(cacheControl(false, "Expires", now.Add(10*time.Minute).Format(http.TimeFormat),
+			"Date", now.Add(-time.Minute).Format(http.TimeFormat))).To(Equal("max-age=660"))
+		Expect(cacheControl(false, "Expires", "0")).To(Equal("max-age=0"))
+	})
+	It("then restrictions kept", func() {
+		Expect(cacheControl(false, "Cache-Control", "no-store, max-age=60")).To(Equal("no-store"))
+		Expect(cacheControl(false, "Cache-Control", "private, no-cache")).To(Equal("private, no-cache"))
+		Expect(cacheControl(false, "Cache-Control", "max-age=60, must-revalidate")).To(Equal("must-revalidate, max-age=60"))
+	})
+	It("then protected page response private", func() {
+		Expect(cacheControl(true, "Cache-Control", "public, max-age=60")).To(Equal("private, max-age=60"))
+		Expect(cacheControl(true)).To(Equal("private"))
+	})
+	It("then no header without origin caching info", func() {
+		Expect(cacheControl(false)).To(BeEmpty())
+	})
+})
@@ -0,0 +1,40 @@
+package imgserver
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+)
+
+// Request headers, that responses rendered from same page URL differ by.
+const varyHeaders = "Accept, Accept-Language, " + ClientHintsHeaders + ", " + OriginAuthorizationHeader
+
+// Every request input that rendered response depends on, so different renderings
+// of same page URL have different cache keys.
+type renderKey struct {
+	URL     string
+	Format  outputFormat
+	Profile string // settings of profile are not in Options, like default format and Cache-Control
+	Options FetchOptions
+	Hints   clientHints
+	Lang    string // negotiated language list, forwarded to origin
+	Fonts   bool
+	Strip   pageStrip
+	JS      bool
+	Timing  bool
+}
+
+// Returns canonical key, same for same inputs.
+func (k renderKey) String() string {
+	return fmt.Sprintf("format=%s profile=%q options=%+v hints={%s} lang=%q fonts=%v strip=%+v js=%v timing=%v url=%s",
+		k.Format, k.Profile, k.Options, k.Hints, k.Lang, k.Fonts, k.Strip, k.JS, k.Timing, k.URL)
+}
+
+// Returns Vary header value of rendered responses. Profile is chosen by API key,
+// so responses vary on authentication headers when profiles are used.
+func responseVary(ctx context.Context) string {
+	if getProfile(ctx) != nil {
+		return varyHeaders + ", Authorization, " + APIKeyHeader
+	}
+	return varyHeaders
+}
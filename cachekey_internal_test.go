@@ -0,0 +1,45 @@
+package imgserver
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("render cache key", func() {
+	base := renderKey{URL: "http://example.com/", Format: formatHTML, Options: DefaultFetchOptions}
+
+	It("then same inputs have same key", func() {
+		same := base
+		same.Options = DefaultFetchOptions
+		Expect(same.String()).To(Equal(base.String()))
+	})
+	It("then every input is part of key", func() {
+		variants := []func(k *renderKey){
+			func(k *renderKey) { k.URL = "http://example.com/other" },
+			func(k *renderKey) { k.Format = formatJSON },
+			func(k *renderKey) { k.Profile = "mobile" },
+			func(k *renderKey) { k.Options.MaxImageSize = 1000 },
+			func(k *renderKey) { k.Options.InlineThreshold = 1000 },
+			func(k *renderKey) { k.Hints.SaveData = true },
+			func(k *renderKey) { k.Hints.Width = 300 },
+			func(k *renderKey) { k.Lang = "fr" },
+			func(k *renderKey) { k.Fonts = true },
+			func(k *renderKey) { k.Strip.Scripts = true },
+			func(k *renderKey) { k.JS = true },
+			func(k *renderKey) { k.Timing = true },
+		}
+		keys := map[string]bool{base.String(): true}
+		for _, variant := range variants {
+			k := base
+			variant(&k)
+			keys[k.String()] = true
+		}
+		Expect(keys).To(HaveLen(len(variants) + 1))
+	})
+	It("then responses vary on authentication with profiles", func() {
+		Expect(responseVary(context.Background())).To(Equal("Accept, Accept-Language, Save-Data, DPR, Width, X-Origin-Authorization"))
+		ctx := context.WithValue(context.Background(), ctxProfileKey, &Profile{Name: "mobile"})
+		Expect(responseVary(ctx)).To(Equal("Accept, Accept-Language, Save-Data, DPR, Width, X-Origin-Authorization, Authorization, X-Api-Key"))
+	})
+})
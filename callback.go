@@ -0,0 +1,197 @@
+package imgserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/asaskevich/govalidator"
+	"github.com/cenk/backoff"
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// callback request headers
+const (
+	CallbackIDHeader        = "X-Imgserver-Callback-Id"
+	CallbackStatusHeader    = "X-Imgserver-Status"
+	CallbackSignatureHeader = "X-Imgserver-Signature"
+)
+
+// LogicHandler decorator for requests with callback_url query param.
+// Such requests are answered 202 Accepted immediately, and processed in background.
+// Result (or error) response is POSTed to callback URL, with retries on network and 5xx errors.
+// Requests without callback_url are passed to LogicHandler as is.
+type CallbackLogicHandler struct {
+	LogicHandler
+	ErrorHandler ErrorHandler  // forms callback body on LogicHandler error
+	Client       *http.Client  // client for callback requests
+	Secret       []byte        // HMAC-SHA256 key for body signature, no signature if empty
+	Timeout      time.Duration // background processing and delivery timeout, no timeout if 0
+	MaxPending   int           // max background requests in process, no limit if 0
+
+	pending chan struct{}
+}
+
+func NewCallbackLogicHandler(h LogicHandler, client *http.Client, secret []byte, timeout time.Duration, maxPending int) *CallbackLogicHandler {
+	res := &CallbackLogicHandler{
+		LogicHandler: h,
+		ErrorHandler: ErrorLogger{},
+		Client:       client,
+		Secret:       secret,
+		Timeout:      timeout,
+		MaxPending:   maxPending,
+	}
+	if maxPending > 0 {
+		res.pending = make(chan struct{}, maxPending)
+	}
+	return res
+}
+
+func (h *CallbackLogicHandler) HandleLogic(ctx context.Context, req *http.Request) (*Response, error) {
+	rawCallbackURL := req.URL.Query().Get("callback_url")
+	if rawCallbackURL == "" {
+		return h.LogicHandler.HandleLogic(ctx, req)
+	}
+	if req.Method == http.MethodPost {
+		// request body is closed, when response is sent
+		return nil, NewHandlerError(400, "'callback_url' query parameter is not supported for POST requests")
+	}
+	callbackURL, err := parseCallbackURL(rawCallbackURL)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newCallbackID()
+	if err != nil {
+		return nil, err
+	}
+	if h.pending != nil {
+		select {
+		case h.pending <- struct{}{}:
+		default:
+			return nil, NewHandlerError(http.StatusServiceUnavailable, "too many pending callback requests")
+		}
+	}
+	log := getLocalLogger(ctx, "CallbackLogicHandler").WithField("callbackID", id)
+	log.WithField("callbackURL", callbackURL.String()).Debug("processing in background")
+
+	// request context is canceled when response is sent, but its values are kept;
+	// early hints are not, as response is sent before processing is finished
+	bgCtx, cancel := context.Context(detachedContext{ctx}), context.CancelFunc(func() {})
+	if h.Timeout > 0 {
+		bgCtx, cancel = context.WithTimeout(bgCtx, h.Timeout)
+	}
+	bgCtx = setEarlyHints(setLogger(bgCtx, log), nil)
+	go func() {
+		defer cancel()
+		if h.pending != nil {
+			defer func() { <-h.pending }()
+		}
+		resp, err := h.LogicHandler.HandleLogic(bgCtx, req)
+		if err != nil {
+			resp = h.ErrorHandler.HandleError(bgCtx, req, err)
+		}
+		if err := h.deliver(bgCtx, id, callbackURL.String(), resp); err != nil {
+			log.Warn("callback delivery failed: ", err)
+			return
+		}
+		log.Debug("callback delivered")
+	}()
+
+	resp := NewResponse()
+	resp.StatusCode = http.StatusAccepted
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Header.Set(CallbackIDHeader, id)
+	if err = json.NewEncoder(resp.Body).Encode(map[string]string{"status": "accepted", "id": id}); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// POST result to callback URL with retries
+func (h *CallbackLogicHandler) deliver(ctx context.Context, id string, callbackURL string, result *Response) error {
+	log := getLocalLogger(ctx, "callbackDeliver")
+	if err := result.Buffer(); err != nil {
+		return err
+	}
+	body := result.Body.Bytes()
+	var opErr error
+	operation := func() error {
+		// return err on retry need, or just returns
+		if ctx.Err() != nil {
+			opErr = ctx.Err()
+			return nil
+		}
+		req, err := http.NewRequest("POST", callbackURL, bytes.NewReader(body))
+		if err != nil {
+			opErr = err
+			return nil
+		}
+		req.Header.Set("Content-Type", result.Header.Get("Content-Type"))
+		req.Header.Set(CallbackIDHeader, id)
+		req.Header.Set(CallbackStatusHeader, strconv.Itoa(result.StatusCode))
+		if len(h.Secret) != 0 {
+			req.Header.Set(CallbackSignatureHeader, SignCallbackBody(h.Secret, body))
+		}
+		resp, err := ctxhttp.Do(ctx, h.Client, req)
+		if err != nil {
+			log.Debug("callback request error -> do next try: ", err)
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			log.Debug("Got server error response -> do next try")
+			return fmt.Errorf("callback response status code %v", resp.StatusCode)
+		}
+		if resp.StatusCode >= 300 {
+			opErr = fmt.Errorf("callback response status code %v", resp.StatusCode)
+		}
+		return nil
+	}
+	b := backoff.NewExponentialBackOff()
+	if deadline, ok := ctx.Deadline(); ok {
+		b.MaxElapsedTime = deadline.Sub(time.Now())
+	}
+	if err := backoff.Retry(operation, b); err != nil {
+		return err
+	}
+	return opErr
+}
+
+// Returns signature header value of callback body.
+// Receivers should compare it with value computed on received body using hmac.Equal.
+func SignCallbackBody(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func parseCallbackURL(rawURL string) (*url.URL, error) {
+	if !govalidator.IsURL(rawURL) {
+		return nil, NewHandlerError(400, "invalid URL as 'callback_url' query parameter")
+	}
+	callbackURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, &HandlerError{400, "invalid URL as 'callback_url' query parameter", err}
+	}
+	if callbackURL.Scheme != "http" && callbackURL.Scheme != "https" {
+		return nil, NewHandlerError(400, "'callback_url' query parameter should be http or https URL")
+	}
+	return callbackURL, nil
+}
+
+func newCallbackID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
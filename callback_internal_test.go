@@ -0,0 +1,113 @@
+package imgserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+type logicHandlerFunc func(ctx context.Context, req *http.Request) (*Response, error)
+
+func (f logicHandlerFunc) HandleLogic(ctx context.Context, req *http.Request) (*Response, error) {
+	return f(ctx, req)
+}
+
+var _ = Describe("callback logic handler", func() {
+	type callback struct {
+		header http.Header
+		body   []byte
+	}
+	var (
+		secret    = []byte("secret")
+		server    *httptest.Server
+		callbacks chan callback
+		handler   *CallbackLogicHandler
+		rawURL    string
+		resp      *Response
+		err       error
+		canceled  chan struct{} // closed, when request context is canceled
+	)
+	BeforeEach(func() {
+		// background goroutines may outlive spec, so they use channels of their own spec
+		received, done := make(chan callback, 1), make(chan struct{})
+		callbacks, canceled = received, done
+		server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			received <- callback{r.Header, body}
+		}))
+		inner := logicHandlerFunc(func(ctx context.Context, req *http.Request) (*Response, error) {
+			if req.URL.Query().Get("callback_url") != "" {
+				<-done
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			body := "<html></html>"
+			if profile := getProfile(ctx); profile != nil {
+				body = "<html>" + profile.Name + "</html>"
+			}
+			return &Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/html"}}, Body: bytes.NewBufferString(body)}, nil
+		})
+		handler = NewCallbackLogicHandler(inner, http.DefaultClient, secret, time.Second, 1)
+	})
+	AfterEach(func() {
+		server.Close()
+	})
+	JustBeforeEach(func() {
+		req, reqErr := http.NewRequest("GET", rawURL, nil)
+		Expect(reqErr).NotTo(HaveOccurred())
+		ctx, cancel := context.WithCancel(setLogger(context.Background(), logger.StandardLogger()))
+		ctx = context.WithValue(ctx, ctxProfileKey, &Profile{Name: "partner"})
+		resp, err = handler.HandleLogic(ctx, req)
+		cancel()
+		close(canceled)
+	})
+
+	Context("when no callback_url", func() {
+		BeforeEach(func() {
+			rawURL = "http://localhost:8888/?url=https%3A%2F%2Fgolang.org%2Fdoc%2F"
+		})
+		It("then request processed synchronously", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(200))
+			Consistently(callbacks).ShouldNot(Receive())
+		})
+	})
+
+	Context("when callback_url", func() {
+		BeforeEach(func() {
+			rawURL = "http://localhost:8888/?url=https%3A%2F%2Fgolang.org%2Fdoc%2F&callback_url=" + url.QueryEscape(server.URL+"/hook")
+		})
+		It("then accepted", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(http.StatusAccepted))
+			Expect(resp.Header.Get(CallbackIDHeader)).NotTo(BeEmpty())
+		})
+		It("then signed result posted to callback", func() {
+			var cb callback
+			Eventually(callbacks).Should(Receive(&cb))
+			Expect(string(cb.body)).To(Equal("<html>partner</html>"))
+			Expect(cb.header.Get(CallbackStatusHeader)).To(Equal("200"))
+			Expect(cb.header.Get(CallbackIDHeader)).To(Equal(resp.Header.Get(CallbackIDHeader)))
+			Expect(cb.header.Get(CallbackSignatureHeader)).To(Equal(SignCallbackBody(secret, cb.body)))
+		})
+	})
+
+	Context("when invalid callback_url", func() {
+		BeforeEach(func() {
+			rawURL = "http://localhost:8888/?url=https%3A%2F%2Fgolang.org%2Fdoc%2F&callback_url=qwerty"
+		})
+		It("then error", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(resp).To(BeNil())
+		})
+	})
+})
@@ -0,0 +1,105 @@
+package imgserver
+
+import (
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Query params of click tracking, that don't change page or image. Names ending with * are prefixes.
+var DefaultTrackingParams = []string{"utm_*", "fbclid", "gclid", "dclid", "msclkid", "yclid", "mc_cid", "mc_eid", "_ga"}
+
+// Canonicalizes page and image URLs of cache and coalescing keys, so same resources requested
+// by slightly different URLs share them: scheme and host are lowercased, default ports, fragment
+// and tracking params are stripped, and query params are sorted.
+type URLCanonicalizer struct {
+	TrackingParams []string // names, or prefixes ending with *, of stripped params
+	Fetch          bool     // canonical URLs are fetched too, instead of requested ones
+}
+
+func NewURLCanonicalizer() *URLCanonicalizer {
+	return &URLCanonicalizer{TrackingParams: DefaultTrackingParams}
+}
+
+func setCanonicalizer(ctx context.Context, c *URLCanonicalizer) context.Context {
+	return context.WithValue(ctx, ctxCanonicalizerKey, c)
+}
+
+// returns nil if URLs are not canonicalized
+func getCanonicalizer(ctx context.Context) *URLCanonicalizer {
+	c, _ := ctx.Value(ctxCanonicalizerKey).(*URLCanonicalizer)
+	return c
+}
+
+// Returns canonical copy of u. Returns u if c is nil.
+func (c *URLCanonicalizer) canonical(u *url.URL) *url.URL {
+	if c == nil {
+		return u
+	}
+	res := *u
+	res.Scheme = strings.ToLower(res.Scheme)
+	host := strings.ToLower(res.Host)
+	if res.Scheme == "http" {
+		host = strings.TrimSuffix(host, ":80")
+	} else if res.Scheme == "https" {
+		host = strings.TrimSuffix(host, ":443")
+	}
+	res.Host = host
+	if res.Path == "" && res.Opaque == "" {
+		res.Path = "/"
+	}
+	res.Fragment = ""
+	if res.RawQuery != "" {
+		query := res.Query()
+		for name := range query {
+			if c.tracking(name) {
+				query.Del(name)
+			}
+		}
+		// encoded sorted by name
+		res.RawQuery = query.Encode()
+	}
+	return &res
+}
+
+// Returns canonical URL string, or URL as is, if it is not valid.
+func (c *URLCanonicalizer) canonicalString(rawURL string) string {
+	if c == nil {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return c.canonical(u).String()
+}
+
+// returns URL to fetch instead of u
+func (c *URLCanonicalizer) fetchURL(u *url.URL) *url.URL {
+	if c == nil || !c.Fetch {
+		return u
+	}
+	return c.canonical(u)
+}
+
+func (c *URLCanonicalizer) fetchString(rawURL string) string {
+	if c == nil || !c.Fetch {
+		return rawURL
+	}
+	return c.canonicalString(rawURL)
+}
+
+func (c *URLCanonicalizer) tracking(name string) bool {
+	name = strings.ToLower(name)
+	for _, param := range c.TrackingParams {
+		if strings.HasSuffix(param, "*") {
+			if strings.HasPrefix(name, strings.TrimSuffix(param, "*")) {
+				return true
+			}
+		} else if name == param {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,39 @@
+package imgserver
+
+import (
+	"net/url"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("URL canonicalizer", func() {
+	canonical := func(c *URLCanonicalizer, rawURL string) string {
+		u, err := url.Parse(rawURL)
+		Expect(err).NotTo(HaveOccurred())
+		return c.canonical(u).String()
+	}
+
+	It("then host is lowercased and default port stripped", func() {
+		c := NewURLCanonicalizer()
+		Expect(canonical(c, "HTTP://Example.COM:80")).To(Equal("http://example.com/"))
+		Expect(canonical(c, "https://example.com:443/a#top")).To(Equal("https://example.com/a"))
+		Expect(canonical(c, "https://example.com:8443/a")).To(Equal("https://example.com:8443/a"))
+	})
+	It("then tracking params are dropped and others sorted", func() {
+		c := NewURLCanonicalizer()
+		Expect(canonical(c, "http://example.com/?b=2&utm_source=x&a=1&UTM_Medium=y&fbclid=z")).To(Equal("http://example.com/?a=1&b=2"))
+		Expect(canonical(c, "http://example.com/?utm_campaign=x")).To(Equal("http://example.com/"))
+	})
+	It("then nil canonicalizer keeps URLs", func() {
+		var c *URLCanonicalizer
+		Expect(canonical(c, "HTTP://Example.COM:80/?utm_source=x")).To(Equal("http://Example.COM:80/?utm_source=x"))
+		Expect(c.fetchString("http://Example.COM/")).To(Equal("http://Example.COM/"))
+	})
+	It("then canonical URLs are fetched only if enabled", func() {
+		c := NewURLCanonicalizer()
+		Expect(c.fetchString("http://Example.COM/?utm_source=x")).To(Equal("http://Example.COM/?utm_source=x"))
+		c.Fetch = true
+		Expect(c.fetchString("http://Example.COM/?utm_source=x")).To(Equal("http://example.com/"))
+	})
+})
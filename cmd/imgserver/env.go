@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/codegangsta/cli"
+)
+
+// Prefix of flag environment variables, IMGSERVER_MAX_CONCURRENCY sets --max-concurrency.
+const envPrefix = "IMGSERVER_"
+
+// Returns flags, that are set by environment variables of their names, when they are not passed.
+// So flags take precedence over variables, and variables over defaults.
+// Variables that flags already have, like AWS_REGION, are kept after prefixed one.
+func withEnvVars(flags []cli.Flag) []cli.Flag {
+	res := make([]cli.Flag, len(flags))
+	for i, flag := range flags {
+		switch f := flag.(type) {
+		case cli.BoolFlag:
+			f.EnvVar = flagEnvVar(f.Name, f.EnvVar)
+			flag = f
+		case cli.BoolTFlag:
+			f.EnvVar = flagEnvVar(f.Name, f.EnvVar)
+			flag = f
+		case cli.DurationFlag:
+			f.EnvVar = flagEnvVar(f.Name, f.EnvVar)
+			flag = f
+		case cli.Float64Flag:
+			f.EnvVar = flagEnvVar(f.Name, f.EnvVar)
+			flag = f
+		case cli.IntFlag:
+			f.EnvVar = flagEnvVar(f.Name, f.EnvVar)
+			flag = f
+		case cli.StringFlag:
+			f.EnvVar = flagEnvVar(f.Name, f.EnvVar)
+			flag = f
+		case cli.StringSliceFlag:
+			// comma separated
+			f.EnvVar = flagEnvVar(f.Name, f.EnvVar)
+			flag = f
+		}
+		res[i] = flag
+	}
+	return res
+}
+
+// returns env var list of flag name, like IMGSERVER_PORT of "port, p"
+func flagEnvVar(name string, envVar string) string {
+	name = strings.TrimSpace(strings.Split(name, ",")[0])
+	prefixed := envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+	if envVar == "" {
+		return prefixed
+	}
+	return prefixed + "," + envVar
+}
@@ -3,12 +3,15 @@ package main
 import (
 	"fmt"
 	stdlog "log"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	logger "github.com/Sirupsen/logrus"
 	"github.com/codegangsta/cli"
+	"golang.org/x/net/context"
 
 	. "github.com/Skipor/imgserver"
 )
@@ -26,21 +29,377 @@ func init() {
 	logger.SetOutput(os.Stderr)
 }
 
-type rootHandler struct {
-	h http.Handler
+var rateLimiter RateLimiter
+
+// Returns rate limiter of API keys and origins, in Redis if it is configured, so replicas share limits.
+func getRateLimiter(c *cli.Context) RateLimiter {
+	if rateLimiter != nil {
+		return rateLimiter
+	}
+	if addr := c.String("redis-addr"); addr != "" {
+		redis := NewRedisRateLimiter(addr)
+		redis.Password = c.String("redis-password")
+		redis.DB = c.Int("redis-db")
+		rateLimiter = redis
+		log.Info("Rate limits shared by Redis ", addr)
+	} else {
+		rateLimiter = NewLocalRateLimiter()
+	}
+	return rateLimiter
+}
+
+// Returns page handler and origin client, configured by global flags.
+func newImgLogicHandler(c *cli.Context) (*ImgLogicHandler, *http.Client) {
+	dialConfig := DialConfig{
+		Timeout:       30 * time.Second,
+		Prefer:        c.String("ip-preference"),
+		FallbackDelay: c.Duration("fallback-delay"),
+		DisableIPv6:   c.Bool("disable-ipv6"),
+		DenyPrivate:   c.Bool("deny-private"),
+	}
+	for _, cidr := range c.StringSlice("allow-net") {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			log.Fatal("invalid allowed network: ", err)
+		}
+		dialConfig.AllowNets = append(dialConfig.AllowNets, ipNet)
+	}
+	if err := dialConfig.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	objectBackends := map[string]ObjectBackend{}
+	for _, scheme := range c.StringSlice("object-storage") {
+		switch scheme {
+		case "s3":
+			objectBackends[scheme] = &S3Backend{
+				Endpoint:  c.String("s3-endpoint"),
+				Region:    c.String("s3-region"),
+				AccessKey: c.String("s3-access-key"),
+				SecretKey: c.String("s3-secret-key"),
+			}
+		case "gs":
+			objectBackends[scheme] = NewGCSBackend(c.String("gs-access-key"), c.String("gs-secret-key"))
+		case "azblob":
+			if c.String("azure-account") == "" {
+				log.Fatal("--azure-account is required for azblob object storage")
+			}
+			objectBackends[scheme] = &AzureBlobBackend{
+				Account:  c.String("azure-account"),
+				SASToken: c.String("azure-sas-token"),
+			}
+		default:
+			log.Fatal("unknown object storage scheme: ", scheme)
+		}
+	}
+	var originTransport http.RoundTripper = NewTransport(dialConfig)
+	if rate := c.Float64("origin-rate-limit"); rate > 0 {
+		originTransport = NewOriginRateLimitTransport(originTransport, log, getRateLimiter(c), rate, c.Int("origin-burst"))
+	}
+	transport := NewObjectStorageTransport(NewGuardedTransport(originTransport, OriginLimits{
+		MaxHeaderBytes:   int64(c.Int("max-header-bytes")),
+		MaxContentLength: int64(c.Int("max-content-length")),
+		BodyIdleTimeout:  c.Duration("body-idle-timeout"),
+		MinBodyRate:      int64(c.Int("min-body-rate")),
+	}), objectBackends)
+	client := &http.Client{Transport: transport}
+	imgLogicHandler := NewImgLogicHandler(client)
+	if root := c.String("local-root"); root != "" {
+		if stat, err := os.Stat(root); err != nil || !stat.IsDir() {
+			log.Fatal("invalid local root directory: ", root)
+		}
+		imgLogicHandler.EnableLocalFiles(root)
+	}
+	imgLogicHandler.MaxOptions = FetchOptions{
+		Timeout:         c.Duration("max-timeout"),
+		MaxImageSize:    int64(c.Int("max-image-size")),
+		Concurrency:     c.Int("max-concurrency"),
+		InlineThreshold: int64(c.Int("max-inline-threshold")),
+		Retries:         c.Int("max-retries"),
+		PageRetries:     c.Int("max-page-retries"),
+		PageRedirects:   c.Int("max-page-redirects"),
+		FirstImages:     c.Int("max-images"),
+		BudgetImages:    c.Int("max-budget-images"),
+		BudgetBytes:     int64(c.Int("max-budget-bytes")),
+		BudgetTime:      c.Duration("max-budget-time"),
+	}
+	imgLogicHandler.MaxCacheAge = c.Duration("max-cache-age")
+	imgLogicHandler.Placeholder = PlaceholderStyle{Width: c.Int("placeholder-width"), Height: c.Int("placeholder-height"), Color: c.String("placeholder-color")}
+	imgLogicHandler.ImageAccept = c.String("image-accept")
+	if c.String("image-types") != "" || c.String("exclude-image-types") != "" {
+		allowed, err := ParseMediaTypes(c.String("image-types"))
+		if err != nil {
+			log.Fatal("invalid image types: ", err)
+		}
+		excluded, err := ParseMediaTypes(c.String("exclude-image-types"))
+		if err != nil {
+			log.Fatal("invalid excluded image types: ", err)
+		}
+		action := c.String("excluded-images")
+		if action != ExcludedImagesSkip && action != ExcludedImagesLink {
+			log.Fatal("unknown excluded images action: ", action)
+		}
+		imgLogicHandler.ImageTypes = &ImageTypePolicy{Allowed: allowed, Excluded: excluded, Action: action}
+	}
+	if interval := c.Duration("probe-interval"); interval > 0 {
+		imgLogicHandler.Health = NewOriginHealth(client)
+		imgLogicHandler.Health.Interval = interval
+		imgLogicHandler.Health.MinRequests = c.Int("probe-min-requests")
+	}
+	switch policy := c.String("data-urls"); policy {
+	case DataURLsKeep, DataURLsDrop, DataURLsProcess:
+		imgLogicHandler.Options.DataURLs = policy
+	default:
+		log.Fatal("unknown data URLs policy: ", policy)
+	}
+	imgLogicHandler.HTTPFallback = c.Bool("http-fallback")
+	imgLogicHandler.SniffPlain = c.Bool("sniff-plain-pages")
+	if c.Bool("canonicalize-urls") {
+		imgLogicHandler.Canonical = &URLCanonicalizer{
+			TrackingParams: strings.Split(c.String("tracking-params"), ","),
+			Fetch:          c.Bool("fetch-canonical-urls"),
+		}
+	}
+	sanitizer, ok := SanitizePolicies[c.String("sanitize")]
+	if !ok {
+		log.Fatal("unknown sanitize policy: ", c.String("sanitize"))
+	}
+	imgLogicHandler.Sanitizer = sanitizer
+	imgLogicHandler.ParseLimits = ParseLimits{
+		MaxPageSize:     int64(c.Int("max-page-size")),
+		MaxDocumentSize: int64(c.Int("max-document-size")),
+		MaxTokenSize:    c.Int("max-token-size"),
+		MaxAttributes:   c.Int("max-attributes"),
+		StallTimeout:    c.Duration("parse-stall-timeout"),
+	}
+	if ttl := c.Duration("cache-ttl"); ttl > 0 {
+		imgLogicHandler.Cache = NewRenderCache(ttl, c.Duration("cache-max-stale"), c.Int("cache-entries"))
+		log.Info("Render cache enabled")
+	}
+	switch {
+	case c.String("storage-dir") != "":
+		imgLogicHandler.Storage = FileStorage{Dir: c.String("storage-dir"), BaseURL: c.String("storage-public-url")}
+	case c.String("s3-bucket") != "":
+		imgLogicHandler.Storage = &S3Storage{
+			Client:    client,
+			Endpoint:  c.String("s3-endpoint"),
+			Region:    c.String("s3-region"),
+			Bucket:    c.String("s3-bucket"),
+			AccessKey: c.String("s3-access-key"),
+			SecretKey: c.String("s3-secret-key"),
+			PublicURL: c.String("storage-public-url"),
+		}
+	}
+	if imgLogicHandler.Storage != nil && c.Bool("snapshots") {
+		archive, err := NewSnapshotArchive(log, c.Int("snapshots-per-url"), c.Duration("snapshots-max-age"), c.String("snapshots-index"))
+		if err != nil {
+			log.Fatal("snapshot index load error: ", err)
+		}
+		imgLogicHandler.Snapshots = archive
+	}
+	if path := c.String("chrome-path"); path != "" {
+		if c.Bool("deny-private") {
+			// browser connects to origins itself, not by guarded dialer
+			log.Fatal("--chrome-path is not supported with --deny-private")
+		}
+		imgLogicHandler.Renderer = NewHeadlessRenderer(path, c.Int("render-pool"), c.Duration("render-timeout"))
+		log.Info("JavaScript rendering enabled")
+	}
+	if percentile := c.Float64("hedge-percentile"); percentile > 0 {
+		imgLogicHandler.EnableHedging(percentile)
+	}
+	imgLogicHandler.Pipeline().EncodeConcurrency = c.Int("encode-concurrency")
+	if c.BoolT("coalesce-images") {
+		imgLogicHandler.EnableImageCoalescing()
+	}
+	if ttl := c.Duration("image-cache-ttl"); ttl > 0 {
+		imgLogicHandler.EnableImageCache(NewImageCache(ttl, c.Int("image-cache-entries")))
+		log.Info("Image cache enabled")
+	}
+	return imgLogicHandler, client
 }
 
-func (h rootHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" {
-		http.NotFound(w, r)
-		return
+func setLogLevel(c *cli.Context) {
+	level, err := logger.ParseLevel(c.String("log-level"))
+	if err != nil {
+		log.Fatal(err)
 	}
-	h.h.ServeHTTP(w, r)
+	logger.SetLevel(level)
 }
 
 func mainAction(c *cli.Context) {
-	imgHandler := NewImgCtxAdaptor(log, http.DefaultClient, timeout)
-	http.Handle("/", rootHandler{imgHandler})
+	setLogLevel(c)
+	var redactor *URLRedactor
+	if c.BoolT("redact") {
+		redactor = NewURLRedactor(strings.Split(c.String("redact-params"), ","), c.Bool("redact-query"))
+		logger.AddHook(RedactionHook{Redactor: redactor})
+	}
+	imgLogicHandler, client := newImgLogicHandler(c)
+	if imgLogicHandler.Health != nil {
+		go imgLogicHandler.Health.Run(context.Background())
+		log.Info("Origin probes enabled")
+	}
+	var logicHandler LogicHandler = NewCallbackLogicHandler(
+		imgLogicHandler,
+		client,
+		[]byte(c.String("callback-secret")),
+		timeout,
+		c.Int("max-callbacks"),
+	)
+	var imagesHandler LogicHandler = ImageIndexLogicHandler{Handler: imgLogicHandler}
+	if secret := c.String("url-secret"); secret != "" {
+		logicHandler = NewSignedURLLogicHandler(logicHandler, []byte(secret))
+		imagesHandler = NewSignedURLLogicHandler(imagesHandler, []byte(secret))
+		log.Info("Signed URL mode enabled")
+	}
+	routes := LogicMux{InlinePath: logicHandler, RootPath: logicHandler, ImagesPath: imagesHandler, ImagesPath + "/": imagesHandler}
+	if c.Bool("crawl") {
+		crawlHandler := NewCrawlLogicHandler(client)
+		crawlHandler.Limits = CrawlLimits{MaxPages: c.Int("crawl-max-pages"), MaxDepth: c.Int("crawl-max-depth"), Delay: c.Duration("crawl-delay")}
+		routes[CrawlPath] = crawlHandler
+		if secret := c.String("url-secret"); secret != "" {
+			routes[CrawlPath] = NewSignedURLLogicHandler(crawlHandler, []byte(secret))
+		}
+	}
+	if imgLogicHandler.Snapshots != nil {
+		snapshots := SnapshotLogicHandler{Archive: imgLogicHandler.Snapshots, Canonical: imgLogicHandler.Canonical}
+		routes[SnapshotsPath] = snapshots
+		routes[SnapshotsDiffPath] = snapshots
+	}
+	postRoutes := LogicMux{InlinePath: logicHandler, RootPath: logicHandler}
+	if c.Bool("email") {
+		if c.String("url-secret") != "" && len(c.StringSlice("api-key")) == 0 && c.String("jwt-secret") == "" {
+			// posted emails have no url param to sign, so their image fetches are restricted by authentication
+			log.Fatal("--email requires --api-key or --jwt-secret with --url-secret")
+		}
+		emailHandler := NewEmailLogicHandler(client)
+		emailHandler.SrcScheme = c.String("email-src-scheme")
+		emailHandler.Sanitizer = imgLogicHandler.Sanitizer
+		postRoutes[EmailPath] = emailHandler
+	}
+	var reporter ErrorReporter
+	if dsn := c.String("sentry-dsn"); dsn != "" {
+		sentry, err := NewSentryReporter(log, dsn)
+		if err != nil {
+			log.Fatal("Sentry DSN error: ", err)
+		}
+		sentry.Environment = c.String("sentry-environment")
+		sentry.Release = c.App.Version
+		reporter = sentry
+		log.Info("Sentry error reporting enabled")
+	}
+	errorTemplate := DefaultErrorTemplate
+	if path := c.String("error-template"); path != "" {
+		var err error
+		if errorTemplate, err = LoadErrorTemplate(path); err != nil {
+			log.Fatal("error template load error: ", err)
+		}
+	}
+	var messages MessageCatalog
+	if path := c.String("messages"); path != "" {
+		catalog, err := LoadMessageCatalog(path)
+		if err != nil {
+			log.Fatal("messages load error: ", err)
+		}
+		messages = catalog
+	}
+	statuses, err := ParseStatusPolicy(c.String("status-policy"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var handler Handler = &ImgHandler{
+		Log:              log,
+		LogicHandler:     SecurityHeadersLogicHandler{LogicHandler: routes, Policy: c.String("csp")},
+		PostLogicHandler: SecurityHeadersLogicHandler{LogicHandler: postRoutes, Policy: c.String("csp")},
+		ErrorHandler:     ErrorLogger{Redactor: redactor, Reporter: reporter, Template: errorTemplate, Messages: messages, Statuses: statuses},
+		Timeout:          timeout,
+		DebugLogToken:    c.String("admin-token"),
+		PropagateTrace:   c.Bool("propagate-trace"),
+		EarlyHints:       c.Bool("early-hints"),
+	}
+	handler = SlowRequestHandler{Handler: handler, Log: log, Threshold: c.Duration("slow-request")}
+	if factor := c.Int("watchdog-factor"); factor > 0 {
+		handler = WatchdogHandler{Handler: handler, Log: log, Timeout: timeout, Factor: factor}
+	}
+	var auditSinks MultiAuditSink
+	if path := c.String("audit-file"); path != "" {
+		sink, err := NewFileAuditSink(log, path, int64(c.Int("audit-max-size"))<<20, c.Int("audit-backups"))
+		if err != nil {
+			log.Fatal("audit log open error: ", err)
+		}
+		defer sink.Close()
+		auditSinks = append(auditSinks, sink)
+		log.Info("Audit log enabled")
+	}
+	var hostStats *HostStats
+	if c.Bool("host-stats") {
+		hostStats = NewHostStats(c.Int("host-stats-max"))
+		auditSinks = append(auditSinks, hostStats)
+		log.Info("Per host stats enabled")
+	}
+	if len(auditSinks) > 0 {
+		handler = AuditHandler{Handler: handler, Sink: auditSinks}
+	}
+	if path := c.String("profiles"); path != "" {
+		profiles, err := LoadProfiles(path)
+		if err != nil {
+			log.Fatal("profiles load error: ", err)
+		}
+		handler = ProfileHandler{Handler: handler, Profiles: profiles}
+		log.Info("Profiles loaded")
+	}
+	if rawKeys, jwtSecret := c.StringSlice("api-key"), c.String("jwt-secret"); len(rawKeys) != 0 || jwtSecret != "" {
+		var keys []APIKey
+		quota := Quota{Requests: int64(c.Int("quota-requests")), Bytes: int64(c.Int("quota-bytes"))}
+		for _, rawKey := range rawKeys {
+			key, err := ParseAPIKey(rawKey)
+			if err != nil {
+				log.Fatal(err)
+			}
+			key.Quota = quota
+			keys = append(keys, key)
+		}
+		authHandler := NewAuthHandler(handler, log, keys, []byte(jwtSecret))
+		authHandler.Limiter = getRateLimiter(c)
+		authHandler.JWTKey.RateLimit = c.Float64("jwt-rate-limit")
+		authHandler.JWTKey.Burst = int(authHandler.JWTKey.RateLimit)
+		authHandler.JWTKey.Quota = quota
+		handler = authHandler
+		log.Infof("Authentication enabled: %v API keys, JWT: %v", len(keys), jwtSecret != "")
+	}
+	var blocklist *Blocklist
+	if maxErrors := c.Int("ban-errors"); maxErrors > 0 {
+		var err error
+		blocklist, err = NewBlocklist(log, maxErrors, c.Duration("ban-window"), c.Duration("ban-duration"), c.String("blocklist-file"))
+		if err != nil {
+			log.Fatal("blocklist load error: ", err)
+		}
+		blocklist.MaxURILength = c.Int("max-uri-length")
+		handler = BlocklistHandler{Handler: handler, Blocklist: blocklist}
+		log.Info("Abuse blocklist enabled")
+	}
+	imgHandler := ContextAdaptor{
+		Handler: handler,
+		Ctx:     context.Background(),
+	}
+	mux := NewAPIMux(imgHandler)
+	mux.Handle(SnapshotsPath, imgHandler)
+	mux.Handle(SnapshotsDiffPath, imgHandler)
+	mux.Handle(CrawlPath, imgHandler)
+	mux.Handle(EmailPath, imgHandler)
+	mux.Handle(UsagePath, imgHandler)
+	mux.Handle(VersionPath, VersionHandler{Info: NewBuildInfo(c.App.Version, imgLogicHandler)})
+	mux.Handle(ImagesPath, imgHandler)
+	mux.Handle(ImagesPath+"/", imgHandler)
+	if blocklist != nil {
+		mux.Handle(AdminBlocklistPath, BlocklistAdminHandler{Blocklist: blocklist, Token: c.String("admin-token")})
+	}
+	mux.Handle(AdminPipelinePath, PipelineAdminHandler{Log: log, Pipeline: imgLogicHandler.Pipeline(), Token: c.String("admin-token")})
+	mux.Handle(AdminVarsPath, VarsAdminHandler{Log: log, Token: c.String("admin-token")})
+	if hostStats != nil {
+		statsHandler := HostStatsAdminHandler{Log: log, Stats: hostStats, Token: c.String("admin-token")}
+		mux.Handle(AdminOriginsPath, statsHandler)
+		mux.Handle(AdminMetricsPath, statsHandler)
+	}
 
 	port := c.Int("port")
 	if !(port > 0 && port < 65536) {
@@ -51,7 +410,7 @@ func mainAction(c *cli.Context) {
 	log.Fatal(
 		http.ListenAndServe(
 			fmt.Sprint(":", port),
-			nil,
+			mux,
 		),
 	)
 
@@ -73,7 +432,517 @@ func main() {
 			Value: 8888,
 			Usage: "listen port",
 		},
+		cli.StringFlag{
+			Name:  "log-level",
+			Value: "debug",
+			Usage: "debug, info, warning or error. Requests with X-Debug-Log: 1 and X-Admin-Token headers are logged by debug",
+		},
+		cli.StringFlag{
+			Name:  "ip-preference",
+			Usage: "origin address family tried first: ipv4 or ipv6, resolver order if empty",
+		},
+		cli.DurationFlag{
+			Name:  "fallback-delay",
+			Usage: "Happy Eyeballs delay before racing other address family, 300ms if 0, no racing if negative",
+		},
+		cli.BoolFlag{
+			Name:  "disable-ipv6",
+			Usage: "connect to origins only by IPv4",
+		},
+		cli.IntFlag{
+			Name:  "max-page-size",
+			Value: int(DefaultParseLimits.MaxPageSize),
+			Usage: "max bytes of fetched page body, 0 is no limit",
+		},
+		cli.IntFlag{
+			Name:  "max-document-size",
+			Value: int(DefaultParseLimits.MaxDocumentSize),
+			Usage: "max bytes of parsed page, 0 is no limit",
+		},
+		cli.IntFlag{
+			Name:  "max-token-size",
+			Value: DefaultParseLimits.MaxTokenSize,
+			Usage: "max bytes of single page token, like tag with attributes, 0 is no limit",
+		},
+		cli.IntFlag{
+			Name:  "max-attributes",
+			Value: DefaultParseLimits.MaxAttributes,
+			Usage: "max attributes of single page tag, 0 is no limit",
+		},
+		cli.DurationFlag{
+			Name:  "parse-stall-timeout",
+			Value: DefaultParseLimits.StallTimeout,
+			Usage: "page parse fails, if it makes no progress for this time, 0 is no limit",
+		},
+		cli.BoolFlag{
+			Name:  "http-fallback",
+			Usage: "fetch url params without scheme by http, when https fetch fails",
+		},
+		cli.BoolFlag{
+			Name:  "sniff-plain-pages",
+			Usage: "parse pages served as text/plain, if their body is sniffed as HTML, like on raw file hosts, instead of rejecting them",
+		},
+		cli.BoolFlag{
+			Name:  "canonicalize-urls",
+			Usage: "canonicalize page and image URLs of cache and coalescing keys",
+		},
+		cli.StringFlag{
+			Name:  "tracking-params",
+			Value: strings.Join(DefaultTrackingParams, ","),
+			Usage: "comma separated query params stripped from canonical URLs, names ending with * are prefixes",
+		},
+		cli.BoolFlag{
+			Name:  "fetch-canonical-urls",
+			Usage: "fetch canonical URLs instead of requested ones, with --canonicalize-urls",
+		},
+		cli.StringFlag{
+			Name:  "image-accept",
+			Value: DefaultImageAccept,
+			Usage: "Accept header of image fetches, as CDNs choose image format by it. Not sent if empty",
+		},
+		cli.StringFlag{
+			Name:  "image-types",
+			Usage: "comma separated media types of inlined images, like image/png,image/jpeg, or wildcards, like image/*. Any image type if empty",
+		},
+		cli.StringFlag{
+			Name:  "exclude-image-types",
+			Usage: "comma separated media types of images, that are not inlined, even if allowed by --image-types, like image/svg+xml,image/x-icon",
+		},
+		cli.StringFlag{
+			Name:  "excluded-images",
+			Value: ExcludedImagesSkip,
+			Usage: "action on images of not inlined types: skip, or link by absolute URL",
+		},
+		cli.DurationFlag{
+			Name:  "probe-interval",
+			Usage: "interval of frequently requested page origins probes; requests of down origins are served from render cache, or fail at once. No probes if 0",
+		},
+		cli.IntFlag{
+			Name:  "probe-min-requests",
+			Value: 3,
+			Usage: "page requests of origin within probe interval, that make it probed",
+		},
+		cli.StringFlag{
+			Name:  "data-urls",
+			Value: DataURLsKeep,
+			Usage: "default policy of data URL images of pages: keep, drop bigger than max image size, or process like fetched images",
+		},
+		cli.IntFlag{
+			Name:  "placeholder-width",
+			Value: DefaultPlaceholderStyle.Width,
+			Usage: "width of failed image placeholders in tolerant mode, when image has no width attribute",
+		},
+		cli.IntFlag{
+			Name:  "placeholder-height",
+			Value: DefaultPlaceholderStyle.Height,
+			Usage: "height of failed image placeholders in tolerant mode, when image has no height attribute",
+		},
+		cli.StringFlag{
+			Name:  "placeholder-color",
+			Value: DefaultPlaceholderStyle.Color,
+			Usage: "CSS background color of failed image placeholders",
+		},
+		cli.IntFlag{
+			Name:  "max-header-bytes",
+			Value: 1 << 20,
+			Usage: "max origin response header size",
+		},
+		cli.IntFlag{
+			Name:  "max-content-length",
+			Value: 1 << 30,
+			Usage: "max declared origin response Content-Length, 0 for no limit",
+		},
+		cli.DurationFlag{
+			Name:  "body-idle-timeout",
+			Value: 30 * time.Second,
+			Usage: "max pause between origin response body bytes, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "min-body-rate",
+			Usage: "min average origin response body bytes per second, checked after first 5 seconds, 0 for no limit",
+		},
+		cli.BoolFlag{
+			Name:  "deny-private",
+			Usage: "deny connections to loopback, private, link-local and other not public origin addresses",
+		},
+		cli.StringSliceFlag{
+			Name:  "allow-net",
+			Usage: "network in CIDR notation, allowed with --deny-private. Can be repeated",
+		},
+		cli.Float64Flag{
+			Name:  "hedge-percentile",
+			Usage: "send second image request, if image is not fetched within this percentile of recent fetch latencies, like 0.95. No hedging if 0",
+		},
+		cli.IntFlag{
+			Name:  "encode-concurrency",
+			Usage: "parallel image encodings per page, GOMAXPROCS if 0",
+		},
+		cli.BoolTFlag{
+			Name:  "coalesce-images",
+			Usage: "share concurrent fetches of same image across page requests",
+		},
+		cli.StringFlag{
+			Name:  "callback-secret",
+			Usage: "HMAC-SHA256 key for callback_url requests body signature",
+		},
+		cli.IntFlag{
+			Name:  "max-callbacks",
+			Value: 100,
+			Usage: "max callback_url requests processed in background, 0 for no limit",
+		},
+		cli.StringFlag{
+			Name:  "url-secret",
+			Usage: "reject requests without url param HMAC-SHA256 signature made with this secret",
+		},
+		cli.DurationFlag{
+			Name:  "max-timeout",
+			Usage: "ceiling of timeout param, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "max-image-size",
+			Usage: "ceiling of max_image_size param in bytes, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "max-concurrency",
+			Usage: "ceiling of concurrency param, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "max-inline-threshold",
+			Usage: "ceiling of inline_threshold param in bytes, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "max-retries",
+			Usage: "ceiling of retries param, 0 for no limit",
+		},
+		cli.DurationFlag{
+			Name:  "max-cache-age",
+			Value: time.Hour,
+			Usage: "ceiling of response max-age propagated from origin page caching headers, not propagated if 0",
+		},
+		cli.DurationFlag{
+			Name:  "image-cache-ttl",
+			Usage: "freshness of cached images, stale ones are served while revalidated by conditional GET, no cache if 0",
+		},
+		cli.IntFlag{
+			Name:  "image-cache-entries",
+			Value: 10000,
+			Usage: "max cached images",
+		},
+		cli.DurationFlag{
+			Name:  "cache-ttl",
+			Usage: "freshness of cached rendered responses, bounded by their max-age, no cache if 0",
+		},
+		cli.DurationFlag{
+			Name:  "cache-max-stale",
+			Usage: "stale cached responses are served this long after expiration, while refreshed in background",
+		},
+		cli.IntFlag{
+			Name:  "cache-entries",
+			Value: 1000,
+			Usage: "max cached rendered responses",
+		},
+		cli.IntFlag{
+			Name:  "max-page-retries",
+			Usage: "ceiling of page_retries param, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "max-page-redirects",
+			Value: 5,
+			Usage: "ceiling of page_redirects param, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "max-images",
+			Usage: "ceiling of first param, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "max-budget-images",
+			Usage: "ceiling and default of budget_images param, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "max-budget-bytes",
+			Usage: "ceiling and default of budget_bytes param, 0 for no limit",
+		},
+		cli.DurationFlag{
+			Name:  "max-budget-time",
+			Usage: "ceiling and default of budget_time param, 0 for no limit",
+		},
+		cli.StringSliceFlag{
+			Name:  "api-key",
+			Usage: "accepted API key in id:secret[:rate[:burst]] form, rate is requests per second. Can be repeated",
+		},
+		cli.StringFlag{
+			Name:  "jwt-secret",
+			Usage: "accept HS256 JWT bearer tokens signed by this secret",
+		},
+		cli.Float64Flag{
+			Name:  "jwt-rate-limit",
+			Usage: "requests per second limit for JWT subjects without configured API key, 0 for no limit",
+		},
+		cli.Float64Flag{
+			Name:  "origin-rate-limit",
+			Usage: "requests per second limit for every page and image origin host, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "origin-burst",
+			Value: 1,
+			Usage: "requests to origin host allowed at once by --origin-rate-limit",
+		},
+		cli.StringFlag{
+			Name:  "redis-addr",
+			Usage: "host:port of Redis, where API key and origin rate limits are shared by server replicas. Limits are per process if empty",
+		},
+		cli.StringFlag{
+			Name:  "redis-password",
+			Usage: "Redis AUTH password",
+		},
+		cli.IntFlag{
+			Name:  "redis-db",
+			Usage: "Redis database number",
+		},
+		cli.IntFlag{
+			Name:  "quota-requests",
+			Usage: "requests allowed to every API key in last 24 hours, 0 for no quota",
+		},
+		cli.IntFlag{
+			Name:  "quota-bytes",
+			Usage: "response bytes allowed to every API key in last 24 hours, 0 for no quota",
+		},
+		cli.StringFlag{
+			Name:  "storage-dir",
+			Usage: "local directory for results stored on store param",
+		},
+		cli.StringFlag{
+			Name:  "s3-bucket",
+			Usage: "S3 compatible storage bucket for results stored on store param",
+		},
+		cli.StringFlag{
+			Name:  "s3-endpoint",
+			Value: "https://s3.amazonaws.com",
+			Usage: "S3 compatible storage endpoint, https://storage.googleapis.com for Google Cloud Storage",
+		},
+		cli.StringFlag{
+			Name:   "s3-region",
+			Value:  "us-east-1",
+			EnvVar: "AWS_REGION",
+			Usage:  "S3 region, auto for Google Cloud Storage",
+		},
+		cli.StringFlag{
+			Name:   "s3-access-key",
+			EnvVar: "AWS_ACCESS_KEY_ID",
+		},
+		cli.StringFlag{
+			Name:   "s3-secret-key",
+			EnvVar: "AWS_SECRET_ACCESS_KEY",
+		},
+		cli.StringSliceFlag{
+			Name:  "object-storage",
+			Usage: "object URL scheme fetched as page and image URLs: s3, gs or azblob. Can be repeated",
+		},
+		cli.StringFlag{
+			Name:  "local-root",
+			Usage: "local directory of file:// page and image URLs, file:///site/index.html is <local-root>/site/index.html",
+		},
+		cli.StringFlag{
+			Name:   "gs-access-key",
+			EnvVar: "GS_ACCESS_KEY_ID",
+			Usage:  "Google Cloud Storage HMAC key of gs:// fetches",
+		},
+		cli.StringFlag{
+			Name:   "gs-secret-key",
+			EnvVar: "GS_SECRET_ACCESS_KEY",
+		},
+		cli.StringFlag{
+			Name:   "azure-account",
+			EnvVar: "AZURE_STORAGE_ACCOUNT",
+			Usage:  "Azure storage account of azblob:// fetches",
+		},
+		cli.StringFlag{
+			Name:   "azure-sas-token",
+			EnvVar: "AZURE_STORAGE_SAS_TOKEN",
+			Usage:  "shared access signature of azblob:// fetches",
+		},
+		cli.StringFlag{
+			Name:  "storage-public-url",
+			Usage: "base URL of stored objects in returned URLs",
+		},
+		cli.StringFlag{
+			Name:  "chrome-path",
+			Usage: "headless Chrome binary, enables render=js param",
+		},
+		cli.IntFlag{
+			Name:  "render-pool",
+			Value: 2,
+			Usage: "max parallel headless renders",
+		},
+		cli.DurationFlag{
+			Name:  "render-timeout",
+			Value: 30 * time.Second,
+			Usage: "headless render timeout of single page",
+		},
+		cli.StringFlag{
+			Name:  "sanitize",
+			Value: "relaxed",
+			Usage: "policy of origin HTML in rendered output: relaxed, strict or none",
+		},
+		cli.StringFlag{
+			Name:  "csp",
+			Value: DefaultContentSecurityPolicy,
+			Usage: "Content-Security-Policy of rendered HTML pages, none if empty",
+		},
+		cli.StringFlag{
+			Name:  "sentry-dsn",
+			Usage: "report 5xx errors to Sentry project of this DSN",
+		},
+		cli.StringFlag{
+			Name:  "sentry-environment",
+			Usage: "environment of Sentry events",
+		},
+		cli.BoolFlag{
+			Name:  "propagate-trace",
+			Usage: "propagate traceparent, tracestate and B3 tracing headers of requests to page and image fetches, for internal deployments",
+		},
+		cli.BoolFlag{
+			Name:  "early-hints",
+			Usage: "send preload links of images of links=true requests in 103 Early Hints responses, before final response",
+		},
+		cli.DurationFlag{
+			Name:  "slow-request",
+			Value: 10 * time.Second,
+			Usage: "requests slower than this are logged at warn level with phases breakdown, none if 0",
+		},
+		cli.IntFlag{
+			Name:  "watchdog-factor",
+			Value: DefaultWatchdogFactor,
+			Usage: "requests running longer than this many timeouts are force canceled, and goroutine stacks are logged, no watchdog if 0",
+		},
+		cli.BoolFlag{
+			Name:  "email",
+			Usage: "enable email rendering, served by POST " + EmailPath + ". Requires --api-key or --jwt-secret with --url-secret",
+		},
+		cli.StringFlag{
+			Name:  "email-src-scheme",
+			Value: DefaultSrcScheme,
+			Usage: "scheme of protocol relative image srcs in emails, as they have no page URL",
+		},
+		cli.BoolFlag{
+			Name:  "crawl",
+			Usage: "enable site crawl mode, served by " + CrawlPath,
+		},
+		cli.IntFlag{
+			Name:  "crawl-max-pages",
+			Value: DefaultCrawlLimits.MaxPages,
+			Usage: "max pages visited per crawl, 0 for no limit",
+		},
+		cli.IntFlag{
+			Name:  "crawl-max-depth",
+			Value: DefaultCrawlLimits.MaxDepth,
+			Usage: "max link hops from crawl root, 0 for no limit",
+		},
+		cli.DurationFlag{
+			Name:  "crawl-delay",
+			Value: DefaultCrawlLimits.Delay,
+			Usage: "min pause between crawled page requests",
+		},
+		cli.BoolFlag{
+			Name:  "snapshots",
+			Usage: "index stored results as page snapshots, served by " + SnapshotsPath,
+		},
+		cli.IntFlag{
+			Name:  "snapshots-per-url",
+			Value: 100,
+			Usage: "snapshots kept per page, 0 for no limit",
+		},
+		cli.DurationFlag{
+			Name:  "snapshots-max-age",
+			Usage: "snapshots retention, 0 for no limit",
+		},
+		cli.StringFlag{
+			Name:  "snapshots-index",
+			Usage: "file snapshots index is persisted to",
+		},
+		cli.StringFlag{
+			Name:  "profiles",
+			Usage: "JSON file of per API key or Host header configuration profiles",
+		},
+		cli.StringFlag{
+			Name:  "audit-file",
+			Usage: "record every outbound page and image request to this file as JSON lines",
+		},
+		cli.IntFlag{
+			Name:  "audit-max-size",
+			Value: 100,
+			Usage: "audit file size in megabytes, after which it is rotated",
+		},
+		cli.IntFlag{
+			Name:  "audit-backups",
+			Value: 5,
+			Usage: "rotated audit files to keep",
+		},
+		cli.BoolFlag{
+			Name:  "host-stats",
+			Usage: "aggregate outbound requests per origin host, served by admin endpoints",
+		},
+		cli.IntFlag{
+			Name:  "host-stats-max",
+			Value: 1000,
+			Usage: "tracked origin hosts, requests to other hosts are counted to \"other\" host",
+		},
+		cli.IntFlag{
+			Name:  "ban-errors",
+			Usage: "ban clients with this many error responses within ban window, no blocklist if 0",
+		},
+		cli.DurationFlag{
+			Name:  "ban-window",
+			Value: time.Minute,
+			Usage: "window of ban-errors counting",
+		},
+		cli.DurationFlag{
+			Name:  "ban-duration",
+			Value: 10 * time.Minute,
+			Usage: "ban duration",
+		},
+		cli.IntFlag{
+			Name:  "max-uri-length",
+			Value: 8192,
+			Usage: "longer requests are rejected and counted as errors, 0 for no limit",
+		},
+		cli.StringFlag{
+			Name:  "blocklist-file",
+			Usage: "file bans are persisted to",
+		},
+		cli.StringFlag{
+			Name:  "admin-token",
+			Usage: "bearer token of admin endpoints, admin endpoints are disabled if empty",
+		},
+		cli.BoolTFlag{
+			Name:  "redact",
+			Usage: "mask passwords and sensitive query param values of URLs in logs and error messages",
+		},
+		cli.StringFlag{
+			Name:  "redact-params",
+			Value: strings.Join(DefaultRedactedParams, ","),
+			Usage: "comma separated query params masked by --redact",
+		},
+		cli.BoolFlag{
+			Name:  "redact-query",
+			Usage: "mask values of all query params by --redact",
+		},
+		cli.StringFlag{
+			Name:  "error-template",
+			Usage: "Go html/template file of error pages, served to clients asking for HTML. Executed with imgserver.ErrorPage",
+		},
+		cli.StringFlag{
+			Name:  "messages",
+			Usage: `JSON file of client error message translations by language, like {"de": {"unsupported format": "..."}}`,
+		},
+		cli.StringFlag{
+			Name:  "status-policy",
+			Usage: "response statuses of error codes, overriding defaults, like origin_status=424,origin_unreachable=503",
+		},
 	}
+	app.Flags = withEnvVars(app.Flags)
+	inlineCommand.Flags = withEnvVars(inlineCommand.Flags)
+	app.Commands = []cli.Command{inlineCommand}
 	app.Action = mainAction
 	app.Run(os.Args)
 }
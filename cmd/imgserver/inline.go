@@ -0,0 +1,119 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/codegangsta/cli"
+	"golang.org/x/net/context"
+
+	. "github.com/Skipor/imgserver"
+)
+
+var inlineCommand = cli.Command{
+	Name:      "inline",
+	Usage:     "process page once without server, and write result to stdout",
+	ArgsUsage: "<url|-> [-o out.html] [param=value...]",
+	Description: "Params are query params of HTTP API, like format=page or timeout=10s. " +
+		"Global flags, like --max-timeout, are set before command. " +
+		"With - URL, HTML of stdin is rewritten with images inlined, relative images are resolved by --base-url.",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "output, o",
+			Usage: "result file, stdout if empty",
+		},
+		cli.StringFlag{
+			Name:  "base-url",
+			Usage: "base of relative image URLs of stdin document",
+		},
+		cli.StringFlag{
+			Name:  "content-type",
+			Value: "text/html",
+			Usage: "media type of stdin document: text/html or text/markdown",
+		},
+	},
+	Action: inlineAction,
+}
+
+func inlineAction(c *cli.Context) {
+	output := c.String("output")
+	baseURL := c.String("base-url")
+	query := url.Values{}
+	args := c.Args()
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-o" || arg == "--output":
+			// flags are parsed before args only
+			if i++; i == len(args) {
+				log.Fatal("output file is expected after ", arg)
+			}
+			output = args[i]
+		case strings.HasPrefix(arg, "--base-url="):
+			baseURL = strings.TrimPrefix(arg, "--base-url=")
+		case query.Get("url") == "":
+			query.Set("url", arg)
+		default:
+			eq := strings.IndexByte(arg, '=')
+			if eq <= 0 {
+				log.Fatal("invalid param argument, expected param=value: ", arg)
+			}
+			query.Add(arg[:eq], arg[eq+1:])
+		}
+	}
+	if query.Get("url") == "" {
+		log.Fatal("page URL argument is required")
+	}
+
+	method := http.MethodGet
+	var body io.Reader
+	if query.Get("url") == "-" {
+		// posted document, so stdin filter works like POST API
+		if baseURL == "" {
+			log.Fatal("--base-url is required for stdin document")
+		}
+		query.Set("url", baseURL)
+		if query.Get("format") == "" {
+			query.Set("format", "page")
+		}
+		method, body = http.MethodPost, os.Stdin
+	}
+
+	setLogLevel(c.Parent())
+	imgLogicHandler, _ := newImgLogicHandler(c.Parent())
+	req, err := http.NewRequest(method, InlinePath+"?"+query.Encode(), body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", c.String("content-type"))
+	}
+	handler := ContextAdaptor{
+		Handler: &ImgHandler{
+			Log:              log,
+			LogicHandler:     imgLogicHandler,
+			PostLogicHandler: imgLogicHandler,
+			ErrorHandler:     ErrorLogger{},
+			Timeout:          timeout,
+		},
+		Ctx: context.Background(),
+	}
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, req)
+	if resp.Code != http.StatusOK {
+		os.Stderr.Write(resp.Body.Bytes())
+		log.Fatalf("page processing failed with status %v", resp.Code)
+	}
+	if output == "" {
+		os.Stdout.Write(resp.Body.Bytes())
+		return
+	}
+	if err := ioutil.WriteFile(output, resp.Body.Bytes(), 0644); err != nil {
+		log.Fatal("output write error: ", err)
+	}
+}
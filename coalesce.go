@@ -0,0 +1,139 @@
+package imgserver
+
+import (
+	"fmt"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// renders response of request, with extraction it is formed of
+type renderFunc func(ctx context.Context) (*Response, *extraction, error)
+
+// Renders response, that is shared by concurrent calls of same key, if coalesce is set.
+// Shared response is cloned for every caller, and extraction of it is empty.
+func (h *ImgLogicHandler) renderCoalesced(ctx context.Context, key string, coalesce bool, render renderFunc) (*Response, *extraction, error) {
+	if !coalesce {
+		return render(ctx)
+	}
+	shared, err := h.flights.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+		response, _, err := render(ctx)
+		return response, err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return cloneResponse(shared.(*Response)), &extraction{}, nil
+}
+
+// Coalesces concurrent calls of same key, so simultaneous identical requests
+// make single origin fetch and share its result.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+type flight struct {
+	done    chan struct{} // closed when value and err are set
+	value   interface{}
+	err     error
+	callers int
+}
+
+func newFlightGroup() *flightGroup {
+	return &flightGroup{flights: make(map[string]*flight)}
+}
+
+// Calls fn once for concurrent calls with same key, and returns its result to every caller.
+// Fn gets ctx values and deadline of first caller, but not its cancellation, so callers that are left
+// still get the result. Every caller stops waiting on its ctx done.
+func (g *flightGroup) do(ctx context.Context, key string, fn func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	f, ok := g.flights[key]
+	if ok {
+		f.callers++
+		getLocalLogger(ctx, "flightGroup").WithField("callers", f.callers).Debug("joined in-flight call")
+	} else {
+		f = &flight{done: make(chan struct{}), callers: 1}
+		g.flights[key] = f
+		fnCtx, cancel := context.Context(detachedContext{ctx}), context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok {
+			fnCtx, cancel = context.WithDeadline(fnCtx, deadline)
+		}
+		go func() {
+			defer cancel()
+			defer func() {
+				if r := recover(); r != nil {
+					f.value, f.err = nil, fmt.Errorf("coalesced call panic: %v", r)
+				}
+				g.mu.Lock()
+				delete(g.flights, key)
+				g.mu.Unlock()
+				close(f.done)
+			}()
+			f.value, f.err = fn(fnCtx)
+		}()
+	}
+	g.mu.Unlock()
+	select {
+	case <-f.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return f.value, f.err
+}
+
+// Returns buffered response copy, that can be written independently.
+func cloneResponse(resp *Response) *Response {
+	return NewResponseBuilder(resp.StatusCode).Headers(resp.Header).Body(append([]byte(nil), resp.Body.Bytes()...)).Build()
+}
+
+// imageFetcher decorator, that coalesces concurrent fetches of same image URL with same fetch settings,
+// across all page requests, so image referenced by many pages is downloaded once at a time.
+// Fetches reporting debug info or timings are not coalesced.
+type coalescingImageFetcher struct {
+	fetcher imageFetcher
+	flights *flightGroup
+}
+
+func newCoalescingImageFetcher(fetcher imageFetcher) coalescingImageFetcher {
+	return coalescingImageFetcher{fetcher, newFlightGroup()}
+}
+
+func (f coalescingImageFetcher) fetchImage(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+	if getDebugImage(ctx) != nil || getFetchTimings(ctx) != nil {
+		f.fetcher.fetchImage(ctx, img, imgURL, result)
+		return
+	}
+	done := goroutines.start(goroutineFetch)
+	go func() {
+		defer done()
+		// every setting that affects fetch result
+		key := fmt.Sprintf("options=%+v hints={%s} auth=%v raw=%v url=%s", getFetchOptions(ctx), getClientHints(ctx), getOriginAuth(ctx), isRawImages(ctx), getCanonicalizer(ctx).canonicalString(imgURL))
+		shared, err := f.flights.do(ctx, key, func(ctx context.Context) (interface{}, error) {
+			res := <-startFetch(ctx, f.fetcher, img, imgURL)
+			if res.err != nil {
+				return nil, res.err
+			}
+			return res.img, nil
+		})
+		if err != nil {
+			result(imgTag{}, err)
+			return
+		}
+		fetched := shared.(imgTag)
+		res := img.withSrc(fetched.src())
+		res.raw = fetched.raw
+		result(res, nil)
+	}()
+}
+
+// Enables coalescing of concurrent fetches of same image. Should be enabled after hedging,
+// so hedged fetches are not coalesced with each other.
+func (h *ImgLogicHandler) EnableImageCoalescing() {
+	if extractor, ok := h.imgExtractor.(imgExtractorImp); ok {
+		extractor.fetcher = newCoalescingImageFetcher(extractor.fetcher)
+		h.imgExtractor = extractor
+		h.enabled = append(h.enabled, "image_coalescing")
+	}
+}
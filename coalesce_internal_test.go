@@ -0,0 +1,173 @@
+package imgserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+var _ = Describe("request coalescing", func() {
+	const callers = 5
+	var ctx context.Context
+	BeforeEach(func() {
+		ctx = setLogger(context.Background(), logger.StandardLogger())
+	})
+
+	It("then concurrent calls share single render", func() {
+		group := newFlightGroup()
+		var renders int32
+		release := make(chan struct{})
+		render := func(ctx context.Context) (interface{}, error) {
+			atomic.AddInt32(&renders, 1)
+			<-release
+			return "rendered", nil
+		}
+		var wg sync.WaitGroup
+		results := make([]string, callers)
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				res, err := group.do(ctx, "key", render)
+				Expect(err).NotTo(HaveOccurred())
+				results[i] = res.(string)
+			}(i)
+		}
+		Eventually(func() int {
+			group.mu.Lock()
+			defer group.mu.Unlock()
+			if f := group.flights["key"]; f != nil {
+				return f.callers
+			}
+			return 0
+		}).Should(Equal(callers))
+		close(release)
+		wg.Wait()
+		Expect(atomic.LoadInt32(&renders)).To(BeEquivalentTo(1))
+		for _, res := range results {
+			Expect(res).To(Equal("rendered"))
+		}
+		Expect(group.flights).To(BeEmpty())
+	})
+
+	It("then canceled caller does not cancel render", func() {
+		group := newFlightGroup()
+		release := make(chan struct{})
+		var renderErr error
+		render := func(ctx context.Context) (interface{}, error) {
+			<-release
+			renderErr = ctx.Err()
+			return "rendered", nil
+		}
+		leaderCtx, cancel := context.WithCancel(ctx)
+		leaderDone := make(chan error)
+		go func() {
+			_, err := group.do(leaderCtx, "key", render)
+			leaderDone <- err
+		}()
+		Eventually(func() int {
+			group.mu.Lock()
+			defer group.mu.Unlock()
+			return len(group.flights)
+		}).Should(Equal(1))
+		followerDone := make(chan error)
+		go func() {
+			_, err := group.do(ctx, "key", render)
+			followerDone <- err
+		}()
+		cancel()
+		Expect(<-leaderDone).To(Equal(context.Canceled))
+		close(release)
+		Expect(<-followerDone).NotTo(HaveOccurred())
+		Expect(renderErr).NotTo(HaveOccurred())
+	})
+
+	It("then concurrent identical requests make single page fetch", func() {
+		var requests int32
+		release := make(chan struct{})
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			<-release
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		}))
+		defer origin.Close()
+		handler := NewImgLogicHandler(http.DefaultClient)
+		var wg sync.WaitGroup
+		for i := 0; i < callers; i++ {
+			wg.Add(1)
+			go func() {
+				defer GinkgoRecover()
+				defer wg.Done()
+				req := httptest.NewRequest("GET", "/?url="+url.QueryEscape(origin.URL), nil)
+				resp, err := handler.HandleLogic(ctx, req)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+			}()
+		}
+		Eventually(func() int32 { return atomic.LoadInt32(&requests) }).Should(BeEquivalentTo(1))
+		Eventually(func() int {
+			handler.flights.mu.Lock()
+			defer handler.flights.mu.Unlock()
+			for _, f := range handler.flights.flights {
+				return f.callers
+			}
+			return 0
+		}).Should(Equal(callers))
+		close(release)
+		wg.Wait()
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(1))
+	})
+})
+
+var _ = Describe("image fetch coalescing", func() {
+	It("then concurrent fetches of same image share single fetch", func() {
+		const pages = 5
+		var fetches int32
+		release := make(chan struct{})
+		fetcher := newCoalescingImageFetcher(imageFetcherFunc(func(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+			go func() {
+				atomic.AddInt32(&fetches, 1)
+				<-release
+				result(img.withSrc("data:image/png;base64,AA=="), nil)
+			}()
+		}))
+		ctx := setLogger(context.Background(), logger.StandardLogger())
+		results := make(chan fetchResult, pages)
+		for i := 0; i < pages; i++ {
+			img := imgTag{0, []html.Attribute{{Key: "src", Val: "http://example.com/logo.png"}, {Key: "alt", Val: fmt.Sprint(i)}}, nil}
+			fetcher.fetchImage(ctx, img, img.src(), func(img imgTag, err error) {
+				results <- fetchResult{img, err}
+			})
+		}
+		Eventually(func() int {
+			fetcher.flights.mu.Lock()
+			defer fetcher.flights.mu.Unlock()
+			for _, f := range fetcher.flights.flights {
+				return f.callers
+			}
+			return 0
+		}).Should(Equal(pages))
+		close(release)
+		alts := map[string]bool{}
+		for i := 0; i < pages; i++ {
+			res := <-results
+			Expect(res.err).NotTo(HaveOccurred())
+			img := res.img
+			Expect(img.src()).To(Equal("data:image/png;base64,AA=="))
+			alts[img.attr[1].Val] = true
+		}
+		Expect(alts).To(HaveLen(pages))
+		Expect(atomic.LoadInt32(&fetches)).To(BeEquivalentTo(1))
+	})
+})
@@ -0,0 +1,135 @@
+package imgserver
+
+import (
+	"bytes"
+	"html"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// Max url params of combined page.
+const maxCombinedURLs = 10
+
+// Params, that results of combined page sources don't support.
+var notCombinedParams = []string{"store", "pick", "debug", "stream", "callback_url"}
+
+// Section of combined page.
+type combinedSource struct {
+	url    string
+	images []imgTag
+	err    error
+}
+
+// Makes HandleLogic put extracted images of request to part, instead of sharing its results.
+func setCombinedPart(ctx context.Context, part *extraction) context.Context {
+	return context.WithValue(ctx, ctxCombinedPartKey, part)
+}
+
+// returns nil if request is not combined page source
+func getCombinedPart(ctx context.Context) *extraction {
+	part, _ := ctx.Value(ctxCombinedPartKey).(*extraction)
+	return part
+}
+
+// Returns true if request has combine=true param.
+func isCombined(query url.Values) (bool, error) {
+	param := query.Get("combine")
+	if param == "" {
+		return false, nil
+	}
+	combine, err := strconv.ParseBool(param)
+	if err != nil {
+		return false, NewHandlerError(400, "invalid 'combine' query parameter: "+param)
+	}
+	return combine, nil
+}
+
+// Renders every url param into section of single HTML page, for comparing image sets of pages.
+// Sources are processed concurrently, like separate requests with same params and headers.
+// Failed sources are sections with error, so one broken page doesn't hide others.
+func (h *ImgLogicHandler) handleCombined(ctx context.Context, req *http.Request) (*Response, error) {
+	query := req.URL.Query()
+	urls := query["url"]
+	if len(urls) == 0 {
+		return nil, NewHandlerError(400, "too few url params")
+	}
+	if len(urls) > maxCombinedURLs {
+		return nil, NewHandlerError(400, "too many url params, max "+strconv.Itoa(maxCombinedURLs)+" are combined")
+	}
+	if format := query.Get("format"); format != "" && outputFormat(format) != formatHTML {
+		return nil, NewHandlerError(400, "combined page is supported only with html format")
+	}
+	for _, name := range notCombinedParams {
+		if query.Get(name) != "" {
+			return nil, NewHandlerError(400, "'"+name+"' query parameter is not supported with combine")
+		}
+	}
+	log := getLocalLogger(ctx, "handleCombined").WithField("sources", len(urls))
+	sources := make([]combinedSource, len(urls))
+	var wg sync.WaitGroup
+	for i, rawURL := range urls {
+		sourceQuery := url.Values{}
+		for name, values := range query {
+			sourceQuery[name] = values
+		}
+		sourceQuery.Del("combine")
+		sourceQuery.Set("url", rawURL)
+		sourceQuery.Set("format", string(formatHTML))
+		sourceURL := *req.URL
+		sourceURL.RawQuery = sourceQuery.Encode()
+		sourceReq := *req
+		sourceReq.URL = &sourceURL
+		sources[i].url = rawURL
+		wg.Add(1)
+		done := goroutines.start(goroutineStage)
+		go func(source *combinedSource) {
+			defer wg.Done()
+			defer done()
+			part := &extraction{}
+			_, source.err = h.HandleLogic(setCombinedPart(ctx, part), &sourceReq)
+			source.images = part.images
+		}(&sources[i])
+	}
+	wg.Wait()
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, &HandlerError{http.StatusGatewayTimeout, "timeout", ctx.Err()}
+	}
+	log.Debug("combined sources processed")
+	resp := NewResponse()
+	resp.StatusCode = http.StatusOK
+	resp.Header.Set("Content-Type", "text/html;charset=utf-8")
+	resp.Header.Set("Vary", responseVary(ctx))
+	resp.Header.Set("Accept-CH", ClientHintsHeaders)
+	images := formCombinedHTML(sources, resp.Body)
+	resp.Header.Set(ImageCountHeader, strconv.Itoa(images))
+	return resp, nil
+}
+
+// writes combined page with section of every source to buf, and returns images count
+func formCombinedHTML(sources []combinedSource, buf *bytes.Buffer) int {
+	images := 0
+	buf.WriteString("<html>\n<head>\n<title>imgserv</title>\n</head>\n<body>\n")
+	for _, source := range sources {
+		escapedURL := html.EscapeString(source.url)
+		buf.WriteString("<section>\n<h2><a href=\"" + escapedURL + "\">" + escapedURL + "</a></h2>\n")
+		if source.err != nil {
+			description := "internal error"
+			if handlerErr, ok := source.err.(*HandlerError); ok {
+				description = handlerErr.description
+			}
+			buf.WriteString("<p class=\"error\">" + html.EscapeString(description) + "</p>\n")
+		}
+		for _, img := range source.images {
+			buf.WriteString(img.token().String())
+			buf.WriteByte('\n')
+		}
+		images += len(source.images)
+		buf.WriteString("</section>\n")
+	}
+	buf.WriteString("</body>\n</html>")
+	return images
+}
@@ -0,0 +1,67 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("combined page", func() {
+	var origin *httptest.Server
+	BeforeEach(func() {
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/a", "/b":
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte(`<img src="` + r.URL.Path + `.gif">`))
+			case "/a.gif", "/b.gif":
+				w.Header().Set("Content-Type", "image/gif")
+				w.Write([]byte("GIF89a" + r.URL.Path))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	handle := func(query string, pages ...string) (*Response, error) {
+		params := url.Values{}
+		for _, page := range pages {
+			params.Add("url", origin.URL+page)
+		}
+		req := httptest.NewRequest("GET", "/?"+params.Encode()+query, nil)
+		return NewImgLogicHandler(http.DefaultClient).HandleLogic(setLogger(context.Background(), logger.StandardLogger()), req)
+	}
+
+	It("then every page is section in url params order", func() {
+		resp, err := handle("&combine=true", "/b", "/a")
+		Expect(err).NotTo(HaveOccurred())
+		body := resp.Body.String()
+		Expect(strings.Count(body, "<section>")).To(Equal(2))
+		Expect(strings.Index(body, origin.URL+"/b")).To(BeNumerically("<", strings.Index(body, origin.URL+"/a")))
+		Expect(body).To(ContainSubstring(encodeDataURL("image/gif", []byte("GIF89a/a.gif"))))
+		Expect(resp.Header.Get(ImageCountHeader)).To(Equal("2"))
+	})
+	It("then failed page is section with error", func() {
+		resp, err := handle("&combine=true", "/a", "/missing")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Body.String()).To(ContainSubstring(`<p class="error">`))
+		Expect(resp.Header.Get(ImageCountHeader)).To(Equal("1"))
+	})
+	It("then many url params are rejected without combine", func() {
+		_, err := handle("", "/a", "/b")
+		Expect(err).To(HaveOccurred())
+	})
+	It("then other formats are rejected", func() {
+		_, err := handle("&combine=true&format=json", "/a", "/b")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(400))
+	})
+})
@@ -0,0 +1,94 @@
+package imgserver
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+// Validators of client conditional requests, forwarded to page origin.
+var pageConditionHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+// Headers of cached response, kept in 304 response.
+var notModifiedHeaders = []string{"ETag", "Last-Modified", "Cache-Control", "Vary"}
+
+// Returns validator headers of conditional request, or nil if request is not conditional.
+func pageConditions(req *http.Request) http.Header {
+	var conditions http.Header
+	for _, name := range pageConditionHeaders {
+		if value := req.Header.Get(name); value != "" {
+			if conditions == nil {
+				conditions = make(http.Header)
+			}
+			conditions.Set(name, value)
+		}
+	}
+	return conditions
+}
+
+// Sets page ETag and Last-Modified on response rendered of it, so clients can make conditional requests.
+func setPageValidators(resp *Response, pageHeader http.Header) {
+	for _, name := range []string{"ETag", "Last-Modified"} {
+		if value := pageHeader.Get(name); value != "" {
+			resp.Header.Set(name, value)
+		}
+	}
+}
+
+// Revalidates cached rendering of key by conditional page fetch with client validators.
+// Returns 304 response without reprocessing, if origin page is not modified and rendering is cached.
+// Otherwise returns nil, and request is processed as unconditional one.
+func (h *ImgLogicHandler) notModified(ctx context.Context, key string, conditions http.Header) *Response {
+	log := getLocalLogger(ctx, "notModified")
+	cached, refresh := h.Cache.get(key)
+	if cached == nil {
+		return nil
+	}
+	if cached.Header.Get("ETag") == "" && cached.Header.Get("Last-Modified") == "" {
+		// not rendered of page origin validators, so client ones are not of page
+		if refresh {
+			h.Cache.refreshFailed(key)
+		}
+		return nil
+	}
+	req, err := newPageRequest(ctx, getURLParam(ctx).String())
+	if err == nil {
+		for name, values := range conditions {
+			req.Header[name] = values
+		}
+		var resp *http.Response
+		if resp, err = cxtAwareDo(ctx, req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusNotModified {
+				log.Debug("page not modified")
+				if refresh {
+					// cached rendering is still of current page
+					cached.Header.Del("Age")
+					cached.Header.Set(RenderCacheHeader, "miss")
+					h.Cache.put(key, cached)
+				}
+				return notModifiedResponse(cached)
+			}
+		}
+	}
+	if err != nil {
+		log.WithField("error", err).Debug("conditional page fetch failed")
+	}
+	if refresh {
+		// request renders again
+		h.Cache.refreshFailed(key)
+	}
+	return nil
+}
+
+func notModifiedResponse(cached *Response) *Response {
+	resp := NewResponseBuilder(http.StatusNotModified).Build()
+	for _, name := range notModifiedHeaders {
+		name = http.CanonicalHeaderKey(name)
+		if values, ok := cached.Header[name]; ok {
+			resp.Header[name] = values
+		}
+	}
+	resp.Header.Set(RenderCacheHeader, "hit")
+	return resp
+}
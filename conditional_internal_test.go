@@ -0,0 +1,67 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("conditional request", func() {
+	var (
+		origin   *httptest.Server
+		requests int32
+		handler  *ImgLogicHandler
+	)
+	BeforeEach(func() {
+		atomic.StoreInt32(&requests, 0)
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.Header().Set("ETag", `"v1"`)
+			if r.Header.Get("If-None-Match") == `"v1"` {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		}))
+		handler = NewImgLogicHandler(http.DefaultClient)
+		handler.Cache = NewRenderCache(time.Hour, 0, 10)
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	get := func(etag string) *Response {
+		req := httptest.NewRequest("GET", "/?url="+url.QueryEscape(origin.URL), nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := handler.HandleLogic(setLogger(context.Background(), logger.StandardLogger()), req)
+		Expect(err).NotTo(HaveOccurred())
+		return resp
+	}
+
+	It("then not modified cached rendering is not processed again", func() {
+		resp := get("")
+		Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		Expect(resp.Header.Get("ETag")).To(Equal(`"v1"`))
+		resp = get(`"v1"`)
+		Expect(resp.StatusCode).To(Equal(http.StatusNotModified))
+		Expect(resp.Body.Len()).To(BeZero())
+		Expect(resp.Header.Get("ETag")).To(Equal(`"v1"`))
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(2))
+	})
+	It("then modified page is processed", func() {
+		get("")
+		Expect(get(`"v0"`).StatusCode).To(Equal(http.StatusOK))
+	})
+	It("then not cached rendering is processed", func() {
+		Expect(get(`"v1"`).StatusCode).To(Equal(http.StatusOK))
+	})
+})
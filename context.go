@@ -4,6 +4,7 @@ import (
 	"errors"
 	"net/http"
 	"net/url"
+	"time"
 
 	"golang.org/x/net/context"
 	"golang.org/x/net/context/ctxhttp"
@@ -14,17 +15,112 @@ type ctxValueKeyType int
 //private keys
 const (
 	ctxURLParamKey ctxValueKeyType = iota
+	ctxFetchOptionsKey
+	ctxOriginAuthKey
+	ctxAuditorKey
+	ctxProfileKey
+	ctxClientHintsKey
+	ctxFetchTimingsKey
+	ctxDebugReportKey
+	ctxDebugImageKey
+	ctxCacheRefreshKey
+	ctxPlaceholderKey
+	ctxRawImagesKey
+	ctxImageAcceptKey
+	ctxParseLimitsKey
+	ctxImageValidatorsKey
+	ctxCanonicalizerKey
+	ctxHTTPFallbackKey
+	ctxCombinedPartKey
+	ctxPhaseTimingsKey
+	ctxSanitizePolicyKey
+	ctxLanguageKey
+	ctxObserverKey
+	ctxTraceHeadersKey
+	ctxImageSinkKey
+	ctxEarlyHintsKey
+	ctxImageTypesKey
+	ctxSniffPlainTextKey
+	ctxPageURLKey
 )
 
 // public keys upper handler can
 const (
 	CtxHTTPClientKey = "httpclient"
 	CtxLoggerKey     = "logger"
+	CtxAPIKeyIDKey   = "apikey" // set by AuthHandler
 )
 
+// Gets page or page resource.
 func cxtAwareGet(ctx context.Context, URL string) (*http.Response, error) {
+	req, err := newPageRequest(ctx, URL)
+	if err != nil {
+		return nil, err
+	}
+	return cxtAwareDo(ctx, req)
+}
+
+// Returns GET request of page or page resource, accepting language set for request.
+// Images are fetched without it, so they are cached for every language.
+func newPageRequest(ctx context.Context, URL string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if lang := getLanguage(ctx); lang != "" {
+		req.Header.Set("Accept-Language", lang)
+	}
+	return req, nil
+}
+
+// Gets image, accepting image formats set for request.
+func imageGet(ctx context.Context, imgURL string) (*http.Response, error) {
+	req, err := newImageRequest(ctx, imgURL)
+	if err != nil {
+		return nil, err
+	}
+	return cxtAwareDo(ctx, req)
+}
+
+// Returns GET request of image, with Accept header set for request.
+func newImageRequest(ctx context.Context, imgURL string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", imgURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if accept := getImageAccept(ctx); accept != "" {
+		req.Header.Set("Accept", accept)
+	}
+	return req, nil
+}
+
+// Makes origin request, with origin auth, tracing and auditing of ctx.
+func cxtAwareDo(ctx context.Context, req *http.Request) (*http.Response, error) {
+	URL := req.URL.String()
+	getOriginAuth(ctx).apply(req)
+	applyTraceHeaders(ctx, req)
+	req.Header.Set("Accept-Encoding", acceptEncoding)
+	ctx, trace := newFetchTrace(ctx, URL)
+	getFetchTimings(ctx).add(trace)
 	// request will be canceled on context cancel or timeout
-	return ctxhttp.Get(ctx, getClient(ctx), URL)
+	resp, err := ctxhttp.Do(ctx, getClient(ctx), req)
+	if err == nil {
+		trace.traceBody(resp)
+	}
+	getAuditor(ctx).audit(URL, trace, resp, err)
+	if err != nil {
+		if isDeniedAddress(err) {
+			return nil, &HandlerError{http.StatusForbidden, "origin address is not allowed: " + URL, err}
+		}
+		if hErr := originHandlerError(err); hErr != nil {
+			return nil, hErr
+		}
+		return nil, err
+	}
+	if err := decodeContentEncoding(resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
 
 	// another way to do context-aware request.
 	// Way to set req.Cancel = ctx.Done seems have better performance, but return not ctx.Err() on ctx.Done
@@ -74,6 +170,34 @@ func getURLParam(ctx context.Context) *url.URL {
 	return urlParam
 }
 
+// Sets URL of fetched page, which differs from url param after http fallback or page redirects.
+func setPageURL(ctx context.Context, pageURL *url.URL) context.Context {
+	return context.WithValue(ctx, ctxPageURLKey, pageURL)
+}
+
+// returns URL of fetched page, which images are resolved relative to, or url param, if it is not set
+func getPageURL(ctx context.Context) *url.URL {
+	if pageURL, ok := ctx.Value(ctxPageURLKey).(*url.URL); ok {
+		return pageURL
+	}
+	return getURLParam(ctx)
+}
+
 func getLocalLogger(ctx context.Context, emitter string) Logger {
 	return SetEmitter(getLogger(ctx), emitter)
 }
+
+// returns authenticated API key ID, or empty string if request is not authenticated
+func getAPIKeyID(ctx context.Context) string {
+	id, _ := ctx.Value(CtxAPIKeyIDKey).(string)
+	return id
+}
+
+// Context with values of parent, that is not canceled with it, for work outliving request.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
@@ -0,0 +1,246 @@
+package imgserver
+
+import (
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+const CrawlPath = "/" + APIVersion + "/crawl"
+
+// Crawl bounds. Zero fields are unlimited, except Delay.
+type CrawlLimits struct {
+	MaxPages int
+	MaxDepth int           // link hops from root or sitemap pages
+	Delay    time.Duration // politeness pause between page requests
+}
+
+var DefaultCrawlLimits = CrawlLimits{MaxPages: 20, MaxDepth: 2, Delay: 200 * time.Millisecond}
+
+// Crawls same origin pages from site root or sitemap.xml in url param,
+// and responds with deduplicated listing of their images.
+// Params max_pages and depth can lower Limits, delay can raise Limits.Delay.
+type CrawlLogicHandler struct {
+	Client *http.Client
+	Limits CrawlLimits
+}
+
+func NewCrawlLogicHandler(client *http.Client) *CrawlLogicHandler {
+	return &CrawlLogicHandler{client, DefaultCrawlLimits}
+}
+
+type crawledPage struct {
+	URL    string `json:"url"`
+	Depth  int    `json:"depth"`
+	Images int    `json:"images"`
+	Error  string `json:"error,omitempty"`
+}
+
+type crawledImage struct {
+	URL   string   `json:"url"`
+	Pages []string `json:"pages"` // pages the image is found on
+}
+
+type crawlResult struct {
+	URL    string          `json:"url"`
+	Pages  []crawledPage   `json:"pages"`
+	Images []*crawledImage `json:"images"` // in order of first appearance
+}
+
+func (h *CrawlLogicHandler) HandleLogic(ctx context.Context, req *http.Request) (*Response, error) {
+	log := getLocalLogger(ctx, "CrawlLogicHandler")
+	query := req.URL.Query()
+	rootParam := query.Get("url")
+	if rootParam == "" {
+		return nil, NewHandlerError(400, "no 'url' query parameter")
+	}
+	root, err := url.Parse(rootParam)
+	if err != nil || !root.IsAbs() {
+		return nil, NewHandlerError(400, "invalid URL as 'url' query parameter")
+	}
+	limits, err := h.parseLimits(query)
+	if err != nil {
+		return nil, err
+	}
+	ctx = newImgLogicContext(ctx, h.Client, root)
+	log.WithField("url", root.String()).Debug("crawl started")
+
+	type queued struct {
+		url   *url.URL
+		depth int
+	}
+	var queue []queued
+	if strings.HasSuffix(root.Path, ".xml") {
+		locs, err := h.fetchSitemap(ctx, root.String())
+		if err != nil {
+			return nil, err
+		}
+		for _, loc := range locs {
+			if u, err := url.Parse(loc); err == nil && sameOrigin(u, root) {
+				queue = append(queue, queued{u, 0})
+			}
+		}
+	} else {
+		queue = append(queue, queued{root, 0})
+	}
+
+	res := &crawlResult{URL: root.String(), Pages: []crawledPage{}, Images: []*crawledImage{}}
+	images := make(map[string]*crawledImage)
+	visited := make(map[string]bool)
+	for len(queue) > 0 && (limits.MaxPages == 0 || len(res.Pages) < limits.MaxPages) {
+		next := queue[0]
+		queue = queue[1:]
+		pageURL := next.url.String()
+		if visited[pageURL] {
+			continue
+		}
+		visited[pageURL] = true
+		if len(res.Pages) > 0 && limits.Delay > 0 {
+			select {
+			case <-time.After(limits.Delay):
+			case <-ctx.Done():
+				return nil, &HandlerError{http.StatusGatewayTimeout, "timeout", ctx.Err()}
+			}
+		}
+		page := crawledPage{URL: pageURL, Depth: next.depth}
+		imgURLs, links, err := h.crawlPage(ctx, next.url)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, &HandlerError{http.StatusGatewayTimeout, "timeout", err}
+			}
+			page.Error = err.Error()
+		}
+		page.Images = len(imgURLs)
+		res.Pages = append(res.Pages, page)
+		for _, imgURL := range imgURLs {
+			img, ok := images[imgURL]
+			if !ok {
+				img = &crawledImage{URL: imgURL}
+				images[imgURL] = img
+				res.Images = append(res.Images, img)
+			}
+			if n := len(img.Pages); n == 0 || img.Pages[n-1] != pageURL {
+				img.Pages = append(img.Pages, pageURL)
+			}
+		}
+		if limits.MaxDepth > 0 && next.depth >= limits.MaxDepth {
+			continue
+		}
+		for _, link := range links {
+			if sameOrigin(link, root) && !visited[link.String()] {
+				queue = append(queue, queued{link, next.depth + 1})
+			}
+		}
+	}
+	log.WithField("pages", len(res.Pages)).Debugf("%v images found", len(res.Images))
+	return jsonResponse(res)
+}
+
+func (h *CrawlLogicHandler) parseLimits(query url.Values) (CrawlLimits, error) {
+	limits := h.Limits
+	if param := query.Get("max_pages"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n <= 0 || h.Limits.MaxPages > 0 && n > h.Limits.MaxPages {
+			return limits, NewHandlerError(400, "invalid 'max_pages' query parameter: "+param)
+		}
+		limits.MaxPages = n
+	}
+	if param := query.Get("depth"); param != "" {
+		n, err := strconv.Atoi(param)
+		if err != nil || n <= 0 || h.Limits.MaxDepth > 0 && n > h.Limits.MaxDepth {
+			return limits, NewHandlerError(400, "invalid 'depth' query parameter: "+param)
+		}
+		limits.MaxDepth = n
+	}
+	delay, err := parseDurationParam(query, "delay", limits.Delay)
+	if err != nil {
+		return limits, err
+	}
+	if delay < h.Limits.Delay {
+		return limits, NewHandlerError(400, "'delay' query parameter is less than server limit "+h.Limits.Delay.String())
+	}
+	limits.Delay = delay
+	return limits, nil
+}
+
+// returns page image URLs in document order, and links without fragments
+func (h *CrawlLogicHandler) crawlPage(ctx context.Context, pageURL *url.URL) ([]string, []*url.URL, error) {
+	resp, err := cxtAwareGet(ctx, pageURL.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	body, err := getBody(ctx, resp)
+	if err != nil {
+		return nil, nil, err
+	}
+	imgURLs, links := parseLinks(body, pageURL)
+	return imgURLs, links, nil
+}
+
+func parseLinks(r io.Reader, pageURL *url.URL) ([]string, []*url.URL) {
+	var imgURLs []string
+	var links []*url.URL
+	folderURL := getFolderURL(*pageURL)
+	tokenizer := html.NewTokenizer(r)
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return imgURLs, links
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "img":
+				img, err := parseImgToken(token)
+				if err != nil || img.isDataURL() || img.src() == "" {
+					continue
+				}
+				if imgURL, err := getImgURL(img.src(), *folderURL); err == nil {
+					imgURLs = append(imgURLs, imgURL)
+				}
+			case "a":
+				for _, attr := range token.Attr {
+					if attr.Key != "href" {
+						continue
+					}
+					if link, err := pageURL.Parse(attr.Val); err == nil {
+						link.Fragment = ""
+						links = append(links, link)
+					}
+				}
+			}
+		}
+	}
+}
+
+// returns page URLs of sitemap
+func (h *CrawlLogicHandler) fetchSitemap(ctx context.Context, sitemapURL string) ([]string, error) {
+	resp, err := cxtAwareGet(ctx, sitemapURL)
+	if err != nil {
+		return nil, &HandlerError{http.StatusBadGateway, "Can't get sitemap", err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, NewHandlerError(400, "Can't get sitemap: expected status code 200 but found "+strconv.Itoa(resp.StatusCode))
+	}
+	var sitemap struct {
+		Locs []string `xml:"url>loc"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&sitemap); err != nil {
+		return nil, &HandlerError{400, "invalid sitemap", err}
+	}
+	for i := range sitemap.Locs {
+		sitemap.Locs[i] = strings.TrimSpace(sitemap.Locs[i])
+	}
+	return sitemap.Locs, nil
+}
+
+func sameOrigin(u, root *url.URL) bool {
+	return strings.EqualFold(u.Scheme, root.Scheme) && strings.EqualFold(u.Host, root.Host)
+}
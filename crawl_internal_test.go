@@ -0,0 +1,92 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("crawl", func() {
+	var (
+		site    *httptest.Server
+		handler *CrawlLogicHandler
+	)
+	pages := map[string]string{
+		"/":      `<a href="/a">a</a><a href="/b#top">b</a><a href="http://other.example.com/">other</a><img src="/logo.png">`,
+		"/a":     `<a href="/deep">deep</a><img src="/logo.png"><img src="/a.png">`,
+		"/b":     `<img src="b.png">`,
+		"/deep":  `<img src="/deep.png">`,
+		"/empty": ``,
+	}
+	BeforeEach(func() {
+		site = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/sitemap.xml" {
+				w.Header().Set("Content-Type", "application/xml")
+				fmt.Fprintf(w, `<urlset><url><loc>%s/b</loc></url><url><loc> %s/empty </loc></url></urlset>`, "http://"+r.Host, "http://"+r.Host)
+				return
+			}
+			page, ok := pages[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(page))
+		}))
+		handler = NewCrawlLogicHandler(http.DefaultClient)
+		handler.Limits.Delay = 0
+	})
+	AfterEach(func() {
+		site.Close()
+	})
+	crawl := func(query string) (*crawlResult, error) {
+		req := httptest.NewRequest("GET", CrawlPath+"?url="+query, nil)
+		ctx := setLogger(context.Background(), logger.StandardLogger())
+		resp, err := handler.HandleLogic(ctx, req)
+		if err != nil {
+			return nil, err
+		}
+		res := &crawlResult{}
+		Expect(json.Unmarshal(resp.Body.Bytes(), res)).To(Succeed())
+		return res, nil
+	}
+
+	It("then same origin pages crawled within depth", func() {
+		res, err := crawl(site.URL + "/&depth=1")
+		Expect(err).NotTo(HaveOccurred())
+		var visited []string
+		for _, page := range res.Pages {
+			visited = append(visited, page.URL)
+		}
+		Expect(visited).To(Equal([]string{site.URL + "/", site.URL + "/a", site.URL + "/b"}))
+		Expect(res.Images).To(HaveLen(3))
+		Expect(res.Images[0].URL).To(Equal(site.URL + "/logo.png"))
+		Expect(res.Images[0].Pages).To(Equal([]string{site.URL + "/", site.URL + "/a"}))
+	})
+	It("then max pages respected", func() {
+		res, err := crawl(site.URL + "/&max_pages=2")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Pages).To(HaveLen(2))
+	})
+	It("then sitemap pages crawled", func() {
+		res, err := crawl(site.URL + "/sitemap.xml&depth=1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.Pages).To(HaveLen(2))
+		Expect(res.Images).To(HaveLen(1))
+		Expect(res.Images[0].URL).To(Equal(site.URL + "/b.png"))
+	})
+	It("then limits can't be exceeded", func() {
+		_, err := crawl(site.URL + "/&max_pages=100")
+		Expect(err).To(HaveOccurred())
+		handler.Limits.Delay = time.Second
+		_, err = crawl(site.URL + "/&delay=1ms")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,38 @@
+package imgserver
+
+import (
+	"mime"
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+// Policy of rendered pages: only data URL images, inline styles and data URL fonts of saved pages
+// are loaded, and scripts never run. Not inlined images are blocked too, policy allowing them
+// should add their origins, like "img-src data: https:".
+const DefaultContentSecurityPolicy = "default-src 'none'; img-src data:; style-src 'unsafe-inline'; font-src data:"
+
+// LogicHandler decorator, that sets Content-Security-Policy header on HTML responses, and
+// X-Content-Type-Options: nosniff on every response. Rendered pages are made of origin content,
+// so markup slipped through from origin page can't run scripts in server origin.
+type SecurityHeadersLogicHandler struct {
+	LogicHandler
+	Policy string // CSP of HTML responses, not set if empty
+}
+
+func (h SecurityHeadersLogicHandler) HandleLogic(ctx context.Context, req *http.Request) (*Response, error) {
+	resp, err := h.LogicHandler.HandleLogic(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Set("X-Content-Type-Options", "nosniff")
+	if h.Policy != "" && isHTMLContentType(resp.Header.Get("Content-Type")) {
+		resp.Header.Set("Content-Security-Policy", h.Policy)
+	}
+	return resp, nil
+}
+
+func isHTMLContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
@@ -0,0 +1,45 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("security headers", func() {
+	handle := func(contentType string, policy string) http.Header {
+		h := SecurityHeadersLogicHandler{logicHandlerFunc(func(ctx context.Context, req *http.Request) (*Response, error) {
+			resp := NewResponse()
+			resp.StatusCode = http.StatusOK
+			resp.Header.Set("Content-Type", contentType)
+			return resp, nil
+		}), policy}
+		resp, err := h.HandleLogic(context.Background(), httptest.NewRequest("GET", "/?url=http://example.com", nil))
+		Expect(err).NotTo(HaveOccurred())
+		return resp.Header
+	}
+	It("then HTML response has policy", func() {
+		header := handle("text/html;charset=utf-8", DefaultContentSecurityPolicy)
+		Expect(header.Get("Content-Security-Policy")).To(Equal(DefaultContentSecurityPolicy))
+		Expect(header.Get("X-Content-Type-Options")).To(Equal("nosniff"))
+		Expect(handle("application/xhtml+xml", "default-src 'none'").Get("Content-Security-Policy")).To(Equal("default-src 'none'"))
+	})
+	It("then not HTML response has no policy", func() {
+		header := handle("application/json", DefaultContentSecurityPolicy)
+		Expect(header.Get("Content-Security-Policy")).To(BeEmpty())
+		Expect(header.Get("X-Content-Type-Options")).To(Equal("nosniff"))
+	})
+	It("then empty policy is not set", func() {
+		Expect(handle("text/html", "").Get("Content-Security-Policy")).To(BeEmpty())
+	})
+	It("then errors are passed", func() {
+		h := SecurityHeadersLogicHandler{logicHandlerFunc(func(ctx context.Context, req *http.Request) (*Response, error) {
+			return nil, NewHandlerError(http.StatusNotFound, "not found")
+		}), DefaultContentSecurityPolicy}
+		_, err := h.HandleLogic(context.Background(), httptest.NewRequest("GET", "/", nil))
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,53 @@
+package imgserver
+
+import (
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Policies of data URL images of page, set by data_urls query param.
+const (
+	DataURLsKeep    = "keep"    // passed as is
+	DataURLsDrop    = "drop"    // ones bigger than max image size are left out of result
+	DataURLsProcess = "process" // checked and recompressed like fetched images, bigger than max image size fail
+)
+
+var dataURLPolicies = []string{DataURLsKeep, DataURLsDrop, DataURLsProcess}
+
+// Returns data URL image of page by policy, or false, if it is dropped.
+// Processed images fail, like fetched ones, if they are too big or are not images.
+func applyDataURLPolicy(ctx context.Context, img imgTag, src string) (imgTag, bool, error) {
+	opts := getFetchOptions(ctx)
+	switch opts.DataURLs {
+	case DataURLsDrop:
+		if opts.MaxImageSize > 0 && int64(dataURLDataSize(src)) > opts.MaxImageSize {
+			return imgTag{}, false, nil
+		}
+		return img, true, nil
+	case DataURLsProcess:
+		res, err := processDataURL(ctx, img, src)
+		return res, err == nil, err
+	default:
+		return img, true, nil
+	}
+}
+
+// Returns img with data URL src decoded, sniffed and recompressed like fetched image data.
+func processDataURL(ctx context.Context, img imgTag, src string) (imgTag, error) {
+	opts := getFetchOptions(ctx)
+	// data URL itself is never logged, as it may be huge
+	const name = "data URL image"
+	if opts.MaxImageSize > 0 && int64(dataURLDataSize(src)) > opts.MaxImageSize {
+		return imgTag{}, NewHandlerError(400, "image is bigger than max image size: "+name)
+	}
+	ct, data, err := splitDataURL(src)
+	if err != nil {
+		return imgTag{}, &HandlerError{400, "invalid " + name, err}
+	}
+	if ct, err = sniffImage(name, strings.TrimSpace(ct), data); err != nil {
+		return imgTag{}, err
+	}
+	data = recompressImage(ctx, ct, data)
+	return img.withSrc(encodeDataURL(ct, data)), nil
+}
@@ -0,0 +1,62 @@
+package imgserver
+
+import (
+	"bytes"
+	"net/url"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("data URL policy", func() {
+	const (
+		small = "data:image/gif;base64,R0lGODlh"                                         // 6 bytes
+		big   = "data:image/gif;base64,R0lGODlhR0lGODlhR0lGODlh"                         // 18 bytes
+		page  = "data:image/png;base64,PGh0bWw+PGJvZHk+bm90IGZvdW5kPC9ib2R5PjwvaHRtbD4=" // HTML
+	)
+	extract := func(opts FetchOptions, srcs ...string) (*extraction, error) {
+		pageURL, _ := url.Parse("http://example.com/page")
+		ctx := context.WithValue(setLogger(context.Background(), log.StandardLogger()), ctxURLParamKey, pageURL)
+		ctx = setFetchOptions(ctx, opts)
+		fetcher := imageFetcherFunc(func(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+			Fail("data URLs should not be fetched")
+		})
+		doc := &bytes.Buffer{}
+		for _, src := range srcs {
+			doc.WriteString(`<img src="` + src + `">`)
+		}
+		return imgExtractorImp{imageParserImp{imgTokenParserFunc(parseImgToken)}, fetcher, nil}.extractImages(ctx, doc)
+	}
+	srcs := func(res *extraction) []string {
+		var srcs []string
+		for _, img := range res.images {
+			srcs = append(srcs, img.src())
+		}
+		return srcs
+	}
+	It("then data URLs are kept by default", func() {
+		res, err := extract(FetchOptions{MaxImageSize: 10}, small, big, page)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(srcs(res)).To(Equal([]string{small, big, page}))
+	})
+	It("then data URLs bigger than max image size are dropped", func() {
+		res, err := extract(FetchOptions{MaxImageSize: 10, DataURLs: DataURLsDrop}, small, big, page)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(srcs(res)).To(Equal([]string{small}))
+	})
+	It("then processed data URLs are checked like fetched images", func() {
+		res, err := extract(FetchOptions{DataURLs: DataURLsProcess}, small, big)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(srcs(res)).To(Equal([]string{small, big}))
+		_, err = extract(FetchOptions{MaxImageSize: 10, DataURLs: DataURLsProcess}, small, big)
+		Expect(err).To(HaveOccurred())
+		_, err = extract(FetchOptions{DataURLs: DataURLsProcess}, page)
+		Expect(err).To(HaveOccurred())
+		res, err = extract(FetchOptions{DataURLs: DataURLsProcess, Tolerant: true}, page, small)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.images).To(HaveLen(2))
+		Expect(res.images[0].src()).NotTo(Equal(page))
+	})
+})
@@ -0,0 +1,170 @@
+package imgserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+// debug report image outcomes
+const (
+	outcomeInlined = "inlined" // replaced by data URL
+	outcomeLinked  = "linked"  // left as absolute link
+	outcomeData    = "data"    // data URL in page already
+	outcomeFailed  = "failed"
+	outcomeSkipped = "skipped" // not fetched, as processing budget exhausted
+)
+
+// max length of data URL src in report
+const debugSrcLength = 64
+
+// Processing report of single discovered image.
+// Is changed only by image fetch routine, until result of fetch is received.
+type DebugImage struct {
+	Position          int    `json:"position"` // in document, from 1
+	Src               string `json:"src"`
+	Srcset            string `json:"srcset,omitempty"`
+	Chosen            string `json:"chosen,omitempty"` // srcset candidate chosen by client hints
+	URL               string `json:"url,omitempty"`    // resolved image URL
+	Outcome           string `json:"outcome"`
+	Reason            string `json:"reason,omitempty"` // of failed, linked or skipped outcome
+	Attempts          int    `json:"attempts,omitempty"`
+	Status            int    `json:"status,omitempty"` // of last attempt
+	ContentType       string `json:"content_type,omitempty"`
+	FetchedBytes      int    `json:"fetched_bytes,omitempty"`
+	Width             int    `json:"width,omitempty"` // decoded dimensions, not set if format decoder is not in build
+	Height            int    `json:"height,omitempty"`
+	RecompressedBytes int    `json:"recompressed_bytes,omitempty"` // set if image was recompressed for Save-Data
+	EncodedBytes      int    `json:"encoded_bytes,omitempty"`      // of data URL
+}
+
+func (d *DebugImage) set(outcome, reason string) {
+	if d != nil {
+		d.Outcome, d.Reason = outcome, reason
+	}
+}
+
+// Report of images discovered in page, returned instead of result with debug param.
+type debugReport struct {
+	mu            sync.Mutex
+	images        []*DebugImage
+	charset       string // of url param page decode
+	charsetSource string
+}
+
+func setDebugReport(ctx context.Context, report *debugReport) context.Context {
+	return context.WithValue(ctx, ctxDebugReportKey, report)
+}
+
+// returns nil if report is not collected
+func getDebugReport(ctx context.Context) *debugReport {
+	report, _ := ctx.Value(ctxDebugReportKey).(*debugReport)
+	return report
+}
+
+// returns nil if report is nil
+func (r *debugReport) discover(position int, img imgTag, src string) *DebugImage {
+	if r == nil {
+		return nil
+	}
+	d := &DebugImage{Position: position, Src: shortenSrc(img.src())}
+	for _, attr := range img.attr {
+		if attr.Key == "srcset" {
+			d.Srcset = attr.Val
+		}
+	}
+	if src != img.src() {
+		d.Chosen = shortenSrc(src)
+	}
+	r.mu.Lock()
+	r.images = append(r.images, d)
+	r.mu.Unlock()
+	return d
+}
+
+// records charset of page decode, pages of frames and redirects fetched after url param page are not recorded
+func (r *debugReport) setCharset(name, source string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.charset == "" {
+		r.charset, r.charsetSource = name, source
+	}
+}
+
+// marks images without outcome skipped, should be called after all fetches finished
+func (r *debugReport) skipUnfinished(reason string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, d := range r.images {
+		if d.Outcome == "" {
+			d.Outcome, d.Reason = outcomeSkipped, reason
+		}
+	}
+}
+
+func (r *debugReport) response(ctx context.Context, format outputFormat, extracted *extraction, extractErr error) (*Response, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	res := struct {
+		URL       string        `json:"url"`
+		Format    outputFormat  `json:"format"`
+		Error     string        `json:"error,omitempty"` // processing error, returned instead of result without debug
+		Truncated bool          `json:"truncated,omitempty"`
+		Charset   string        `json:"charset,omitempty"`
+		Source    string        `json:"charset_source,omitempty"` // charsetDeclared, charsetDetected or charsetFallback
+		Images    []*DebugImage `json:"images"`
+		Timings   []URLTiming   `json:"timings,omitempty"`
+	}{URL: getURLParam(ctx).String(), Format: format, Charset: r.charset, Source: r.charsetSource, Images: r.images}
+	if res.Images == nil {
+		res.Images = []*DebugImage{}
+	}
+	if extractErr != nil {
+		res.Error = extractErr.Error()
+	} else {
+		res.Truncated = extracted.truncated
+	}
+	if timings := getFetchTimings(ctx); timings != nil {
+		res.Timings = timings.list()
+	}
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(res); err != nil {
+		return nil, err
+	}
+	resp := NewResponse()
+	resp.StatusCode = http.StatusOK
+	resp.Header.Set("Content-Type", "application/json")
+	resp.Body = buf
+	return resp, nil
+}
+
+func setDebugImage(ctx context.Context, d *DebugImage) context.Context {
+	if d == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxDebugImageKey, d)
+}
+
+// returns nil if image is not reported
+func getDebugImage(ctx context.Context) *DebugImage {
+	d, _ := ctx.Value(ctxDebugImageKey).(*DebugImage)
+	return d
+}
+
+func shortenSrc(src string) string {
+	if len(src) > debugSrcLength && strings.HasPrefix(src, "data:") {
+		return src[:debugSrcLength] + "..."
+	}
+	return src
+}
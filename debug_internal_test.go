@@ -0,0 +1,85 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("debug report", func() {
+	var origin *httptest.Server
+	BeforeEach(func() {
+		pages := map[string]string{
+			"/ok.html":     `<img src="small.png"><img src="data:image/png;base64,aW1n"><img src="big.png" alt="big">`,
+			"/broken.html": `<img src="small.png"><img src="missing.png">`,
+		}
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/small.png":
+				w.Header().Set("Content-Type", "image/png")
+				w.Write([]byte("img"))
+			case "/big.png":
+				w.Header().Set("Content-Type", "image/png")
+				w.Write([]byte("big image"))
+			default:
+				page, ok := pages[r.URL.Path]
+				if !ok {
+					http.NotFound(w, r)
+					return
+				}
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte(page))
+			}
+		}))
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	type report struct {
+		URL    string       `json:"url"`
+		Error  string       `json:"error"`
+		Images []DebugImage `json:"images"`
+	}
+	get := func(page string, query string) report {
+		req := httptest.NewRequest("GET", "/?url="+url.QueryEscape(origin.URL+page)+"&debug=1"+query, nil)
+		resp, err := NewImgLogicHandler(http.DefaultClient).HandleLogic(setLogger(context.Background(), logger.StandardLogger()), req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+		var res report
+		Expect(json.Unmarshal(resp.Body.Bytes(), &res)).To(Succeed())
+		return res
+	}
+
+	It("then every image outcome reported", func() {
+		res := get("/ok.html", "&inline_threshold=5")
+		Expect(res.Error).To(BeEmpty())
+		Expect(res.Images).To(HaveLen(3))
+		Expect(res.Images[0]).To(Equal(DebugImage{
+			Position: 1, Src: "small.png", URL: origin.URL + "/small.png", Outcome: outcomeInlined,
+			Attempts: 1, Status: 200, ContentType: "image/png", FetchedBytes: 3, EncodedBytes: len("data:image/png;base64,aW1n"),
+		}))
+		Expect(res.Images[1].Outcome).To(Equal(outcomeData))
+		Expect(res.Images[2].Outcome).To(Equal(outcomeLinked))
+		Expect(res.Images[2].Reason).To(Equal("over inline threshold"))
+		Expect(res.Images[2].FetchedBytes).To(Equal(9))
+	})
+	It("then report returned on failure", func() {
+		res := get("/broken.html", "&concurrency=1")
+		Expect(res.Error).To(ContainSubstring("404"))
+		Expect(res.Images).To(HaveLen(2))
+		Expect(res.Images[0].Outcome).To(Equal(outcomeInlined))
+		Expect(res.Images[1].Outcome).To(Equal(outcomeFailed))
+		Expect(res.Images[1].Status).To(Equal(404))
+	})
+	It("then invalid param rejected", func() {
+		req := httptest.NewRequest("GET", "/?url="+url.QueryEscape(origin.URL)+"&debug=1&format=page", nil)
+		_, err := NewImgLogicHandler(http.DefaultClient).HandleLogic(setLogger(context.Background(), logger.StandardLogger()), req)
+		Expect(err.(*HandlerError).statusCode).To(Equal(400))
+	})
+})
@@ -0,0 +1,66 @@
+package imgserver
+
+import (
+	"crypto/subtle"
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const (
+	// Request header, that elevates log level of request to debug, when it is "1".
+	// Accepted only with admin token in AdminTokenHeader.
+	DebugLogHeader   = "X-Debug-Log"
+	AdminTokenHeader = "X-Admin-Token"
+	// Client request ID, logged with every request record for correlation.
+	RequestIDHeader = "X-Request-Id"
+)
+
+// longer request IDs are cut
+const maxRequestIDLength = 128
+
+// returns client ID of request, or empty string
+func requestID(req *http.Request) string {
+	id := req.Header.Get(RequestIDHeader)
+	if len(id) > maxRequestIDLength {
+		id = id[:maxRequestIDLength]
+	}
+	return id
+}
+
+// Returns logger of request with its ID, and with debug level, if debug log is requested by admin.
+func requestLogger(log Logger, req *http.Request, adminToken string) (Logger, bool) {
+	if id := requestID(req); id != "" {
+		log = log.WithField("request_id", id)
+	}
+	if adminToken == "" || req.Header.Get(DebugLogHeader) != "1" ||
+		subtle.ConstantTimeCompare([]byte(req.Header.Get(AdminTokenHeader)), []byte(adminToken)) != 1 {
+		return log, false
+	}
+	return withDebugLevel(log), true
+}
+
+// Returns logger of same output, hooks and fields, that logs debug records.
+// Loggers of other implementations are returned as is.
+func withDebugLevel(log Logger) Logger {
+	var base *logrus.Logger
+	fields := logrus.Fields{}
+	switch l := log.(type) {
+	case *logrus.Logger:
+		base = l
+	case *logrus.Entry:
+		base, fields = l.Logger, l.Data
+	default:
+		return log
+	}
+	if base.Level >= logrus.DebugLevel {
+		return log
+	}
+	debug := &logrus.Logger{
+		Out:       base.Out,
+		Hooks:     base.Hooks,
+		Formatter: base.Formatter,
+		Level:     logrus.DebugLevel,
+	}
+	return debug.WithFields(fields)
+}
@@ -0,0 +1,52 @@
+package imgserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("debug log", func() {
+	var (
+		out     *bytes.Buffer
+		handler *ImgHandler
+	)
+	BeforeEach(func() {
+		out = &bytes.Buffer{}
+		log := logrus.New()
+		log.Out = out
+		log.Level = logrus.InfoLevel
+		handler = &ImgHandler{
+			Log: log,
+			LogicHandler: logicHandlerFunc(func(ctx context.Context, req *http.Request) (*Response, error) {
+				getLocalLogger(ctx, "test").Debug("debug record")
+				resp := NewResponse()
+				resp.StatusCode = http.StatusOK
+				return resp, nil
+			}),
+			DebugLogToken: "admin",
+		}
+	})
+	serve := func(token string) {
+		req := httptest.NewRequest("GET", InlinePath, nil)
+		req.Header.Set(DebugLogHeader, "1")
+		req.Header.Set(AdminTokenHeader, token)
+		req.Header.Set(RequestIDHeader, "r1")
+		handler.ServeHTTPC(context.Background(), httptest.NewRecorder(), req)
+	}
+
+	It("then request of admin is logged by debug", func() {
+		serve("admin")
+		Expect(out.String()).To(ContainSubstring("debug record"))
+		Expect(out.String()).To(ContainSubstring("r1"))
+	})
+	It("then header without admin token is ignored", func() {
+		serve("guess")
+		Expect(out.String()).NotTo(ContainSubstring("debug record"))
+	})
+})
@@ -0,0 +1,36 @@
+package imgserver
+
+import (
+	"bytes"
+	"image"
+	_ "image/gif" // decoders registered for image package
+	_ "image/jpeg"
+	_ "image/png"
+	"strings"
+)
+
+// Content types of images, which decoders are in build. WebP and AVIF decoders
+// are built with webp and avif build tags. Processing stages pass images
+// of other formats through as is.
+var decodedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+func canDecodeImage(contentType string) bool {
+	mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	return decodedImageTypes[mediaType]
+}
+
+// Returns image dimensions, or false if image format decoder is not in build, or image is invalid.
+func imageDimensions(contentType string, data []byte) (int, int, bool) {
+	if !canDecodeImage(contentType) {
+		return 0, 0, false
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, false
+	}
+	return config.Width, config.Height, true
+}
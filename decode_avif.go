@@ -0,0 +1,18 @@
+//go:build avif
+// +build avif
+
+package imgserver
+
+import (
+	"image"
+	"io"
+
+	"github.com/gen2brain/avif"
+)
+
+func init() {
+	// avif.Decode takes options
+	decode := func(r io.Reader) (image.Image, error) { return avif.Decode(r) }
+	image.RegisterFormat("avif", "????ftypavif", decode, avif.DecodeConfig)
+	decodedImageTypes["image/avif"] = true
+}
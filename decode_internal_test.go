@@ -0,0 +1,27 @@
+package imgserver
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("image decoding", func() {
+	It("then dimensions of built in format decoded", func() {
+		buf := &bytes.Buffer{}
+		Expect(png.Encode(buf, image.NewGray(image.Rect(0, 0, 40, 30)))).To(Succeed())
+		width, height, ok := imageDimensions("image/png; charset=binary", buf.Bytes())
+		Expect(ok).To(BeTrue())
+		Expect(width).To(Equal(40))
+		Expect(height).To(Equal(30))
+	})
+	It("then format without decoder passed through", func() {
+		_, _, ok := imageDimensions("image/x-unknown", []byte("data"))
+		Expect(ok).To(BeFalse())
+		_, _, ok = imageDimensions("image/png", []byte("not png"))
+		Expect(ok).To(BeFalse())
+	})
+})
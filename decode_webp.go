@@ -0,0 +1,10 @@
+//go:build webp
+// +build webp
+
+package imgserver
+
+import _ "golang.org/x/image/webp" // registers decoder for image package
+
+func init() {
+	decodedImageTypes["image/webp"] = true
+}
@@ -0,0 +1,307 @@
+package imgserver
+
+import (
+	"context" // net and http dial API use standard context
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// address family preference
+const (
+	PreferAuto = ""     // resolver order, usually IPv6 first
+	PreferIPv4 = "ipv4" // IPv4 addresses first, IPv6 as fallback
+	PreferIPv6 = "ipv6" // IPv6 addresses first, IPv4 as fallback
+)
+
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// Not public networks: loopback, private, shared, link-local, multicast, reserved and documentation ranges.
+// NAT64, Teredo and 6to4 ranges are denied as a whole, as their addresses embed IPv4 ones, possibly private.
+var privateNets = parseNets(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16", "172.16.0.0/12",
+	"192.0.0.0/24", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15", "198.51.100.0/24", "203.0.113.0/24",
+	"224.0.0.0/4", "240.0.0.0/4",
+	"::/128", "::1/128", "64:ff9b::/96", "100::/64", "2001::/32", "2001:db8::/32", "2002::/16", "fc00::/7", "fe80::/10", "ff00::/8",
+)
+
+func parseNets(cidrs ...string) []*net.IPNet {
+	res := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		res[i] = ipNet
+	}
+	return res
+}
+
+// Error of dial to address denied by DialConfig.
+type DeniedAddressError struct {
+	Host string
+	IP   net.IP
+}
+
+func (e *DeniedAddressError) Error() string {
+	return "address " + e.IP.String() + " of " + e.Host + " is not allowed"
+}
+
+// returns true if err is caused by denied dial address
+func isDeniedAddress(err error) bool {
+	for {
+		switch e := err.(type) {
+		case *DeniedAddressError:
+			return true
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		default:
+			return false
+		}
+	}
+}
+
+// Origin connections dial configuration.
+type DialConfig struct {
+	Timeout time.Duration // connect timeout, no timeout if 0
+	Prefer  string        // one of Prefer* constants
+	// Happy Eyeballs (RFC 6555) delay before racing connection to fallback address family.
+	// 300ms if 0, fallback is tried only after primary family fail if negative
+	FallbackDelay time.Duration
+	DisableIPv6   bool // dial only IPv4 addresses, for environments with broken IPv6 routing
+	// Deny connections to not public addresses, except AllowNets. Addresses are checked after resolve,
+	// and connection is made to checked address, so DNS rebinding can't bypass the check.
+	// Every redirect hop is dialed, so checked, the same way. Proxy from environment is not used then.
+	DenyPrivate bool
+	AllowNets   []*net.IPNet
+}
+
+func (c DialConfig) Validate() error {
+	switch c.Prefer {
+	case PreferAuto, PreferIPv4, PreferIPv6:
+		return nil
+	}
+	return errors.New("unsupported IP preference: " + c.Prefer)
+}
+
+// returns true if connection to ip is allowed
+func (c DialConfig) allowed(ip net.IP) bool {
+	if !c.DenyPrivate {
+		return true
+	}
+	for _, ipNet := range c.AllowNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		// IPv4-mapped IPv6 addresses are checked as IPv4
+		ip = ip4
+	}
+	for _, ipNet := range privateNets {
+		if ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// returns allowed addresses of host, or error if there are none
+func (c DialConfig) allowedAddrs(host string, addrs []net.IPAddr) ([]net.IPAddr, error) {
+	var res []net.IPAddr
+	for _, addr := range addrs {
+		if c.allowed(addr.IP) {
+			res = append(res, addr)
+		}
+	}
+	if len(res) == 0 && len(addrs) > 0 {
+		return nil, &DeniedAddressError{host, addrs[0].IP}
+	}
+	return res, nil
+}
+
+// Returns transport with http.DefaultTransport settings, dialing by config.
+func NewTransport(c DialConfig) *http.Transport {
+	d := &dialer{
+		Dialer: net.Dialer{
+			Timeout:       c.Timeout,
+			KeepAlive:     30 * time.Second,
+			DualStack:     c.FallbackDelay >= 0,
+			FallbackDelay: c.FallbackDelay,
+		},
+		config: c,
+	}
+	proxy := http.ProxyFromEnvironment
+	if c.DenyPrivate {
+		// proxy would resolve and connect to not checked addresses
+		proxy = nil
+	}
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           d.DialContext,
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+type dialer struct {
+	net.Dialer
+	config       DialConfig
+	lookupIPAddr func(ctx context.Context, host string) ([]net.IPAddr, error) // net.DefaultResolver if nil
+}
+
+func (d *dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if d.config.DisableIPv6 && network == "tcp" {
+		network = "tcp4"
+	}
+	if !d.config.DenyPrivate && (d.config.Prefer == PreferAuto || network != "tcp") {
+		// net.Dialer implements Happy Eyeballs in resolver order itself
+		return d.Dialer.DialContext(ctx, network, address)
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	lookup := d.lookupIPAddr
+	if lookup == nil {
+		lookup = net.DefaultResolver.LookupIPAddr
+	}
+	addrs, err := lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if network != "tcp" {
+		addrs = familyAddrs(addrs, network == "tcp4")
+	}
+	if addrs, err = d.config.allowedAddrs(host, addrs); err != nil {
+		return nil, err
+	}
+	prefer := d.config.Prefer
+	if prefer == PreferAuto && len(addrs) > 0 {
+		// resolver order
+		prefer = PreferIPv6
+		if addrs[0].IP.To4() != nil {
+			prefer = PreferIPv4
+		}
+	}
+	primaries, fallbacks := partitionAddrs(addrs, prefer)
+	if len(primaries) == 0 {
+		primaries, fallbacks = fallbacks, nil
+	}
+	if len(fallbacks) == 0 {
+		return d.dialSerial(ctx, primaries, port)
+	}
+	return d.dialParallel(ctx, primaries, fallbacks, port)
+}
+
+func (d *dialer) dialSerial(ctx context.Context, addrs []net.IPAddr, port string) (net.Conn, error) {
+	err := errors.New("no addresses to dial")
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = d.Dialer.DialContext(ctx, "tcp", net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
+
+// races fallbacks with primaries after fallback delay or primaries fail
+func (d *dialer) dialParallel(ctx context.Context, primaries, fallbacks []net.IPAddr, port string) (net.Conn, error) {
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan dialResult)
+	returned := make(chan struct{})
+	defer close(returned)
+	dial := func(addrs []net.IPAddr, primary bool) {
+		conn, err := d.dialSerial(ctx, addrs, port)
+		select {
+		case results <- dialResult{conn, err, primary}:
+		case <-returned:
+			// loser connection
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+
+	go dial(primaries, true)
+	var fallbackTimer <-chan time.Time
+	if delay := d.config.FallbackDelay; delay >= 0 {
+		if delay == 0 {
+			delay = defaultFallbackDelay
+		}
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		fallbackTimer = timer.C
+	}
+	fallbackStarted := false
+	startFallback := func() {
+		fallbackStarted = true
+		fallbackTimer = nil
+		go dial(fallbacks, false)
+	}
+	pending := 1
+	var primaryErr error
+	for {
+		select {
+		case <-fallbackTimer:
+			startFallback()
+			pending++
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary || primaryErr == nil {
+				primaryErr = res.err
+			}
+			if !fallbackStarted {
+				startFallback()
+				pending++
+				continue
+			}
+			if pending == 0 {
+				return nil, primaryErr
+			}
+		}
+	}
+}
+
+// returns IPv4 or IPv6 addresses
+func familyAddrs(addrs []net.IPAddr, ipv4 bool) []net.IPAddr {
+	var res []net.IPAddr
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == ipv4 {
+			res = append(res, addr)
+		}
+	}
+	return res
+}
+
+// splits addresses on preferred and other family
+func partitionAddrs(addrs []net.IPAddr, prefer string) (primaries, fallbacks []net.IPAddr) {
+	for _, addr := range addrs {
+		isIPv4 := addr.IP.To4() != nil
+		if isIPv4 == (prefer == PreferIPv4) {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	return
+}
@@ -0,0 +1,88 @@
+package imgserver
+
+import (
+	stdcontext "context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("dial address partition", func() {
+	addrs := []net.IPAddr{
+		{IP: net.ParseIP("2001:db8::1")},
+		{IP: net.ParseIP("192.0.2.1")},
+		{IP: net.ParseIP("2001:db8::2")},
+	}
+	It("then IPv4 first on IPv4 preference", func() {
+		primaries, fallbacks := partitionAddrs(addrs, PreferIPv4)
+		Expect(primaries).To(Equal(addrs[1:2]))
+		Expect(fallbacks).To(Equal([]net.IPAddr{addrs[0], addrs[2]}))
+	})
+	It("then IPv6 first on IPv6 preference", func() {
+		primaries, fallbacks := partitionAddrs(addrs, PreferIPv6)
+		Expect(primaries).To(Equal([]net.IPAddr{addrs[0], addrs[2]}))
+		Expect(fallbacks).To(Equal(addrs[1:2]))
+	})
+	It("then unknown preference is invalid", func() {
+		Expect(DialConfig{Prefer: "ipv5"}.Validate()).To(HaveOccurred())
+	})
+})
+
+var _ = Describe("dial address policy", func() {
+	config := DialConfig{DenyPrivate: true, AllowNets: parseNets("10.1.0.0/16")}
+	It("then not public addresses denied", func() {
+		for _, ip := range []string{"127.0.0.1", "10.0.0.1", "192.168.1.1", "169.254.169.254", "::1", "fe80::1", "fd00::1", "::ffff:127.0.0.1", "0.0.0.0",
+			"64:ff9b::a9fe:a9fe", "2002:7f00:1::1", "2001:0:4136:e378:8000:63bf:3fff:fdd2"} {
+			Expect(config.allowed(net.ParseIP(ip))).To(BeFalse(), ip)
+		}
+	})
+	It("then public and allowed addresses allowed", func() {
+		for _, ip := range []string{"8.8.8.8", "2a00:1450::1", "10.1.2.3"} {
+			Expect(config.allowed(net.ParseIP(ip))).To(BeTrue(), ip)
+		}
+		Expect(DialConfig{}.allowed(net.ParseIP("127.0.0.1"))).To(BeTrue())
+	})
+	It("then only allowed resolved addresses kept", func() {
+		addrs := []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}, {IP: net.ParseIP("8.8.8.8")}}
+		res, err := config.allowedAddrs("rebind.example", addrs)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res).To(Equal(addrs[1:]))
+		_, err = config.allowedAddrs("rebind.example", addrs[:1])
+		Expect(err).To(BeAssignableToTypeOf(&DeniedAddressError{}))
+	})
+	Context("when host resolves to denied address", func() {
+		var origin *httptest.Server
+		BeforeEach(func() {
+			origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Redirect(w, r, "http://rebind.example/", http.StatusFound)
+			}))
+		})
+		AfterEach(func() {
+			origin.Close()
+		})
+		It("then redirect hop denied", func() {
+			_, port, _ := net.SplitHostPort(origin.Listener.Addr().String())
+			policy := DialConfig{DenyPrivate: true, AllowNets: parseNets("127.0.0.1/32")}
+			transport := NewTransport(policy)
+			resolves := 0
+			transport.DialContext = (&dialer{
+				config: policy,
+				lookupIPAddr: func(ctx stdcontext.Context, host string) ([]net.IPAddr, error) {
+					resolves++
+					if host == "rebind.example" {
+						return []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}, nil
+					}
+					return []net.IPAddr{{IP: net.ParseIP(host)}}, nil
+				},
+			}).DialContext
+			client := &http.Client{Transport: transport}
+			_, err := client.Get("http://127.0.0.1:" + port + "/")
+			Expect(err).To(HaveOccurred())
+			Expect(isDeniedAddress(err)).To(BeTrue())
+			Expect(resolves).To(Equal(2))
+		})
+	})
+})
@@ -0,0 +1,91 @@
+package imgserver
+
+import (
+	"bytes"
+	"io"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+// Rewrites HTML document with img tags src inlined in place, other content is kept as is,
+// unless ctx has sanitize policy.
+// Src resolved by resolve is replaced by returned value, like cid: references of email parts.
+// Absolute http(s) URLs are fetched by fetcher, not fetched images are left as links.
+// Protocol relative URLs have scheme of ctx URL param.
+// Returns rewritten document and inlined images.
+func inlineDocument(ctx context.Context, fetcher imageFetcher, r io.Reader, resolve func(src string) (string, bool)) (*bytes.Buffer, []imgTag, error) {
+	log := getLocalLogger(ctx, "inlineDocument")
+	type chunk struct {
+		raw       []byte
+		img       imgTag
+		tokenType html.TokenType
+		fetched   <-chan fetchResult // nil if img is not fetched
+	}
+	var chunks []*chunk
+	tokenizer := html.NewTokenizer(r)
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			if err := tokenizer.Err(); err != io.EOF {
+				return nil, nil, &HandlerError{400, "invalid HTML", err}
+			}
+			break
+		}
+		c := &chunk{raw: append([]byte(nil), tokenizer.Raw()...), tokenType: tokenType}
+		chunks = append(chunks, c)
+		if tokenType != html.StartTagToken && tokenType != html.SelfClosingTagToken {
+			continue
+		}
+		token := tokenizer.Token()
+		if token.Data != "img" {
+			continue
+		}
+		c.img = imgTag{-1, token.Attr, nil}
+		for i, attr := range token.Attr {
+			if attr.Key == "src" {
+				c.img.srcIndex = i
+			}
+		}
+		if c.img.srcIndex < 0 {
+			continue
+		}
+		src := strings.TrimSpace(c.img.src())
+		if resolved, ok := resolve(src); ok {
+			c.img = c.img.withSrc(resolved)
+			c.raw = nil
+			continue
+		}
+		if strings.HasPrefix(src, "//") {
+			src = srcScheme(getPageURL(ctx).Scheme) + ":" + src
+		}
+		if srcURL, err := url.Parse(src); err == nil && isSubresourceURL(getPageURL(ctx), srcURL) {
+			c.fetched = startFetch(ctx, fetcher, c.img, src)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	var images []imgTag
+	for _, c := range chunks {
+		if c.fetched != nil {
+			if res := <-c.fetched; res.err != nil {
+				log.WithField("src", c.img.src()).Warn("image is left as link: ", res.err)
+			} else {
+				c.img, c.raw = res.img, nil
+			}
+		}
+		if c.raw != nil {
+			buf.Write(c.raw)
+			continue
+		}
+		token := c.img.token()
+		token.Type = c.tokenType
+		buf.WriteString(token.String())
+		if c.img.isDataURL() {
+			images = append(images, c.img)
+		}
+	}
+	return getSanitizePolicy(ctx).sanitizeDocument(buf), images, nil
+}
@@ -0,0 +1,83 @@
+package imgserver
+
+import (
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	earlyHintsBatch = 10 // preload links sent by one 103 Early Hints response
+	maxEarlyHints   = 50 // preload links sent per request
+)
+
+// Sends preload links of linked images in 103 Early Hints responses, so client starts
+// their fetch before final response. Links are added by pipeline goroutines, until close.
+type earlyHints struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	pending []string
+	sent    int
+	closed  bool
+}
+
+func newEarlyHints(w http.ResponseWriter) *earlyHints {
+	return &earlyHints{w: w}
+}
+
+func setEarlyHints(ctx context.Context, hints *earlyHints) context.Context {
+	return context.WithValue(ctx, ctxEarlyHintsKey, hints)
+}
+
+// returns nil if early hints are disabled, nil hints do nothing
+func getEarlyHints(ctx context.Context) *earlyHints {
+	hints, _ := ctx.Value(ctxEarlyHintsKey).(*earlyHints)
+	return hints
+}
+
+// Adds preload link of image URL. Pending links are sent, when batch is full.
+func (h *earlyHints) add(imgURL string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed || h.sent+len(h.pending) >= maxEarlyHints {
+		return
+	}
+	h.pending = append(h.pending, imgURL)
+	if len(h.pending) >= earlyHintsBatch {
+		h.send()
+	}
+}
+
+// Sends pending links.
+func (h *earlyHints) flush() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.closed && len(h.pending) > 0 {
+		h.send()
+	}
+}
+
+// Drops pending links, and stops hints, so final response can be written.
+func (h *earlyHints) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	h.pending = nil
+}
+
+func (h *earlyHints) send() {
+	links := make([]string, len(h.pending))
+	for i, imgURL := range h.pending {
+		links[i] = "<" + imgURL + ">; rel=preload; as=image"
+	}
+	h.sent += len(h.pending)
+	h.pending = h.pending[:0]
+	writeEarlyHints(h.w, links)
+}
@@ -0,0 +1,14 @@
+//go:build go1.19
+// +build go1.19
+
+package imgserver
+
+import "net/http"
+
+// Writes 103 Early Hints response with Link header of links. Link header is removed then,
+// so it is not sent with final response.
+func writeEarlyHints(w http.ResponseWriter, links []string) {
+	w.Header()["Link"] = links
+	w.WriteHeader(http.StatusEarlyHints)
+	w.Header().Del("Link")
+}
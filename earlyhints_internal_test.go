@@ -0,0 +1,103 @@
+//go:build go1.19
+// +build go1.19
+
+package imgserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"net/url"
+	"strings"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("early hints", func() {
+	var (
+		origin  *httptest.Server
+		server  *httptest.Server
+		fetched int
+	)
+	BeforeEach(func() {
+		fetched = 0
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/" {
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte(`<img src="a.png"><img src="b.png">`))
+				return
+			}
+			fetched++
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png"))
+		}))
+		server = httptest.NewServer(ContextAdaptor{
+			Handler: &ImgHandler{
+				Log:          logger.StandardLogger(),
+				LogicHandler: NewImgLogicHandler(http.DefaultClient),
+				ErrorHandler: ErrorLogger{},
+				EarlyHints:   true,
+			},
+			Ctx: context.Background(),
+		})
+	})
+	AfterEach(func() {
+		server.Close()
+		origin.Close()
+	})
+	// returns Link headers of every informational response, and final response body
+	get := func(params string) ([][]string, string) {
+		var hints [][]string
+		trace := &httptrace.ClientTrace{
+			Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+				Expect(code).To(Equal(http.StatusEarlyHints))
+				hints = append(hints, header["Link"])
+				return nil
+			},
+		}
+		req, err := http.NewRequest("GET", server.URL+"/?url="+url.QueryEscape(origin.URL+"/")+params, nil)
+		Expect(err).NotTo(HaveOccurred())
+		req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+		resp, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(200))
+		Expect(resp.Header.Get("Link")).To(BeEmpty())
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return hints, string(body)
+	}
+	It("then preload links of images are sent before result, and images are not fetched", func() {
+		hints, body := get("&links=true&format=json")
+		Expect(hints).To(HaveLen(1))
+		Expect(hints[0]).To(Equal([]string{
+			"<" + origin.URL + "/a.png>; rel=preload; as=image",
+			"<" + origin.URL + "/b.png>; rel=preload; as=image",
+		}))
+		Expect(body).To(ContainSubstring(origin.URL + "/a.png"))
+		Expect(fetched).To(Equal(0))
+	})
+	It("then inlined images are not hinted", func() {
+		hints, body := get("")
+		Expect(hints).To(BeEmpty())
+		Expect(strings.Count(body, "data:image/png")).To(Equal(2))
+	})
+	It("then links are sent in batches, up to limit", func() {
+		hints := newEarlyHints(httptest.NewRecorder())
+		for i := 0; i < maxEarlyHints+5; i++ {
+			hints.add("http://example.com/img.png")
+		}
+		hints.flush()
+		Expect(hints.sent).To(Equal(maxEarlyHints))
+		hints.close()
+		hints.add("http://example.com/img.png")
+		hints.flush()
+		Expect(hints.sent).To(Equal(maxEarlyHints))
+		Expect(hints.pending).To(BeEmpty())
+	})
+})
@@ -0,0 +1,9 @@
+//go:build !go1.19
+// +build !go1.19
+
+package imgserver
+
+import "net/http"
+
+// net/http before Go 1.19 can't write informational responses, so hints are not sent.
+func writeEarlyHints(w http.ResponseWriter, links []string) {}
@@ -0,0 +1,168 @@
+package imgserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/cenk/backoff"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html/charset"
+)
+
+const EmailPath = "/" + APIVersion + "/email"
+
+// Accepts POST of raw RFC 822 email, and responds with its HTML part,
+// where cid: references are resolved to attached parts and remote images are inlined.
+type EmailLogicHandler struct {
+	client    *http.Client
+	fetcher   imageFetcher
+	MaxSize   int64           // bytes of email, no limit if 0
+	SrcScheme string          // of protocol relative image srcs, as email has no page URL
+	Sanitizer *SanitizePolicy // of email HTML, kept as is if nil
+}
+
+func NewEmailLogicHandler(client *http.Client) *EmailLogicHandler {
+	return &EmailLogicHandler{
+		client,
+		backoffImageFetcher{
+			&sync.Mutex{},
+			backoff.NewExponentialBackOff(),
+		},
+		25 << 20,
+		DefaultSrcScheme,
+		RelaxedSanitizePolicy,
+	}
+}
+
+type mimePart struct {
+	mediaType   string
+	contentType string
+	contentID   string
+	data        []byte
+}
+
+func (h *EmailLogicHandler) HandleLogic(ctx context.Context, req *http.Request) (*Response, error) {
+	log := getLocalLogger(ctx, "EmailLogicHandler")
+	body := io.Reader(req.Body)
+	if h.MaxSize > 0 {
+		body = io.LimitReader(body, h.MaxSize+1)
+	}
+	raw, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, &HandlerError{400, "email read error", err}
+	}
+	if h.MaxSize > 0 && int64(len(raw)) > h.MaxSize {
+		return nil, NewHandlerError(http.StatusRequestEntityTooLarge, "email is bigger than "+strconv.FormatInt(h.MaxSize, 10)+" bytes")
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, &HandlerError{400, "invalid email", err}
+	}
+	var parts []mimePart
+	if err := collectMIMEParts(textproto.MIMEHeader(msg.Header), msg.Body, &parts); err != nil {
+		return nil, &HandlerError{400, "invalid email MIME structure", err}
+	}
+	var htmlPart *mimePart
+	cids := make(map[string]*mimePart)
+	for i := range parts {
+		part := &parts[i]
+		if part.mediaType == "text/html" && htmlPart == nil {
+			htmlPart = part
+		}
+		if part.contentID != "" {
+			cids[part.contentID] = part
+		}
+	}
+	if htmlPart == nil {
+		return nil, NewHandlerError(400, "email has no HTML part")
+	}
+	page, err := charset.NewReader(bytes.NewReader(htmlPart.data), htmlPart.contentType)
+	if err == io.EOF {
+		// empty HTML part
+		page, err = bytes.NewReader(nil), nil
+	}
+	if err != nil {
+		return nil, &HandlerError{400, "email HTML part has unsupported charset", err}
+	}
+	resolveCID := func(src string) (string, bool) {
+		if !strings.HasPrefix(strings.ToLower(src), "cid:") {
+			return "", false
+		}
+		id, err := url.QueryUnescape(src[len("cid:"):])
+		if err != nil {
+			return "", false
+		}
+		part, ok := cids[id]
+		if !ok {
+			return "", false
+		}
+		return "data:" + part.mediaType + ";base64," + base64.StdEncoding.EncodeToString(part.data), true
+	}
+	ctx = newImgLogicContext(ctx, h.client, &url.URL{Scheme: h.SrcScheme})
+	ctx = setSanitizePolicy(ctx, h.Sanitizer)
+	doc, images, err := inlineDocument(ctx, h.fetcher, page, resolveCID)
+	if err != nil {
+		return nil, err
+	}
+	log.WithField("parts", len(parts)).Debugf("%v images inlined", len(images))
+
+	resp := NewResponse()
+	resp.StatusCode = http.StatusOK
+	resp.Header.Set("Content-Type", "text/html;charset=utf-8")
+	resp.Header.Set(ImageCountHeader, strconv.Itoa(len(images)))
+	resp.Body = doc
+	return resp, nil
+}
+
+// appends leaf parts of MIME entity to parts, with transfer encoding decoded
+func collectMIMEParts(header textproto.MIMEHeader, body io.Reader, parts *[]mimePart) error {
+	contentType := header.Get("Content-Type")
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = "text/plain"
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if err := collectMIMEParts(part.Header, part, parts); err != nil {
+				return err
+			}
+		}
+	}
+	switch strings.ToLower(header.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	*parts = append(*parts, mimePart{
+		mediaType:   mediaType,
+		contentType: contentType,
+		contentID:   strings.Trim(header.Get("Content-ID"), "<> "),
+		data:        data,
+	})
+	return nil
+}
@@ -0,0 +1,75 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("email", func() {
+	const email = "From: a@example.com\r\n" +
+		"To: b@example.com\r\n" +
+		"Subject: test\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: multipart/related; boundary=\"rel\"\r\n" +
+		"\r\n" +
+		"--rel\r\n" +
+		"Content-Type: multipart/alternative; boundary=\"alt\"\r\n" +
+		"\r\n" +
+		"--alt\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		"plain\r\n" +
+		"--alt\r\n" +
+		"Content-Type: text/html; charset=utf-8\r\n" +
+		"Content-Transfer-Encoding: quoted-printable\r\n" +
+		"\r\n" +
+		"<p>Hi</p><img src=3D\"cid:logo@example.com\" alt=3D\"logo\"><img src=3D\"%s/remote.png\">\r\n" +
+		"--alt--\r\n" +
+		"--rel\r\n" +
+		"Content-Type: image/png\r\n" +
+		"Content-Transfer-Encoding: base64\r\n" +
+		"Content-ID: <logo@example.com>\r\n" +
+		"\r\n" +
+		"iVBO\r\nRw0K\r\n" +
+		"--rel--\r\n"
+	var origin *httptest.Server
+	BeforeEach(func() {
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("remote"))
+		}))
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	handle := func(body string) (*Response, error) {
+		req := httptest.NewRequest("POST", EmailPath, strings.NewReader(body))
+		ctx := setLogger(context.Background(), logger.StandardLogger())
+		return NewEmailLogicHandler(http.DefaultClient).HandleLogic(ctx, req)
+	}
+
+	It("then cid references and remote images inlined", func() {
+		resp, err := handle(strings.Replace(email, "%s", origin.URL, 1))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Header.Get(ImageCountHeader)).To(Equal("2"))
+		Expect(resp.Body.String()).To(Equal(`<p>Hi</p><img src="data:image/png;base64,iVBORw0K" alt="logo">` +
+			`<img src="data:image/png;base64,cmVtb3Rl">`))
+	})
+	It("then email without HTML part rejected", func() {
+		_, err := handle("Subject: test\r\nContent-Type: text/plain\r\n\r\nplain\r\n")
+		Expect(err).To(HaveOccurred())
+	})
+	It("then too big email rejected", func() {
+		handler := NewEmailLogicHandler(http.DefaultClient)
+		handler.MaxSize = 10
+		req := httptest.NewRequest("POST", EmailPath, strings.NewReader(email))
+		_, err := handler.HandleLogic(setLogger(context.Background(), logger.StandardLogger()), req)
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusRequestEntityTooLarge))
+	})
+})
@@ -0,0 +1,76 @@
+package imgserver
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// Content codings accepted from origins. Responses are decoded by decodeContentEncoding,
+// so it is done the same way for any transport, not only for ones with Go automatic gzip decoding.
+const acceptEncoding = "gzip, deflate"
+
+type decodedBody struct {
+	io.Reader
+	body io.Closer
+}
+
+func (b *decodedBody) Close() error {
+	if c, ok := b.Reader.(io.Closer); ok {
+		c.Close()
+	}
+	return b.body.Close()
+}
+
+// Replaces encoded response body with decoded one. Content-Encoding and Content-Length headers are removed then.
+func decodeContentEncoding(resp *http.Response) error {
+	header := resp.Header.Get("Content-Encoding")
+	if header == "" {
+		return nil
+	}
+	codings := strings.Split(header, ",")
+	body := io.Reader(resp.Body)
+	// codings are listed in order they were applied
+	for i := len(codings) - 1; i >= 0; i-- {
+		var err error
+		switch coding := strings.ToLower(strings.TrimSpace(codings[i])); coding {
+		case "identity", "":
+		case "gzip", "x-gzip":
+			body, err = gzip.NewReader(body)
+		case "deflate":
+			body, err = newDeflateReader(body)
+		default:
+			err = NewHandlerError(http.StatusBadGateway, "unsupported Content-Encoding: "+coding)
+		}
+		if err != nil {
+			resp.Body.Close()
+			if _, ok := err.(*HandlerError); ok {
+				return err
+			}
+			return &HandlerError{http.StatusBadGateway, "invalid " + header + " encoded response", err}
+		}
+	}
+	resp.Body = &decodedBody{body, resp.Body}
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	resp.Uncompressed = true
+	return nil
+}
+
+// deflate coding should be zlib stream, but some servers send raw deflate
+func newDeflateReader(r io.Reader) (io.Reader, error) {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0]&0x0f == 8 && (uint(header[0])<<8|uint(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
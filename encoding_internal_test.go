@@ -0,0 +1,78 @@
+package imgserver
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("content encoding", func() {
+	const page = "<html><img src=\"a.png\"></html>"
+	encode := func(newWriter func(w io.Writer) io.WriteCloser) []byte {
+		buf := &bytes.Buffer{}
+		w := newWriter(buf)
+		w.Write([]byte(page))
+		w.Close()
+		return buf.Bytes()
+	}
+	bodies := map[string][]byte{
+		"gzip":       encode(func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) }),
+		"deflate":    encode(func(w io.Writer) io.WriteCloser { return zlib.NewWriter(w) }),
+		"rawdeflate": encode(func(w io.Writer) io.WriteCloser { fw, _ := flate.NewWriter(w, flate.DefaultCompression); return fw }),
+		"identity":   []byte(page),
+		"br":         []byte("brotli"),
+	}
+	var (
+		origin         *httptest.Server
+		acceptEncoding string
+	)
+	BeforeEach(func() {
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			acceptEncoding = r.Header.Get("Accept-Encoding")
+			coding := r.URL.Path[1:]
+			w.Header().Set("Content-Type", "text/html")
+			if coding == "rawdeflate" {
+				w.Header().Set("Content-Encoding", "deflate")
+			} else {
+				w.Header().Set("Content-Encoding", coding)
+			}
+			w.Write(bodies[coding])
+		}))
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	get := func(coding string) (string, error) {
+		ctx := context.WithValue(context.Background(), CtxHTTPClientKey, http.DefaultClient)
+		resp, err := cxtAwareGet(ctx, origin.URL+"/"+coding)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		Expect(resp.Header.Get("Content-Encoding")).To(BeEmpty())
+		data, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		return string(data), nil
+	}
+
+	for _, coding := range []string{"gzip", "deflate", "rawdeflate", "identity"} {
+		coding := coding
+		It("then "+coding+" response decoded", func() {
+			Expect(get(coding)).To(Equal(page))
+			Expect(acceptEncoding).To(Equal("gzip, deflate"))
+		})
+	}
+	It("then unsupported coding rejected", func() {
+		_, err := get("br")
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusBadGateway))
+	})
+})
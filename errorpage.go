@@ -0,0 +1,86 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+)
+
+// Data of HTML error page template.
+type ErrorPage struct {
+	StatusCode int
+	Status     string // status text, like "Bad Gateway"
+	Message    string
+	Code       string // of origin errors, empty otherwise
+	RequestID  string // from X-Request-Id header, empty if not passed
+}
+
+// Template of HTML error pages, used if ErrorLogger has none.
+var DefaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.StatusCode}} {{.Status}}</title>
+</head>
+<body>
+<h1>{{.StatusCode}} {{.Status}}</h1>
+<p class="error">{{.Message}}</p>
+{{if .Code}}<p>Code: <code>{{.Code}}</code></p>
+{{end}}{{if .RequestID}}<p>Request ID: <code>{{.RequestID}}</code></p>
+{{end}}</body>
+</html>
+`))
+
+// Parses HTML error page template file, executed with ErrorPage.
+func LoadErrorTemplate(path string) (*template.Template, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return template.New("error").Parse(string(data))
+}
+
+// Errors are HTML pages, when client explicitly asks for HTML by format param or Accept header,
+// like browsers do. API clients, that pass no Accept or */*, get JSON errors.
+func wantsHTMLError(req *http.Request) bool {
+	if req == nil {
+		return false
+	}
+	format, err := negotiateFormat(req, formatJSON)
+	return err == nil && format == formatHTML
+}
+
+// Returns HTML page of JSON error response, with same status and headers.
+func (h ErrorLogger) errorPage(log Logger, req *http.Request, resp *Response) *Response {
+	var fields struct {
+		Error string `json:"error"`
+		Code  string `json:"code"`
+	}
+	if err := json.Unmarshal(resp.Body.Bytes(), &fields); err != nil {
+		log.Error("error response unmarshal error: ", err)
+		return resp
+	}
+	tmpl := h.Template
+	if tmpl == nil {
+		tmpl = DefaultErrorTemplate
+	}
+	page := NewResponse()
+	page.StatusCode = resp.StatusCode
+	for key, values := range resp.Header {
+		page.Header[key] = values
+	}
+	page.Header.Set("Content-Type", "text/html; charset=utf-8")
+	err := tmpl.Execute(page.Body, ErrorPage{
+		StatusCode: resp.StatusCode,
+		Status:     http.StatusText(resp.StatusCode),
+		Message:    fields.Error,
+		Code:       fields.Code,
+		RequestID:  requestID(req),
+	})
+	if err != nil {
+		log.Error("error page template error: ", err)
+		return resp
+	}
+	return page
+}
@@ -0,0 +1,39 @@
+package imgserver
+
+import (
+	"net/http/httptest"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("error page", func() {
+	ctx := setLogger(context.Background(), logger.StandardLogger())
+	err := &HandlerError{502, "can't get page: <slow>", &OriginError{OriginBodyTooSlow, "slow body"}}
+	It("then errors are JSON by default", func() {
+		req := httptest.NewRequest("GET", "/?url=http://a", nil)
+		req.Header.Set("Accept", "*/*")
+		resp := ErrorLogger{}.HandleError(ctx, req, err)
+		Expect(resp.Header.Get("Content-Type")).To(Equal("application/json"))
+	})
+	It("then errors are HTML pages, when client asks for HTML", func() {
+		req := httptest.NewRequest("GET", "/?url=http://a", nil)
+		req.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+		req.Header.Set(RequestIDHeader, "req-42")
+		resp := ErrorLogger{}.HandleError(ctx, req, err)
+		Expect(resp.StatusCode).To(Equal(502))
+		Expect(resp.Header.Get("Content-Type")).To(HavePrefix("text/html"))
+		body := resp.Body.String()
+		Expect(body).To(ContainSubstring("502 Bad Gateway"))
+		Expect(body).To(ContainSubstring("can&#39;t get page: &lt;slow&gt;"))
+		Expect(body).To(ContainSubstring(OriginBodyTooSlow))
+		Expect(body).To(ContainSubstring("req-42"))
+	})
+	It("then format param selects HTML page too", func() {
+		req := httptest.NewRequest("GET", "/?url=http://a&format=html", nil)
+		resp := ErrorLogger{}.HandleError(ctx, req, NewHandlerError(400, "bad"))
+		Expect(resp.Header.Get("Content-Type")).To(HavePrefix("text/html"))
+	})
+})
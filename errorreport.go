@@ -0,0 +1,69 @@
+package imgserver
+
+import (
+	"fmt"
+	"net/http"
+	"runtime"
+
+	"golang.org/x/net/context"
+)
+
+// Report of server error, with URL and messages redacted.
+type ErrorReport struct {
+	StatusCode int
+	Method     string
+	URL        string
+	Causes     []ReportedCause // from error to its root cause
+	Stack      []uintptr       // of error handling, as errors don't carry stacks
+}
+
+// Error or one of its wrapped causes.
+type ReportedCause struct {
+	Type    string
+	Message string
+}
+
+// Receives 5xx errors from ErrorLogger, for alerting like Sentry.
+// Report should not block, as it is called on request goroutine.
+type ErrorReporter interface {
+	Report(ctx context.Context, report ErrorReport)
+}
+
+type ErrorReporterFunc func(ctx context.Context, report ErrorReport)
+
+func (f ErrorReporterFunc) Report(ctx context.Context, report ErrorReport) {
+	f(ctx, report)
+}
+
+// Makes report of err, following HandlerError causes.
+func newErrorReport(req *http.Request, statusCode int, err error, redactor *URLRedactor) ErrorReport {
+	report := ErrorReport{StatusCode: statusCode}
+	if req != nil {
+		report.Method = req.Method
+		report.URL = redactor.Redact(redactRequestURL(req.URL))
+	}
+	for err != nil {
+		cause := ReportedCause{Type: fmt.Sprintf("%T", err), Message: redactor.Redact(err.Error())}
+		hErr, ok := err.(*HandlerError)
+		if ok {
+			// cause is reported separately
+			cause.Message = redactor.Redact(hErr.description)
+			err = hErr.cause
+		} else {
+			err = nil
+		}
+		report.Causes = append(report.Causes, cause)
+	}
+	stack := make([]uintptr, 64)
+	// skips runtime.Callers, newErrorReport and report of ErrorLogger
+	report.Stack = stack[:runtime.Callers(3, stack)]
+	return report
+}
+
+// reports server errors, does nothing without reporter
+func (h ErrorLogger) report(ctx context.Context, req *http.Request, statusCode int, err error) {
+	if h.Reporter == nil || statusCode < 500 {
+		return
+	}
+	h.Reporter.Report(ctx, newErrorReport(req, statusCode, err, h.Redactor))
+}
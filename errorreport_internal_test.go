@@ -0,0 +1,76 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("error reporting", func() {
+	var (
+		ctx     context.Context
+		reports []ErrorReport
+		h       ErrorLogger
+	)
+	BeforeEach(func() {
+		ctx = setLogger(context.Background(), logger.StandardLogger())
+		reports = nil
+		h = ErrorLogger{Reporter: ErrorReporterFunc(func(ctx context.Context, report ErrorReport) {
+			reports = append(reports, report)
+		})}
+	})
+
+	It("then server errors are reported with causes", func() {
+		req := httptest.NewRequest("GET", "/v1/inline?url=http://example.com", nil)
+		h.HandleError(ctx, req, &HandlerError{502, "can't get page", &OriginError{OriginBodyTooSlow, "slow body"}})
+		Expect(reports).To(HaveLen(1))
+		Expect(reports[0].StatusCode).To(Equal(502))
+		Expect(reports[0].URL).To(ContainSubstring("example.com"))
+		Expect(reports[0].Causes).To(Equal([]ReportedCause{
+			{"*imgserver.HandlerError", "can't get page"},
+			{"*imgserver.OriginError", "slow body"},
+		}))
+		Expect(reports[0].Stack).NotTo(BeEmpty())
+	})
+	It("then internal errors are reported", func() {
+		h.HandleError(ctx, httptest.NewRequest("GET", "/", nil), errors.New("boom"))
+		Expect(reports).To(HaveLen(1))
+		Expect(reports[0].StatusCode).To(Equal(500))
+	})
+	It("then client errors are not reported", func() {
+		h.HandleError(ctx, httptest.NewRequest("GET", "/", nil), NewHandlerError(400, "bad"))
+		Expect(reports).To(BeEmpty())
+	})
+	It("then Sentry receives event", func() {
+		events := make(chan map[string]interface{}, 1)
+		auth := make(chan string, 1)
+		sentry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			Expect(r.URL.Path).To(Equal("/api/42/store/"))
+			auth <- r.Header.Get("X-Sentry-Auth")
+			data, _ := ioutil.ReadAll(r.Body)
+			var event map[string]interface{}
+			json.Unmarshal(data, &event)
+			events <- event
+		}))
+		defer sentry.Close()
+		reporter, err := NewSentryReporter(logger.StandardLogger(), strings.Replace(sentry.URL, "http://", "http://publickey@", 1)+"/42")
+		Expect(err).NotTo(HaveOccurred())
+		ErrorLogger{Reporter: reporter}.HandleError(ctx, httptest.NewRequest("GET", "/", nil), errors.New("boom"))
+		Expect(<-auth).To(ContainSubstring("sentry_key=publickey"))
+		event := <-events
+		Expect(event["message"]).To(Equal("boom"))
+		Expect(event["exception"]).To(HaveKey("values"))
+	})
+	It("then invalid DSN is rejected", func() {
+		_, err := NewSentryReporter(logger.StandardLogger(), "https://sentry.example.com/42")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,139 @@
+package imgserver
+
+import (
+	"bytes"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+// Bounds of frames traversal: frames nested deeper, or over total count, are not fetched.
+const (
+	maxFrameDepth = 2
+	maxFrames     = 10
+)
+
+// Fetches same origin frames and iframes of page, and appends their img tags to body,
+// with srcs resolved relative to frame, so they are extracted like page images, after them.
+// Frames that can't be fetched are skipped, as page is usable without them.
+func (h *ImgLogicHandler) mergeFrames(ctx context.Context, body *bytes.Buffer) (*bytes.Buffer, error) {
+	log := getLocalLogger(ctx, "mergeFrames")
+	pageURL := getPageURL(ctx)
+	visited := map[string]bool{pageURL.String(): true}
+	type frame struct {
+		url   *url.URL
+		depth int
+	}
+	var queue []frame
+	for _, frameURL := range parseFrames(body.Bytes(), pageURL) {
+		queue = append(queue, frame{frameURL, 1})
+	}
+	fetched := 0
+	for len(queue) > 0 && fetched < maxFrames {
+		next := queue[0]
+		queue = queue[1:]
+		if visited[next.url.String()] || !sameOrigin(next.url, pageURL) {
+			continue
+		}
+		visited[next.url.String()] = true
+		fetched++
+		frameBody, err := h.fetchFrame(ctx, next.url)
+		if ctx.Err() != nil {
+			return nil, originPageError(ctx, ctx.Err())
+		}
+		if err != nil {
+			log.WithField("frame", next.url.String()).Debug("frame skipped: ", err)
+			continue
+		}
+		if next.depth < maxFrameDepth {
+			for _, frameURL := range parseFrames(frameBody.Bytes(), next.url) {
+				queue = append(queue, frame{frameURL, next.depth + 1})
+			}
+		}
+		writeFrameImages(body, frameBody.Bytes(), next.url)
+		buffers.put(frameBody)
+	}
+	return body, nil
+}
+
+func (h *ImgLogicHandler) fetchFrame(ctx context.Context, frameURL *url.URL) (*bytes.Buffer, error) {
+	resp, err := getPage(ctx, frameURL.String(), 0)
+	if err != nil {
+		return nil, err
+	}
+	return h.bodyGetter.getBody(ctx, resp)
+}
+
+// returns absolute URLs of frame and iframe srcs of page, in document order
+func parseFrames(page []byte, pageURL *url.URL) []*url.URL {
+	var res []*url.URL
+	tokenizer := html.NewTokenizer(bytes.NewReader(page))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return res
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.Data != "frame" && token.Data != "iframe" {
+				continue
+			}
+			src := strings.TrimSpace(tokenAttr(token, "src"))
+			if src == "" {
+				continue
+			}
+			if frameURL, err := pageURL.Parse(src); err == nil && isSubresourceURL(pageURL, frameURL) {
+				frameURL.Fragment = ""
+				res = append(res, frameURL)
+			}
+		}
+	}
+}
+
+// writes img tags of frame page to buf, with src and srcset resolved relative to frame URL
+func writeFrameImages(buf *bytes.Buffer, page []byte, frameURL *url.URL) {
+	folderURL := *getFolderURL(*frameURL)
+	tokenizer := html.NewTokenizer(bytes.NewReader(page))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.Data != "img" {
+				continue
+			}
+			for i, attr := range token.Attr {
+				switch attr.Key {
+				case "src":
+					if !strings.HasPrefix(attr.Val, "data:") && attr.Val != "" {
+						if src, err := getImgURL(attr.Val, folderURL); err == nil {
+							token.Attr[i].Val = src
+						}
+					}
+				case "srcset":
+					token.Attr[i].Val = absoluteSrcset(attr.Val, folderURL)
+				}
+			}
+			buf.WriteByte('\n')
+			buf.WriteString(token.String())
+		}
+	}
+}
+
+// returns srcset with candidate URLs resolved relative to folder URL
+func absoluteSrcset(srcset string, folderURL url.URL) string {
+	items := strings.Split(srcset, ",")
+	for i, item := range items {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			continue
+		}
+		if src, err := getImgURL(fields[0], folderURL); err == nil {
+			fields[0] = src
+		}
+		items[i] = strings.Join(fields, " ")
+	}
+	return strings.Join(items, ", ")
+}
@@ -0,0 +1,60 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("frames", func() {
+	var (
+		origin   *httptest.Server
+		requests map[string]int
+	)
+	BeforeEach(func() {
+		requests = make(map[string]int)
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests[r.URL.Path]++
+			w.Header().Set("Content-Type", "text/html")
+			switch r.URL.Path {
+			case "/":
+				w.Write([]byte(`<img src="top.png"><frameset><frame src="/menu/index.html"><frame src="/menu/index.html#again"></frameset>` +
+					`<iframe src="http://example.com/ad"></iframe><iframe src="/missing"></iframe>`))
+			case "/menu/index.html":
+				w.Write([]byte(`<img src="logo.png" srcset="logo.png 1x, /hd/logo.png 2x"><iframe src="deep.html"></iframe>`))
+			case "/menu/deep.html":
+				w.Write([]byte(`<img src="//cdn.example.com/deep.png"><iframe src="deeper.html"></iframe>`))
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}))
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	fetch := func(frames bool) string {
+		pageURL, _ := url.Parse(origin.URL + "/")
+		ctx := newImgLogicContext(setLogger(context.Background(), logger.StandardLogger()), http.DefaultClient, pageURL)
+		ctx = setFetchOptions(ctx, FetchOptions{Frames: frames})
+		body, _, _, err := NewImgLogicHandler(http.DefaultClient).fetchPage(ctx, 0)
+		Expect(err).NotTo(HaveOccurred())
+		return body.String()
+	}
+	It("then same origin frame images are appended with absolute srcs", func() {
+		body := fetch(true)
+		Expect(body).To(ContainSubstring(`<img src="` + origin.URL + `/menu/logo.png" srcset="` +
+			origin.URL + `/menu/logo.png 1x, ` + origin.URL + `/hd/logo.png 2x">`))
+		Expect(body).To(ContainSubstring(`<img src="http://cdn.example.com/deep.png">`))
+		Expect(requests).To(Equal(map[string]int{"/": 1, "/menu/index.html": 1, "/menu/deep.html": 1, "/missing": 1}))
+	})
+	It("then frames are not fetched by default", func() {
+		body := fetch(false)
+		Expect(body).NotTo(ContainSubstring("logo.png"))
+		Expect(requests).To(Equal(map[string]int{"/": 1}))
+	})
+})
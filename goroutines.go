@@ -0,0 +1,101 @@
+package imgserver
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+const AdminVarsPath = "/admin/vars"
+
+// Kinds of tracked goroutines.
+const (
+	goroutineFetch = "fetch" // image fetch
+	goroutineParse = "parse" // page tokenizer
+	goroutineStage = "stage" // extraction pipeline stage
+)
+
+// Gauges of active goroutines by kind. Goroutine lifecycle of pipeline is not trivial,
+// so gauges not returning to zero on idle server, or after test, show leaks.
+type goroutineTracker struct {
+	mu     sync.Mutex
+	active map[string]int64
+}
+
+// Published by expvar as imgserver_goroutines.
+var goroutines = newGoroutineTracker()
+
+func init() {
+	expvar.Publish("imgserver_goroutines", expvar.Func(func() interface{} { return goroutines.snapshot() }))
+}
+
+func newGoroutineTracker() *goroutineTracker {
+	return &goroutineTracker{active: make(map[string]int64)}
+}
+
+// Registers goroutine of kind, returns func unregistering it, that should be deferred by goroutine.
+func (t *goroutineTracker) start(kind string) func() {
+	t.mu.Lock()
+	t.active[kind]++
+	t.mu.Unlock()
+	return func() {
+		t.mu.Lock()
+		t.active[kind]--
+		t.mu.Unlock()
+	}
+}
+
+func (t *goroutineTracker) total() int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var res int64
+	for _, n := range t.active {
+		res += n
+	}
+	return res
+}
+
+func (t *goroutineTracker) snapshot() map[string]int64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	res := make(map[string]int64, len(t.active))
+	for kind, n := range t.active {
+		res[kind] = n
+	}
+	return res
+}
+
+func writeGoroutineMetrics(w io.Writer, t *goroutineTracker) {
+	snapshot := t.snapshot()
+	kinds := make([]string, 0, len(snapshot))
+	for kind := range snapshot {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	fmt.Fprint(w, "# HELP imgserver_goroutines Active goroutines by kind.\n# TYPE imgserver_goroutines gauge\n")
+	for _, kind := range kinds {
+		fmt.Fprintf(w, "imgserver_goroutines{kind=%q} %v\n", kind, snapshot[kind])
+	}
+}
+
+// Admin API of expvar variables: GET AdminVarsPath returns them as JSON, like /debug/vars.
+type VarsAdminHandler struct {
+	Log   Logger
+	Token string // disabled if empty
+}
+
+func (h VarsAdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	log := SetEmitter(h.Log, "VarsAdminHandler")
+	if h.Token == "" || !checkBearerToken(req, h.Token) {
+		writeResponse(log, w, req, NewErrorResponse(http.StatusUnauthorized, "invalid admin token"))
+		return
+	}
+	if !(req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	expvar.Handler().ServeHTTP(w, req)
+}
@@ -0,0 +1,40 @@
+package imgserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("goroutine tracker", func() {
+	It("then active goroutines counted by kind", func() {
+		tracker := newGoroutineTracker()
+		doneFetch := tracker.start(goroutineFetch)
+		doneParse := tracker.start(goroutineParse)
+		tracker.start(goroutineFetch)()
+		Expect(tracker.snapshot()).To(Equal(map[string]int64{goroutineFetch: 1, goroutineParse: 1}))
+		doneFetch()
+		doneParse()
+		Expect(tracker.total()).To(BeZero())
+
+		buf := &bytes.Buffer{}
+		writeGoroutineMetrics(buf, tracker)
+		Expect(buf.String()).To(ContainSubstring(`imgserver_goroutines{kind="fetch"} 0`))
+	})
+	It("then vars require admin token", func() {
+		h := VarsAdminHandler{log.StandardLogger(), "secret"}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", AdminVarsPath, nil))
+		Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+		req := httptest.NewRequest("GET", AdminVarsPath, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).To(ContainSubstring(`"imgserver_goroutines"`))
+	})
+})
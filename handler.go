@@ -3,6 +3,7 @@ package imgserver
 import (
 	"bytes"
 	"encoding/json"
+	"html/template"
 	"io"
 	"net/http"
 	"net/url"
@@ -12,7 +13,6 @@ import (
 	"time"
 
 	"golang.org/x/net/context"
-	"golang.org/x/net/html/charset"
 
 	"sync"
 
@@ -36,10 +36,16 @@ func (h ContextAdaptor) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
+// Response of logic handler, built by ResponseBuilder. Body is buffered in Body, unless it is streamed.
+// Handlers forming buffered responses may fill fields directly.
 type Response struct {
 	StatusCode int
 	Header     http.Header
 	Body       *bytes.Buffer
+	stream     io.Reader // read while response is written, Body is empty then
+
+	trailerNames []string    // declared before body
+	trailer      http.Header // filled by stream producer before body EOF
 }
 
 type LogicHandler interface {
@@ -56,6 +62,14 @@ type ImgHandler struct {
 	ErrorHandler ErrorHandler
 	Timeout      time.Duration //no timeout if 0
 	reqCount     uint32
+	// handles POST requests, they are not allowed if nil
+	PostLogicHandler LogicHandler
+	// admin token of DebugLogHeader requests, header is ignored if empty
+	DebugLogToken string
+	// tracing headers of requests, like traceparent, are propagated to origin fetches
+	PropagateTrace bool
+	// preload links of images left as links are sent in 103 Early Hints responses, before final one
+	EarlyHints bool
 }
 
 func (h *ImgHandler) ServeHTTPC(ctx context.Context, w http.ResponseWriter, req *http.Request) {
@@ -65,24 +79,45 @@ func (h *ImgHandler) ServeHTTPC(ctx context.Context, w http.ResponseWriter, req
 	}
 	defer cancel()
 
-	log := SetEmitter(h.Log, "ImgHandler").WithField("reqnum", atomic.AddUint32(&h.reqCount, 1))
+	log, debug := requestLogger(SetEmitter(h.Log, "ImgHandler").WithField("reqnum", atomic.AddUint32(&h.reqCount, 1)), req, h.DebugLogToken)
 	ctx = setLogger(ctx, log)
+	if debug {
+		log.Info("debug log enabled for request")
+	}
+	if h.PropagateTrace {
+		ctx = setTraceHeaders(ctx, requestTraceHeaders(req))
+	}
 
 	log.WithFields(logger.Fields{
-		"url":    req.URL.String(),
+		"url":    redactRequestURL(req.URL),
 		"method": req.Method,
 	}).Debug("got request")
 
-	if !(req.Method == http.MethodGet || req.Method == http.MethodHead) {
+	logicHandler := h.LogicHandler
+	if req.Method == http.MethodPost && h.PostLogicHandler != nil {
+		logicHandler = h.PostLogicHandler
+	} else if !(req.Method == http.MethodGet || req.Method == http.MethodHead) {
 		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
 		return
 	}
 
-	resp, err := h.LogicHandler.HandleLogic(ctx, req)
+	var hints *earlyHints
+	if h.EarlyHints && req.ProtoAtLeast(1, 1) {
+		// HTTP/1.0 clients don't expect informational responses
+		hints = newEarlyHints(w)
+		ctx = setEarlyHints(ctx, hints)
+	}
+	resp, err := logicHandler.HandleLogic(ctx, req)
 	if err != nil {
 		resp = h.ErrorHandler.HandleError(ctx, req, err)
 	}
+	if hints != nil {
+		hints.close()
+	}
+	writeResponse(log, w, req, resp)
+}
 
+func writeResponse(log Logger, w http.ResponseWriter, req *http.Request, resp *Response) {
 	for key, valueList := range resp.Header {
 		w.Header().Del(key)
 		for _, value := range valueList {
@@ -90,39 +125,75 @@ func (h *ImgHandler) ServeHTTPC(ctx context.Context, w http.ResponseWriter, req
 		}
 	}
 
-	w.Header().Set("Content-Length", strconv.Itoa(resp.Body.Len()))
+	// HEAD response can have length of not transferred body, and 304 response has no length.
+	// Streamed body of unknown length is sent chunked.
+	if length := resp.ContentLength(); length >= 0 && resp.StatusCode != http.StatusNotModified {
+		w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	if len(resp.trailerNames) > 0 && req.Method != http.MethodHead {
+		w.Header().Set("Trailer", strings.Join(resp.trailerNames, ", "))
+	}
 	w.WriteHeader(resp.StatusCode)
-	if req.Method == http.MethodGet {
-		if _, err := resp.Body.WriteTo(w); err != nil {
-			log.Error("Body write error: ", err)
+	if req.Method == http.MethodHead {
+		closeReader(resp.stream)
+		return
+	}
+	if f, ok := w.(http.Flusher); ok && resp.IsStreamed() {
+		// headers are sent before first body part
+		f.Flush()
+	}
+	if _, err := resp.WriteBody(w); err != nil {
+		log.Error("Body write error: ", err)
+		return
+	}
+	for _, name := range resp.trailerNames {
+		if value := resp.trailer.Get(name); value != "" {
+			w.Header().Set(name, value)
 		}
 	}
 }
 
 type ErrorLogger struct {
+	Redactor *URLRedactor       // masks URL secrets in error descriptions, nothing masked if nil
+	Reporter ErrorReporter      // receives 5xx errors, not reported if nil
+	Template *template.Template // of HTML error pages, DefaultErrorTemplate if nil
+	Messages MessageCatalog     // translations of client error messages, English only if nil
+	Statuses StatusPolicy       // of error codes, overriding default statuses
 }
 
 func NewInternalErrorResponse() *Response {
-	return &Response{
-		http.StatusInternalServerError,
-		http.Header(map[string][]string{
-			"Content-Type": []string{"application/json"},
-		}),
-		bytes.NewBufferString(`{ "error":"Internal Error" }`),
-	}
+	return NewResponseBuilder(http.StatusInternalServerError).
+		Header("Content-Type", "application/json").
+		Body([]byte(`{ "error":"Internal Error" }`)).
+		Build()
 }
 
 func NewTimeoutResponse() *Response {
-	return &Response{
-		http.StatusGatewayTimeout,
-		http.Header(map[string][]string{
-			"Content-Type": []string{"application/json"},
-		}),
-		bytes.NewBufferString(`{ "error":"timeout" }`),
-	}
+	return NewResponseBuilder(http.StatusGatewayTimeout).
+		Header("Content-Type", "application/json").
+		Body([]byte(`{ "error":"timeout" }`)).
+		Build()
+}
+
+// returns JSON error response with given description
+func NewErrorResponse(statusCode int, description string) *Response {
+	resp := NewResponse()
+	resp.StatusCode = statusCode
+	resp.Header.Set("Content-Type", "application/json")
+	json.NewEncoder(resp.Body).Encode(map[string]string{"error": description})
+	return resp
 }
 
+// Returns JSON error response, or HTML error page, if client asks for HTML.
 func (h ErrorLogger) HandleError(ctx context.Context, req *http.Request, err error) *Response {
+	resp := h.handleError(ctx, req, err)
+	if wantsHTMLError(req) {
+		return h.errorPage(getLocalLogger(ctx, "ErrorLogger"), req, resp)
+	}
+	return resp
+}
+
+func (h ErrorLogger) handleError(ctx context.Context, req *http.Request, err error) *Response {
 	log := getLocalLogger(ctx, "ErrorLogger")
 	//TODO handle http.context errors
 	if deadline, ok := ctx.Deadline(); ok && time.Now().After(deadline) {
@@ -131,16 +202,37 @@ func (h ErrorLogger) HandleError(ctx context.Context, req *http.Request, err err
 	}
 
 	if hErr, ok := err.(*HandlerError); ok {
-		if hErr.statusCode >= 400 && hErr.statusCode < 500 {
-			log.WithField("StatusCode", hErr.statusCode).Info("Body handle client error: ", hErr)
+		statusCode := h.Statuses.status(hErr)
+		if statusCode >= 400 && statusCode < 500 {
+			log.WithField("StatusCode", statusCode).Info("Body handle client error: ", hErr)
 		} else {
-			log.WithField("StatusCode", hErr.statusCode).Warn("Body handle error: ", hErr)
+			log.WithField("StatusCode", statusCode).Warn("Body handle error: ", hErr)
+			h.report(ctx, req, statusCode, hErr)
 		}
 
 		resp := NewResponse()
-		resp.StatusCode = hErr.statusCode
+		resp.StatusCode = statusCode
 		resp.Header.Set("Content-Type", "application/json")
-		marshalError := map[string]string{"error": hErr.description}
+		description := hErr.description
+		if statusCode < 500 {
+			var lang string
+			if description, lang = localizeMessage(h.Messages, req, description); lang != "" {
+				resp.Header.Set("Content-Language", lang)
+			}
+		}
+		marshalError := map[string]interface{}{"error": h.Redactor.Redact(description)}
+		if originErr, ok := hErr.cause.(*OriginError); ok {
+			marshalError["code"] = originErr.Code
+		}
+		if downErr, ok := hErr.cause.(*OriginDownError); ok {
+			marshalError["code"] = downErr.Code
+			if !downErr.LastSuccess.IsZero() {
+				marshalError["last_success"] = downErr.LastSuccess.UTC().Format(time.RFC3339)
+			}
+		}
+		if paramsErr, ok := hErr.cause.(*QueryParamsError); ok {
+			marshalError["params"] = paramsErr.Problems
+		}
 		if err = json.NewEncoder(resp.Body).Encode(marshalError); err != nil {
 			log.Error("handlerErr marshal error: ", err)
 			return NewInternalErrorResponse()
@@ -150,6 +242,7 @@ func (h ErrorLogger) HandleError(ctx context.Context, req *http.Request, err err
 
 	resp := NewInternalErrorResponse()
 	log.WithField("StatusCode", resp.StatusCode).Error("Body handle error: ", err)
+	h.report(ctx, req, resp.StatusCode, err)
 	return resp
 }
 
@@ -157,10 +250,47 @@ type ImgLogicHandler struct {
 	client       *http.Client // default client for this handler requests
 	bodyGetter   bodyGetter
 	imgExtractor imgExtractor
+	meta         *metaCache        // headers of recent responses for HEAD requests
+	flights      *flightGroup      // in-flight renders of concurrent identical requests
+	enabled      []string          // optional features enabled by Enable methods, reported by build info
+	localFiles   bool              // file URLs are served, enabled by EnableLocalFiles
+	Options      FetchOptions      // defaults of not passed fetch option params
+	MaxOptions   FetchOptions      // ceilings of fetch options, no ceiling for zero fields
+	Storage      Storage           // results are stored on store param, store is not supported if nil
+	Snapshots    *SnapshotArchive  // stored results are indexed if not nil
+	Renderer     *HeadlessRenderer // render=js is not supported if nil
+	MaxCacheAge  time.Duration     // ceiling of max-age propagated from origin page caching headers, not propagated if 0
+	Cache        *RenderCache      // rendered responses are not cached if nil
+	Placeholder  PlaceholderStyle  // of failed images in tolerant mode
+	ImageAccept  string            // Accept header of image fetches, not sent if empty
+	ImageTypes   *ImageTypePolicy  // types of inlined images, any image type if nil
+	ParseLimits  ParseLimits       // guards of page tokenizer
+	Canonical    *URLCanonicalizer // of cache and coalescing keys, URLs are used as is if nil
+	HTTPFallback bool              // schemeless url params are fetched by http, when https fetch fails
+	SniffPlain   bool              // text/plain pages are parsed, if their body is sniffed as HTML
+	Sanitizer    *SanitizePolicy   // of origin HTML in rendered output, kept as is if nil
+	Observer     Observer          // receives request events, not observed if nil
+	Health       *OriginHealth     // page origins are not probed if nil
 }
 
 func (h *ImgLogicHandler) HandleLogic(ctx context.Context, req *http.Request) (*Response, error) {
+	if h.Observer == nil {
+		return h.handleLogic(ctx, req)
+	}
+	start := time.Now()
+	ctx = setObserver(ctx, h.Observer)
+	resp, err := h.handleLogic(ctx, req)
+	h.Observer.RequestCompleted(ctx, newRequestEvent(req, resp, err, start))
+	return resp, err
+}
+
+func (h *ImgLogicHandler) handleLogic(ctx context.Context, req *http.Request) (*Response, error) {
 	log := getLocalLogger(ctx, "HandleLogic")
+	if combine, err := isCombined(req.URL.Query()); err != nil {
+		return nil, err
+	} else if combine {
+		return h.handleCombined(ctx, req)
+	}
 
 	// ctx is the Context for this handler. Calling cancel closes the
 	// ctx.Done channel, which is the cancellation signal for requests
@@ -170,41 +300,446 @@ func (h *ImgLogicHandler) HandleLogic(ctx context.Context, req *http.Request) (*
 	if err != nil {
 		return nil, err
 	}
+	if err := h.checkLocalFile(urlParam); err != nil {
+		return nil, err
+	}
+	urlParam, auth := extractOriginAuth(urlParam, req.Header.Get(OriginAuthorizationHeader))
+	urlParam = h.Canonical.fetchURL(urlParam)
 	log.WithField("urlParam", urlParam.String()).Debug("Url parsed")
-	ctx = newImgLogicContext(ctx, h.client, urlParam)
-	//ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Millisecond * 10)) //TODO just for test
-
-	//log.Debugf("Content-Type: %s", req.Header.Get("Content-Type"))
-	resp, err := cxtAwareGet(ctx, urlParam.String())
+	options, maxOptions, formatDefault := h.Options, h.MaxOptions, defaultFormat
+	useMeta := true
+	profile := getProfile(ctx)
+	if profile != nil {
+		log = log.WithField("profile", profile.Name)
+		if !profile.hostAllowed(urlParam.Hostname()) {
+			return nil, NewHandlerError(http.StatusForbidden, "page host is not allowed: "+urlParam.Hostname())
+		}
+		options, maxOptions = profile.Options, profile.MaxOptions
+		if profile.Format != "" {
+			formatDefault = outputFormat(profile.Format)
+		}
+		useMeta = !profile.NoMetaCache
+	}
+	format, err := negotiateFormat(req, formatDefault)
 	if err != nil {
-		return nil, &HandlerError{500, "Can't get requested page", err}
+		return nil, err
 	}
-	httpBody, err := h.bodyGetter.getBody(ctx, resp)
+	opts, err := parseFetchOptions(req.URL.Query(), options, maxOptions)
 	if err != nil {
 		return nil, err
 	}
-	log.WithField("size", httpBody.Len()).Debugf("Got decoded page")
-
-	images, err := h.imgExtractor.extractImages(ctx, httpBody)
+	if opts.Match != "" && format == formatPage {
+		return nil, NewHandlerError(400, "match is not supported with page format")
+	}
+	if opts.Sort != "" && opts.Sort != sortPosition && format == formatPage {
+		return nil, NewHandlerError(400, "sort is not supported with page format")
+	}
+	if (opts.Offset > 0 || opts.Limit > 0) && format == formatPage {
+		return nil, NewHandlerError(400, "offset and limit are not supported with page format")
+	}
+	if opts.Pick > 0 {
+		if format == formatPage {
+			return nil, NewHandlerError(400, "pick is not supported with page format")
+		}
+		// picked image is returned as is
+		opts.InlineThreshold = 0
+		opts.Links = false
+	}
+	store := req.URL.Query().Get("store")
+	if store != "" {
+		if store != "page" && store != "all" {
+			return nil, NewHandlerError(400, "invalid 'store' query parameter, expected page or all: "+store)
+		}
+		if h.Storage == nil {
+			return nil, NewHandlerError(400, "results storage is not configured")
+		}
+	}
+	renderJS := false
+	if param := req.URL.Query().Get("render"); param != "" {
+		if param != "js" {
+			return nil, NewHandlerError(400, "invalid 'render' query parameter, expected js: "+param)
+		}
+		if h.Renderer == nil {
+			return nil, NewHandlerError(400, "JavaScript rendering is not enabled")
+		}
+		if auth != nil {
+			return nil, NewHandlerError(400, "origin authorization is not supported with JavaScript rendering")
+		}
+		if !isRenderedScheme(urlParam.Scheme) {
+			return nil, NewHandlerError(400, "only http and https URLs are supported with JavaScript rendering")
+		}
+		renderJS = true
+	}
+	inlineFonts := false
+	if param := req.URL.Query().Get("fonts"); param != "" {
+		if inlineFonts, err = strconv.ParseBool(param); err != nil {
+			return nil, NewHandlerError(400, "invalid 'fonts' query parameter: "+param)
+		}
+	}
+	strip, err := parsePageStrip(req.URL.Query().Get("strip"))
+	if err != nil {
+		return nil, err
+	}
+	if strip != (pageStrip{}) && format != formatPage {
+		return nil, NewHandlerError(400, "'strip' query parameter is supported only with page format")
+	}
+	hints, err := parseClientHints(req)
 	if err != nil {
 		return nil, err
 	}
-	log.Debugf("%v images extracted", len(images))
+	lang, err := parseLanguage(req)
+	if err != nil {
+		return nil, err
+	}
+	var timings *fetchTimings
+	if param := req.URL.Query().Get("timing"); param != "" {
+		timing, err := strconv.ParseBool(param)
+		if err != nil {
+			return nil, NewHandlerError(400, "invalid 'timing' query parameter: "+param)
+		}
+		if timing {
+			timings = &fetchTimings{}
+		}
+	}
+	var report *debugReport
+	if param := req.URL.Query().Get("debug"); param != "" {
+		debug, err := strconv.ParseBool(param)
+		if err != nil {
+			return nil, NewHandlerError(400, "invalid 'debug' query parameter: "+param)
+		}
+		if debug {
+			if format == formatPage {
+				return nil, NewHandlerError(400, "debug report is not supported with page format")
+			}
+			report = &debugReport{}
+			useMeta = false
+		}
+	}
+	stream := false
+	if param := req.URL.Query().Get("stream"); param != "" {
+		if stream, err = strconv.ParseBool(param); err != nil {
+			return nil, NewHandlerError(400, "invalid 'stream' query parameter: "+param)
+		}
+	}
+	if stream {
+		if format != formatHTML || opts.Pick > 0 || store != "" || report != nil || renderJS {
+			return nil, NewHandlerError(400, "stream is supported only with html format, without pick, store, debug and render")
+		}
+		if opts.Sort != "" && opts.Sort != sortPosition {
+			return nil, NewHandlerError(400, "sort is not supported with stream")
+		}
+		// images are sent as soon as they are fetched
+		opts.CompletionOrder = true
+		// per request response
+		useMeta = false
+	}
+	key := renderKey{
+		URL:     h.Canonical.canonical(urlParam).String(),
+		Format:  format,
+		Options: opts,
+		Hints:   hints,
+		Lang:    lang,
+		Fonts:   inlineFonts,
+		Strip:   strip,
+		JS:      renderJS,
+		Timing:  timings != nil,
+	}
+	if profile != nil {
+		key.Profile = profile.Name
+	}
+	metaKey := key.String()
+	// protected page statistics are not shared with other clients
+	useMeta = useMeta && auth == nil && req.Method != http.MethodPost
+	if req.Method == http.MethodHead && useMeta {
+		if header := h.meta.get(metaKey); header != nil {
+			log.Debug("HEAD response from meta cache")
+			header.Set(MetaCacheHeader, "hit")
+			return NewResponseBuilder(200).Headers(header).Build(), nil
+		}
+	}
+	// per request results are not shared
+	part := getCombinedPart(ctx)
+	coalesce := useMeta && req.Method == http.MethodGet && timings == nil && store == "" && part == nil
+	useCache := h.Cache != nil && coalesce
+	probed := h.Health != nil && req.Method != http.MethodPost
+	if probed {
+		h.Health.requested(urlParam)
+		if downErr := h.Health.downError(urlParam.Host); downErr != nil {
+			return h.originDownResponse(ctx, metaKey, useCache, downErr)
+		}
+	}
+	if useCache && !isCacheRefresh(ctx) {
+		pageCtx := setLanguage(setOriginAuth(newImgLogicContext(ctx, h.client, urlParam), auth), lang)
+		if cached := h.cachedResponse(ctx, pageCtx, req, metaKey); cached != nil {
+			return cached, nil
+		}
+	}
+	// renders response, result is shared by concurrent identical requests if coalesced
+	render := renderFunc(func(ctx context.Context) (*Response, *extraction, error) {
+		var err error
+		cancel := context.CancelFunc(func() {})
+		if opts.Timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		}
+		// streamed extraction outlives render, and cancels ctx itself
+		streamed := false
+		defer func() {
+			if !streamed {
+				cancel()
+			}
+		}()
+		ctx = setFetchOptions(newImgLogicContext(ctx, h.client, urlParam), opts)
+		ctx = setOriginAuth(ctx, auth)
+		ctx = setClientHints(ctx, hints)
+		ctx = setLanguage(ctx, lang)
+		ctx = setPlaceholderStyle(ctx, h.Placeholder)
+		ctx = setImageAccept(ctx, h.ImageAccept)
+		ctx = setImageTypePolicy(ctx, h.ImageTypes)
+		ctx = setParseLimits(ctx, h.ParseLimits)
+		ctx = setCanonicalizer(ctx, h.Canonical)
+		ctx = setSanitizePolicy(ctx, h.Sanitizer)
+		if h.HTTPFallback && isSchemeless(req.URL.Query().Get("url")) {
+			ctx = setHTTPFallback(ctx)
+		}
+		if h.SniffPlain {
+			ctx = setSniffPlainText(ctx)
+		}
+		if format == formatMultipart || opts.Pick > 0 {
+			ctx = setRawImages(ctx)
+		}
+		if timings != nil {
+			ctx = setFetchTimings(ctx, timings)
+		}
+		if report != nil {
+			ctx = setDebugReport(ctx, report)
+		}
+		//ctx, cancel := context.WithDeadline(context.Background(), time.Now().Add(time.Millisecond * 10)) //TODO just for test
+
+		//log.Debugf("Content-Type: %s", req.Header.Get("Content-Type"))
+		var (
+			httpBody   *bytes.Buffer
+			pageHeader http.Header // nil if page is not fetched
+		)
+		if req.Method == http.MethodPost {
+			// posted document, url param is base of relative image URLs
+			httpBody, err = readPostedDocument(req)
+		} else if renderJS {
+			httpBody, err = h.Renderer.render(ctx, urlParam.String())
+		} else {
+			fetchStart := time.Now()
+			var pageURL *url.URL
+			httpBody, pageHeader, pageURL, err = h.fetchPage(ctx, opts.PageRetries)
+			if err == nil {
+				// images are resolved relative to fetched page
+				ctx = setPageURL(ctx, pageURL)
+			}
+			getPhaseTimings(ctx).add(phasePageFetch, fetchStart)
+			if err == nil && probed {
+				h.Health.succeeded(urlParam)
+			}
+			if err == nil {
+				getObserver(ctx).PageFetched(ctx, PageEvent{getURLParam(ctx).String(), httpBody.Len(), time.Since(fetchStart)})
+			}
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		log.WithField("size", httpBody.Len()).Debugf("Got decoded page")
+		if stream {
+			streamed = true
+			return h.streamImages(ctx, cancel, httpBody), &extraction{}, nil
+		}
 
-	respBody, err := formImagesHTML(ctx, images)
+		var response *Response
+		extracted := &extraction{}
+		if format == formatPage {
+			response, err = savePage(ctx, h.imageFetcher(), httpBody, urlParam, inlineFonts, strip)
+			// page is tokenized synchronously, unlike on extraction, where parser may still read it
+			buffers.put(httpBody)
+		} else {
+			extracted, err = h.imgExtractor.extractImages(ctx, httpBody)
+			if report != nil {
+				// report is returned on processing error too, as it is most useful then
+				response, err := report.response(ctx, format, extracted, err)
+				return response, extracted, err
+			}
+			if err != nil {
+				if ctx.Err() == context.DeadlineExceeded {
+					return nil, nil, &HandlerError{http.StatusGatewayTimeout, "timeout", err}
+				}
+				return nil, nil, err
+			}
+			log.Debugf("%v images extracted", len(extracted.images))
+			renderStart := time.Now()
+			if opts.Pick > 0 {
+				response, err = pickedImageResponse(ctx, extracted, opts.Pick)
+			} else {
+				response, err = renderResponse(ctx, format, extracted)
+			}
+			getPhaseTimings(ctx).add(phaseRender, renderStart)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		log.WithField("format", format).Debug("response formed")
+		if pageHeader != nil && !opts.Frames && opts.PageRedirects == 0 {
+			// validators are of url param page, not of redirect target or frames
+			setPageValidators(response, pageHeader)
+		}
+		if h.MaxCacheAge > 0 && pageHeader != nil {
+			if cacheControl := renderedCacheControl(pageHeader, time.Now(), h.MaxCacheAge, auth != nil); cacheControl != "" {
+				response.Header.Set("Cache-Control", cacheControl)
+			}
+		}
+		if profile != nil && profile.CacheControl != "" {
+			response.Header.Set("Cache-Control", profile.CacheControl)
+		}
+		meta := cloneHeader(response.Header)
+		meta.Set("Content-Length", strconv.FormatInt(response.ContentLength(), 10))
+		if useMeta {
+			h.meta.put(metaKey, meta)
+		}
+		if useCache {
+			response.Header.Set(RenderCacheHeader, "miss")
+			h.Cache.put(metaKey, response)
+		}
+		return response, extracted, nil
+	})
+	response, extracted, err := h.renderCoalesced(ctx, metaKey, coalesce, render)
 	if err != nil {
 		return nil, err
 	}
-	log.Debug("response formed")
+	if timings != nil {
+		// differs for every request, so not kept in meta cache
+		response.Header.Set(TimingHeader, formatTimingHeader(timings.list()))
+	}
+	if part != nil {
+		*part = *extracted
+	}
+	if store != "" && req.Method == http.MethodGet {
+		if err := h.storeResponse(ctx, urlParam, response, extracted, store == "all"); err != nil {
+			return nil, err
+		}
+	}
+	return response, nil
+
+}
+
+// fetcher of images outside of extraction
+// Gets page, retrying with exponential backoff on origin server and network errors.
+// Retry is not started, if it can't be made before request deadline.
+func getPage(ctx context.Context, pageURL string, retries int) (*http.Response, error) {
+	log := getLocalLogger(ctx, "getPage")
+	b := backoff.NewExponentialBackOff()
+	for attempt := 0; ; attempt++ {
+		resp, err := cxtAwareGet(ctx, pageURL)
+		_, invalidResponse := err.(*HandlerError)
+		networkError := err != nil && !invalidResponse && ctx.Err() == nil
+		if !(networkError || err == nil && resp.StatusCode >= 500) || attempt >= retries {
+			return resp, err
+		}
+		wait := b.NextBackOff()
+		if deadline, ok := ctx.Deadline(); wait == backoff.Stop || ok && time.Now().Add(wait).After(deadline) {
+			return resp, err
+		}
+		if err == nil {
+			resp.Body.Close()
+			log.WithField("status", resp.StatusCode).Debug("page fetch retry in ", wait)
+		} else {
+			log.WithField("error", err).Debug("page fetch retry in ", wait)
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Fetches and decodes page of ctx URL param. Returns URL of fetched page, which images are resolved relative to.
+// Schemeless page URL is fetched by http, if https fetch fails with network error and fallback is enabled.
+// URL param is not changed, so results are of requested URL.
+func (h *ImgLogicHandler) fetchPage(ctx context.Context, retries int) (*bytes.Buffer, http.Header, *url.URL, error) {
+	pageURL := &url.URL{}
+	*pageURL = *getURLParam(ctx)
+	resp, err := getPage(ctx, pageURL.String(), retries)
+	if _, invalidResponse := err.(*HandlerError); err != nil && !invalidResponse && ctx.Err() == nil && isHTTPFallback(ctx) {
+		getLocalLogger(ctx, "fetchPage").WithField("error", err).Info("https page fetch failed, fallback to http")
+		pageURL.Scheme = "http"
+		resp, err = getPage(ctx, pageURL.String(), retries)
+	}
+	if err != nil {
+		return nil, nil, nil, originPageError(ctx, err)
+	}
+	body, err := h.bodyGetter.getBody(ctx, resp)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	visited := map[string]bool{pageURL.String(): true}
+	for hop := 0; hop < getFetchOptions(ctx).PageRedirects; hop++ {
+		target := pageRedirect(body.Bytes(), pageURL)
+		if target == nil || visited[target.String()] {
+			break
+		}
+		visited[target.String()] = true
+		buffers.put(body)
+		if profile := getProfile(ctx); profile != nil && !profile.hostAllowed(target.Hostname()) {
+			// allowed page can't redirect server to other hosts
+			return nil, nil, nil, NewHandlerError(http.StatusForbidden, "page redirect host is not allowed: "+target.Hostname())
+		}
+		getLocalLogger(ctx, "fetchPage").WithField("target", target.String()).Debug("follow page redirect")
+		pageURL = getCanonicalizer(ctx).fetchURL(target)
+		if resp, err = getPage(ctx, pageURL.String(), retries); err != nil {
+			return nil, nil, nil, originPageError(ctx, err)
+		}
+		if body, err = h.bodyGetter.getBody(ctx, resp); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	if getFetchOptions(ctx).Frames {
+		if body, err = h.mergeFrames(setPageURL(ctx, pageURL), body); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+	return body, resp.Header, pageURL, nil
+}
 
-	header := make(http.Header)
-	header.Set("Content-Type", "text/html;charset=utf-8")
-	return &Response{200, header, respBody}, nil
+// returns handler error of page get error
+func originPageError(ctx context.Context, err error) *HandlerError {
+	if ctx.Err() == context.DeadlineExceeded {
+		return &HandlerError{http.StatusGatewayTimeout, "timeout", err}
+	}
+	if handlerErr, ok := err.(*HandlerError); ok {
+		return handlerErr
+	}
+	return originUnreachable("Can't get requested page", err)
+}
 
+// Returns extraction pipeline settings and stats, or nil if extractor is not pipeline.
+func (h *ImgLogicHandler) Pipeline() *Pipeline {
+	if extractor, ok := h.imgExtractor.(imgExtractorImp); ok {
+		return extractor.pipeline
+	}
+	return nil
+}
+
+func (h *ImgLogicHandler) imageParser() imageParser {
+	if extractor, ok := h.imgExtractor.(imgExtractorImp); ok {
+		return extractor.parser
+	}
+	return imageParserImp{imgTokenParserFunc(parseImgToken)}
+}
+
+func (h *ImgLogicHandler) imageFetcher() imageFetcher {
+	if extractor, ok := h.imgExtractor.(imgExtractorImp); ok {
+		return extractor.fetcher
+	}
+	return imageFetcherFunc(fetchImage)
 }
 
 func formImagesHTML(ctx context.Context, images []imgTag) (*bytes.Buffer, error) {
-	buf := bytes.NewBufferString("<html>\n<head>\n<title>imgserv</title>\n</head>\n<body>\n")
+	buf := buffers.get()
+	buf.WriteString("<html>\n<head>\n<title>imgserv</title>\n</head>\n<body>\n")
 	for _, img := range images {
 		buf.WriteString(img.token().String())
 		buf.WriteByte('\n')
@@ -227,7 +762,7 @@ func getBody(ctx context.Context, resp *http.Response) (*bytes.Buffer, error) {
 	var err error
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
-		return nil, NewHandlerError(400, "Can't get requested page: expected status code 200 but found "+strconv.Itoa(resp.StatusCode))
+		return nil, originStatusError("Can't get requested page", resp.StatusCode)
 	}
 	ct := resp.Header.Get("Content-Type")
 	var ctWithoutParameter string
@@ -237,25 +772,100 @@ func getBody(ctx context.Context, resp *http.Response) (*bytes.Buffer, error) {
 		ctWithoutParameter = ct
 	}
 	ctWithoutParameter = strings.TrimSpace(ctWithoutParameter)
-	if ctWithoutParameter != "text/html" {
-		return nil, NewHandlerError(400, "requested page have unsupported content type")
+	markdown := markdownMediaTypes[ctWithoutParameter]
+	xhtml := xhtmlMediaTypes[ctWithoutParameter]
+	// mislabeled page is known only after body is read
+	plain := ctWithoutParameter == "text/plain" && isSniffPlainText(ctx)
+	if ctWithoutParameter != "text/html" && !markdown && !xhtml && !plain {
+		return nil, originFailure(OriginUnsupported, "requested page have unsupported content type", nil)
+	}
+	var body io.Reader = resp.Body
+	var limited *io.LimitedReader
+	if maxSize := getParseLimits(ctx).MaxPageSize; maxSize > 0 {
+		if resp.ContentLength > maxSize {
+			return nil, pageBodyTooLargeError(maxSize)
+		}
+		limited = &io.LimitedReader{R: resp.Body, N: maxSize + 1}
+		body = limited
+	}
+	raw := buffers.get()
+	defer buffers.put(raw)
+	_, err = raw.ReadFrom(body)
+	if limited != nil && limited.N <= 0 {
+		return nil, pageBodyTooLargeError(getParseLimits(ctx).MaxPageSize)
+	}
+	if hErr := originHandlerError(err); hErr != nil {
+		return nil, hErr
 	}
-	r, err := charset.NewReader(resp.Body, ct)
-	buf := &bytes.Buffer{}
-	_, err = io.Copy(buf, r)
 	if err != nil {
-		return nil, &HandlerError{400, "Requested page have unsupported charset or invalid charset sequence", err}
+		return nil, originFailure(OriginUnsupported, "Can't get requested page", err)
+	}
+	if plain && !isSniffedHTML(raw.Bytes()) {
+		return nil, originFailure(OriginUnsupported, "requested page have unsupported content type", nil)
+	}
+	if xhtml {
+		ct = xhtmlContentType(raw.Bytes(), ct)
+	}
+	decoded, charsetName, charsetSource := decodePage(raw.Bytes(), ct)
+	getDebugReport(ctx).setCharset(charsetName, charsetSource)
+	buf := buffers.get()
+	buf.Write(trimPrologue(decoded, xhtml))
+	if markdown {
+		rendered := renderMarkdown(buf.Bytes())
+		buffers.put(buf)
+		return rendered, nil
 	}
 	return buf, nil
 }
 
+// Returns true for URLs like example.com/page, that users paste without scheme.
+// Protocol relative URLs, and words without domain dot, are not schemeless URLs.
+func isSchemeless(rawURL string) bool {
+	if strings.Contains(rawURL, "://") || strings.HasPrefix(rawURL, "//") {
+		return false
+	}
+	host := rawURL
+	if i := strings.IndexAny(host, "/?#"); i >= 0 {
+		host = host[:i]
+	}
+	return strings.Contains(host, ".")
+}
+
+// Makes text/plain pages parsed, when their body is sniffed as HTML.
+func setSniffPlainText(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxSniffPlainTextKey, true)
+}
+
+func isSniffPlainText(ctx context.Context) bool {
+	sniff, _ := ctx.Value(ctxSniffPlainTextKey).(bool)
+	return sniff
+}
+
+// Returns true, if page body starts like HTML document, by MIME sniffing algorithm.
+func isSniffedHTML(raw []byte) bool {
+	return strings.HasPrefix(http.DetectContentType(bytes.TrimPrefix(raw, utf8BOM)), "text/html")
+}
+
+// Makes page fetch fallback to http, when https fetch of schemeless URL fails.
+func setHTTPFallback(ctx context.Context) context.Context {
+	return context.WithValue(ctx, ctxHTTPFallbackKey, true)
+}
+
+func isHTTPFallback(ctx context.Context) bool {
+	fallback, _ := ctx.Value(ctxHTTPFallbackKey).(bool)
+	return fallback
+}
+
+// Schemeless url param defaults to https, unless strict_url param requires scheme.
 func extractURLParam(requestURL *url.URL) (*url.URL, error) {
 	query := requestURL.Query()
 
-	const expectedParamsNum = 1
-	if len(query) != expectedParamsNum {
+	if len(query) == 0 {
 		return nil, NewHandlerError(400, "unexpected param num")
 	}
+	if err := validateQuery(query); err != nil {
+		return nil, err
+	}
 
 	urlParms := query["url"]
 	const expectedURLParams = 1
@@ -266,35 +876,56 @@ func extractURLParam(requestURL *url.URL) (*url.URL, error) {
 		return nil, NewHandlerError(400, "too few url params")
 	}
 
-	urlParam := urlParms[0]
+	rawURL := urlParms[0]
+	if isSchemeless(rawURL) {
+		if param := query.Get("strict_url"); param != "" {
+			strict, err := strconv.ParseBool(param)
+			if err != nil {
+				return nil, NewHandlerError(400, "invalid 'strict_url' query parameter: "+param)
+			}
+			if strict {
+				return nil, NewHandlerError(400, "URL scheme is required in 'url' query parameter")
+			}
+		}
+		rawURL = "https://" + rawURL
+	}
+	urlParam, err := asciiURL(rawURL)
+	if err != nil {
+		return nil, &HandlerError{400, "invalid URL as 'url' query parameter", err}
+	}
 
-	if !govalidator.IsURL(urlParam) {
+	parsed, err := url.Parse(urlParam)
+	if err != nil || !isObjectURL(parsed) && !govalidator.IsURL(urlParam) {
 		return nil, NewHandlerError(400, "invalid URL as 'url' query parameter")
 	}
-
-	return url.Parse(urlParam)
+	return parsed, nil
 }
 
+// Returns buffered response to fill, compatible with handlers predating ResponseBuilder.
 func NewResponse() *Response {
-	return &Response{
-		-1,
-		make(http.Header),
-		&bytes.Buffer{},
-	}
+	return NewResponseBuilder(-1).Build()
 }
 
 func NewImgLogicHandler(client *http.Client) *ImgLogicHandler {
 	return &ImgLogicHandler{
-		client,
-		bodyGetterFunc(getBody),
-		imgExtractorImp{
+		client:     client,
+		bodyGetter: bodyGetterFunc(getBody),
+		imgExtractor: imgExtractorImp{
 			imageParserImp{imgTokenParserFunc(parseImgToken)},
 			//imageFetcherFunc(fetchImage),
 			backoffImageFetcher{
 				&sync.Mutex{},
 				backoff.NewExponentialBackOff(),
 			},
+			NewPipeline(),
 		},
+		meta:        newMetaCache(time.Minute, 1024),
+		flights:     newFlightGroup(),
+		Options:     DefaultFetchOptions,
+		Placeholder: DefaultPlaceholderStyle,
+		ImageAccept: DefaultImageAccept,
+		ParseLimits: DefaultParseLimits,
+		Sanitizer:   RelaxedSanitizePolicy,
 	}
 }
 
@@ -302,7 +933,7 @@ func NewImgCtxAdaptor(log Logger, client *http.Client, timeout time.Duration) Co
 	return ContextAdaptor{
 		Handler: &ImgHandler{
 			Log:          log,
-			LogicHandler: NewImgLogicHandler(client),
+			LogicHandler: NewCallbackLogicHandler(NewImgLogicHandler(client), client, nil, timeout, 0),
 			ErrorHandler: ErrorLogger{},
 			Timeout:      timeout,
 		},
@@ -1,7 +1,14 @@
 package imgserver
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"strings"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -39,6 +46,37 @@ var _ = Describe("Parameter Parse", func() {
 		})
 	})
 
+	Context("when internationalized URL", func() {
+		BeforeEach(func() {
+			inputRawURL = "http://localhost:8888/?url=" + url.QueryEscape("https://Bücher.example/straße?q=café")
+		})
+		It("then no error", func() {
+			Expect(err).ToNot(HaveOccurred())
+		})
+		It("then host is punycode and path and query percent-encoded", func() {
+			Expect(res.String()).To(Equal("https://xn--bcher-kva.example/stra%C3%9Fe?q=caf%C3%A9"))
+		})
+	})
+
+	Context("when URL without scheme", func() {
+		BeforeEach(func() {
+			inputRawURL = "http://localhost:8888/?url=golang.org%2Fdoc%2F"
+		})
+		It("then https is default", func() {
+			Expect(err).ToNot(HaveOccurred())
+			Expect(res.String()).To(Equal("https://golang.org/doc/"))
+		})
+	})
+
+	Context("when URL without scheme in strict mode", func() {
+		BeforeEach(func() {
+			inputRawURL = "http://localhost:8888/?url=golang.org%2Fdoc%2F&strict_url=true"
+		})
+		It("then error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
 	Context("when unexpexted parameter name", func() {
 		BeforeEach(func() {
 			inputRawURL = "http://localhost:8888/?qwerty=https%3A%2F%2Fgolang.org%2Fdoc%2F"
@@ -120,3 +158,107 @@ var _ = Describe("Parameter Parse", func() {
 		})
 	})
 })
+
+var _ = Describe("page fetch retry", func() {
+	var (
+		origin   *httptest.Server
+		failures int // responses with 502 before 200
+		requests int
+		ctx      context.Context
+	)
+	BeforeEach(func() {
+		requests = 0
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if requests <= failures {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+		}))
+		ctx = context.WithValue(setLogger(context.Background(), logger.StandardLogger()), CtxHTTPClientKey, http.DefaultClient)
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+
+	It("then server error retried", func() {
+		failures = 1
+		resp, err := getPage(ctx, origin.URL, 1)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(200))
+		Expect(requests).To(Equal(2))
+	})
+	It("then last response returned after retries", func() {
+		failures = 1
+		resp, err := getPage(ctx, origin.URL, 0)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+		Expect(requests).To(Equal(1))
+	})
+	It("then no retry after deadline", func() {
+		failures = 10
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		resp, err := getPage(ctx, origin.URL, 5)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(http.StatusBadGateway))
+		Expect(requests).To(Equal(1))
+		Expect(time.Since(start)).To(BeNumerically("<", 100*time.Millisecond))
+	})
+	It("then schemeless page is fetched by http after https failure", func() {
+		failures = 0
+		pageURL, err := url.Parse("https://" + strings.TrimPrefix(origin.URL, "http://"))
+		Expect(err).NotTo(HaveOccurred())
+		ctx = setHTTPFallback(newImgLogicContext(ctx, http.DefaultClient, pageURL))
+		_, _, fetchedURL, err := NewImgLogicHandler(http.DefaultClient).fetchPage(ctx, 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(fetchedURL.Scheme).To(Equal("http"))
+		Expect(pageURL.Scheme).To(Equal("https"))
+		Expect(requests).To(Equal(1))
+	})
+})
+
+var _ = Describe("picked image", func() {
+	var origin *httptest.Server
+	BeforeEach(func() {
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/":
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte(`<img src="/1.png"><img src="/images/2.gif"><img src="/3.png">`))
+			default:
+				w.Header().Set("Content-Type", "image/gif")
+				w.Write([]byte("GIF89a" + r.URL.Path))
+			}
+		}))
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	handle := func(query string) (*Response, error) {
+		req := httptest.NewRequest("GET", "/?url="+url.QueryEscape(origin.URL+"/")+query, nil)
+		return NewImgLogicHandler(http.DefaultClient).HandleLogic(setLogger(context.Background(), logger.StandardLogger()), req)
+	}
+	It("then Nth image returned as attachment", func() {
+		resp, err := handle("&pick=2&inline_threshold=1")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Header.Get("Content-Type")).To(Equal("image/gif"))
+		Expect(resp.Header.Get("Content-Disposition")).To(Equal(`attachment; filename=2.gif`))
+		Expect(resp.Body.String()).To(Equal("GIF89a/images/2.gif"))
+	})
+	It("then missing image not found", func() {
+		_, err := handle("&pick=4")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusNotFound))
+	})
+	It("then page format rejected", func() {
+		_, err := handle("&pick=1&format=page")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(400))
+	})
+})
@@ -0,0 +1,88 @@
+package imgserver
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Renders pages by headless Chrome, for pages referencing images only after JavaScript runs.
+// Returns DOM after page load, as printed by chrome --dump-dom.
+type HeadlessRenderer struct {
+	Path    string        // Chrome binary path
+	Timeout time.Duration // of single page render, no timeout if 0
+	MaxSize int64         // bytes of rendered DOM, no limit if 0
+	pool    chan struct{} // render slots
+}
+
+func NewHeadlessRenderer(path string, poolSize int, timeout time.Duration) *HeadlessRenderer {
+	return &HeadlessRenderer{
+		Path:    path,
+		Timeout: timeout,
+		MaxSize: 10 << 20,
+		pool:    make(chan struct{}, poolSize),
+	}
+}
+
+func (r *HeadlessRenderer) render(ctx context.Context, pageURL string) (*bytes.Buffer, error) {
+	log := getLocalLogger(ctx, "HeadlessRenderer")
+	select {
+	case r.pool <- struct{}{}:
+		defer func() { <-r.pool }()
+	case <-ctx.Done():
+		return nil, &HandlerError{http.StatusServiceUnavailable, "no free headless browser", ctx.Err()}
+	}
+	if r.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.Timeout)
+		defer cancel()
+	}
+	if u, err := url.Parse(pageURL); err != nil || !isRenderedScheme(u.Scheme) {
+		// browser reads file: and chrome: URLs too
+		return nil, NewHandlerError(400, "only http and https URLs are rendered: "+pageURL)
+	}
+	cmd := exec.CommandContext(ctx, r.Path, "--headless", "--disable-gpu", "--dump-dom", pageURL)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		return nil, &HandlerError{500, "headless browser start error", err}
+	}
+	buf := &bytes.Buffer{}
+	src := io.Reader(stdout)
+	if r.MaxSize > 0 {
+		src = io.LimitReader(stdout, r.MaxSize+1)
+	}
+	_, readErr := io.Copy(buf, src)
+	if r.MaxSize > 0 && int64(buf.Len()) > r.MaxSize {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, NewHandlerError(400, "rendered page is too big")
+	}
+	if err := cmd.Wait(); err != nil || readErr != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &HandlerError{http.StatusGatewayTimeout, "headless render timeout", ctx.Err()}
+		}
+		if err == nil {
+			err = readErr
+		}
+		log.WithField("stderr", stderr.String()).Warn("headless render failed")
+		return nil, &HandlerError{http.StatusBadGateway, "headless render error", err}
+	}
+	log.WithField("duration", time.Since(start)).Debug("page rendered")
+	return buf, nil
+}
+
+// returns true for URL schemes, that are fetched by browser as by imgserver itself
+func isRenderedScheme(scheme string) bool {
+	return scheme == "http" || scheme == "https"
+}
@@ -0,0 +1,69 @@
+package imgserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("headless renderer", func() {
+	var (
+		dir string
+		ctx context.Context
+	)
+	// fake browser printing its last argument
+	browser := func(script string) string {
+		path := filepath.Join(dir, "chrome")
+		Expect(ioutil.WriteFile(path, []byte("#!/bin/sh\n"+script+"\n"), 0755)).To(Succeed())
+		return path
+	}
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "headless")
+		Expect(err).NotTo(HaveOccurred())
+		ctx = setLogger(context.Background(), logger.StandardLogger())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	It("then rendered DOM returned", func() {
+		renderer := NewHeadlessRenderer(browser(`for last; do :; done; echo "<img src=\"$last/a.png\">"`), 1, time.Second)
+		body, err := renderer.render(ctx, "http://example.com")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body.String()).To(Equal(`<img src="http://example.com/a.png">` + "\n"))
+	})
+	It("then render timeout reported", func() {
+		renderer := NewHeadlessRenderer(browser("exec sleep 5"), 1, 50*time.Millisecond)
+		_, err := renderer.render(ctx, "http://example.com")
+		Expect(err.(*HandlerError).statusCode).To(Equal(504))
+	})
+	It("then browser failure reported", func() {
+		renderer := NewHeadlessRenderer(browser("exit 1"), 1, time.Second)
+		_, err := renderer.render(ctx, "http://example.com")
+		Expect(err.(*HandlerError).statusCode).To(Equal(502))
+	})
+	It("then not http URLs are not rendered", func() {
+		renderer := NewHeadlessRenderer(browser("echo rendered"), 1, time.Second)
+		_, err := renderer.render(ctx, "chrome://settings")
+		Expect(err.(*HandlerError).statusCode).To(Equal(400))
+
+		handler := NewImgLogicHandler(http.DefaultClient)
+		handler.EnableLocalFiles(dir)
+		handler.Renderer = renderer
+		req := httptest.NewRequest("GET", "/?render=js&url="+url.QueryEscape("file:///etc/passwd"), nil)
+		_, err = handler.HandleLogic(ctx, req)
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(400))
+		Expect(err.(*HandlerError).description).To(ContainSubstring("http and https"))
+	})
+})
@@ -0,0 +1,116 @@
+package imgserver
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	latencyWindow     = 256 // recent fetches used for hedge delay
+	minLatencySamples = 16  // no hedging until enough fetches
+)
+
+// Recent image fetch latencies.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples []time.Duration
+	next    int
+}
+
+func (t *latencyTracker) add(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.samples) < latencyWindow {
+		t.samples = append(t.samples, d)
+		return
+	}
+	t.samples[t.next] = d
+	t.next = (t.next + 1) % latencyWindow
+}
+
+// returns latency percentile, or false if there not enough samples
+func (t *latencyTracker) percentile(p float64) (time.Duration, bool) {
+	t.mu.Lock()
+	sorted := append([]time.Duration(nil), t.samples...)
+	t.mu.Unlock()
+	if len(sorted) < minLatencySamples {
+		return 0, false
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	i := int(p * float64(len(sorted)))
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i], true
+}
+
+// imageFetcher decorator, that issues second fetch if first is not finished within
+// percentile of recent successful fetch latencies. First fetched result is taken,
+// and another fetch is canceled.
+type hedgedImageFetcher struct {
+	fetcher    imageFetcher
+	percentile float64
+	latency    *latencyTracker
+}
+
+func newHedgedImageFetcher(fetcher imageFetcher, percentile float64) hedgedImageFetcher {
+	return hedgedImageFetcher{fetcher, percentile, &latencyTracker{}}
+}
+
+func (h hedgedImageFetcher) fetchImage(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+	done := goroutines.start(goroutineFetch)
+	go func() {
+		defer done()
+		log := getLocalLogger(ctx, "hedgedFetcher")
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel() // cancel loser
+		// buffered for both fetches, so loser don't block after return
+		results := make(chan fetchResult, 2)
+		fetched := func(img imgTag, err error) {
+			results <- fetchResult{img, err}
+		}
+		start := time.Now()
+		h.fetcher.fetchImage(ctx, img, imgURL, fetched)
+		inFlight := 1
+
+		var hedge <-chan time.Time
+		if delay, ok := h.latency.percentile(h.percentile); ok {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			hedge = timer.C
+		}
+		for {
+			select {
+			case <-hedge:
+				log.WithField("url", imgURL).Debug("image fetch is slow, sending hedged request")
+				hedge = nil
+				h.fetcher.fetchImage(ctx, img, imgURL, fetched)
+				inFlight++
+			case res := <-results:
+				if res.err == nil {
+					h.latency.add(time.Since(start))
+					result(res.img, nil)
+					return
+				}
+				inFlight--
+				if inFlight == 0 {
+					result(imgTag{}, res.err)
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Enables hedged image fetches: second request is sent, if image is not fetched
+// within given percentile (0.95 for p95) of recent fetch latencies.
+func (h *ImgLogicHandler) EnableHedging(percentile float64) {
+	if extractor, ok := h.imgExtractor.(imgExtractorImp); ok {
+		extractor.fetcher = newHedgedImageFetcher(extractor.fetcher, percentile)
+		h.imgExtractor = extractor
+		h.enabled = append(h.enabled, "hedging")
+	}
+}
@@ -0,0 +1,85 @@
+package imgserver
+
+import (
+	"sync/atomic"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+var _ = Describe("hedged image fetcher", func() {
+	var (
+		calls    int32
+		canceled chan struct{}
+		fetcher  hedgedImageFetcher
+		results  chan fetchResult
+		cancel   context.CancelFunc
+	)
+	img := imgTag{0, []html.Attribute{{Key: "src", Val: "a.png"}}, nil}
+	BeforeEach(func() {
+		calls = 0
+		canceled = make(chan struct{})
+		results = make(chan fetchResult, 1)
+		slowFirst := imageFetcherFunc(func(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+			call := atomic.AddInt32(&calls, 1)
+			go func() {
+				if call == 1 {
+					<-ctx.Done()
+					close(canceled)
+					result(imgTag{}, ctx.Err())
+					return
+				}
+				result(img.withSrc("data:image/png;base64,"), nil)
+			}()
+		})
+		fetcher = newHedgedImageFetcher(slowFirst, 0.9)
+	})
+	JustBeforeEach(func() {
+		var ctx context.Context
+		ctx, cancel = context.WithCancel(setLogger(context.Background(), logger.StandardLogger()))
+		fetcher.fetchImage(ctx, img, "http://example.com/a.png", func(img imgTag, err error) {
+			results <- fetchResult{img, err}
+		})
+	})
+	AfterEach(func() {
+		cancel()
+	})
+
+	Context("when enough latency samples", func() {
+		BeforeEach(func() {
+			for i := 0; i < minLatencySamples; i++ {
+				fetcher.latency.add(time.Millisecond)
+			}
+		})
+		It("then hedged request result taken and slow one canceled", func() {
+			var res fetchResult
+			Eventually(results).Should(Receive(&res))
+			Expect(res.err).NotTo(HaveOccurred())
+			Expect(res.img.src()).To(Equal("data:image/png;base64,"))
+			Eventually(canceled).Should(BeClosed())
+			Expect(atomic.LoadInt32(&calls)).To(BeEquivalentTo(2))
+		})
+	})
+	Context("when no latency samples", func() {
+		It("then no hedged request", func() {
+			Consistently(results, "50ms").ShouldNot(Receive())
+			Expect(atomic.LoadInt32(&calls)).To(BeEquivalentTo(1))
+		})
+	})
+})
+
+var _ = Describe("latency tracker", func() {
+	It("then percentile of recent samples", func() {
+		tracker := &latencyTracker{}
+		for i := 1; i <= 100; i++ {
+			tracker.add(time.Duration(i) * time.Millisecond)
+		}
+		p, ok := tracker.percentile(0.95)
+		Expect(ok).To(BeTrue())
+		Expect(p).To(Equal(96 * time.Millisecond))
+	})
+})
@@ -0,0 +1,187 @@
+package imgserver
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+// Client hint headers responses vary on.
+const ClientHintsHeaders = "Save-Data, DPR, Width"
+
+// JPEG quality of images recompressed for Save-Data clients.
+const saveDataJPEGQuality = 40
+
+// Bandwidth and display hints of client, from Save-Data, DPR and Width headers and lowdata param.
+type clientHints struct {
+	SaveData bool
+	DPR      float64 // device pixel ratio, 0 if unknown
+	Width    int     // wanted image width in physical pixels, 0 if unknown
+}
+
+func parseClientHints(req *http.Request) (clientHints, error) {
+	var hints clientHints
+	hints.SaveData = strings.EqualFold(strings.TrimSpace(req.Header.Get("Save-Data")), "on")
+	if param := req.URL.Query().Get("lowdata"); param != "" {
+		lowData, err := strconv.ParseBool(param)
+		if err != nil {
+			return hints, NewHandlerError(400, "invalid 'lowdata' query parameter: "+param)
+		}
+		hints.SaveData = hints.SaveData || lowData
+	}
+	// invalid hint headers are ignored, as browsers do with hints they don't understand
+	if dpr, err := strconv.ParseFloat(strings.TrimSpace(req.Header.Get("DPR")), 64); err == nil && dpr > 0 {
+		hints.DPR = dpr
+	}
+	if width, err := strconv.Atoi(strings.TrimSpace(req.Header.Get("Width"))); err == nil && width > 0 {
+		hints.Width = width
+	}
+	return hints, nil
+}
+
+func (h clientHints) isZero() bool {
+	return h == clientHints{}
+}
+
+func (h clientHints) String() string {
+	return fmt.Sprintf("save-data=%v dpr=%v width=%v", h.SaveData, h.DPR, h.Width)
+}
+
+func setClientHints(ctx context.Context, hints clientHints) context.Context {
+	return context.WithValue(ctx, ctxClientHintsKey, hints)
+}
+
+// returns zero hints if not set
+func getClientHints(ctx context.Context) clientHints {
+	hints, _ := ctx.Value(ctxClientHintsKey).(clientHints)
+	return hints
+}
+
+type srcsetCandidate struct {
+	url   string
+	width int     // w descriptor, 0 if density descriptor used
+	x     float64 // density descriptor
+}
+
+func parseSrcset(srcset string) []srcsetCandidate {
+	var res []srcsetCandidate
+	for _, item := range strings.Split(srcset, ",") {
+		fields := strings.Fields(item)
+		if len(fields) == 0 {
+			continue
+		}
+		candidate := srcsetCandidate{url: fields[0], x: 1}
+		if len(fields) > 1 {
+			descriptor := fields[1]
+			value := descriptor[:len(descriptor)-1]
+			switch descriptor[len(descriptor)-1] {
+			case 'w':
+				width, err := strconv.Atoi(value)
+				if err != nil || width <= 0 {
+					continue
+				}
+				candidate.width = width
+			case 'x':
+				x, err := strconv.ParseFloat(value, 64)
+				if err != nil || x <= 0 {
+					continue
+				}
+				candidate.x = x
+			default:
+				continue
+			}
+		}
+		res = append(res, candidate)
+	}
+	return res
+}
+
+// Returns img without srcset, and src candidate best matching hints.
+// Smallest candidate, that is not smaller than wanted, is chosen; smallest one for Save-Data clients,
+// when wanted size is unknown. Img src is returned if there is no hints or srcset.
+func chooseSrc(img imgTag, hints clientHints) (imgTag, string) {
+	srcset := ""
+	res := imgTag{-1, make([]html.Attribute, 0, len(img.attr)), nil}
+	for i, attr := range img.attr {
+		if attr.Key == "srcset" {
+			srcset = attr.Val
+			continue
+		}
+		if i == img.srcIndex {
+			res.srcIndex = len(res.attr)
+		}
+		res.attr = append(res.attr, attr)
+	}
+	candidates := parseSrcset(srcset)
+	if hints.isZero() || len(candidates) == 0 {
+		return res, res.src()
+	}
+	size := func(c srcsetCandidate) float64 {
+		if c.width > 0 {
+			return float64(c.width)
+		}
+		return c.x
+	}
+	// descriptors of different kinds are not comparable, so only kind of first candidate is used
+	widthDescriptors := candidates[0].width > 0
+	filtered := candidates[:0]
+	for _, c := range candidates {
+		if (c.width > 0) == widthDescriptors {
+			filtered = append(filtered, c)
+		}
+	}
+	candidates = filtered
+	sort.Slice(candidates, func(i, j int) bool { return size(candidates[i]) < size(candidates[j]) })
+	var wanted float64
+	if widthDescriptors {
+		wanted = float64(hints.Width)
+	} else if !hints.SaveData {
+		wanted = hints.DPR
+	}
+	if wanted == 0 {
+		if !hints.SaveData {
+			return res, res.src()
+		}
+		return res, candidates[0].url
+	}
+	for _, c := range candidates {
+		if size(c) >= wanted {
+			return res, c.url
+		}
+	}
+	return res, candidates[len(candidates)-1].url
+}
+
+// Recompresses JPEG images for Save-Data clients. Returns data as is, if recompressed is not smaller.
+// ICC profile of image is embedded in recompressed one, so its colors don't shift.
+// CMYK images are not recompressed, as they can't be converted to RGB without color management.
+func recompressImage(ctx context.Context, contentType string, data []byte) []byte {
+	if !getClientHints(ctx).SaveData || !strings.HasPrefix(contentType, "image/jpeg") {
+		return data
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		getLocalLogger(ctx, "recompressImage").Debug("image decode error: ", err)
+		return data
+	}
+	if _, ok := img.(*image.CMYK); ok {
+		return data
+	}
+	buf := &bytes.Buffer{}
+	if err := jpeg.Encode(buf, img, &jpeg.Options{Quality: saveDataJPEGQuality}); err != nil {
+		return data
+	}
+	res := embedJPEGSegments(buf.Bytes(), jpegICCSegments(data))
+	if len(res) >= len(data) {
+		return data
+	}
+	return res
+}
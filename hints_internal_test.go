@@ -0,0 +1,64 @@
+package imgserver
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+var _ = Describe("client hints", func() {
+	img := func(srcset string) imgTag {
+		return imgTag{0, []html.Attribute{{Key: "src", Val: "default.png"}, {Key: "srcset", Val: srcset}, {Key: "alt", Val: "a"}}, nil}
+	}
+	It("then hints parsed", func() {
+		req := httptest.NewRequest("GET", "/?url=http://example.com&lowdata=1", nil)
+		req.Header.Set("DPR", "2")
+		req.Header.Set("Width", "invalid")
+		hints, err := parseClientHints(req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(hints).To(Equal(clientHints{SaveData: true, DPR: 2}))
+
+		req = httptest.NewRequest("GET", "/?url=http://example.com&lowdata=maybe", nil)
+		_, err = parseClientHints(req)
+		Expect(err).To(HaveOccurred())
+	})
+	It("then srcset dropped and src used without hints", func() {
+		res, src := chooseSrc(img("small.png 1x, big.png 2x"), clientHints{})
+		Expect(src).To(Equal("default.png"))
+		Expect(res.attr).To(Equal([]html.Attribute{{Key: "src", Val: "default.png"}, {Key: "alt", Val: "a"}}))
+	})
+	It("then density candidate chosen by DPR", func() {
+		_, src := chooseSrc(img("big.png 3x, small.png, medium.png 2x"), clientHints{DPR: 1.5})
+		Expect(src).To(Equal("medium.png"))
+		_, src = chooseSrc(img("big.png 3x, small.png"), clientHints{DPR: 4})
+		Expect(src).To(Equal("big.png"))
+		_, src = chooseSrc(img("big.png 3x, small.png"), clientHints{DPR: 3, SaveData: true})
+		Expect(src).To(Equal("small.png"))
+	})
+	It("then width candidate chosen by Width", func() {
+		_, src := chooseSrc(img("a.png 400w, b.png 800w, c.png 1600w"), clientHints{Width: 500})
+		Expect(src).To(Equal("b.png"))
+		_, src = chooseSrc(img("b.png 800w, a.png 400w"), clientHints{SaveData: true})
+		Expect(src).To(Equal("a.png"))
+	})
+	It("then JPEG recompressed for Save-Data clients", func() {
+		picture := image.NewRGBA(image.Rect(0, 0, 64, 64))
+		for i := range picture.Pix {
+			picture.Pix[i] = byte(i * 7)
+		}
+		buf := &bytes.Buffer{}
+		Expect(jpeg.Encode(buf, picture, &jpeg.Options{Quality: 100})).To(Succeed())
+		data := buf.Bytes()
+
+		Expect(recompressImage(context.Background(), "image/jpeg", data)).To(Equal(data))
+		ctx := setClientHints(context.Background(), clientHints{SaveData: true})
+		Expect(len(recompressImage(ctx, "image/jpeg", data))).To(BeNumerically("<", len(data)))
+		Expect(recompressImage(ctx, "image/png", data)).To(Equal(data))
+	})
+})
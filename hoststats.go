@@ -0,0 +1,191 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	AdminOriginsPath = "/admin/origins"
+	AdminMetricsPath = "/admin/metrics"
+)
+
+// Host stats of requests to not tracked hosts are counted to, when max hosts reached.
+const otherHosts = "other"
+
+// Outbound request totals of single origin host.
+type HostStat struct {
+	Host     string  `json:"host"`
+	Requests int64   `json:"requests"`
+	Errors   int64   `json:"errors"` // failed requests and error status responses
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration_ms"` // total
+}
+
+func (s HostStat) ErrorRate() float64 {
+	if s.Requests == 0 {
+		return 0
+	}
+	return float64(s.Errors) / float64(s.Requests)
+}
+
+// Audit sink aggregating outbound requests per remote host.
+type HostStats struct {
+	MaxHosts int // tracked hosts, no limit if 0
+
+	mu    sync.Mutex
+	hosts map[string]*HostStat
+}
+
+func NewHostStats(maxHosts int) *HostStats {
+	return &HostStats{MaxHosts: maxHosts, hosts: make(map[string]*HostStat)}
+}
+
+func (s *HostStats) Record(rec AuditRecord) {
+	host := otherHosts
+	if u, err := url.Parse(rec.URL); err == nil && u.Host != "" {
+		host = u.Hostname()
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stat, ok := s.hosts[host]
+	if !ok {
+		if s.MaxHosts > 0 && len(s.hosts) >= s.MaxHosts {
+			host = otherHosts
+			stat = s.hosts[host]
+		}
+		if stat == nil {
+			stat = &HostStat{Host: host}
+			s.hosts[host] = stat
+		}
+	}
+	stat.Requests++
+	if rec.Error != "" || rec.Status >= 400 {
+		stat.Errors++
+	}
+	stat.Bytes += rec.Bytes
+	stat.Duration += rec.Duration
+}
+
+// Returns host stats ordered by "requests", "bytes", "errors", "error_rate" or "duration" descending,
+// and by host name on ties. At most top stats are returned, all if top is 0.
+func (s *HostStats) Top(order string, top int) ([]HostStat, error) {
+	var key func(HostStat) float64
+	switch order {
+	case "requests", "":
+		key = func(s HostStat) float64 { return float64(s.Requests) }
+	case "bytes":
+		key = func(s HostStat) float64 { return float64(s.Bytes) }
+	case "errors":
+		key = func(s HostStat) float64 { return float64(s.Errors) }
+	case "error_rate":
+		key = HostStat.ErrorRate
+	case "duration":
+		key = func(s HostStat) float64 { return s.Duration }
+	default:
+		return nil, fmt.Errorf("unsupported order: %v", order)
+	}
+	s.mu.Lock()
+	res := make([]HostStat, 0, len(s.hosts))
+	for _, stat := range s.hosts {
+		res = append(res, *stat)
+	}
+	s.mu.Unlock()
+	sort.Slice(res, func(i, j int) bool {
+		if ki, kj := key(res[i]), key(res[j]); ki != kj {
+			return ki > kj
+		}
+		return res[i].Host < res[j].Host
+	})
+	if top > 0 && len(res) > top {
+		res = res[:top]
+	}
+	return res, nil
+}
+
+// Admin API of host stats:
+// GET AdminOriginsPath?order=<order>&top=<n> returns top origins JSON report,
+// GET AdminMetricsPath returns stats in Prometheus text format.
+type HostStatsAdminHandler struct {
+	Log   Logger
+	Stats *HostStats
+	Token string // admin endpoints are disabled if empty
+}
+
+func (h HostStatsAdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	log := SetEmitter(h.Log, "HostStatsAdminHandler")
+	if h.Token == "" || !checkBearerToken(req, h.Token) {
+		writeResponse(log, w, req, NewErrorResponse(http.StatusUnauthorized, "invalid admin token"))
+		return
+	}
+	if !(req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := NewResponse()
+	resp.StatusCode = http.StatusOK
+	if req.URL.Path == AdminMetricsPath {
+		stats, _ := h.Stats.Top("", 0)
+		resp.Header.Set("Content-Type", "text/plain; version=0.0.4")
+		writeHostMetrics(resp.Body, stats)
+		writeGoroutineMetrics(resp.Body, goroutines)
+		writeRequestMetrics(resp.Body, requestDurations)
+		writeWatchdogMetrics(resp.Body)
+		writeResponse(log, w, req, resp)
+		return
+	}
+	top := 0
+	if param := req.URL.Query().Get("top"); param != "" {
+		var err error
+		if top, err = strconv.Atoi(param); err != nil || top < 0 {
+			writeResponse(log, w, req, NewErrorResponse(400, "invalid top: "+param))
+			return
+		}
+	}
+	stats, err := h.Stats.Top(req.URL.Query().Get("order"), top)
+	if err != nil {
+		writeResponse(log, w, req, NewErrorResponse(400, err.Error()))
+		return
+	}
+	type originReport struct {
+		HostStat
+		ErrorRate float64 `json:"error_rate"`
+	}
+	report := make([]originReport, len(stats))
+	for i, stat := range stats {
+		report[i] = originReport{stat, stat.ErrorRate()}
+	}
+	resp.Header.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp.Body).Encode(report); err != nil {
+		resp = NewInternalErrorResponse()
+	}
+	writeResponse(log, w, req, resp)
+}
+
+func writeHostMetrics(w io.Writer, stats []HostStat) {
+	metrics := []struct {
+		name, help string
+		value      func(HostStat) string
+	}{
+		{"imgserver_origin_requests_total", "Outbound requests by origin host.",
+			func(s HostStat) string { return strconv.FormatInt(s.Requests, 10) }},
+		{"imgserver_origin_errors_total", "Failed outbound requests and error status responses by origin host.",
+			func(s HostStat) string { return strconv.FormatInt(s.Errors, 10) }},
+		{"imgserver_origin_bytes_total", "Response body bytes read by origin host.",
+			func(s HostStat) string { return strconv.FormatInt(s.Bytes, 10) }},
+		{"imgserver_origin_duration_seconds_total", "Outbound request duration by origin host.",
+			func(s HostStat) string { return strconv.FormatFloat(s.Duration/1000, 'g', -1, 64) }},
+	}
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", m.name, m.help, m.name)
+		for _, s := range stats {
+			fmt.Fprintf(w, "%s{host=%q} %s\n", m.name, s.Host, m.value(s))
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("host stats", func() {
+	var stats *HostStats
+	BeforeEach(func() {
+		stats = NewHostStats(2)
+		stats.Record(AuditRecord{URL: "http://a.com/1.png", Status: 200, Bytes: 100, Duration: 10})
+		stats.Record(AuditRecord{URL: "http://a.com:8080/2.png", Status: 404, Bytes: 10, Duration: 5})
+		stats.Record(AuditRecord{URL: "http://b.com/1.png", Error: "timeout", Duration: 1000})
+		stats.Record(AuditRecord{URL: "http://c.com/1.png", Status: 200, Bytes: 1000})
+	})
+
+	It("then requests aggregated per host", func() {
+		top, err := stats.Top("", 0)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(top).To(Equal([]HostStat{
+			{Host: "a.com", Requests: 2, Errors: 1, Bytes: 110, Duration: 15},
+			{Host: "b.com", Requests: 1, Errors: 1, Duration: 1000},
+			{Host: otherHosts, Requests: 1, Bytes: 1000},
+		}))
+		top, _ = stats.Top("error_rate", 1)
+		Expect(top[0].Host).To(Equal("b.com"))
+	})
+	It("then hosts over max counted as other", func() {
+		stats.Record(AuditRecord{URL: "http://d.com/1.png", Status: 200, Bytes: 1})
+		top, _ := stats.Top("bytes", 0)
+		Expect(top).To(HaveLen(3))
+		Expect(top[0]).To(Equal(HostStat{Host: otherHosts, Requests: 2, Bytes: 1001}))
+	})
+
+	Context("admin handler", func() {
+		admin := func(path, token string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", path, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			rec := httptest.NewRecorder()
+			HostStatsAdminHandler{logger.StandardLogger(), stats, "admintoken"}.ServeHTTP(rec, req)
+			return rec
+		}
+		It("then top origins reported", func() {
+			rec := admin(AdminOriginsPath+"?order=duration&top=1", "admintoken")
+			Expect(rec.Code).To(Equal(200))
+			var report []map[string]interface{}
+			Expect(json.Unmarshal(rec.Body.Bytes(), &report)).To(Succeed())
+			Expect(report).To(HaveLen(1))
+			Expect(report[0]["host"]).To(Equal("b.com"))
+			Expect(report[0]["error_rate"]).To(Equal(1.0))
+		})
+		It("then metrics served", func() {
+			rec := admin(AdminMetricsPath, "admintoken")
+			Expect(rec.Code).To(Equal(200))
+			Expect(rec.Body.String()).To(ContainSubstring(`imgserver_origin_requests_total{host="a.com"} 2` + "\n"))
+			Expect(rec.Body.String()).To(ContainSubstring(`imgserver_origin_duration_seconds_total{host="b.com"} 1` + "\n"))
+		})
+		It("then invalid requests rejected", func() {
+			Expect(admin(AdminOriginsPath, "wrong").Code).To(Equal(http.StatusUnauthorized))
+			Expect(admin(AdminOriginsPath+"?order=name", "admintoken").Code).To(Equal(400))
+		})
+	})
+})
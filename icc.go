@@ -0,0 +1,63 @@
+package imgserver
+
+import "bytes"
+
+// JPEG markers of ICC profile segments scan.
+const (
+	jpegSOI  = 0xD8
+	jpegSOS  = 0xDA
+	jpegEOI  = 0xD9
+	jpegAPP2 = 0xE2
+)
+
+var iccProfileID = []byte("ICC_PROFILE\x00")
+
+// Returns APP2 segments with ICC profile chunks of JPEG data, with their markers, in order.
+// Re-encoded images lose them, and then colors of not sRGB images shift.
+func jpegICCSegments(data []byte) [][]byte {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != jpegSOI {
+		return nil
+	}
+	var res [][]byte
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return res
+		}
+		marker := data[i+1]
+		if marker == 0xFF {
+			// fill byte
+			i++
+			continue
+		}
+		if marker == jpegSOS || marker == jpegEOI {
+			// profile segments are before scan data
+			return res
+		}
+		end := i + 2 + int(data[i+2])<<8 | int(data[i+3])
+		if end > len(data) || end < i+4 {
+			return res
+		}
+		if marker == jpegAPP2 && bytes.HasPrefix(data[i+4:end], iccProfileID) {
+			res = append(res, data[i:end])
+		}
+		i = end
+	}
+	return res
+}
+
+// Returns JPEG data with segments inserted after SOI marker.
+func embedJPEGSegments(data []byte, segments [][]byte) []byte {
+	if len(segments) == 0 || len(data) < 2 {
+		return data
+	}
+	size := len(data)
+	for _, segment := range segments {
+		size += len(segment)
+	}
+	res := make([]byte, 0, size)
+	res = append(res, data[:2]...)
+	for _, segment := range segments {
+		res = append(res, segment...)
+	}
+	return append(res, data[2:]...)
+}
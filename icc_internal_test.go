@@ -0,0 +1,41 @@
+package imgserver
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("ICC profiles", func() {
+	encode := func(picture image.Image) []byte {
+		buf := &bytes.Buffer{}
+		Expect(jpeg.Encode(buf, picture, &jpeg.Options{Quality: 100})).To(Succeed())
+		return buf.Bytes()
+	}
+	profile := append([]byte{0xFF, jpegAPP2, 0, 2 + byte(len(iccProfileID)) + 4}, iccProfileID...)
+	profile = append(profile, 1, 1, 'P', '3')
+	ctx := setClientHints(context.Background(), clientHints{SaveData: true})
+
+	It("then profile embedded in recompressed image", func() {
+		picture := image.NewRGBA(image.Rect(0, 0, 64, 64))
+		for i := range picture.Pix {
+			picture.Pix[i] = byte(i * 7)
+		}
+		data := embedJPEGSegments(encode(picture), [][]byte{profile})
+		Expect(jpegICCSegments(data)).To(Equal([][]byte{profile}))
+
+		res := recompressImage(ctx, "image/jpeg", data)
+		Expect(len(res)).To(BeNumerically("<", len(data)))
+		Expect(jpegICCSegments(res)).To(Equal([][]byte{profile}))
+		_, err := jpeg.Decode(bytes.NewReader(res))
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("then image without profile has no segments", func() {
+		Expect(jpegICCSegments(encode(image.NewGray(image.Rect(0, 0, 8, 8))))).To(BeEmpty())
+		Expect(jpegICCSegments([]byte("GIF89a"))).To(BeEmpty())
+	})
+})
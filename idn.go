@@ -0,0 +1,61 @@
+package imgserver
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// Converts internationalized URL to ASCII one, that validator accepts and origins expect:
+// unicode host is converted to punycode, and non-ASCII path, query and fragment are percent-encoded.
+// ASCII URLs are returned as is.
+func asciiURL(rawURL string) (string, error) {
+	if isASCII(rawURL) {
+		return rawURL, nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	if host := u.Hostname(); !isASCII(host) {
+		ascii, err := idna.ToASCII(strings.ToLower(host))
+		if err != nil {
+			return "", fmt.Errorf("invalid internationalized host %q: %v", host, err)
+		}
+		if port := u.Port(); port != "" {
+			ascii += ":" + port
+		}
+		u.Host = ascii
+	}
+	// escaped path and fragment of String are ASCII already
+	u.RawQuery = escapeNonASCII(u.RawQuery)
+	return u.String(), nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// percent-encodes non-ASCII bytes, keeping others as is
+func escapeNonASCII(s string) string {
+	if isASCII(s) {
+		return s
+	}
+	const hex = "0123456789ABCDEF"
+	res := make([]byte, 0, len(s)*3)
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c >= 0x80 {
+			res = append(res, '%', hex[c>>4], hex[c&15])
+		} else {
+			res = append(res, c)
+		}
+	}
+	return string(res)
+}
@@ -0,0 +1,247 @@
+package imgserver
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Caches fetched images by canonical URL across page requests, with their ETag and Last-Modified.
+// Stale images are served, while single background refresh revalidates them by conditional GET,
+// so long running servers don't serve outdated images forever. Images failing revalidation are dropped.
+// Images fetched with origin auth, or recompressed for Save-Data clients, are not cached.
+type ImageCache struct {
+	TTL            time.Duration // freshness of images, before revalidation
+	MaxEntries     int
+	RefreshTimeout time.Duration // of background revalidation, no timeout if 0
+
+	mu         sync.Mutex
+	entries    map[string]imageCacheEntry
+	refreshing map[string]bool
+}
+
+type imageCacheEntry struct {
+	contentType string
+	data        []byte
+	validators  imageValidators
+	expires     time.Time
+}
+
+// Validators of fetched image response. Set by fetcher, if ctx has them.
+type imageValidators struct {
+	etag         string
+	lastModified string
+}
+
+func setImageValidators(ctx context.Context, validators *imageValidators) context.Context {
+	return context.WithValue(ctx, ctxImageValidatorsKey, validators)
+}
+
+// returns nil if validators are not needed
+func getImageValidators(ctx context.Context) *imageValidators {
+	validators, _ := ctx.Value(ctxImageValidatorsKey).(*imageValidators)
+	return validators
+}
+
+// does nothing for nil validators
+func (v *imageValidators) set(header http.Header) {
+	if v != nil {
+		v.etag, v.lastModified = header.Get("ETag"), header.Get("Last-Modified")
+	}
+}
+
+func NewImageCache(ttl time.Duration, maxEntries int) *ImageCache {
+	return &ImageCache{
+		TTL:            ttl,
+		MaxEntries:     maxEntries,
+		RefreshTimeout: time.Minute,
+		entries:        make(map[string]imageCacheEntry),
+		refreshing:     make(map[string]bool),
+	}
+}
+
+// Returns cached image. Refresh is true if image is stale, and caller should revalidate it;
+// revalidation of image is started only once until refreshed.
+func (c *ImageCache) get(imgURL string) (entry imageCacheEntry, ok bool, refresh bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok = c.entries[imgURL]
+	if ok && time.Now().After(entry.expires) {
+		refresh = !c.refreshing[imgURL]
+		c.refreshing[imgURL] = true
+	}
+	return entry, ok, refresh
+}
+
+func (c *ImageCache) put(imgURL string, entry imageCacheEntry) {
+	entry.expires = time.Now().Add(c.TTL)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.refreshing, imgURL)
+	if _, ok := c.entries[imgURL]; !ok && c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries {
+		c.evict()
+	}
+	c.entries[imgURL] = entry
+}
+
+// drops image failed revalidation
+func (c *ImageCache) drop(imgURL string) {
+	c.mu.Lock()
+	delete(c.entries, imgURL)
+	delete(c.refreshing, imgURL)
+	c.mu.Unlock()
+}
+
+// removes entry expiring first
+func (c *ImageCache) evict() {
+	oldest := ""
+	for key, entry := range c.entries {
+		if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+			oldest = key
+		}
+	}
+	delete(c.entries, oldest)
+}
+
+// imageFetcher decorator, that serves images from cache.
+type cachingImageFetcher struct {
+	fetcher imageFetcher
+	cache   *ImageCache
+}
+
+func (f cachingImageFetcher) fetchImage(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+	if getOriginAuth(ctx) != nil || getClientHints(ctx).SaveData {
+		f.fetcher.fetchImage(ctx, img, imgURL, result)
+		return
+	}
+	done := goroutines.start(goroutineFetch)
+	go func() {
+		defer done()
+		key := getCanonicalizer(ctx).canonicalString(imgURL)
+		entry, ok, refresh := f.cache.get(key)
+		if refresh {
+			done := goroutines.start(goroutineFetch)
+			go func() {
+				defer done()
+				f.revalidate(ctx, key, imgURL, entry)
+			}()
+		}
+		if ok {
+			result(cachedImage(ctx, img, imgURL, entry))
+			return
+		}
+		// cached data is raw
+		validators := &imageValidators{}
+		f.fetcher.fetchImage(setImageValidators(setRawImages(ctx), validators), img, imgURL, func(res imgTag, err error) {
+			if err != nil {
+				result(imgTag{}, err)
+				return
+			}
+			if res.raw != nil {
+				f.cache.put(key, imageCacheEntry{contentType: res.raw.contentType, data: res.raw.data, validators: *validators})
+				if !isRawImages(ctx) {
+					res = res.withSrc(encodeDataURL(res.raw.contentType, res.raw.data))
+					if debug := getDebugImage(ctx); debug != nil {
+						debug.EncodedBytes = len(res.src())
+					}
+				}
+			}
+			result(res, nil)
+		})
+	}()
+}
+
+// Returns cached image, with size limits of request applied.
+func cachedImage(ctx context.Context, img imgTag, imgURL string, entry imageCacheEntry) (imgTag, error) {
+	opts := getFetchOptions(ctx)
+	debug := getDebugImage(ctx)
+	size := int64(len(entry.data))
+	if opts.MaxImageSize > 0 && size > opts.MaxImageSize {
+		return imgTag{}, NewHandlerError(400, "image is bigger than max image size: "+imgURL)
+	}
+	if debug != nil {
+		debug.ContentType, debug.FetchedBytes = entry.contentType, len(entry.data)
+	}
+	if opts.InlineThreshold > 0 && size > opts.InlineThreshold {
+		debug.set(outcomeLinked, "over inline threshold")
+		return img.withSrc(imgURL), nil
+	}
+	debug.set(outcomeInlined, "cached")
+	if isRawImages(ctx) {
+		if debug != nil {
+			debug.EncodedBytes = len(entry.data)
+		}
+		return img.withRaw(imgURL, entry.contentType, entry.data), nil
+	}
+	res := img.withSrc(encodeDataURL(entry.contentType, entry.data))
+	if debug != nil {
+		debug.EncodedBytes = len(res.src())
+	}
+	return res, nil
+}
+
+// Revalidates stale image by conditional GET, with ctx values, but not its cancellation.
+func (f cachingImageFetcher) revalidate(ctx context.Context, key string, imgURL string, entry imageCacheEntry) {
+	log := getLocalLogger(ctx, "imageCache").WithField("url", imgURL)
+	ctx = detachedContext{ctx}
+	if f.cache.RefreshTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, f.cache.RefreshTimeout)
+		defer cancel()
+	}
+	req, err := newImageRequest(ctx, imgURL)
+	if err != nil {
+		f.cache.drop(key)
+		return
+	}
+	if entry.validators.etag != "" {
+		req.Header.Set("If-None-Match", entry.validators.etag)
+	}
+	if entry.validators.lastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.validators.lastModified)
+	}
+	resp, err := cxtAwareDo(ctx, req)
+	if err != nil {
+		log.Warn("image revalidation error: ", err)
+		f.cache.drop(key)
+		return
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		log.Debug("cached image not modified")
+		f.cache.put(key, entry)
+	case http.StatusOK:
+		buf, err := readImageBuffer(resp, imgURL, 0)
+		if err != nil {
+			f.cache.drop(key)
+			return
+		}
+		// cached data is referenced by results, so buffer is not reused
+		data := buf.Bytes()
+		contentType, err := sniffImage(imgURL, resp.Header.Get("Content-Type"), data)
+		if err != nil {
+			log.Warn("image revalidation error: ", err)
+			f.cache.drop(key)
+			return
+		}
+		log.Debug("cached image modified")
+		entry = imageCacheEntry{contentType: contentType, data: data}
+		entry.validators.set(resp.Header)
+		f.cache.put(key, entry)
+	default:
+		log.WithField("status", resp.StatusCode).Info("cached image dropped on revalidation")
+		f.cache.drop(key)
+	}
+}
+
+// Enables image cache. Should be enabled after coalescing, so only cache misses are coalesced.
+func (h *ImgLogicHandler) EnableImageCache(cache *ImageCache) {
+	if extractor, ok := h.imgExtractor.(imgExtractorImp); ok {
+		extractor.fetcher = cachingImageFetcher{extractor.fetcher, cache}
+		h.imgExtractor = extractor
+		h.enabled = append(h.enabled, "image_cache")
+	}
+}
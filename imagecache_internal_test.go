@@ -0,0 +1,117 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+var _ = Describe("image cache", func() {
+	var (
+		origin      *httptest.Server
+		mu          sync.Mutex
+		body, etag  string
+		status      int
+		requests    int32
+		conditional int32 // requests with If-None-Match
+		cache       *ImageCache
+		fetcher     imageFetcher
+	)
+	BeforeEach(func() {
+		body, etag, status, requests, conditional = "GIF89a-v1", `"v1"`, http.StatusOK, 0, 0
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			mu.Lock()
+			defer mu.Unlock()
+			if match := req.Header.Get("If-None-Match"); match != "" {
+				atomic.AddInt32(&conditional, 1)
+				if match == etag && status == http.StatusOK {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+			}
+			if status != http.StatusOK {
+				w.WriteHeader(status)
+				return
+			}
+			w.Header().Set("Content-Type", "image/gif")
+			w.Header().Set("ETag", etag)
+			w.Write([]byte(body))
+		}))
+		cache = NewImageCache(time.Hour, 10)
+		fetcher = cachingImageFetcher{backoffImageFetcher{&sync.Mutex{}, nil}, cache}
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	fetch := func() imgTag {
+		ctx := context.WithValue(setLogger(context.Background(), log.StandardLogger()), CtxHTTPClientKey, http.DefaultClient)
+		ctx = setRawImages(ctx)
+		res := <-startFetch(ctx, fetcher, imgTag{0, []html.Attribute{{Key: "src", Val: "a.gif"}}, nil}, origin.URL+"/a.gif")
+		Expect(res.err).NotTo(HaveOccurred())
+		return res.img
+	}
+	expire := func() {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		for key, entry := range cache.entries {
+			entry.expires = time.Now().Add(-time.Second)
+			cache.entries[key] = entry
+		}
+	}
+	cached := func() string {
+		cache.mu.Lock()
+		defer cache.mu.Unlock()
+		return string(cache.entries[origin.URL+"/a.gif"].data)
+	}
+
+	It("then fresh image is served from cache", func() {
+		Expect(string(fetch().raw.data)).To(Equal("GIF89a-v1"))
+		Expect(string(fetch().raw.data)).To(Equal("GIF89a-v1"))
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(1))
+		Expect(cache.entries[origin.URL+"/a.gif"].validators.etag).To(Equal(`"v1"`))
+	})
+	It("then not modified stale image is kept", func() {
+		fetch()
+		expire()
+		Expect(string(fetch().raw.data)).To(Equal("GIF89a-v1"))
+		Eventually(func() int32 { return atomic.LoadInt32(&conditional) }).Should(BeEquivalentTo(1))
+		Eventually(func() bool {
+			_, _, refresh := cache.get(origin.URL + "/a.gif")
+			return refresh
+		}).Should(BeFalse())
+		fetch()
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(2))
+	})
+	It("then modified stale image is replaced", func() {
+		fetch()
+		mu.Lock()
+		body, etag = "GIF89a-v2", `"v2"`
+		mu.Unlock()
+		expire()
+		Expect(string(fetch().raw.data)).To(Equal("GIF89a-v1"))
+		Eventually(cached).Should(Equal("GIF89a-v2"))
+		Expect(string(fetch().raw.data)).To(Equal("GIF89a-v2"))
+	})
+	It("then image failed revalidation is dropped", func() {
+		fetch()
+		mu.Lock()
+		status = http.StatusNotFound
+		mu.Unlock()
+		expire()
+		fetch()
+		Eventually(func() int {
+			cache.mu.Lock()
+			defer cache.mu.Unlock()
+			return len(cache.entries)
+		}).Should(Equal(0))
+	})
+})
@@ -0,0 +1,188 @@
+package imgserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+const ImagesPath = "/" + APIVersion + "/images"
+
+// Two step image access: ImagesPath?url= responds with JSON index of page images
+// by stable IDs without fetching them, and ImagesPath/<id>?url= responds with single indexed image as is.
+// Fetch options params and client hints are applied like on inline requests.
+type ImageIndexLogicHandler struct {
+	Handler *ImgLogicHandler
+}
+
+type indexedImage struct {
+	ID         string            `json:"id"`
+	URL        string            `json:"url"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+
+	img imgTag
+}
+
+type imageIndex struct {
+	URL    string          `json:"url"`
+	Count  int             `json:"count"`
+	Images []*indexedImage `json:"images"` // in document order
+}
+
+// Returns stable ID of image: prefix of resolved image URL hash.
+func imageID(imgURL string) string {
+	sum := sha256.Sum256([]byte(imgURL))
+	return hex.EncodeToString(sum[:8])
+}
+
+func (h ImageIndexLogicHandler) HandleLogic(ctx context.Context, req *http.Request) (*Response, error) {
+	id := ""
+	if req.URL.Path != ImagesPath {
+		id = strings.TrimPrefix(req.URL.Path, ImagesPath+"/")
+		if id == req.URL.Path || id == "" || strings.Contains(id, "/") {
+			return nil, NewHandlerError(http.StatusNotFound, "not found")
+		}
+	}
+	urlParam, err := extractURLParam(req.URL)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.Handler.checkLocalFile(urlParam); err != nil {
+		return nil, err
+	}
+	urlParam, auth := extractOriginAuth(urlParam, req.Header.Get(OriginAuthorizationHeader))
+	urlParam = h.Handler.Canonical.fetchURL(urlParam)
+	options, maxOptions := h.Handler.Options, h.Handler.MaxOptions
+	if profile := getProfile(ctx); profile != nil {
+		if !profile.hostAllowed(urlParam.Hostname()) {
+			return nil, NewHandlerError(http.StatusForbidden, "page host is not allowed: "+urlParam.Hostname())
+		}
+		options, maxOptions = profile.Options, profile.MaxOptions
+	}
+	opts, err := parseFetchOptions(req.URL.Query(), options, maxOptions)
+	if err != nil {
+		return nil, err
+	}
+	// indexed image is returned as is, and can't be left out
+	opts.InlineThreshold = 0
+	opts.Links = false
+	opts.SkipRateLimited = false
+	hints, err := parseClientHints(req)
+	if err != nil {
+		return nil, err
+	}
+	lang, err := parseLanguage(req)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.Timeout)
+		defer cancel()
+	}
+	ctx = setFetchOptions(newImgLogicContext(ctx, h.Handler.client, urlParam), opts)
+	ctx = setOriginAuth(ctx, auth)
+	ctx = setClientHints(ctx, hints)
+	ctx = setLanguage(ctx, lang)
+	ctx = setImageAccept(ctx, h.Handler.ImageAccept)
+	ctx = setParseLimits(ctx, h.Handler.ParseLimits)
+	ctx = setCanonicalizer(ctx, h.Handler.Canonical)
+	ctx = setSanitizePolicy(ctx, h.Handler.Sanitizer)
+	if h.Handler.HTTPFallback && isSchemeless(req.URL.Query().Get("url")) {
+		ctx = setHTTPFallback(ctx)
+	}
+	ctx = setRawImages(ctx)
+	index, err := h.index(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		resp := NewResponse()
+		resp.StatusCode = http.StatusOK
+		resp.Header.Set("Content-Type", "application/json")
+		resp.Header.Set("Vary", responseVary(ctx))
+		resp.Header.Set("Accept-CH", ClientHintsHeaders)
+		err := json.NewEncoder(resp.Body).Encode(index)
+		return resp, err
+	}
+	for _, image := range index.Images {
+		if image.ID == id {
+			return h.imageResponse(ctx, image)
+		}
+	}
+	return nil, NewHandlerError(http.StatusNotFound, "page has no image "+id)
+}
+
+// Parses page images of ctx URL param. Images with data URLs have nothing to fetch, and
+// images with invalid URLs can't be fetched, so they are not indexed. Repeated images are indexed once.
+func (h ImageIndexLogicHandler) index(ctx context.Context) (*imageIndex, error) {
+	log := getLocalLogger(ctx, "ImageIndexLogicHandler")
+	body, _, fetchedURL, err := h.Handler.fetchPage(ctx, getFetchOptions(ctx).PageRetries)
+	if err != nil {
+		return nil, err
+	}
+	ctx = setPageURL(ctx, fetchedURL)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel() // stops parse
+	imgc, errc := h.Handler.imageParser().parseImage(ctx, body)
+	folderURL := *getFolderURL(*getPageURL(ctx))
+	hints := getClientHints(ctx)
+	res := &imageIndex{URL: getURLParam(ctx).String(), Images: []*indexedImage{}}
+	indexed := make(map[string]bool)
+	for {
+		var img imgTag
+		var ok bool
+		select {
+		case img, ok = <-imgc:
+		case err := <-errc:
+			return nil, err
+		}
+		if !ok {
+			break
+		}
+		img, src := chooseSrc(img, hints)
+		if strings.HasPrefix(src, "data:") {
+			continue
+		}
+		imgURL, err := getImgURL(src, folderURL)
+		if err != nil {
+			log.WithField("src", src).Debug("not indexed image: ", err)
+			continue
+		}
+		id := imageID(imgURL)
+		if indexed[id] {
+			continue
+		}
+		indexed[id] = true
+		image := &indexedImage{ID: id, URL: imgURL, img: img}
+		for i, attr := range img.attr {
+			if i == img.srcIndex {
+				continue
+			}
+			if image.Attributes == nil {
+				image.Attributes = make(map[string]string)
+			}
+			image.Attributes[attr.Key] = attr.Val
+		}
+		res.Images = append(res.Images, image)
+	}
+	// page is parsed to the end
+	buffers.put(body)
+	res.Count = len(res.Images)
+	return res, nil
+}
+
+func (h ImageIndexLogicHandler) imageResponse(ctx context.Context, image *indexedImage) (*Response, error) {
+	res := <-startFetch(ctx, h.Handler.imageFetcher(), image.img, image.URL)
+	if res.err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, &HandlerError{http.StatusGatewayTimeout, "timeout", res.err}
+		}
+		return nil, res.err
+	}
+	return pickedImageResponse(ctx, &extraction{images: []imgTag{res.img}, pickedURL: image.URL}, 1)
+}
@@ -0,0 +1,67 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("image index", func() {
+	var (
+		origin  *httptest.Server
+		fetched []string
+	)
+	BeforeEach(func() {
+		fetched = nil
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/":
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte(`<img src="/1.png" alt="one"><img src="data:image/gif;base64,R0lG"><img src="images/2.gif"><img src="/1.png">`))
+			default:
+				fetched = append(fetched, r.URL.Path)
+				w.Header().Set("Content-Type", "image/gif")
+				w.Write([]byte("GIF89a" + r.URL.Path))
+			}
+		}))
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	handle := func(path string) (*Response, error) {
+		req := httptest.NewRequest("GET", path+"?url="+url.QueryEscape(origin.URL+"/"), nil)
+		h := ImageIndexLogicHandler{NewImgLogicHandler(http.DefaultClient)}
+		return h.HandleLogic(setLogger(context.Background(), logger.StandardLogger()), req)
+	}
+	It("then images indexed without fetching", func() {
+		resp, err := handle(ImagesPath)
+		Expect(err).NotTo(HaveOccurred())
+		var index imageIndex
+		Expect(json.Unmarshal(resp.Body.Bytes(), &index)).To(Succeed())
+		Expect(index.Count).To(Equal(2))
+		Expect(index.Images[0].URL).To(Equal(origin.URL + "/1.png"))
+		Expect(index.Images[0].ID).To(Equal(imageID(origin.URL + "/1.png")))
+		Expect(index.Images[0].Attributes).To(Equal(map[string]string{"alt": "one"}))
+		Expect(index.Images[1].URL).To(Equal(origin.URL + "/images/2.gif"))
+		Expect(fetched).To(BeEmpty())
+	})
+	It("then indexed image returned as is", func() {
+		resp, err := handle(ImagesPath + "/" + imageID(origin.URL+"/images/2.gif"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Header.Get("Content-Type")).To(Equal("image/gif"))
+		Expect(resp.Header.Get("Content-Disposition")).To(Equal(`attachment; filename=2.gif`))
+		Expect(resp.Body.String()).To(Equal("GIF89a/images/2.gif"))
+		Expect(fetched).To(Equal([]string{"/images/2.gif"}))
+	})
+	It("then unknown id not found", func() {
+		_, err := handle(ImagesPath + "/0123456789abcdef")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusNotFound))
+	})
+})
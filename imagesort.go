@@ -0,0 +1,77 @@
+package imgserver
+
+import (
+	"sort"
+	"strings"
+)
+
+// Orders of result images by fetched metadata, set by sort query param.
+// Images without the metadata, like not inlined or not decodable ones, are last.
+// Ties are kept in document order.
+const (
+	sortPosition   = "position"   // document order
+	sortSize       = "size"       // bigger inlined data first
+	sortDimensions = "dimensions" // bigger area in pixels first
+	sortType       = "type"       // content type, alphabetically
+)
+
+var imageSorts = []string{sortPosition, sortSize, sortDimensions, sortType}
+
+// Sorts images by order key, stable. Images are in document order before.
+func sortImages(images []imgTag, order string) {
+	if order == "" || order == sortPosition {
+		return
+	}
+	keys := make([]imageSortKey, len(images))
+	for i, img := range images {
+		keys[i] = newImageSortKey(img, order)
+	}
+	sort.Stable(byImageSortKey{keys, images})
+}
+
+type imageSortKey struct {
+	known bool
+	size  int // size or area, compared descending
+	str   string
+}
+
+func newImageSortKey(img imgTag, order string) imageSortKey {
+	if !img.isInlined() {
+		return imageSortKey{}
+	}
+	contentType, data, err := img.inlineData()
+	if err != nil {
+		return imageSortKey{}
+	}
+	switch order {
+	case sortSize:
+		return imageSortKey{known: true, size: len(data)}
+	case sortDimensions:
+		width, height, ok := imageDimensions(contentType, data)
+		return imageSortKey{known: ok, size: width * height}
+	default:
+		mediaType := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+		return imageSortKey{known: mediaType != "", str: mediaType}
+	}
+}
+
+type byImageSortKey struct {
+	keys   []imageSortKey
+	images []imgTag
+}
+
+func (s byImageSortKey) Len() int { return len(s.images) }
+func (s byImageSortKey) Less(i, j int) bool {
+	a, b := s.keys[i], s.keys[j]
+	if a.known != b.known {
+		return a.known
+	}
+	if a.size != b.size {
+		return a.size > b.size
+	}
+	return a.str < b.str
+}
+func (s byImageSortKey) Swap(i, j int) {
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+	s.images[i], s.images[j] = s.images[j], s.images[i]
+}
@@ -0,0 +1,55 @@
+package imgserver
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/html"
+)
+
+var _ = Describe("image sort", func() {
+	pngOf := func(width, height int) []byte {
+		buf := &bytes.Buffer{}
+		Expect(png.Encode(buf, image.NewGray(image.Rect(0, 0, width, height)))).To(Succeed())
+		return buf.Bytes()
+	}
+	img := func(name, contentType string, data []byte) imgTag {
+		res := imgTag{0, []html.Attribute{{Key: "src", Val: name}}, nil}
+		if data == nil {
+			return res
+		}
+		return res.withRaw(name, contentType, data)
+	}
+	sorted := func(order string, images ...imgTag) []string {
+		sortImages(images, order)
+		var res []string
+		for _, img := range images {
+			res = append(res, img.src())
+		}
+		return res
+	}
+	var images []imgTag
+	BeforeEach(func() {
+		images = []imgTag{
+			img("small.png", "image/png", pngOf(1, 1)),
+			img("linked.png", "", nil),
+			img("big.gif", "image/gif", bytes.Repeat([]byte("G"), 1000)),
+			img("wide.png", "image/png", pngOf(20, 2)),
+		}
+	})
+	It("then images are sorted by size, biggest first, and not inlined are last", func() {
+		Expect(sorted(sortSize, images...)).To(Equal([]string{"big.gif", "wide.png", "small.png", "linked.png"}))
+	})
+	It("then images are sorted by area, and not decodable are last", func() {
+		Expect(sorted(sortDimensions, images...)).To(Equal([]string{"wide.png", "small.png", "linked.png", "big.gif"}))
+	})
+	It("then images are sorted by type, ties in document order", func() {
+		Expect(sorted(sortType, images...)).To(Equal([]string{"big.gif", "small.png", "wide.png", "linked.png"}))
+	})
+	It("then position sort keeps document order", func() {
+		Expect(sorted(sortPosition, images...)).To(Equal([]string{"small.png", "linked.png", "big.gif", "wide.png"}))
+	})
+})
@@ -0,0 +1,73 @@
+package imgserver
+
+import (
+	"fmt"
+	"mime"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Actions on fetched images of types, that are not inlined.
+const (
+	ExcludedImagesSkip = "skip" // images are left out of result
+	ExcludedImagesLink = "link" // images are left as absolute URL links
+)
+
+// Media types of inlined images, as any image/ type is inlined by default.
+// Picked image is returned as is, regardless of its type.
+type ImageTypePolicy struct {
+	Allowed  []string // media types, like image/png, or wildcards, like image/*; any image type if empty
+	Excluded []string // media types or wildcards, that are not inlined, even if allowed
+	Action   string   // on images of not inlined types, ExcludedImagesSkip or ExcludedImagesLink; skipped if empty
+}
+
+// Parses comma separated list of media types or wildcards, like "image/png,image/jpeg" or "image/*".
+func ParseMediaTypes(list string) ([]string, error) {
+	var res []string
+	for _, mediaType := range strings.Split(list, ",") {
+		mediaType = strings.ToLower(strings.TrimSpace(mediaType))
+		if mediaType == "" {
+			continue
+		}
+		if parts := strings.Split(mediaType, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid media type %q, expected type/subtype", mediaType)
+		}
+		res = append(res, mediaType)
+	}
+	return res, nil
+}
+
+// Returns true, if image of content type is inlined. Nil policy inlines any image.
+func (p *ImageTypePolicy) inlined(contentType string) bool {
+	if p == nil {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		mediaType = strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	}
+	if len(p.Allowed) > 0 && !matchMediaType(p.Allowed, mediaType) {
+		return false
+	}
+	return !matchMediaType(p.Excluded, mediaType)
+}
+
+func matchMediaType(patterns []string, mediaType string) bool {
+	for _, pattern := range patterns {
+		if pattern == mediaType || strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, pattern[:len(pattern)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func setImageTypePolicy(ctx context.Context, policy *ImageTypePolicy) context.Context {
+	return context.WithValue(ctx, ctxImageTypesKey, policy)
+}
+
+// returns nil, if any image type is inlined
+func getImageTypePolicy(ctx context.Context) *ImageTypePolicy {
+	policy, _ := ctx.Value(ctxImageTypesKey).(*ImageTypePolicy)
+	return policy
+}
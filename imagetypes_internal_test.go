@@ -0,0 +1,73 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+var _ = Describe("image type policy", func() {
+	var origin *httptest.Server
+	BeforeEach(func() {
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			switch req.URL.Path {
+			case "/a.ico":
+				w.Header().Set("Content-Type", "image/x-icon")
+			default:
+				w.Header().Set("Content-Type", "image/gif")
+			}
+			w.Write([]byte("GIF"))
+		}))
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	fetch := func(policy *ImageTypePolicy, opts FetchOptions, path string) (imgTag, error) {
+		ctx := context.WithValue(setLogger(context.Background(), log.StandardLogger()), CtxHTTPClientKey, http.DefaultClient)
+		ctx = setImageTypePolicy(setFetchOptions(ctx, opts), policy)
+		fetcher := backoffImageFetcher{&sync.Mutex{}, nil}
+		res := <-startFetch(ctx, fetcher, imgTag{0, []html.Attribute{{Key: "src", Val: path}}, nil}, origin.URL+path)
+		return res.img, res.err
+	}
+
+	It("then media types are parsed", func() {
+		types, err := ParseMediaTypes(" image/PNG, image/*,")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(types).To(Equal([]string{"image/png", "image/*"}))
+		_, err = ParseMediaTypes("png")
+		Expect(err).To(HaveOccurred())
+	})
+	It("then types are matched by allowed and excluded ones", func() {
+		policy := &ImageTypePolicy{Allowed: []string{"image/*"}, Excluded: []string{"image/svg+xml"}}
+		Expect(policy.inlined("image/png")).To(BeTrue())
+		Expect(policy.inlined("image/svg+xml; charset=utf-8")).To(BeFalse())
+		Expect((&ImageTypePolicy{Allowed: []string{"image/png"}}).inlined("image/gif")).To(BeFalse())
+		var any *ImageTypePolicy
+		Expect(any.inlined("image/x-icon")).To(BeTrue())
+	})
+	It("then allowed image is inlined", func() {
+		img, err := fetch(&ImageTypePolicy{Excluded: []string{"image/x-icon"}}, FetchOptions{}, "/a.gif")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(img.src()).To(HavePrefix("data:image/gif"))
+	})
+	It("then excluded image is skipped", func() {
+		_, err := fetch(&ImageTypePolicy{Excluded: []string{"image/x-icon"}}, FetchOptions{}, "/a.ico")
+		Expect(err).To(Equal(errImageSkipped))
+	})
+	It("then excluded image is linked", func() {
+		img, err := fetch(&ImageTypePolicy{Excluded: []string{"image/x-icon"}, Action: ExcludedImagesLink}, FetchOptions{}, "/a.ico")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(img.src()).To(Equal(origin.URL + "/a.ico"))
+	})
+	It("then picked image is returned regardless of type", func() {
+		img, err := fetch(&ImageTypePolicy{Allowed: []string{"image/png"}}, FetchOptions{Pick: 1}, "/a.ico")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(img.src()).To(HavePrefix("data:image/x-icon"))
+	})
+})
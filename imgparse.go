@@ -5,8 +5,11 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/url"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/asaskevich/govalidator"
@@ -23,6 +26,7 @@ import (
 type imgTag struct {
 	srcIndex int
 	attr     []html.Attribute
+	raw      *rawImage // inlined image data, kept instead of data URL src in raw images mode
 }
 
 func (img *imgTag) setSrc(src string) {
@@ -31,14 +35,47 @@ func (img *imgTag) setSrc(src string) {
 func (img imgTag) src() string {
 	return img.attr[img.srcIndex].Val
 }
+
+// returns copy of img with replaced src
+func (img imgTag) withSrc(src string) imgTag {
+	res := imgTag{img.srcIndex, append([]html.Attribute{}, img.attr...), nil}
+	res.setSrc(src)
+	return res
+}
 func (img imgTag) isDataURL() bool {
 	return strings.HasPrefix(img.src(), "data:")
 }
 
+// returns true if image data is in data URL src, or raw
+func (img imgTag) isInlined() bool {
+	return img.raw != nil || img.isDataURL()
+}
+
+// returns content type and data of inlined image
+func (img imgTag) inlineData() (string, []byte, error) {
+	if img.raw != nil {
+		return img.raw.contentType, img.raw.data, nil
+	}
+	return splitDataURL(img.src())
+}
+
+// returns size of inlined image data without decoding, 0 if image is not inlined
+func (img imgTag) inlineSize() int {
+	if img.raw != nil {
+		return len(img.raw.data)
+	}
+	if img.isDataURL() {
+		return dataURLDataSize(img.src())
+	}
+	return 0
+}
+
 var supportedImgAttributes = map[string]bool{
 	"src":      true,
 	"alt":      true,
+	"title":    true,
 	"style":    true,
+	"srcset":   true, // resolved to src by client hints
 	"longdesc": true,
 	"width":    true,
 	"height":   true,
@@ -49,156 +86,247 @@ func (img imgTag) token() html.Token {
 		Type:     html.StartTagToken,
 		DataAtom: atom.Img,
 		Data:     "img",
-		Attr:     img.attr,
+		Attr:     renderedImgAttrs(img.attr),
 	}
 }
 
 //run goroutine that parse http and goroutine for image download
 
+type extraction struct {
+	images    []imgTag
+	truncated bool   // processing budget exhausted, not all page images returned
+	total     int    // images of page, including ones out of offset and limit; 0 if unknown
+	pickedURL string // of picked image, empty if it has data URL
+}
+
 type imgExtractor interface {
 	//read html data from r and return all <img> tags converted to data:URL form
-	extractImages(ctx context.Context, r io.Reader) ([]imgTag, error)
+	extractImages(ctx context.Context, r io.Reader) (*extraction, error)
 }
-type imgExtractorFunc func(ctx context.Context, r io.Reader) ([]imgTag, error)
+type imgExtractorFunc func(ctx context.Context, r io.Reader) (*extraction, error)
 
-func (f imgExtractorFunc) extractImages(ctx context.Context, r io.Reader) ([]imgTag, error) {
+func (f imgExtractorFunc) extractImages(ctx context.Context, r io.Reader) (*extraction, error) {
 	return f(ctx, r)
 }
 
 type imgExtractorImp struct {
-	parser  imageParser
-	fetcher imageFetcher
+	parser   imageParser
+	fetcher  imageFetcher
+	pipeline *Pipeline // nil if stages are not measured
 }
 
-func (imp imgExtractorImp) extractImages(ctx context.Context, r io.Reader) ([]imgTag, error) {
+// Runs pipeline stages: parse, resolve, fetch and encode in own goroutines, and assembles their results.
+// Returns after every stage goroutine is finished.
+func (imp imgExtractorImp) extractImages(ctx context.Context, r io.Reader) (*extraction, error) {
 	log := getLocalLogger(ctx, "extractImages")
 	log.Debug("Extracting images")
-	ctx, cancel := context.WithCancel(ctx)
-	parseResChan, parseErrChan := imp.parser.parseImage(ctx, r)
-
-	// by contract all fetch subrotines should write either to res either to err channel
-	fetchResChan := make(chan imgTag)
-	fetchErrChan := make(chan error)
-	await := 0 //number of fetch routines to await
-	var result []imgTag
-	//await subroutines on panic or
-	defer func() {
-		cancel() // cancel subroutines fetch requests
-		//await canceled subroutines
-		log.WithField("fetchToAwait", await).Debug("awaiting")
-		for ; await > 0; await-- {
-			select {
-			case <-fetchResChan:
-				log.Debug("img awaited")
-			case <-fetchErrChan:
-				log.Debug("error awaited")
-			}
+	run := newPipelineRun(ctx, imp.pipeline)
+	ctx = run.ctx
+	parseCtx, cancelParse := context.WithCancel(ctx)
+	defer cancelParse()
+	opts := getFetchOptions(ctx)
+	// placeholders of failed images are not fetched ones
+	var fetcher imageFetcher = observingImageFetcher{imp.fetcher}
+	if opts.Tolerant {
+		fetcher = placeholderImageFetcher{fetcher}
+	}
+	parsed, parseErrs := imp.parser.parseImage(parseCtx, r)
+	resolved := make(chan pendingFetch)
+	fetched := make(chan pendingFetch)
+	encoded := make(chan pendingFetch)
+	run.goStage(func() error { return run.resolveStage(parsed, parseErrs, cancelParse, resolved) })
+	run.goStage(func() error { return run.fetchStage(fetcher, resolved, fetched) })
+	run.goStage(func() error { return run.encodeStage(fetched, encoded) })
+
+	start := time.Now()
+	result := &extraction{}
+	var positions []int // of result images in document
+	// reassembles result images by document position, unless completion order is requested
+	assemble := func() *extraction {
+		if !opts.CompletionOrder {
+			sort.Sort(byPosition{positions, result.images})
+			sortImages(result.images, opts.Sort)
 		}
-		//for debug close fetch channels
-		//leaked fetch subroutine will cause panic on closed channel
-		close(fetchResChan)
-		close(fetchErrChan)
-
+		return result
+	}
+	report := getDebugReport(ctx)
+	sink := getImageSink(ctx)
+	skipReason := "processing canceled"
+	var resErr error
+	defer func() {
+		run.stop() // cancel stages and their fetch requests
+		log.Debug("awaiting stages")
+		run.wait()
+		report.skipUnfinished(skipReason)
+		run.pipeline.record(StageAssemble, len(result.images), start, resErr)
 	}()
-	folderURL := *getFolderURL(*getURLParam(ctx))
-
-	log.Debug("Async await")
-	//while parsing in process and fetch tasks not finished
-	for parseResChan != nil || await > 0 {
+	var imagesBytes int64
+	var budgetTimeout <-chan time.Time
+	if opts.BudgetTime > 0 {
+		timer := time.NewTimer(opts.BudgetTime)
+		defer timer.Stop()
+		budgetTimeout = timer.C
+	}
+	for {
 		select {
-		case img, ok := <-parseResChan:
-			log.Debug("Async got image")
+		case item, ok := <-encoded:
 			if !ok {
-				//check if parse finish successful
-				log.Debug("parse finished succesfuly")
-				//disable parse channels on parse finish
-				parseResChan = nil
-				parseErrChan = nil
-				continue
+				// stages finished, failed or canceled
+				if resErr = run.wait(); resErr != nil {
+					return nil, resErr
+				}
+				log.Debug("Async await Done")
+				result.truncated = result.truncated || run.truncated
+				result.total = run.total
+				return assemble(), nil
+			}
+			result.images = append(result.images, item.img)
+			positions = append(positions, item.position)
+			if sink != nil {
+				if resErr = sink(item.img); resErr != nil {
+					return nil, resErr
+				}
 			}
-			//create new fetch routine on img
-			if img.isDataURL() {
-				log.Debug("img with data URL parsed")
-				result = append(result, img)
-				continue
+			if opts.Pick > 0 {
+				result.pickedURL = item.url
 			}
-			imgURL, err := getImgURL(img.src(), folderURL)
-			if err != nil {
-				return nil, err
+			imagesBytes += int64(item.img.inlineSize())
+			if opts.BudgetBytes > 0 && imagesBytes >= opts.BudgetBytes {
+				log.WithField("bytes", imagesBytes).Info("bytes budget exhausted")
+				result.truncated = true
+				skipReason = "bytes budget exhausted"
+				return assemble(), nil
 			}
-			log.WithField("token", img.token().String()).
-				Debug("img parsed. Send for fetching")
-			await++
-			log.Debug("Async fetching image")
-			imp.fetcher.fetchImage(ctx, img, imgURL, fetchResChan, fetchErrChan)
-		case err := <-parseErrChan:
-			log.Debug("parse finished with error")
-			return nil, err
-		case img := <-fetchResChan:
-			log.Debug("img fetched")
-			await--
-			result = append(result, img)
-		case err := <-fetchErrChan:
-			log.Debug("error on img fetch")
-			await--
-			return nil, err
+		case <-budgetTimeout:
+			log.WithField("time", opts.BudgetTime).Info("time budget exhausted")
+			result.truncated = true
+			skipReason = "time budget exhausted"
+			return assemble(), nil
 		}
-
 	}
-	log.Debug("Async await Done")
-	return result, nil
+}
+
+type pendingFetch struct {
+	position int // in document
+	img      imgTag
+	url      string
+	debug    *DebugImage // nil if not reported
+}
+
+// sorts images by their document positions
+type byPosition struct {
+	positions []int
+	images    []imgTag
+}
+
+func (s byPosition) Len() int           { return len(s.images) }
+func (s byPosition) Less(i, j int) bool { return s.positions[i] < s.positions[j] }
+func (s byPosition) Swap(i, j int) {
+	s.positions[i], s.positions[j] = s.positions[j], s.positions[i]
+	s.images[i], s.images[j] = s.images[j], s.images[i]
+}
+
+// heap of pending fetches ordered by document position
+type fetchQueue []pendingFetch
+
+func (q fetchQueue) Len() int            { return len(q) }
+func (q fetchQueue) Less(i, j int) bool  { return q[i].position < q[j].position }
+func (q fetchQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *fetchQueue) Push(x interface{}) { *q = append(*q, x.(pendingFetch)) }
+func (q *fetchQueue) Pop() interface{} {
+	old := *q
+	res := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return res
 }
 
 type imageFetcher interface {
-	// try to download parsedImage
-	// on success send only img to imgc
-	// on fail send only error to errc
-	fetchImage(ctx context.Context, img imgTag, imgURL string, imgc chan<- imgTag, errc chan<- error)
+	// Starts download of parsed image, and returns without waiting for it.
+	// Result is called exactly once from another goroutine, with fetched img on success, or with error on fail.
+	fetchImage(ctx context.Context, img imgTag, imgURL string, result fetchCallback)
+}
+type imageFetcherFunc func(ctx context.Context, img imgTag, imgURL string, result fetchCallback)
+
+func (f imageFetcherFunc) fetchImage(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+	f(ctx, img, imgURL, result)
+}
+
+// Receives result of image fetch. It is called from fetch goroutine, and should not block
+// after ctx of fetch is canceled, so fetch goroutine terminates when its result is not needed anymore.
+type fetchCallback func(img imgTag, err error)
+
+type fetchResult struct {
+	img imgTag
+	err error
 }
-type imageFetcherFunc func(ctx context.Context, img imgTag, imgURL string, imgc chan<- imgTag, errc chan<- error)
 
-func (f imageFetcherFunc) fetchImage(ctx context.Context, img imgTag, imgURL string, imgc chan<- imgTag, errc chan<- error) {
-	f(ctx, img, imgURL, imgc, errc)
+// Starts fetch, and returns channel receiving its result. Channel is buffered, so fetch
+// terminates, even if caller returns without receiving result.
+func startFetch(ctx context.Context, fetcher imageFetcher, img imgTag, imgURL string) <-chan fetchResult {
+	res := make(chan fetchResult, 1)
+	fetcher.fetchImage(ctx, img, imgURL, observeFetch(ctx, imgURL, func(img imgTag, err error) {
+		res <- fetchResult{img, err}
+	}))
+	return res
 }
 
-func fetchImage(ctx context.Context, img imgTag, imgURL string, imgc chan<- imgTag, errc chan<- error) {
+func fetchImage(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+	done := goroutines.start(goroutineFetch)
 	go func() {
-		resp, err := cxtAwareGet(ctx, imgURL)
+		defer done()
+		resp, err := imageGet(ctx, imgURL)
 		if err != nil {
-			errc <- &HandlerError{500, "can't fetch image: " + imgURL, err}
+			result(imgTag{}, originUnreachable("can't fetch image: "+imgURL, err))
 			return
 		}
 		defer resp.Body.Close()
+		if resp.StatusCode == http.StatusTooManyRequests {
+			result(imgTag{}, rateLimitedError(imgURL, 1))
+			return
+		}
 		if resp.StatusCode != http.StatusOK {
-			errc <- NewHandlerError(400, fmt.Sprintf("expected status code 200 but found %v on image: %v )", resp.StatusCode, imgURL))
+			result(imgTag{}, originStatusError("can't fetch image: "+imgURL, resp.StatusCode))
 			return
 		}
 		ct := strings.TrimSpace(resp.Header.Get("Content-Type"))
 		if ct == "" {
-			errc <- NewHandlerError(400, "no content-type on image: "+imgURL)
+			result(imgTag{}, NewHandlerError(400, "no content-type on image: "+imgURL))
 			return
 		}
 		if !strings.HasPrefix(ct, "image") {
-			errc <- NewHandlerError(400, "not image content-type on image: "+imgURL)
+			result(imgTag{}, NewHandlerError(400, "not image content-type on image: "+imgURL))
 			return
 		}
-		dataURLBuf := bytes.NewBufferString("data:")
+		if isRawImages(ctx) {
+			data, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				result(imgTag{}, &HandlerError{400, "image fetching error: " + imgURL, err})
+				return
+			}
+			result(img.withRaw(imgURL, ct, data), nil)
+			return
+		}
+		dataURLBuf := buffers.get()
+		defer buffers.put(dataURLBuf)
+		dataURLBuf.WriteString("data:")
 		dataURLBuf.WriteString(ct)
 		dataURLBuf.WriteString(";base64,")
 
 		w := base64.NewEncoder(base64.StdEncoding, dataURLBuf)
-		defer w.Close()
 		_, err = io.Copy(w, resp.Body)
 		if err != nil {
-			errc <- &HandlerError{400, "image fetching error: " + imgURL, err}
+			result(imgTag{}, &HandlerError{400, "image fetching error: " + imgURL, err})
 			return
 		}
+		// flushes last partial block
+		w.Close()
 		resImg := imgTag{ //copy
 			img.srcIndex,
 			append([]html.Attribute{}, img.attr...),
+			nil,
 		}
 		resImg.setSrc(dataURLBuf.String())
-		imgc <- resImg
+		result(resImg, nil)
 
 	}()
 }
@@ -220,77 +348,237 @@ func (h backoffImageFetcher) Reset() {
 	h.backoffLock.Unlock()
 }
 
-func (bif backoffImageFetcher) fetchImage(ctx context.Context, img imgTag, imgURL string, imgc chan<- imgTag, errc chan<- error) {
+func (bif backoffImageFetcher) fetchImage(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+	done := goroutines.start(goroutineFetch)
 	go func() {
+		defer done()
 		log := getLocalLogger(ctx, "backoffFetcher")
+		opts := getFetchOptions(ctx)
+		debug := getDebugImage(ctx)
+		reported := debug != nil
+		if debug == nil {
+			// stats of not reported image are discarded
+			debug = &DebugImage{}
+		}
 		var (
-			opErr  error
-			opImg * imgTag
+			opErr         error
+			opImg         *imgTag
+			rateLimited   bool          // last response is 429
+			typeExcluded  bool          // image type is not inlined, and image is skipped
+			rateLimitWait time.Duration // requested by last 429 response, -1 if retry can't be made in time
 		)
 		operation := func() error {
 			// return err on retry need, or just returns
 			log.Debug("Another try")
+			debug.Attempts++
+			rateLimited = false
+			typeExcluded = false
 			//TODO remove code duplication
-			resp, err := cxtAwareGet(ctx, imgURL)
+			resp, err := imageGet(ctx, imgURL)
 			if err != nil {
 				log.Debug("Get error")
-				opErr = &HandlerError{500, "can't fetch image: " + imgURL, err}
+				opErr = originUnreachable("can't fetch image: "+imgURL, err)
 				return nil
 			}
 			defer resp.Body.Close()
+			debug.Status = resp.StatusCode
 
 			if resp.StatusCode >= 500 {
 				//retry on server error
 				log.Debug("Got server error response -> do next try")
-				return &HandlerError{500, "need retry", nil}
+				return originStatusError("can't fetch image: "+imgURL, resp.StatusCode)
+			}
+			if resp.StatusCode == http.StatusTooManyRequests {
+				// retried after Retry-After, instead of backoff
+				rateLimited = true
+				opErr = rateLimitedError(imgURL, debug.Attempts)
+				if wait, ok := rateLimitRetryWait(ctx, resp); ok {
+					rateLimitWait = wait
+				} else {
+					rateLimitWait = -1
+				}
+				return nil
 			}
 
 			if resp.StatusCode != http.StatusOK {
-				opErr = NewHandlerError(400, fmt.Sprintf("expected status code 200 but found %v on image: %v )", resp.StatusCode, imgURL))
+				opErr = originStatusError("can't fetch image: "+imgURL, resp.StatusCode)
 				return nil
 			}
 			ct := strings.TrimSpace(resp.Header.Get("Content-Type"))
-			if ct == "" {
-				opErr = NewHandlerError(400, "no content-type on image: "+imgURL)
+			debug.ContentType = ct
+			getImageValidators(ctx).set(resp.Header)
+			buf, err := readImageBuffer(resp, imgURL, opts.MaxImageSize)
+			if err != nil {
+				opErr = err
 				return nil
 			}
-			if !strings.HasPrefix(ct, "image") {
-				opErr = NewHandlerError(400, "not image content-type on image: "+imgURL)
+			data := buf.Bytes()
+			if ct, err = sniffImage(imgURL, ct, data); err != nil {
+				buffers.put(buf)
+				opErr = err
 				return nil
 			}
-			dataURLBuf := bytes.NewBufferString("data:")
-			dataURLBuf.WriteString(ct)
-			dataURLBuf.WriteString(";base64,")
-
-			w := base64.NewEncoder(base64.StdEncoding, dataURLBuf)
-			defer w.Close()
-			_, err = io.Copy(w, resp.Body)
-			if err != nil {
-				opErr = &HandlerError{400, "image fetching error: " + imgURL, err}
+			debug.ContentType = ct
+			debug.FetchedBytes = len(data)
+			if policy := getImageTypePolicy(ctx); opts.Pick == 0 && !policy.inlined(ct) {
+				buffers.put(buf)
+				if policy.Action == ExcludedImagesLink {
+					log.WithField("type", ct).Debug("image type is not inlined, image is linked")
+					debug.set(outcomeLinked, "image type is not inlined")
+					resImg := img.withSrc(imgURL)
+					opImg = &resImg
+					return nil
+				}
+				typeExcluded = true
+				return nil
+			}
+			if reported {
+				debug.Width, debug.Height, _ = imageDimensions(ct, data)
+			}
+			if data = recompressImage(ctx, ct, data); len(data) != debug.FetchedBytes {
+				debug.RecompressedBytes = len(data)
+			}
+			if opts.InlineThreshold > 0 && int64(len(data)) > opts.InlineThreshold {
+				log.WithField("size", len(data)).Debug("image is over inline threshold")
+				debug.set(outcomeLinked, "over inline threshold")
+				buffers.put(buf)
+				resImg := img.withSrc(imgURL)
+				opImg = &resImg
 				return nil
 			}
-			opImg = &imgTag{ //copy
-				img.srcIndex,
-				append([]html.Attribute{}, img.attr...),
+			debug.set(outcomeInlined, "")
+			if isRawImages(ctx) {
+				// raw data is referenced by result, so buffer is not reused
+				resImg := img.withRaw(imgURL, ct, data)
+				debug.EncodedBytes = len(data)
+				opImg = &resImg
+				return nil
 			}
-			opImg.setSrc(dataURLBuf.String())
+			resImg := img.withSrc(encodeDataURL(ct, data))
+			buffers.put(buf)
+			debug.EncodedBytes = len(resImg.src())
+			opImg = &resImg
 			return nil
 		}
 		//err := backoff.Retry(operation, bif)
-		err := backoff.Retry(operation, backoff.NewExponentialBackOff())
+		err := backoff.Retry(operation, &maxRetriesBackOff{BackOff: backoff.NewExponentialBackOff(), max: opts.Retries})
+		for retries := 0; err == nil && rateLimited && rateLimitWait >= 0 && retries < opts.Retries; retries++ {
+			log.WithField("wait", rateLimitWait).Debug("rate limited, retry after wait")
+			if !sleepCtx(ctx, rateLimitWait) {
+				break
+			}
+			opErr = nil
+			err = backoff.Retry(operation, &maxRetriesBackOff{BackOff: backoff.NewExponentialBackOff(), max: opts.Retries})
+		}
+		if err == nil && typeExcluded {
+			log.WithField("type", debug.ContentType).Info("image of not inlined type skipped: ", imgURL)
+			debug.set(outcomeSkipped, "image type is not inlined")
+			result(imgTag{}, errImageSkipped)
+			return
+		}
+		if err == nil && rateLimited && opts.SkipRateLimited && opts.Pick == 0 && ctx.Err() == nil {
+			// picked image can't be left out
+			log.Info("rate limited image skipped: ", opErr)
+			debug.set(outcomeSkipped, "origin rate limited")
+			result(imgTag{}, errImageSkipped)
+			return
+		}
+		if ctx.Err() == nil {
+			// canceled fetches are reported as skipped
+			if err != nil {
+				debug.set(outcomeFailed, fmt.Sprintf("status %v after %v attempts", debug.Status, debug.Attempts))
+			} else if opErr != nil {
+				debug.set(outcomeFailed, opErr.Error())
+			}
+		}
 		if err != nil {
-			errc <- err
+			result(imgTag{}, err)
 		} else {
 			if opErr != nil {
-				errc <- err
+				result(imgTag{}, opErr)
 			} else {
-				imgc <- img
+				result(*opImg, nil)
 			}
 
 		}
 	}()
 }
 
+// reads image body, failing if it is bigger than maxSize
+func readImageBody(resp *http.Response, imgURL string, maxSize int64) ([]byte, error) {
+	buf, err := readImageBuffer(resp, imgURL, maxSize)
+	if err != nil {
+		return nil, err
+	}
+	data := append([]byte(nil), buf.Bytes()...)
+	buffers.put(buf)
+	return data, nil
+}
+
+// reads image body to pooled buffer, failing if it is bigger than maxSize
+func readImageBuffer(resp *http.Response, imgURL string, maxSize int64) (*bytes.Buffer, error) {
+	tooLarge := NewHandlerError(400, "image is bigger than max image size: "+imgURL)
+	if maxSize > 0 && resp.ContentLength > maxSize {
+		return nil, tooLarge
+	}
+	var r io.Reader = resp.Body
+	if maxSize > 0 {
+		r = io.LimitReader(resp.Body, maxSize+1)
+	}
+	buf := buffers.get()
+	if resp.ContentLength > 0 && (maxSize <= 0 || resp.ContentLength <= maxSize) {
+		buf.Grow(int(resp.ContentLength) + bytes.MinRead)
+	}
+	_, err := buf.ReadFrom(r)
+	if hErr := originHandlerError(err); hErr != nil {
+		buffers.put(buf)
+		return nil, hErr
+	}
+	if err != nil {
+		buffers.put(buf)
+		return nil, &HandlerError{400, "image fetching error: " + imgURL, err}
+	}
+	if maxSize > 0 && int64(buf.Len()) > maxSize {
+		buffers.put(buf)
+		return nil, tooLarge
+	}
+	return buf, nil
+}
+
+// returns base64 data URL of data, encoded without intermediate copies
+func encodeDataURL(contentType string, data []byte) string {
+	buf := buffers.get()
+	defer buffers.put(buf)
+	buf.Grow(len("data:;base64,") + len(contentType) + base64.StdEncoding.EncodedLen(len(data)))
+	buf.WriteString("data:")
+	buf.WriteString(contentType)
+	buf.WriteString(";base64,")
+	w := base64.NewEncoder(base64.StdEncoding, buf)
+	w.Write(data)
+	w.Close()
+	return buf.String()
+}
+
+// stops wrapped backoff after max retries
+type maxRetriesBackOff struct {
+	backoff.BackOff
+	max     int
+	retries int
+}
+
+func (b *maxRetriesBackOff) NextBackOff() time.Duration {
+	if b.retries >= b.max {
+		return backoff.Stop
+	}
+	b.retries++
+	return b.BackOff.NextBackOff()
+}
+
+func (b *maxRetriesBackOff) Reset() {
+	b.retries = 0
+	b.BackOff.Reset()
+}
+
 type imageParser interface {
 	//parse html content in separate goroutine and send imgTags to output img chan
 	//img chan will be closed on parse finish
@@ -312,18 +600,36 @@ type imageParserImp struct {
 func (imp imageParserImp) parseImage(ctx context.Context, r io.Reader) (<-chan imgTag, <-chan error) {
 	imgc := make(chan imgTag)
 	errc := make(chan error)
+	limits := getParseLimits(ctx)
+	if limits.MaxDocumentSize > 0 {
+		r = newDocumentLimitReader(r, limits.MaxDocumentSize)
+	}
+	var watchdog *parseWatchdog
+	if limits.StallTimeout > 0 {
+		watchdog = startParseWatchdog(ctx, limits.StallTimeout, errc)
+	}
+	done := goroutines.start(goroutineParse)
 	go func() {
 		// on error, error is send before deffer, so receiver got error, and then close signal
 		defer func() {
+			watchdog.stop()
 			close(imgc)
+			done()
 		}() // indicate finish
 		z := html.NewTokenizer(r)
+		if limits.MaxTokenSize > 0 {
+			z.SetMaxBuf(limits.MaxTokenSize)
+		}
 		for {
 			tokenType := z.Next()
+			watchdog.token()
 			if tokenType == html.ErrorToken {
 				if z.Err() != io.EOF {
 					//EOF == successful finish
-					errc <- z.Err() //block until receiver got error
+					select {
+					case errc <- tokenizerError(z.Err(), limits): //block until receiver got error
+					case <-ctx.Done():
+					}
 				}
 				return
 			}
@@ -332,16 +638,53 @@ func (imp imageParserImp) parseImage(ctx context.Context, r io.Reader) (<-chan i
 			case html.SelfClosingTagToken:
 				fallthrough
 			case html.StartTagToken: // <tag>
-				if token.DataAtom != atom.Img || token.Data != "img" {
-					continue
-				}
-
-				img, err := imp.tokenParse.parseImgToken(token)
-				if err != nil {
-					errc <- err
+				if limits.MaxAttributes > 0 && len(token.Attr) > limits.MaxAttributes {
+					select {
+					case errc <- pageLimitError(PageTooManyAttributes, "page has tag with more than "+strconv.Itoa(limits.MaxAttributes)+" attributes"):
+					case <-ctx.Done():
+					}
 					return
 				}
-				imgc <- img
+				var imgs []imgTag
+				switch {
+				case token.DataAtom == atom.Script:
+					if tokenType != html.StartTagToken || !getFetchOptions(ctx).Scripts {
+						continue
+					}
+					// script text is single raw text token; on error, it is got by next loop
+					if z.Next() != html.TextToken {
+						continue
+					}
+					watchdog.token()
+					imgs = scriptImages(tokenAttr(token, "type"), z.Text())
+				case token.DataAtom != atom.Img || token.Data != "img":
+					related, ok := relatedImage(token)
+					if !ok {
+						continue
+					}
+					imgs = []imgTag{related}
+				default:
+					img, err := imp.tokenParse.parseImgToken(token)
+					if err != nil {
+						select {
+						case errc <- err:
+						case <-ctx.Done():
+						}
+						return
+					}
+					imgs = []imgTag{img}
+				}
+				for _, img := range imgs {
+					img = getSanitizePolicy(ctx).sanitizeImg(img)
+					watchdog.setWaiting(true)
+					select {
+					case imgc <- img:
+					case <-ctx.Done():
+						// receiver don't need more images
+						return
+					}
+					watchdog.setWaiting(false)
+				}
 
 			}
 		}
@@ -359,7 +702,7 @@ func (f imgTokenParserFunc) parseImgToken(token html.Token) (imgTag, error) {
 }
 
 func parseImgToken(token html.Token) (imgTag, error) {
-	img := imgTag{-1, make([]html.Attribute, 0, len(token.Attr))}
+	img := imgTag{-1, make([]html.Attribute, 0, len(token.Attr)), nil}
 	for i, attr := range token.Attr {
 		key := attr.Key
 		if supportedImgAttributes[key] {
@@ -383,11 +726,23 @@ func getFolderURL(pageURL url.URL) *url.URL {
 		pageURL.Path = ""
 	} else {
 		split := strings.Split(pageURL.Path, "/")
-		pageURL.Path = strings.Join(split[:len(split)-1], "/")
+		// rooted, as URLs without host, like file ones, are not rooted by String
+		pageURL.Path = "/" + strings.Join(split[:len(split)-1], "/")
 	}
 	return &pageURL
 }
 
+// Scheme of protocol relative srcs in documents without page scheme.
+const DefaultSrcScheme = "https"
+
+// returns scheme of protocol relative srcs in document of page scheme
+func srcScheme(pageScheme string) string {
+	if pageScheme == "" {
+		return DefaultSrcScheme
+	}
+	return pageScheme
+}
+
 func getImgURL(src string, folderURL url.URL) (string, error) {
 	imgSrcURL, err := url.Parse(src)
 	if err != nil {
@@ -397,8 +752,8 @@ func getImgURL(src string, folderURL url.URL) (string, error) {
 	if imgSrcURL.IsAbs() {
 		res = src
 	} else if strings.HasPrefix(src, "//") {
-		//yep, is absolute too
-		res = "http:" + src
+		//yep, is absolute too, with scheme of page
+		res = srcScheme(folderURL.Scheme) + ":" + src
 	} else if src[0] == '/' {
 		folderURL.Path = src
 		folderURL.RawPath = src
@@ -411,9 +766,16 @@ func getImgURL(src string, folderURL url.URL) (string, error) {
 			res = folderStr + "/" + src
 		}
 	}
-	if !govalidator.IsURL(res) {
+	if res, err = asciiURL(res); err != nil {
+		return "", &HandlerError{400, "invalid img tag src URL: internationalized URL", err}
+	}
+	resURL, err := url.Parse(res)
+	if err != nil || !isObjectURL(resURL) && !govalidator.IsURL(res) {
 		return "", &HandlerError{400, "invalid img tag src URL: is not valid URL", err}
 	}
+	if objectSchemes[resURL.Scheme] && !sameObjectBucket(&folderURL, resURL) {
+		return "", NewHandlerError(400, "invalid img tag src URL: object URL is not of page bucket")
+	}
 	return res, nil
 
 }
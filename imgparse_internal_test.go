@@ -3,12 +3,16 @@ package imgserver
 import (
 	"bytes"
 	"net/url"
+	"path"
+	"strings"
 
 	"golang.org/x/net/context"
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
 
+	"sync"
 	"sync/atomic"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	. "github.com/onsi/ginkgo"
@@ -103,6 +107,32 @@ var _ = Describe("getImgURL by src atribute and folder URL", func() {
 		})
 	})
 
+	Context("when image URL is protocol relative in document without scheme", func() {
+		const correctRes = DefaultSrcScheme + "://cdn.golang.org/html5.gif"
+		BeforeEach(func() {
+			src = "//cdn.golang.org/html5.gif"
+			folderRawURL = ""
+		})
+		It("then default scheme is used", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res).To(Equal(correctRes))
+		})
+	})
+
+	Context("when image URL is internationalized", func() {
+		const correctRes = "https://xn--bcher-kva.example/b%C3%BCcher/stra%C3%9Fe.gif"
+		BeforeEach(func() {
+			src = "straße.gif"
+			folderRawURL = "https://bücher.example/bücher"
+		})
+		It("then not error", func() {
+			Expect(err).NotTo(HaveOccurred())
+		})
+		It("then host is punycode and path percent-encoded", func() {
+			Expect(res).To(Equal(correctRes))
+		})
+	})
+
 	Context("when image is absolute URL", func() {
 		const correctRes = "https://golang.org/doc/images/html5.gif"
 		BeforeEach(func() {
@@ -118,7 +148,7 @@ var _ = Describe("getImgURL by src atribute and folder URL", func() {
 	})
 
 	Context("when image is absolute '//URL'", func() {
-		const correctRes = `http://habrastorage.org/getpro/habr/avatars/f7b/155/cea/f7b155cea7f7369ff8c0bf797b2e8b9d.jpg`
+		const correctRes = `https://habrastorage.org/getpro/habr/avatars/f7b/155/cea/f7b155cea7f7369ff8c0bf797b2e8b9d.jpg`
 		BeforeEach(func() {
 			src = `//habrastorage.org/getpro/habr/avatars/f7b/155/cea/f7b155cea7f7369ff8c0bf797b2e8b9d.jpg`
 			folderRawURL = "https://golang.org/doc"
@@ -381,3 +411,109 @@ var _ = Describe("parse html by parseImage", func() {
 	})
 
 })
+
+var _ = Describe("extract images", func() {
+	var (
+		opts    FetchOptions
+		fetched []string
+		res     *extraction
+		err     error
+	)
+	const input = `<img src="/1.png"><p><img src="/2.png"></p><img src="/3.png"><img src="/4.png">`
+	JustBeforeEach(func() {
+		fetched = nil
+		var mu sync.Mutex
+		fetcher := imageFetcherFunc(func(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+			mu.Lock()
+			fetched = append(fetched, imgURL)
+			mu.Unlock()
+			go result(img.withSrc("data:image/png;base64,"), nil)
+		})
+		pageURL, _ := url.Parse("http://example.com/page")
+		ctx := context.WithValue(setLogger(context.Background(), log.StandardLogger()), ctxURLParamKey, pageURL)
+		ctx = setFetchOptions(ctx, opts)
+		extractor := imgExtractorImp{imageParserImp{imgTokenParserFunc(parseImgToken)}, fetcher, nil}
+		res, err = extractor.extractImages(ctx, bytes.NewBufferString(input))
+	})
+	Context("when one fetch at time", func() {
+		BeforeEach(func() {
+			opts = FetchOptions{Concurrency: 1}
+		})
+		It("then images fetched in document order", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fetched).To(Equal([]string{
+				"http://example.com/1.png",
+				"http://example.com/2.png",
+				"http://example.com/3.png",
+				"http://example.com/4.png",
+			}))
+		})
+	})
+	Context("when first images limit", func() {
+		BeforeEach(func() {
+			opts = FetchOptions{FirstImages: 2}
+		})
+		It("then only first images processed", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.images).To(HaveLen(2))
+			Expect(res.truncated).To(BeFalse())
+			Expect(fetched).To(ConsistOf("http://example.com/1.png", "http://example.com/2.png"))
+		})
+	})
+	Context("when images budget", func() {
+		BeforeEach(func() {
+			opts = FetchOptions{BudgetImages: 3}
+		})
+		It("then result truncated", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.images).To(HaveLen(3))
+			Expect(res.truncated).To(BeTrue())
+		})
+	})
+	Context("when later images fetched sooner", func() {
+		var fetcher imageFetcher
+		BeforeEach(func() {
+			opts = FetchOptions{}
+			fetcher = imageFetcherFunc(func(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+				// first image completes last
+				delay := time.Duration(0)
+				if strings.HasSuffix(imgURL, "/1.png") {
+					delay = 50 * time.Millisecond
+				}
+				go func() {
+					time.Sleep(delay)
+					result(img.withSrc("data:image/png;base64,"+path.Base(imgURL)), nil)
+				}()
+			})
+		})
+		srcs := func() []string {
+			pageURL, _ := url.Parse("http://example.com/page")
+			ctx := context.WithValue(setLogger(context.Background(), log.StandardLogger()), ctxURLParamKey, pageURL)
+			ctx = setFetchOptions(ctx, opts)
+			res, err := imgExtractorImp{imageParserImp{imgTokenParserFunc(parseImgToken)}, fetcher, nil}.extractImages(ctx, bytes.NewBufferString(input))
+			Expect(err).NotTo(HaveOccurred())
+			var srcs []string
+			for _, img := range res.images {
+				srcs = append(srcs, strings.TrimPrefix(img.src(), "data:image/png;base64,"))
+			}
+			return srcs
+		}
+		It("then images returned in document order", func() {
+			Expect(srcs()).To(Equal([]string{"1.png", "2.png", "3.png", "4.png"}))
+		})
+		It("then completion order returned on request", func() {
+			opts.CompletionOrder = true
+			Expect(srcs()[3]).To(Equal("1.png"))
+		})
+	})
+	Context("when images budget is not reached", func() {
+		BeforeEach(func() {
+			opts = FetchOptions{BudgetImages: 4}
+		})
+		It("then result not truncated", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.images).To(HaveLen(4))
+			Expect(res.truncated).To(BeFalse())
+		})
+	})
+})
@@ -0,0 +1,89 @@
+package imgserver
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+// Max runes of alt and longdesc of rendered img tags. Longer alt is truncated with ellipsis,
+// and longer longdesc is left out, as truncated URL is broken.
+const maxImgTextLength = 1000
+
+// Returns attributes of img tag rendered to output page, with alt and longdesc made safe:
+// they are taken from origin page, so invalid UTF-8, control characters and bidirectional
+// overrides, that could make output page text spoofed, are removed. Values are HTML escaped on render.
+func renderedImgAttrs(attrs []html.Attribute) []html.Attribute {
+	var res []html.Attribute // nil until attribute is changed
+	for i, attr := range attrs {
+		val, keep := attr.Val, true
+		if attr.Key == "alt" || attr.Key == "longdesc" {
+			val, keep = safeImgText(attr.Key, attr.Val)
+		}
+		if res == nil && keep && val == attr.Val {
+			continue
+		}
+		if res == nil {
+			res = append(make([]html.Attribute, 0, len(attrs)), attrs[:i]...)
+		}
+		if keep {
+			attr.Val = val
+			res = append(res, attr)
+		}
+	}
+	if res == nil {
+		return attrs
+	}
+	return res
+}
+
+// returns sanitized and capped text attribute value, or false if attribute should be left out
+func safeImgText(key, text string) (string, bool) {
+	text = sanitizeImgText(text)
+	if utf8.RuneCountInString(text) <= maxImgTextLength {
+		return text, true
+	}
+	if key == "longdesc" {
+		return "", false
+	}
+	return truncateRunes(text, maxImgTextLength-1) + "…", true
+}
+
+// returns text without invalid UTF-8, control characters and bidi overrides; whitespace controls become spaces
+func sanitizeImgText(text string) string {
+	clean := true
+	for _, r := range text {
+		if r == utf8.RuneError || unsafeTextRune(r) {
+			clean = false
+			break
+		}
+	}
+	if clean {
+		return text
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t' || r == '\n' || r == '\r':
+			return ' '
+		case r == utf8.RuneError || unsafeTextRune(r):
+			return -1
+		}
+		return r
+	}, text)
+}
+
+func unsafeTextRune(r rune) bool {
+	return unicode.IsControl(r) || (r >= '\u202a' && r <= '\u202e') || (r >= '\u2066' && r <= '\u2069')
+}
+
+func truncateRunes(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
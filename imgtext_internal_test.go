@@ -0,0 +1,39 @@
+package imgserver
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/html"
+)
+
+var _ = Describe("img text attributes", func() {
+	render := func(attrs ...html.Attribute) string {
+		return imgTag{0, append([]html.Attribute{{Key: "src", Val: "a.png"}}, attrs...), nil}.token().String()
+	}
+	It("then hostile alt is escaped", func() {
+		Expect(render(html.Attribute{Key: "alt", Val: `"><script>alert(1)</script>`})).
+			To(Equal(`<img src="a.png" alt="&#34;&gt;&lt;script&gt;alert(1)&lt;/script&gt;">`))
+	})
+	It("then controls, bidi overrides and invalid UTF-8 are removed", func() {
+		Expect(render(html.Attribute{Key: "alt", Val: "cat\n\u202eexe.gpj\x00 \xffпёс"})).
+			To(Equal(`<img src="a.png" alt="cat exe.gpj пёс">`))
+	})
+	It("then long alt is truncated by runes, and long longdesc left out", func() {
+		long := strings.Repeat("я", 2*maxImgTextLength)
+		img := imgTag{0, []html.Attribute{{Key: "src", Val: "a.png"}, {Key: "alt", Val: long}, {Key: "longdesc", Val: long}, {Key: "width", Val: "10"}}, nil}
+		attrs := img.token().Attr
+		Expect(attrs).To(HaveLen(3))
+		Expect(utf8.RuneCountInString(attrs[1].Val)).To(Equal(maxImgTextLength))
+		Expect(attrs[1].Val).To(HaveSuffix("…"))
+		Expect(attrs[2]).To(Equal(html.Attribute{Key: "width", Val: "10"}))
+		// parsed tag is not changed
+		Expect(img.attr[1].Val).To(Equal(long))
+	})
+	It("then safe attributes are not copied", func() {
+		attrs := []html.Attribute{{Key: "src", Val: "a.png"}, {Key: "alt", Val: "Кот"}}
+		Expect(&renderedImgAttrs(attrs)[0]).To(BeIdenticalTo(&attrs[0]))
+	})
+})
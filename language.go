@@ -0,0 +1,60 @@
+package imgserver
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Max length of forwarded language list, longer headers are cut at range boundary.
+const maxLanguageLength = 128
+
+// language range with optional weight, like en-US or fr;q=0.8
+var languageRange = regexp.MustCompile(`^(\*|[a-z]{1,8}(-[a-z0-9]{1,8})*)(;q=(0(\.[0-9]{0,3})?|1(\.0{0,3})?))?$`)
+
+// Returns normalized language list of lang param, or of Accept-Language header when param is
+// not passed. Invalid header is ignored, as browsers send what origin would get anyway.
+// Returns empty string, if there is no language.
+func parseLanguage(req *http.Request) (string, error) {
+	if param := req.URL.Query().Get("lang"); param != "" {
+		lang, ok := normalizeLanguage(param)
+		if !ok {
+			return "", NewHandlerError(400, "invalid 'lang' query parameter, expected language tags like en-US,fr;q=0.8: "+param)
+		}
+		return lang, nil
+	}
+	lang, _ := normalizeLanguage(req.Header.Get("Accept-Language"))
+	return lang, nil
+}
+
+// Returns lower cased language list without spaces, so equivalent lists have same cache key.
+func normalizeLanguage(list string) (string, bool) {
+	var ranges []string
+	length := 0
+	for _, item := range strings.Split(list, ",") {
+		item = strings.ToLower(strings.Replace(item, " ", "", -1))
+		if item == "" {
+			continue
+		}
+		if !languageRange.MatchString(item) {
+			return "", false
+		}
+		if length += len(item) + 1; length > maxLanguageLength+1 {
+			break
+		}
+		ranges = append(ranges, item)
+	}
+	return strings.Join(ranges, ","), true
+}
+
+func setLanguage(ctx context.Context, lang string) context.Context {
+	return context.WithValue(ctx, ctxLanguageKey, lang)
+}
+
+// returns empty string if language is not set
+func getLanguage(ctx context.Context) string {
+	lang, _ := ctx.Value(ctxLanguageKey).(string)
+	return lang
+}
@@ -0,0 +1,55 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("language", func() {
+	parse := func(query string, header string) string {
+		req := httptest.NewRequest("GET", "/?url=example.com"+query, nil)
+		if header != "" {
+			req.Header.Set("Accept-Language", header)
+		}
+		lang, err := parseLanguage(req)
+		Expect(err).NotTo(HaveOccurred())
+		return lang
+	}
+	It("then header is normalized", func() {
+		Expect(parse("", "fr-CA, fr;q=0.9, EN;q=0.8, *;q=0.5")).To(Equal("fr-ca,fr;q=0.9,en;q=0.8,*;q=0.5"))
+		Expect(parse("", "")).To(BeEmpty())
+	})
+	It("then param takes precedence", func() {
+		Expect(parse("&lang="+url.QueryEscape("de,en;q=0.5"), "fr")).To(Equal("de,en;q=0.5"))
+	})
+	It("then invalid header is ignored, and invalid param rejected", func() {
+		Expect(parse("", "fr\r\nX-Injected: 1")).To(BeEmpty())
+		_, err := parseLanguage(httptest.NewRequest("GET", "/?url=example.com&lang=%3Cscript%3E", nil))
+		Expect(err).To(HaveOccurred())
+	})
+	It("then language is forwarded to page requests only", func() {
+		var pageLang, imageLang string
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/img.png" {
+				imageLang = r.Header.Get("Accept-Language")
+				return
+			}
+			pageLang = r.Header.Get("Accept-Language")
+		}))
+		defer origin.Close()
+		ctx := setLanguage(context.WithValue(context.Background(), CtxHTTPClientKey, http.DefaultClient), "fr")
+		resp, err := cxtAwareGet(ctx, origin.URL+"/page")
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		resp, err = imageGet(ctx, origin.URL+"/img.png")
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(pageLang).To(Equal("fr"))
+		Expect(imageLang).To(BeEmpty())
+	})
+})
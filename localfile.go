@@ -0,0 +1,77 @@
+package imgserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+)
+
+// Returns RoundTripper decorator, that serves file:// URLs by files under root directory,
+// and passes other requests to rt. file:///site/index.html is root/site/index.html,
+// and paths out of root are not served. Directories without index.html are not listed.
+func NewLocalFileTransport(rt http.RoundTripper, root string) http.RoundTripper {
+	return localFileTransport{rt, http.NewFileTransport(localDir{http.Dir(root)})}
+}
+
+type localFileTransport struct {
+	http.RoundTripper
+	files http.RoundTripper
+}
+
+func (t localFileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "file" {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	if host := req.URL.Host; host != "" && host != "localhost" {
+		return nil, fmt.Errorf("file URL of remote host %v", host)
+	}
+	if err := checkObjectRedirect(req); err != nil {
+		return nil, err
+	}
+	return t.files.RoundTrip(req)
+}
+
+// Enables file:// page URLs, served by files under root directory as by NewLocalFileTransport.
+// Otherwise file URLs are rejected, so local files can't be read by clients.
+// Only pages of file URLs have file images and frames.
+func (h *ImgLogicHandler) EnableLocalFiles(root string) {
+	client := *h.client
+	if client.Transport == nil {
+		client.Transport = http.DefaultTransport
+	}
+	client.Transport = NewLocalFileTransport(client.Transport, root)
+	h.client = &client
+	h.localFiles = true
+	h.enabled = append(h.enabled, "local_files")
+}
+
+// returns error, if page URL is file URL, and local files are not enabled
+func (h *ImgLogicHandler) checkLocalFile(pageURL *url.URL) error {
+	if pageURL.Scheme == "file" && !h.localFiles {
+		return NewHandlerError(400, "invalid URL as 'url' query parameter: file URLs are not enabled")
+	}
+	return nil
+}
+
+// Local root, which directories are served only by index.html.
+type localDir struct {
+	http.Dir
+}
+
+func (d localDir) Open(name string) (http.File, error) {
+	f, err := d.Dir.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if stat, err := f.Stat(); err == nil && stat.IsDir() {
+		index, err := d.Dir.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
@@ -0,0 +1,71 @@
+package imgserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("local files", func() {
+	var root string
+	BeforeEach(func() {
+		var err error
+		root, err = ioutil.TempDir("", "imgserver")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(os.MkdirAll(filepath.Join(root, "site", "img"), 0755)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(root, "site", "index.html"), []byte(`<img src="img/logo.png">`), 0644)).To(Succeed())
+		Expect(ioutil.WriteFile(filepath.Join(root, "site", "img", "logo.png"), []byte("logo"), 0644)).To(Succeed())
+	})
+	AfterEach(func() {
+		os.RemoveAll(root)
+	})
+	// local files are not enabled, if root is empty
+	handle := func(root string, pageURL string) (*Response, error) {
+		req := httptest.NewRequest("GET", "/?url="+url.QueryEscape(pageURL), nil)
+		handler := NewImgLogicHandler(&http.Client{Transport: NewObjectStorageTransport(http.DefaultTransport, nil)})
+		if root != "" {
+			handler.EnableLocalFiles(root)
+		}
+		return handler.HandleLogic(setLogger(context.Background(), logger.StandardLogger()), req)
+	}
+
+	It("then page and its relative images are read under root", func() {
+		resp, err := handle(root, "file:///site/index.html")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Body.String()).To(ContainSubstring("data:image/png;base64,bG9nbw=="))
+	})
+	It("then directory without index is not listed", func() {
+		_, err := handle(root, "file:///site/img/")
+		Expect(err).To(HaveOccurred())
+	})
+	It("then file URLs are rejected, when local root is not set", func() {
+		_, err := handle("", "file:///site/index.html")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusBadRequest))
+		_, err = handle("", "file:///etc/passwd")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusBadRequest))
+	})
+	It("then paths out of root are not read", func() {
+		_, err := handle(root, "file:///site/../../etc/passwd")
+		Expect(err).To(HaveOccurred())
+	})
+	It("then file images of http pages are not read", func() {
+		page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<img src="file:///site/img/logo.png">`))
+		}))
+		defer page.Close()
+		_, err := handle(root, page.URL)
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusBadRequest))
+	})
+})
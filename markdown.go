@@ -0,0 +1,233 @@
+package imgserver
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html/charset"
+)
+
+// Max size of posted HTML and Markdown documents.
+var MaxMarkdownSize int64 = 10 << 20
+
+// Markdown media types, rendered to HTML before images inlining.
+var markdownMediaTypes = map[string]bool{
+	"text/markdown":   true,
+	"text/x-markdown": true,
+}
+
+// Renders common Markdown subset to HTML: ATX headings, paragraphs, fenced and indented code,
+// lists, block quotes, rules, images, links, emphasis and code spans.
+// Raw HTML is passed through, as CommonMark does.
+func renderMarkdown(src []byte) *bytes.Buffer {
+	buf := &bytes.Buffer{}
+	lines := strings.Split(strings.Replace(string(src), "\r\n", "\n", -1), "\n")
+	var paragraph []string
+	listTag := ""
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			buf.WriteString("<p>" + renderMarkdownInline(strings.Join(paragraph, "\n")) + "</p>\n")
+			paragraph = nil
+		}
+	}
+	closeList := func() {
+		if listTag != "" {
+			buf.WriteString("</" + listTag + ">\n")
+			listTag = ""
+		}
+	}
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "":
+			flushParagraph()
+			closeList()
+		case strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~"):
+			flushParagraph()
+			closeList()
+			fence := trimmed[:3]
+			var code []string
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code = append(code, lines[i])
+			}
+			writeMarkdownCode(buf, code)
+		case len(paragraph) == 0 && listTag == "" && strings.HasPrefix(line, "    "):
+			var code []string
+			for ; i < len(lines) && (strings.HasPrefix(lines[i], "    ") || strings.TrimSpace(lines[i]) == ""); i++ {
+				code = append(code, strings.TrimPrefix(lines[i], "    "))
+			}
+			i--
+			for len(code) > 0 && strings.TrimSpace(code[len(code)-1]) == "" {
+				code = code[:len(code)-1]
+			}
+			writeMarkdownCode(buf, code)
+		case markdownHeading.MatchString(trimmed):
+			flushParagraph()
+			closeList()
+			m := markdownHeading.FindStringSubmatch(trimmed)
+			level := strconv.Itoa(len(m[1]))
+			text := strings.TrimRight(strings.TrimSpace(m[2]), "#")
+			buf.WriteString("<h" + level + ">" + renderMarkdownInline(strings.TrimSpace(text)) + "</h" + level + ">\n")
+		case markdownRule.MatchString(trimmed):
+			flushParagraph()
+			closeList()
+			buf.WriteString("<hr>\n")
+		case len(paragraph) == 0 && strings.HasPrefix(trimmed, "<"):
+			closeList()
+			// HTML block lasts until blank line
+			for ; i < len(lines) && strings.TrimSpace(lines[i]) != ""; i++ {
+				buf.WriteString(lines[i] + "\n")
+			}
+		case strings.HasPrefix(trimmed, ">"):
+			flushParagraph()
+			closeList()
+			var quote []string
+			for ; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), ">"); i++ {
+				quote = append(quote, strings.TrimPrefix(strings.TrimPrefix(strings.TrimSpace(lines[i]), ">"), " "))
+			}
+			i--
+			buf.WriteString("<blockquote>\n")
+			buf.Write(renderMarkdown([]byte(strings.Join(quote, "\n"))).Bytes())
+			buf.WriteString("</blockquote>\n")
+		case markdownListItem.MatchString(trimmed):
+			flushParagraph()
+			m := markdownListItem.FindStringSubmatch(trimmed)
+			tag := "ul"
+			if m[1] != "-" && m[1] != "*" && m[1] != "+" {
+				tag = "ol"
+			}
+			if tag != listTag {
+				closeList()
+				listTag = tag
+				buf.WriteString("<" + tag + ">\n")
+			}
+			buf.WriteString("<li>" + renderMarkdownInline(m[2]) + "</li>\n")
+		default:
+			if listTag != "" {
+				closeList()
+			}
+			paragraph = append(paragraph, trimmed)
+		}
+	}
+	flushParagraph()
+	closeList()
+	return buf
+}
+
+var (
+	markdownHeading  = regexp.MustCompile(`^(#{1,6})(?:\s+(.*))?$`)
+	markdownRule     = regexp.MustCompile(`^([-*_])(\s*([-*_]))(\s*([-*_]))[-*_\s]*$`)
+	markdownListItem = regexp.MustCompile(`^([-*+]|\d+[.)])\s+(.*)$`)
+
+	markdownImage  = regexp.MustCompile(`^!\[([^\]]*)\]\(\s*(<[^>]*>|[^\s)]*)(?:\s+"([^"]*)")?\s*\)`)
+	markdownLink   = regexp.MustCompile(`^\[((?:[^\[\]]|\[[^\]]*\])*)\]\(\s*(<[^>]*>|[^\s)]*)(?:\s+"([^"]*)")?\s*\)`)
+	markdownHTML   = regexp.MustCompile(`^</?[A-Za-z][^<>]*>`)
+	markdownStrong = regexp.MustCompile(`^(\*\*|__)([^*_]+)(\*\*|__)`)
+	markdownEm     = regexp.MustCompile(`^(\*|_)([^*_]+)(\*|_)`)
+)
+
+func writeMarkdownCode(buf *bytes.Buffer, code []string) {
+	buf.WriteString("<pre><code>")
+	for _, line := range code {
+		buf.WriteString(html.EscapeString(line) + "\n")
+	}
+	buf.WriteString("</code></pre>\n")
+}
+
+func renderMarkdownInline(text string) string {
+	var buf bytes.Buffer
+	for len(text) > 0 {
+		switch text[0] {
+		case '\\':
+			if len(text) > 1 && strings.IndexByte("\\`*_[]()#+-.!<>", text[1]) >= 0 {
+				buf.WriteString(html.EscapeString(text[1:2]))
+				text = text[2:]
+				continue
+			}
+		case '`':
+			if end := strings.IndexByte(text[1:], '`'); end >= 0 {
+				buf.WriteString("<code>" + html.EscapeString(text[1:end+1]) + "</code>")
+				text = text[end+2:]
+				continue
+			}
+		case '!':
+			if m := markdownImage.FindStringSubmatch(text); m != nil {
+				buf.WriteString(`<img src="` + html.EscapeString(strings.Trim(m[2], "<>")) + `" alt="` + html.EscapeString(m[1]) + `"`)
+				if m[3] != "" {
+					buf.WriteString(` title="` + html.EscapeString(m[3]) + `"`)
+				}
+				buf.WriteString(">")
+				text = text[len(m[0]):]
+				continue
+			}
+		case '[':
+			if m := markdownLink.FindStringSubmatch(text); m != nil {
+				buf.WriteString(`<a href="` + html.EscapeString(strings.Trim(m[2], "<>")) + `"`)
+				if m[3] != "" {
+					buf.WriteString(` title="` + html.EscapeString(m[3]) + `"`)
+				}
+				buf.WriteString(">" + renderMarkdownInline(m[1]) + "</a>")
+				text = text[len(m[0]):]
+				continue
+			}
+		case '<':
+			if m := markdownHTML.FindString(text); m != "" {
+				buf.WriteString(m)
+				text = text[len(m):]
+				continue
+			}
+		case '*', '_':
+			if m := markdownStrong.FindStringSubmatch(text); m != nil && m[1] == m[3] {
+				buf.WriteString("<strong>" + renderMarkdownInline(m[2]) + "</strong>")
+				text = text[len(m[0]):]
+				continue
+			}
+			if m := markdownEm.FindStringSubmatch(text); m != nil && m[1] == m[3] {
+				buf.WriteString("<em>" + renderMarkdownInline(m[2]) + "</em>")
+				text = text[len(m[0]):]
+				continue
+			}
+		}
+		buf.WriteString(html.EscapeString(text[:1]))
+		text = text[1:]
+	}
+	return buf.String()
+}
+
+// returns posted HTML body, or HTML rendering of posted Markdown body
+func readPostedDocument(req *http.Request) (*bytes.Buffer, error) {
+	contentType := req.Header.Get("Content-Type")
+	mediaType, params, _ := mime.ParseMediaType(contentType)
+	isHTML := mediaType == "text/html"
+	if !isHTML && !markdownMediaTypes[mediaType] {
+		return nil, NewHandlerError(http.StatusUnsupportedMediaType, "expected text/html or text/markdown request body: "+contentType)
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(req.Body, MaxMarkdownSize+1))
+	if err != nil {
+		return nil, &HandlerError{400, "request body read error", err}
+	}
+	if int64(len(data)) > MaxMarkdownSize {
+		return nil, NewHandlerError(http.StatusRequestEntityTooLarge, "document is bigger than "+strconv.FormatInt(MaxMarkdownSize, 10)+" bytes")
+	}
+	if label := params["charset"]; label != "" && !strings.EqualFold(label, "utf-8") {
+		r, err := charset.NewReaderLabel(label, bytes.NewReader(data))
+		if err != nil {
+			return nil, &HandlerError{400, "unsupported charset: " + label, err}
+		}
+		if data, err = ioutil.ReadAll(r); err != nil {
+			return nil, &HandlerError{400, "invalid charset sequence", err}
+		}
+	}
+	if isHTML {
+		return bytes.NewBuffer(data), nil
+	}
+	return renderMarkdown(data), nil
+}
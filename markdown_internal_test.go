@@ -0,0 +1,73 @@
+package imgserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("markdown", func() {
+	It("then blocks rendered", func() {
+		md := "# Title #\n\nSome *em* and **strong** `<code>`\ntext\n\n- one\n- two\n\n```\n<pre>\n```\n\n<div>raw</div>\n\n> quote\n"
+		Expect(renderMarkdown([]byte(md)).String()).To(Equal("<h1>Title</h1>\n" +
+			"<p>Some <em>em</em> and <strong>strong</strong> <code>&lt;code&gt;</code>\ntext</p>\n" +
+			"<ul>\n<li>one</li>\n<li>two</li>\n</ul>\n" +
+			"<pre><code>&lt;pre&gt;\n</code></pre>\n" +
+			"<div>raw</div>\n" +
+			"<blockquote>\n<p>quote</p>\n</blockquote>\n"))
+	})
+	It("then images and links rendered", func() {
+		md := `See [![logo](img/logo.png "Logo")](http://example.com) and <img src="a.png"> & \*`
+		Expect(renderMarkdown([]byte(md)).String()).To(Equal(`<p>See <a href="http://example.com">` +
+			`<img src="img/logo.png" alt="logo" title="Logo"></a> and <img src="a.png"> &amp; *</p>` + "\n"))
+	})
+	It("then markdown page rendered", func() {
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/markdown; charset=utf-8"}},
+			Body:       ioutil.NopCloser(strings.NewReader("![a](a.png)")),
+		}
+		body, err := getBody(context.Background(), resp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body.String()).To(Equal(`<p><img src="a.png" alt="a"></p>` + "\n"))
+	})
+	It("then posted markdown rendered", func() {
+		req := httptest.NewRequest("POST", InlinePath+"?url=http://example.com/", bytes.NewBufferString("![a](a.png)"))
+		req.Header.Set("Content-Type", "text/markdown")
+		body, err := readPostedDocument(req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body.String()).To(Equal(`<p><img src="a.png" alt="a"></p>` + "\n"))
+
+		req.Header.Set("Content-Type", "text/plain")
+		_, err = readPostedDocument(req)
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusUnsupportedMediaType))
+	})
+	It("then posted HTML passed as is", func() {
+		req := httptest.NewRequest("POST", InlinePath+"?url=http://example.com/", bytes.NewBufferString(`<img src="a.png">`))
+		req.Header.Set("Content-Type", "text/html; charset=utf-8")
+		body, err := readPostedDocument(req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body.String()).To(Equal(`<img src="a.png">`))
+	})
+	It("then response of posted document has body", func() {
+		handler := &ImgHandler{
+			Log: logger.StandardLogger(),
+			PostLogicHandler: logicHandlerFunc(func(ctx context.Context, req *http.Request) (*Response, error) {
+				resp := NewResponse()
+				resp.StatusCode = http.StatusOK
+				resp.Body.WriteString("inlined")
+				return resp, nil
+			}),
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTPC(context.Background(), w, httptest.NewRequest("POST", InlinePath+"?url=http://example.com/", nil))
+		Expect(w.Body.String()).To(Equal("inlined"))
+	})
+})
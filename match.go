@@ -0,0 +1,60 @@
+package imgserver
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Filter of images by alt text, title or URL, set by match query param.
+// Value wrapped in slashes, like /product|diagram/, is regular expression,
+// and other values are case insensitive substrings.
+type imageMatcher func(img imgTag, imgURL string) bool
+
+// Returns matcher of match param, or nil matcher of any image, if param is empty.
+func parseImageMatch(match string) (imageMatcher, error) {
+	if match == "" {
+		return nil, nil
+	}
+	if len(match) > 2 && strings.HasPrefix(match, "/") && strings.HasSuffix(match, "/") {
+		re, err := regexp.Compile(match[1 : len(match)-1])
+		if err != nil {
+			return nil, err
+		}
+		return newImageMatcher(re.MatchString), nil
+	}
+	match = strings.ToLower(match)
+	return newImageMatcher(func(s string) bool {
+		return strings.Contains(strings.ToLower(s), match)
+	}), nil
+}
+
+// Returns matcher of images, which alt, title, src or resolved URL is matched.
+// Data URLs are matched only by text attributes.
+func newImageMatcher(matchString func(s string) bool) imageMatcher {
+	return func(img imgTag, imgURL string) bool {
+		for _, attr := range img.attr {
+			if attr.Key == "alt" || attr.Key == "title" {
+				if matchString(attr.Val) {
+					return true
+				}
+			}
+		}
+		if img.isDataURL() {
+			return false
+		}
+		return matchString(img.src()) || imgURL != "" && matchString(imgURL)
+	}
+}
+
+// returns absolute URL of src, or empty string, if it is not resolvable
+func resolvedURL(src string, folderURL url.URL) string {
+	if strings.HasPrefix(src, "data:") {
+		return ""
+	}
+	imgURL, err := getImgURL(src, folderURL)
+	if err != nil {
+		return ""
+	}
+	return imgURL
+}
@@ -0,0 +1,63 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+var _ = Describe("match", func() {
+	img := func(attrs ...string) imgTag {
+		res := imgTag{0, nil, nil}
+		for i := 0; i < len(attrs); i += 2 {
+			res.attr = append(res.attr, html.Attribute{Key: attrs[i], Val: attrs[i+1]})
+		}
+		return res
+	}
+	It("then substring is matched case insensitive by alt, title or URL", func() {
+		match, err := parseImageMatch("Product")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(match(img("src", "a.png", "alt", "product photo"), "")).To(BeTrue())
+		Expect(match(img("src", "a.png", "title", "New PRODUCT"), "")).To(BeTrue())
+		Expect(match(img("src", "a.png"), "http://shop.test/products/a.png")).To(BeTrue())
+		Expect(match(img("src", "data:image/png;base64,product"), "")).To(BeFalse())
+		Expect(match(img("src", "logo.png", "alt", "Logo"), "http://shop.test/logo.png")).To(BeFalse())
+	})
+	It("then slash wrapped value is regular expression", func() {
+		match, err := parseImageMatch(`/^(diagram|chart)\b/`)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(match(img("src", "a.png", "alt", "chart of sales"), "")).To(BeTrue())
+		Expect(match(img("src", "a.png", "alt", "pie chart"), "")).To(BeFalse())
+		_, err = parseImageMatch("/(/")
+		Expect(err).To(HaveOccurred())
+		_, err = parseFetchOptions(url.Values{"match": {"/(/"}}, FetchOptions{}, FetchOptions{})
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusBadRequest))
+	})
+	It("then only matched images are fetched, and counted by first", func() {
+		var fetched []string
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/" {
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte(`<img src="logo.png" alt="Shop"><img src="p1.png" alt="Product 1"><img src="p2.png" title="product 2"><img src="p3.png" alt="Product 3">`))
+				return
+			}
+			fetched = append(fetched, r.URL.Path)
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("img"))
+		}))
+		defer origin.Close()
+		req := httptest.NewRequest("GET", "/?first=2&match=product&url="+url.QueryEscape(origin.URL+"/"), nil)
+		resp, err := NewImgLogicHandler(http.DefaultClient).HandleLogic(setLogger(context.Background(), logger.StandardLogger()), req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Body.String()).To(ContainSubstring(`alt="Product 1"`))
+		Expect(resp.Body.String()).To(ContainSubstring(`title="product 2"`))
+		Expect(resp.Body.String()).NotTo(ContainSubstring("Shop"))
+		Expect(fetched).To(ConsistOf("/p1.png", "/p2.png"))
+	})
+})
@@ -0,0 +1,73 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Localized client error messages. Messages are English by default.
+type MessageCatalog interface {
+	// Returns English message translated to language, like "de" or "pt-br", or false if there is no translation.
+	Message(lang, message string) (string, bool)
+}
+
+// Catalog of translations by lower cased language and English message.
+// Message can be description prefix before ": ", then detail after it, like bad param value, is kept.
+type MapCatalog map[string]map[string]string
+
+func (c MapCatalog) Message(lang, message string) (string, bool) {
+	translations, ok := c[lang]
+	if !ok {
+		return "", false
+	}
+	if res, ok := translations[message]; ok {
+		return res, true
+	}
+	if i := strings.Index(message, ": "); i > 0 {
+		if res, ok := translations[message[:i]]; ok {
+			return res + message[i:], true
+		}
+	}
+	return "", false
+}
+
+// Loads MapCatalog from JSON file, like {"de": {"unsupported format": "Format wird nicht unterstützt"}}.
+func LoadMessageCatalog(path string) (MapCatalog, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var parsed MapCatalog
+	if err := json.Unmarshal(data, &parsed); err != nil {
+		return nil, err
+	}
+	res := make(MapCatalog, len(parsed))
+	for lang, translations := range parsed {
+		res[strings.ToLower(lang)] = translations
+	}
+	return res, nil
+}
+
+// Returns message translated to most preferred language of client Accept-Language header,
+// language of translation, or message as is and empty language, when English is preferred or nothing matches.
+// Region tags fall back to base language, like pt-br to pt.
+func localizeMessage(catalog MessageCatalog, req *http.Request, message string) (string, string) {
+	if catalog == nil || req == nil {
+		return message, ""
+	}
+	for _, lang := range parseAccept(req.Header.Get("Accept-Language")) {
+		base := strings.Split(lang, "-")[0]
+		if base == "en" || base == "*" {
+			break
+		}
+		if res, ok := catalog.Message(lang, message); ok {
+			return res, lang
+		}
+		if res, ok := catalog.Message(base, message); ok && base != lang {
+			return res, base
+		}
+	}
+	return message, ""
+}
@@ -0,0 +1,45 @@
+package imgserver
+
+import (
+	"net/http/httptest"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("error messages", func() {
+	catalog := MapCatalog{
+		"de": {"unsupported format": "Format wird nicht unterstützt"},
+		"pt": {"bad": "ruim"},
+	}
+	localize := func(acceptLanguage, message string) (string, string) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", acceptLanguage)
+		return localizeMessage(catalog, req, message)
+	}
+	It("then message is translated to preferred language, with detail kept", func() {
+		msg, lang := localize("fr;q=0.5, de", "unsupported format: xml")
+		Expect(msg).To(Equal("Format wird nicht unterstützt: xml"))
+		Expect(lang).To(Equal("de"))
+		msg, lang = localize("pt-BR", "bad")
+		Expect(msg).To(Equal("ruim"))
+		Expect(lang).To(Equal("pt"))
+	})
+	It("then message is English, when English is preferred or there is no translation", func() {
+		msg, lang := localize("en-US, de;q=0.9", "bad")
+		Expect(msg).To(Equal("bad"))
+		Expect(lang).To(BeEmpty())
+		msg, _ = localize("de", "timeout is too big")
+		Expect(msg).To(Equal("timeout is too big"))
+	})
+	It("then client errors are localized", func() {
+		ctx := setLogger(context.Background(), logger.StandardLogger())
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", "de")
+		resp := ErrorLogger{Messages: catalog}.HandleError(ctx, req, NewHandlerError(400, "unsupported format: xml"))
+		Expect(resp.Header.Get("Content-Language")).To(Equal("de"))
+		Expect(resp.Body.String()).To(ContainSubstring("Format wird nicht unterstützt: xml"))
+	})
+})
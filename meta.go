@@ -0,0 +1,97 @@
+package imgserver
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// response statistics headers
+const (
+	ImageCountHeader  = "X-Imgserver-Image-Count"
+	ImagesBytesHeader = "X-Imgserver-Images-Bytes"
+	MetaCacheHeader   = "X-Imgserver-Meta-Cache"
+	TruncatedHeader   = "X-Imgserver-Truncated"    // processing budget exhausted
+	TotalImagesHeader = "X-Imgserver-Total-Images" // images of page, on offset or limit params
+)
+
+// Caches headers of rendered responses, so HEAD requests following GET or
+// another HEAD on same page are answered without page processing.
+type metaCache struct {
+	mu         sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]metaCacheEntry
+}
+
+type metaCacheEntry struct {
+	header  http.Header
+	expires time.Time
+}
+
+func newMetaCache(ttl time.Duration, maxEntries int) *metaCache {
+	return &metaCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    make(map[string]metaCacheEntry),
+	}
+}
+
+// returns copy of cached header, or nil
+func (c *metaCache) get(key string) http.Header {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return cloneHeader(entry.header)
+}
+
+func (c *metaCache) put(key string, header http.Header) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= c.maxEntries {
+		now := time.Now()
+		for k, entry := range c.entries {
+			if now.After(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		// still full: evict any
+		for k := range c.entries {
+			if len(c.entries) < c.maxEntries {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = metaCacheEntry{cloneHeader(header), time.Now().Add(c.ttl)}
+}
+
+func cloneHeader(h http.Header) http.Header {
+	res := make(http.Header, len(h))
+	for k, v := range h {
+		res[k] = append([]string(nil), v...)
+	}
+	return res
+}
+
+// returns size of data encoded in data URL without decoding
+func dataURLDataSize(dataURL string) int {
+	comma := strings.IndexByte(dataURL, ',')
+	if comma < 0 {
+		return 0
+	}
+	meta, payload := dataURL[:comma], dataURL[comma+1:]
+	if !strings.HasSuffix(meta, ";base64") {
+		return len(payload)
+	}
+	padding := len(payload) - len(strings.TrimRight(payload, "="))
+	return len(payload)/4*3 - padding
+}
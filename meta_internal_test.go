@@ -0,0 +1,45 @@
+package imgserver
+
+import (
+	"net/http"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("response meta cache", func() {
+	var cache *metaCache
+	BeforeEach(func() {
+		cache = newMetaCache(time.Minute, 2)
+	})
+	It("then returns put header copy", func() {
+		cache.put("a", http.Header{"Content-Length": {"10"}})
+		header := cache.get("a")
+		Expect(header.Get("Content-Length")).To(Equal("10"))
+		header.Set("Content-Length", "20")
+		Expect(cache.get("a").Get("Content-Length")).To(Equal("10"))
+	})
+	It("then evicts entries over limit", func() {
+		cache.put("a", http.Header{})
+		cache.put("b", http.Header{})
+		cache.put("c", http.Header{})
+		Expect(cache.entries).To(HaveLen(2))
+		Expect(cache.get("c")).NotTo(BeNil())
+	})
+	It("then expired entries are not returned", func() {
+		cache.ttl = -time.Second
+		cache.put("a", http.Header{})
+		Expect(cache.get("a")).To(BeNil())
+	})
+})
+
+var _ = Describe("data URL data size", func() {
+	It("then size of base64 data", func() {
+		Expect(dataURLDataSize("data:image/gif;base64,R0lG")).To(Equal(3))
+		Expect(dataURLDataSize("data:image/gif;base64,R0k=")).To(Equal(2))
+	})
+	It("then size of not encoded data", func() {
+		Expect(dataURLDataSize("data:,abc")).To(Equal(3))
+	})
+})
@@ -0,0 +1,192 @@
+package imgserver
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Code of OriginError of object URL, which scheme has no backend.
+const ObjectStorageDisabled = "object_storage_disabled"
+
+// Object storage URL schemes, that are accepted as page and image URLs.
+// Host of object URL is bucket or container, and path is object key.
+// file URLs are paths under root of ImgLogicHandler.EnableLocalFiles.
+var objectSchemes = map[string]bool{
+	"s3":     true,
+	"gs":     true,
+	"azblob": true,
+	"file":   true,
+}
+
+func isObjectURL(u *url.URL) bool {
+	if u.Scheme == "file" {
+		return u.Path != "" && (u.Host == "" || u.Host == "localhost")
+	}
+	return objectSchemes[u.Scheme] && u.Host != ""
+}
+
+// Returns true if src URL of subresource (image or frame) of page may be fetched. Object URLs are
+// fetched only as subresources of page from the same bucket, so public pages can't make server
+// read private objects by its storage credentials.
+func isSubresourceURL(pageURL, u *url.URL) bool {
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return true
+	}
+	return isObjectURL(u) && sameObjectBucket(pageURL, u)
+}
+
+// returns true if u is object URL of same scheme and bucket as base
+func sameObjectBucket(base, u *url.URL) bool {
+	if !objectSchemes[u.Scheme] || base.Scheme != u.Scheme {
+		return false
+	}
+	if u.Scheme == "file" {
+		// localhost is the only file host
+		return true
+	}
+	return strings.EqualFold(base.Host, u.Host)
+}
+
+// returns error, if req is redirect to object URL from other bucket or not object URL
+func checkObjectRedirect(req *http.Request) error {
+	if req.Response == nil || req.Response.Request == nil {
+		return nil
+	}
+	if from := req.Response.Request.URL; !sameObjectBucket(from, req.URL) {
+		return fmt.Errorf("redirect from %v to %v:// URL of other bucket is not allowed", from.Scheme, req.URL.Scheme)
+	}
+	return nil
+}
+
+// Resolves object URL to request of storage HTTP API, and authorizes it.
+// Returned request is sent instead of object one.
+type ObjectBackend interface {
+	ObjectRequest(req *http.Request) (*http.Request, error)
+}
+
+type ObjectBackendFunc func(req *http.Request) (*http.Request, error)
+
+func (f ObjectBackendFunc) ObjectRequest(req *http.Request) (*http.Request, error) {
+	return f(req)
+}
+
+// Returns RoundTripper decorator, that sends requests of object URLs to rt by backends of their schemes.
+// Other requests are passed to rt as is. Object URLs of schemes without backend fail with
+// ObjectStorageDisabled OriginError, so only configured storages are readable by clients.
+func NewObjectStorageTransport(rt http.RoundTripper, backends map[string]ObjectBackend) http.RoundTripper {
+	return objectStorageTransport{rt, backends}
+}
+
+type objectStorageTransport struct {
+	http.RoundTripper
+	backends map[string]ObjectBackend
+}
+
+func (t objectStorageTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !objectSchemes[req.URL.Scheme] {
+		return t.RoundTripper.RoundTrip(req)
+	}
+	var objectReq *http.Request
+	backend, ok := t.backends[req.URL.Scheme]
+	err := checkObjectRedirect(req)
+	if err != nil {
+		// page or image of public site can't redirect to private object
+	} else if !ok {
+		err = &OriginError{ObjectStorageDisabled, fmt.Sprintf("fetch of %v:// URLs is not enabled", req.URL.Scheme)}
+	} else if objectReq, err = backend.ObjectRequest(req); err != nil {
+		err = fmt.Errorf("object request error: %v", err)
+	}
+	if err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.RoundTripper.RoundTrip(objectReq)
+}
+
+// Returns copy of object request to storage URL, with headers of it.
+func newStorageRequest(req *http.Request, storageURL string) (*http.Request, error) {
+	u, err := url.Parse(storageURL)
+	if err != nil {
+		return nil, err
+	}
+	// RoundTripper should not modify request
+	res := *req
+	res.URL = u
+	res.Host = ""
+	res.Header = cloneHeader(req.Header)
+	return &res, nil
+}
+
+// Returns object key of URL path, escaped for storage URL.
+func objectKey(u *url.URL) string {
+	return strings.TrimPrefix(u.EscapedPath(), "/")
+}
+
+// Fetches s3://bucket/key objects by path-style S3 API requests, signed by AWS Signature V4.
+// Objects are fetched anonymously, when keys are not set.
+type S3Backend struct {
+	Endpoint  string // https://s3.<Region>.amazonaws.com, if empty
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+func (b *S3Backend) ObjectRequest(req *http.Request) (*http.Request, error) {
+	endpoint := b.Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + b.Region + ".amazonaws.com"
+	}
+	res, err := newStorageRequest(req, strings.TrimRight(endpoint, "/")+"/"+req.URL.Host+"/"+objectKey(req.URL))
+	if err != nil {
+		return nil, err
+	}
+	if b.AccessKey != "" {
+		signAWSV4(res, sha256Hex(nil), b.Region, b.AccessKey, b.SecretKey, time.Now().UTC())
+	}
+	return res, nil
+}
+
+// Default endpoint of Google Cloud Storage XML API, which is S3 compatible.
+const GCSEndpoint = "https://storage.googleapis.com"
+
+// Returns backend of gs://bucket/object URLs, that signs requests by GCS HMAC keys.
+// Objects are fetched anonymously, when keys are empty.
+func NewGCSBackend(accessKey, secretKey string) *S3Backend {
+	return &S3Backend{GCSEndpoint, "auto", accessKey, secretKey}
+}
+
+// Fetches azblob://container/blob objects of storage account by Blob service requests.
+// Shared access signature is added to every request, and public containers are read without it.
+type AzureBlobBackend struct {
+	Account  string
+	SASToken string // query string, with or without leading '?'
+	Endpoint string // https://<Account>.blob.core.windows.net, if empty
+}
+
+// Blob service API version, that is sent with requests.
+const azureBlobAPIVersion = "2019-12-12"
+
+func (b *AzureBlobBackend) ObjectRequest(req *http.Request) (*http.Request, error) {
+	endpoint := b.Endpoint
+	if endpoint == "" {
+		if b.Account == "" {
+			return nil, fmt.Errorf("azure storage account is not set")
+		}
+		endpoint = "https://" + b.Account + ".blob.core.windows.net"
+	}
+	storageURL := strings.TrimRight(endpoint, "/") + "/" + req.URL.Host + "/" + objectKey(req.URL)
+	if sas := strings.TrimPrefix(b.SASToken, "?"); sas != "" {
+		storageURL += "?" + sas
+	}
+	res, err := newStorageRequest(req, storageURL)
+	if err != nil {
+		return nil, err
+	}
+	res.Header.Set("X-Ms-Version", azureBlobAPIVersion)
+	return res, nil
+}
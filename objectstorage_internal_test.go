@@ -0,0 +1,93 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("object storage", func() {
+	var (
+		storage *httptest.Server
+		auth    []string
+	)
+	BeforeEach(func() {
+		auth = nil
+		storage = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth = append(auth, r.Header.Get("Authorization"))
+			switch r.URL.Path {
+			case "/reports/daily/index.html":
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte(`<img src="chart.png">`))
+			case "/reports/daily/chart.png":
+				w.Header().Set("Content-Type", "image/png")
+				w.Write([]byte("chart"))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+	})
+	AfterEach(func() {
+		storage.Close()
+	})
+	handle := func(backends map[string]ObjectBackend, pageURL string) (*Response, error) {
+		client := &http.Client{Transport: NewObjectStorageTransport(http.DefaultTransport, backends)}
+		req := httptest.NewRequest("GET", "/?url="+url.QueryEscape(pageURL), nil)
+		return NewImgLogicHandler(client).HandleLogic(setLogger(context.Background(), logger.StandardLogger()), req)
+	}
+
+	It("then page and its relative images are fetched by signed requests", func() {
+		backend := &S3Backend{storage.URL, "us-east-1", "AKID", "secret"}
+		resp, err := handle(map[string]ObjectBackend{"s3": backend}, "s3://reports/daily/index.html")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Body.String()).To(ContainSubstring("data:image/png;base64,Y2hhcnQ="))
+		Expect(auth).To(HaveLen(2))
+		for _, a := range auth {
+			Expect(a).To(HavePrefix("AWS4-HMAC-SHA256 Credential=AKID/"))
+		}
+	})
+	It("then azure shared access signature is added", func() {
+		backend := &AzureBlobBackend{Endpoint: storage.URL, SASToken: "?sig=s"}
+		req, err := http.NewRequest("GET", "azblob://reports/daily/index.html", nil)
+		Expect(err).NotTo(HaveOccurred())
+		objectReq, err := backend.ObjectRequest(req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(objectReq.URL.String()).To(Equal(storage.URL + "/reports/daily/index.html?sig=s"))
+		Expect(req.URL.Scheme).To(Equal("azblob"))
+	})
+	It("then not enabled scheme is rejected", func() {
+		_, err := handle(nil, "gs://reports/daily/index.html")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusBadRequest))
+		Expect(strings.Join(auth, "")).To(BeEmpty())
+	})
+	It("then objects are not fetched as subresources of http page", func() {
+		page := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/redirect.png" {
+				http.Redirect(w, r, "s3://reports/daily/chart.png", http.StatusFound)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			if r.URL.Path == "/object.html" {
+				w.Write([]byte(`<img src="s3://reports/daily/chart.png">`))
+				return
+			}
+			w.Write([]byte(`<img src="/redirect.png">`))
+		}))
+		defer page.Close()
+		backend := &S3Backend{storage.URL, "us-east-1", "AKID", "secret"}
+		_, err := handle(map[string]ObjectBackend{"s3": backend}, page.URL+"/object.html")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusBadRequest))
+		_, err = handle(map[string]ObjectBackend{"s3": backend}, page.URL+"/redirect.html")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusBadGateway))
+		Expect(auth).To(BeEmpty())
+	})
+})
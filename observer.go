@@ -0,0 +1,136 @@
+package imgserver
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Receives events of ImgLogicHandler requests, for custom metrics, auditing or side effects.
+// Callbacks are called from request goroutines, concurrently for different requests and images,
+// so they should be safe for concurrent use and should not block. Embed NopObserver to implement some of them.
+type Observer interface {
+	PageFetched(ctx context.Context, event PageEvent)
+	ImageDiscovered(ctx context.Context, event ImageEvent) // image URL is resolved, before fetch
+	ImageFetched(ctx context.Context, event ImageEvent)
+	ImageFailed(ctx context.Context, event ImageEvent)
+	RequestCompleted(ctx context.Context, event RequestEvent)
+}
+
+type PageEvent struct {
+	URL      string // of fetched page, after page redirects
+	Bytes    int    // decoded page size
+	Duration time.Duration
+}
+
+type ImageEvent struct {
+	PageURL  string
+	URL      string
+	Duration time.Duration // fetch duration, zero for discovered image
+	Err      error         // fetch error of failed image
+}
+
+type RequestEvent struct {
+	URL      string // url param as passed
+	Status   int
+	Images   int // inlined images count, 0 if not reported by response
+	Duration time.Duration
+	Err      error // nil if request succeeded
+}
+
+type NopObserver struct{}
+
+func (NopObserver) PageFetched(ctx context.Context, event PageEvent)         {}
+func (NopObserver) ImageDiscovered(ctx context.Context, event ImageEvent)    {}
+func (NopObserver) ImageFetched(ctx context.Context, event ImageEvent)       {}
+func (NopObserver) ImageFailed(ctx context.Context, event ImageEvent)        {}
+func (NopObserver) RequestCompleted(ctx context.Context, event RequestEvent) {}
+
+// Passes events to every observer in order.
+type MultiObserver []Observer
+
+func (m MultiObserver) PageFetched(ctx context.Context, event PageEvent) {
+	for _, o := range m {
+		o.PageFetched(ctx, event)
+	}
+}
+
+func (m MultiObserver) ImageDiscovered(ctx context.Context, event ImageEvent) {
+	for _, o := range m {
+		o.ImageDiscovered(ctx, event)
+	}
+}
+
+func (m MultiObserver) ImageFetched(ctx context.Context, event ImageEvent) {
+	for _, o := range m {
+		o.ImageFetched(ctx, event)
+	}
+}
+
+func (m MultiObserver) ImageFailed(ctx context.Context, event ImageEvent) {
+	for _, o := range m {
+		o.ImageFailed(ctx, event)
+	}
+}
+
+func (m MultiObserver) RequestCompleted(ctx context.Context, event RequestEvent) {
+	for _, o := range m {
+		o.RequestCompleted(ctx, event)
+	}
+}
+
+func setObserver(ctx context.Context, observer Observer) context.Context {
+	return context.WithValue(ctx, ctxObserverKey, observer)
+}
+
+// returns NopObserver if observer is not set
+func getObserver(ctx context.Context) Observer {
+	if observer, ok := ctx.Value(ctxObserverKey).(Observer); ok {
+		return observer
+	}
+	return NopObserver{}
+}
+
+// Returns callback, that reports fetch result of imgURL to ctx observer, and passes it to result.
+// Skipped images are not reported.
+func observeFetch(ctx context.Context, imgURL string, result fetchCallback) fetchCallback {
+	observer := getObserver(ctx)
+	if _, ok := observer.(NopObserver); ok {
+		return result
+	}
+	start := time.Now()
+	return func(img imgTag, err error) {
+		event := ImageEvent{getURLParam(ctx).String(), imgURL, time.Since(start), err}
+		if err == nil {
+			observer.ImageFetched(ctx, event)
+		} else if err != errImageSkipped {
+			observer.ImageFailed(ctx, event)
+		}
+		result(img, err)
+	}
+}
+
+// imageFetcher decorator, that reports fetch results to ctx observer.
+type observingImageFetcher struct {
+	fetcher imageFetcher
+}
+
+func (f observingImageFetcher) fetchImage(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+	f.fetcher.fetchImage(ctx, img, imgURL, observeFetch(ctx, imgURL, result))
+}
+
+func newRequestEvent(req *http.Request, resp *Response, err error, start time.Time) RequestEvent {
+	event := RequestEvent{URL: req.URL.Query().Get("url"), Duration: time.Since(start), Err: err}
+	if err != nil {
+		event.Status = http.StatusInternalServerError
+		if handlerErr, ok := err.(*HandlerError); ok {
+			event.Status = handlerErr.statusCode
+		}
+		return event
+	}
+	event.Status = resp.StatusCode
+	event.Images, _ = strconv.Atoi(resp.Header.Get(ImageCountHeader))
+	return event
+}
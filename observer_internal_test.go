@@ -0,0 +1,85 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"sync"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+type recordingObserver struct {
+	NopObserver
+	mu       sync.Mutex
+	events   []string
+	requests []RequestEvent
+}
+
+func (o *recordingObserver) record(event string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.events = append(o.events, event)
+}
+
+func (o *recordingObserver) PageFetched(ctx context.Context, event PageEvent) {
+	o.record("page " + event.URL)
+}
+
+func (o *recordingObserver) ImageDiscovered(ctx context.Context, event ImageEvent) {
+	o.record("discovered " + event.URL)
+}
+
+func (o *recordingObserver) ImageFetched(ctx context.Context, event ImageEvent) {
+	o.record("fetched " + event.URL)
+}
+
+func (o *recordingObserver) ImageFailed(ctx context.Context, event ImageEvent) {
+	o.record("failed " + event.URL)
+}
+
+func (o *recordingObserver) RequestCompleted(ctx context.Context, event RequestEvent) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requests = append(o.requests, event)
+}
+
+var _ = Describe("observer", func() {
+	It("then page, image and request events are observed", func() {
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/":
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte(`<img src="a.png"><img src="missing.png">`))
+			case "/a.png":
+				w.Header().Set("Content-Type", "image/png")
+				w.Write([]byte("a"))
+			default:
+				http.NotFound(w, r)
+			}
+		}))
+		defer origin.Close()
+		observer := &recordingObserver{}
+		handler := NewImgLogicHandler(http.DefaultClient)
+		handler.Observer = observer
+		req := httptest.NewRequest("GET", "/?tolerant=true&url="+url.QueryEscape(origin.URL+"/"), nil)
+		_, err := handler.HandleLogic(setLogger(context.Background(), logger.StandardLogger()), req)
+		Expect(err).NotTo(HaveOccurred())
+
+		sort.Strings(observer.events)
+		Expect(observer.events).To(Equal([]string{
+			"discovered " + origin.URL + "/a.png",
+			"discovered " + origin.URL + "/missing.png",
+			"failed " + origin.URL + "/missing.png",
+			"fetched " + origin.URL + "/a.png",
+			"page " + origin.URL + "/",
+		}))
+		Expect(observer.requests).To(HaveLen(1))
+		Expect(observer.requests[0].Status).To(Equal(http.StatusOK))
+		Expect(observer.requests[0].Images).To(Equal(2))
+	})
+})
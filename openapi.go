@@ -0,0 +1,614 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+const OpenAPIPath = "/openapi.json"
+
+type jsonObject map[string]interface{}
+
+func ref(name string) jsonObject {
+	return jsonObject{"$ref": name}
+}
+
+func queryParam(name string, required bool, description string, schema jsonObject) jsonObject {
+	return jsonObject{
+		"name":        name,
+		"in":          "query",
+		"required":    required,
+		"description": description,
+		"schema":      schema,
+	}
+}
+
+func headerParam(name string, description string) jsonObject {
+	return jsonObject{
+		"name":        name,
+		"in":          "header",
+		"required":    false,
+		"description": description,
+		"schema":      jsonObject{"type": "string"},
+	}
+}
+
+// OpenAPI 3 description of service API.
+// Should be updated with every API change.
+func newOpenAPISpec() jsonObject {
+	errorResponse := ref("#/components/responses/Error")
+	imageIndexParams := []jsonObject{
+		ref("#/components/parameters/url"),
+		ref("#/components/parameters/timeout"),
+		ref("#/components/parameters/max_image_size"),
+		ref("#/components/parameters/retries"),
+		ref("#/components/parameters/page_retries"),
+		ref("#/components/parameters/lowdata"),
+		ref("#/components/parameters/lang"),
+	}
+	inline := jsonObject{
+		"parameters": []jsonObject{
+			ref("#/components/parameters/url"),
+			ref("#/components/parameters/format"),
+			ref("#/components/parameters/callback_url"),
+			ref("#/components/parameters/combine"),
+			ref("#/components/parameters/sig"),
+			ref("#/components/parameters/timeout"),
+			ref("#/components/parameters/max_image_size"),
+			ref("#/components/parameters/concurrency"),
+			ref("#/components/parameters/inline_threshold"),
+			ref("#/components/parameters/links"),
+			ref("#/components/parameters/retries"),
+			ref("#/components/parameters/page_retries"),
+			ref("#/components/parameters/page_redirects"),
+			ref("#/components/parameters/frames"),
+			ref("#/components/parameters/scripts"),
+			ref("#/components/parameters/first"),
+			ref("#/components/parameters/offset"),
+			ref("#/components/parameters/limit"),
+			ref("#/components/parameters/tolerant"),
+			ref("#/components/parameters/skip_rate_limited"),
+			ref("#/components/parameters/strict_url"),
+			ref("#/components/parameters/order"),
+			ref("#/components/parameters/sort"),
+			ref("#/components/parameters/data_urls"),
+			ref("#/components/parameters/pick"),
+			ref("#/components/parameters/match"),
+			ref("#/components/parameters/budget_images"),
+			ref("#/components/parameters/budget_bytes"),
+			ref("#/components/parameters/budget_time"),
+			ref("#/components/parameters/store"),
+			ref("#/components/parameters/fonts"),
+			ref("#/components/parameters/strip"),
+			ref("#/components/parameters/render"),
+			ref("#/components/parameters/lowdata"),
+			ref("#/components/parameters/lang"),
+			ref("#/components/parameters/timing"),
+			ref("#/components/parameters/debug"),
+			ref("#/components/parameters/stream"),
+			ref("#/components/parameters/Accept"),
+			ref("#/components/parameters/X-Origin-Authorization"),
+		},
+		"get": jsonObject{
+			"summary": "Inline page images",
+			"responses": jsonObject{
+				"200": ref("#/components/responses/Inlined"),
+				"202": ref("#/components/responses/Accepted"),
+				"304": jsonObject{"description": "Page origin responded 304 Not Modified to forwarded If-None-Match or If-Modified-Since, and rendering is cached"},
+				"400": errorResponse,
+				"401": errorResponse,
+				"403": errorResponse,
+				"406": errorResponse,
+				"413": errorResponse,
+				"429": errorResponse,
+				"500": errorResponse,
+				"502": errorResponse,
+				"503": errorResponse,
+				"504": errorResponse,
+			},
+		},
+		"post": jsonObject{
+			"summary":     "Inline images of posted HTML or Markdown document",
+			"description": "url param is base of relative image URLs, page is not fetched. Pages with Markdown content type are rendered on GET too.",
+			"requestBody": jsonObject{
+				"required": true,
+				"content": jsonObject{
+					"text/html":     jsonObject{"schema": jsonObject{"type": "string"}},
+					"text/markdown": jsonObject{"schema": jsonObject{"type": "string"}},
+				},
+			},
+			"responses": jsonObject{
+				"200": ref("#/components/responses/Inlined"),
+				"400": errorResponse,
+				"413": errorResponse,
+				"415": errorResponse,
+			},
+		},
+		"head": jsonObject{
+			"summary": "Inline page images, response without body",
+			"description": "Returns headers of GET response, including Content-Length and statistics. " +
+				"Headers of recently rendered pages are served from cache without page processing, " + MetaCacheHeader + " header is set then.",
+			"responses": jsonObject{"200": jsonObject{
+				"description": "Headers of inlined page response",
+				"headers": jsonObject{
+					"Content-Length":  jsonObject{"schema": jsonObject{"type": "integer"}},
+					ImageCountHeader:  jsonObject{"schema": jsonObject{"type": "integer"}},
+					ImagesBytesHeader: jsonObject{"schema": jsonObject{"type": "integer"}},
+					MetaCacheHeader:   jsonObject{"schema": jsonObject{"type": "string", "enum": []string{"hit"}}},
+				},
+			}},
+		},
+	}
+	return jsonObject{
+		"openapi": "3.0.0",
+		"info": jsonObject{
+			"title":       "imgserver",
+			"description": "Downloads all <img> tag images from HTML page and returns page with images inlined as base64 data URLs. " + RootPath + " is an alias of " + InlinePath + ".",
+			"version":     "1.0.0",
+		},
+		// applied only when server started with API keys or JWT secret
+		"security": []jsonObject{
+			{},
+			{"apiKey": []string{}},
+			{"bearer": []string{}},
+		},
+		"paths": jsonObject{
+			InlinePath: inline,
+			RootPath:   inline,
+			SnapshotsPath: jsonObject{
+				"get": jsonObject{
+					"summary":     "List page snapshots, or redirect to snapshot by id",
+					"description": "Available when server started with snapshots archive. Snapshots are recorded by store param.",
+					"parameters": []jsonObject{
+						ref("#/components/parameters/url"),
+						queryParam("id", false, "Snapshot id. Redirects to stored snapshot, when passed", jsonObject{"type": "string"}),
+					},
+					"responses": jsonObject{
+						"200": jsonObject{"description": "Page snapshots ordered by time", "content": jsonObject{"application/json": jsonObject{"schema": ref("#/components/schemas/Snapshots")}}},
+						"302": jsonObject{"description": "Redirect to stored snapshot"},
+						"400": errorResponse,
+						"404": errorResponse,
+					},
+				},
+			},
+			SnapshotsDiffPath: jsonObject{
+				"get": jsonObject{
+					"summary": "Compare inlined image sets of two page snapshots",
+					"parameters": []jsonObject{
+						ref("#/components/parameters/url"),
+						queryParam("from", true, "Snapshot id", jsonObject{"type": "string"}),
+						queryParam("to", true, "Snapshot id", jsonObject{"type": "string"}),
+					},
+					"responses": jsonObject{
+						"200": jsonObject{"description": "Image content hashes added and removed in 'to' snapshot", "content": jsonObject{"application/json": jsonObject{"schema": ref("#/components/schemas/SnapshotsDiff")}}},
+						"400": errorResponse,
+						"404": errorResponse,
+					},
+				},
+			},
+			EmailPath: jsonObject{
+				"post": jsonObject{
+					"summary":     "Render HTML part of email with cid: references resolved and remote images inlined",
+					"description": "Available when server started with email mode. Remote images that can't be fetched are left as links.",
+					"requestBody": jsonObject{
+						"required": true,
+						"content":  jsonObject{"message/rfc822": jsonObject{"schema": jsonObject{"type": "string", "format": "binary"}}},
+					},
+					"responses": jsonObject{
+						"200": jsonObject{
+							"description": "Self-contained HTML",
+							"headers":     jsonObject{ImageCountHeader: jsonObject{"schema": jsonObject{"type": "integer"}}},
+							"content":     jsonObject{"text/html": jsonObject{"schema": jsonObject{"type": "string"}}},
+						},
+						"400": errorResponse,
+						"413": errorResponse,
+					},
+				},
+			},
+			CrawlPath: jsonObject{
+				"get": jsonObject{
+					"summary":     "List images of same origin pages crawled from site root or sitemap.xml",
+					"description": "Available when server started with crawl mode. Pages are visited breadth first, sequentially with politeness delay.",
+					"parameters": []jsonObject{
+						queryParam("url", true, "Site root page, or sitemap.xml URL", jsonObject{"type": "string", "format": "uri"}),
+						queryParam("max_pages", false, "Max visited pages. Can't exceed server limit", jsonObject{"type": "integer", "minimum": 1}),
+						queryParam("depth", false, "Max link hops from root. Can't exceed server limit", jsonObject{"type": "integer", "minimum": 1}),
+						queryParam("delay", false, "Pause between page requests in Go duration syntax. Can't be less than server limit", jsonObject{"type": "string"}),
+					},
+					"responses": jsonObject{
+						"200": jsonObject{"description": "Visited pages and deduplicated images", "content": jsonObject{"application/json": jsonObject{"schema": ref("#/components/schemas/Crawl")}}},
+						"400": errorResponse,
+						"502": errorResponse,
+						"504": errorResponse,
+					},
+				},
+			},
+			ImagesPath: jsonObject{
+				"get": jsonObject{
+					"summary":     "Index of page images by stable IDs",
+					"description": "Images are not fetched. IDs are hashes of resolved image URLs, so they are same for same image on every request.",
+					"parameters":  imageIndexParams,
+					"responses": jsonObject{
+						"200": jsonObject{"description": "Page images in document order", "content": jsonObject{"application/json": jsonObject{"schema": ref("#/components/schemas/ImageIndex")}}},
+						"400": errorResponse,
+						"504": errorResponse,
+					},
+				},
+			},
+			ImagesPath + "/{id}": jsonObject{
+				"get": jsonObject{
+					"summary":    "Single image of page index, as is",
+					"parameters": append([]jsonObject{{"name": "id", "in": "path", "required": true, "schema": jsonObject{"type": "string"}}}, imageIndexParams...),
+					"responses": jsonObject{
+						"200": jsonObject{"description": "Image, downloadable as attachment named by image URL", "content": jsonObject{"image/*": jsonObject{"schema": jsonObject{"type": "string", "format": "binary"}}}},
+						"400": errorResponse,
+						"404": errorResponse,
+						"502": errorResponse,
+						"504": errorResponse,
+					},
+				},
+			},
+			UsagePath: jsonObject{
+				"get": jsonObject{
+					"summary":     "Usage and quota of requesting API key in last 24 hours",
+					"description": "Available when server started with API keys or JWT secret. Not counted to usage.",
+					"responses": jsonObject{
+						"200": jsonObject{"description": "Key usage", "content": jsonObject{"application/json": jsonObject{"schema": ref("#/components/schemas/Usage")}}},
+						"401": errorResponse,
+					},
+				},
+			},
+			VersionPath: jsonObject{
+				"get": jsonObject{
+					"summary": "Build version and enabled optional features",
+					"responses": jsonObject{
+						"200": jsonObject{"description": "Build info", "content": jsonObject{"application/json": jsonObject{"schema": ref("#/components/schemas/BuildInfo")}}},
+					},
+				},
+			},
+			OpenAPIPath: jsonObject{
+				"get": jsonObject{
+					"summary": "This document",
+					"responses": jsonObject{
+						"200": jsonObject{"description": "OpenAPI document", "content": jsonObject{"application/json": jsonObject{}}},
+					},
+				},
+			},
+		},
+		"components": jsonObject{
+			"parameters": jsonObject{
+				"url": queryParam("url", true,
+					"URL of HTML page to process. URL without scheme, like example.com/page, is fetched by https. "+
+						"s3://, gs:// and azblob:// object URLs are fetched, if their object storage is enabled",
+					jsonObject{"type": "string", "format": "uri"}),
+				"format": queryParam("format", false,
+					"Output format, takes precedence over Accept header. page is whole page saved as single self-contained HTML file, "+
+						"multipart is multipart/mixed of HTML page and images as binary parts, without base64 overhead",
+					jsonObject{"type": "string", "enum": []string{"html", "json", "mhtml", "zip", "page", "multipart"}, "default": "html"}),
+				"render": queryParam("render", false,
+					"Render page by headless browser, for pages referencing images only after JavaScript runs. "+
+						"Available when server started with headless browser",
+					jsonObject{"type": "string", "enum": []string{"js"}}),
+				"lowdata": queryParam("lowdata", false,
+					"Choose smallest srcset candidates and recompress JPEG images, as for Save-Data: on header. "+
+						"DPR and Width client hint headers choose srcset candidates too",
+					jsonObject{"type": "boolean", "default": false}),
+				"lang": queryParam("lang", false,
+					"Language list forwarded to page origin in Accept-Language header, like en-US,fr;q=0.8. "+
+						"Client Accept-Language header is forwarded, when param is not passed",
+					jsonObject{"type": "string"}),
+				"timing": queryParam("timing", false,
+					"Report DNS, connect, TLS, time to first byte and transfer durations of page and image fetches "+
+						"in "+TimingHeader+" header, and in timings field of json format",
+					jsonObject{"type": "boolean", "default": false}),
+				"stream": queryParam("stream", false,
+					"Send status and headers as soon as page is fetched, and stream gallery images in fetch completion order. "+
+						"Image count, bytes and truncation are sent in trailers, failure after headers in "+StreamErrorTrailer+" trailer and error paragraph. "+
+						"Supported only with html format, without pick, store, debug, render and sort",
+					jsonObject{"type": "boolean", "default": false}),
+				"debug": queryParam("debug", false,
+					"Return JSON processing report instead of result: every discovered image with chosen source, "+
+						"fetch outcome, attempts and sizes, and not fetched images with reasons. Not supported with page format",
+					jsonObject{"type": "boolean", "default": false}),
+				"fonts": queryParam("fonts", false,
+					"Inline fonts referenced by CSS in page format",
+					jsonObject{"type": "boolean", "default": false}),
+				"strip": queryParam("strip", false,
+					"Comma separated list of resources removed from page format, for static snapshot making no requests: "+
+						"scripts with event handlers, css stylesheet links and imports, frames with objects and embeds, and fonts",
+					jsonObject{"type": "string", "pattern": "^(scripts|css|frames|fonts)(,(scripts|css|frames|fonts))*$"}),
+				"callback_url": queryParam("callback_url", false,
+					"Process page in background and POST result to this URL. "+
+						"Result body is signed by HMAC-SHA256 in "+CallbackSignatureHeader+" header when server has callback secret",
+					jsonObject{"type": "string", "format": "uri"}),
+				"combine": queryParam("combine", false,
+					"Render every of many url params into section of single HTML page. Not supported with store, pick, debug and callback_url",
+					jsonObject{"type": "boolean", "default": false}),
+				"sig": queryParam("sig", false,
+					"Base64url encoded HMAC-SHA256 of url param value. Required when server started with URL secret",
+					jsonObject{"type": "string"}),
+				"timeout": queryParam("timeout", false,
+					"Page processing timeout in Go duration syntax, like 10s. Can't exceed server limit",
+					jsonObject{"type": "string"}),
+				"max_image_size": queryParam("max_image_size", false,
+					"Request fails if any image is bigger, in bytes. Can't exceed server limit",
+					jsonObject{"type": "integer", "minimum": 1}),
+				"concurrency": queryParam("concurrency", false,
+					"Max parallel image fetches. Can't exceed server limit",
+					jsonObject{"type": "integer", "minimum": 1}),
+				"inline_threshold": queryParam("inline_threshold", false,
+					"Images bigger than this size in bytes are left as absolute URL links. Can't exceed server limit",
+					jsonObject{"type": "integer", "minimum": 1}),
+				"links": queryParam("links", false,
+					"Leave all images as absolute URL links without fetching them. Server with early hints enabled sends preload links of them in 103 Early Hints response",
+					jsonObject{"type": "boolean", "default": false}),
+				"retries": queryParam("retries", false,
+					"Image fetch retries on origin server error. Can't exceed server limit",
+					jsonObject{"type": "integer", "minimum": 0, "default": DefaultFetchOptions.Retries}),
+				"page_retries": queryParam("page_retries", false,
+					"Page fetch retries on origin server or network error, made only before request deadline. Can't exceed server limit",
+					jsonObject{"type": "integer", "minimum": 0, "default": DefaultFetchOptions.PageRetries}),
+				"page_redirects": queryParam("page_redirects", false,
+					"Meta refresh and canonical link hops followed before extraction, so images of shortener and interstitial pages target are returned. Can't exceed server limit",
+					jsonObject{"type": "integer", "minimum": 0, "default": DefaultFetchOptions.PageRedirects}),
+				"frames": queryParam("frames", false,
+					"Also return images of same origin frames and iframes, after page images. Nested frames are followed up to depth 2, at most 10 frames",
+					jsonObject{"type": "boolean", "default": false}),
+				"scripts": queryParam("scripts", false,
+					"Also return images of JSON-LD image properties and quoted image URLs of lazy loader and gallery script configs, in place of their scripts",
+					jsonObject{"type": "boolean", "default": false}),
+				"pick": queryParam("pick", false,
+					"Return only Nth image of page in document order, as raw image attachment instead of HTML. Not supported with page format",
+					jsonObject{"type": "integer", "minimum": 1}),
+				"match": queryParam("match", false,
+					"Return only images which alt text, title or URL contains value, case insensitive. Value wrapped in slashes, like /product|diagram/, is regular expression. First, pick and budgets count matched images. Not supported with page format",
+					jsonObject{"type": "string"}),
+				"order": queryParam("order", false,
+					"Order of images in result: document order, or fetch completion order, that returns first images sooner on streaming clients",
+					jsonObject{"type": "string", "enum": []string{"document", "completion"}, "default": "document"}),
+				"sort": queryParam("sort", false,
+					"Order of result images by fetched metadata: inlined data size or pixel area, biggest first, or content type. Images without metadata, like not inlined ones, are last, and ties are in document order. Not supported with completion order and page format",
+					jsonObject{"type": "string", "enum": imageSorts, "default": sortPosition}),
+				"data_urls": queryParam("data_urls", false,
+					"Policy of data URL images of page: keep as is, drop ones bigger than max_image_size, or process like fetched images, so they are checked, recompressed by client hints, and bigger than max_image_size fail. Server default is set by --data-urls",
+					jsonObject{"type": "string", "enum": dataURLPolicies, "default": DataURLsKeep}),
+				"tolerant": queryParam("tolerant", false,
+					"Replace images that can't be fetched by inline SVG placeholders showing image URL, instead of failing request",
+					jsonObject{"type": "boolean", "default": false}),
+				"skip_rate_limited": queryParam("skip_rate_limited", false,
+					"Leave out images, which origins still respond 429 Too Many Requests after retries, instead of failing request with 502",
+					jsonObject{"type": "boolean", "default": false}),
+				"strict_url": queryParam("strict_url", false,
+					"Reject url param without scheme, instead of defaulting it to https",
+					jsonObject{"type": "boolean", "default": false}),
+				"first": queryParam("first", false,
+					"Process only first images in document order, for previews. Can't exceed server limit",
+					jsonObject{"type": "integer", "minimum": 1}),
+				"offset": queryParam("offset", false,
+					"Skip images before offset in document order. Skipped images are not fetched, but counted in "+TotalImagesHeader+" header and JSON total",
+					jsonObject{"type": "integer", "minimum": 0, "default": 0}),
+				"limit": queryParam("limit", false,
+					"Process at most limit images after offset, for paging through pages with many images. Page is parsed to the end, so total is counted",
+					jsonObject{"type": "integer", "minimum": 1}),
+				"budget_images": queryParam("budget_images", false,
+					"Max images in result, result is truncated on more images. Can't exceed server limit",
+					jsonObject{"type": "integer", "minimum": 1}),
+				"budget_bytes": queryParam("budget_bytes", false,
+					"Fetching stops, when inlined images total size reaches budget, and result is truncated. Can't exceed server limit",
+					jsonObject{"type": "integer", "minimum": 1}),
+				"budget_time": queryParam("budget_time", false,
+					"Fetching stops after this time in Go duration syntax, and result is truncated. Can't exceed server limit",
+					jsonObject{"type": "string"}),
+				"store": queryParam("store", false,
+					"Store rendered page (page), or page and inlined images (all) to object storage by content addressed keys. "+
+						"Page URL is returned in "+StorageURLHeader+" header",
+					jsonObject{"type": "string", "enum": []string{"page", "all"}}),
+				"Accept": headerParam("Accept", "Output format negotiation when no format param passed"),
+				"X-Origin-Authorization": headerParam(OriginAuthorizationHeader,
+					"Authorization header value for page origin requests. Basic credentials can be passed in url userinfo too"),
+			},
+			"responses": jsonObject{
+				"Inlined": jsonObject{
+					"description": "Page with inlined images",
+					"headers": jsonObject{
+						"Vary":            jsonObject{"schema": jsonObject{"type": "string"}},
+						ImageCountHeader:  jsonObject{"schema": jsonObject{"type": "integer"}},
+						ImagesBytesHeader: jsonObject{"schema": jsonObject{"type": "integer"}, "description": "Total size of inlined images"},
+						TruncatedHeader:   jsonObject{"schema": jsonObject{"type": "boolean"}, "description": "Processing budget exhausted, not all page images returned"},
+						TotalImagesHeader: jsonObject{"schema": jsonObject{"type": "integer"}, "description": "Images of page, on offset or limit param, unless parse is stopped by first, pick or budget"},
+						StorageURLHeader:  jsonObject{"schema": jsonObject{"type": "string"}, "description": "Stored page URL, on store param"},
+						SnapshotIDHeader:  jsonObject{"schema": jsonObject{"type": "string"}, "description": "Recorded snapshot id, on store param"},
+						TimingHeader:      jsonObject{"schema": jsonObject{"type": "string"}, "description": "Fetch timings, on timing param"},
+					},
+					"content": jsonObject{
+						"text/html":         jsonObject{"schema": jsonObject{"type": "string"}},
+						"application/json":  jsonObject{"schema": ref("#/components/schemas/Images")},
+						"multipart/related": jsonObject{"schema": jsonObject{"type": "string", "format": "binary"}},
+						"multipart/mixed":   jsonObject{"schema": jsonObject{"type": "string", "format": "binary"}},
+						"application/zip":   jsonObject{"schema": jsonObject{"type": "string", "format": "binary"}},
+					},
+				},
+				"Accepted": jsonObject{
+					"description": "Request accepted for background processing with callback",
+					"headers":     jsonObject{CallbackIDHeader: jsonObject{"schema": jsonObject{"type": "string"}}},
+					"content":     jsonObject{"application/json": jsonObject{"schema": ref("#/components/schemas/Accepted")}},
+				},
+				"Error": jsonObject{
+					"description": "Request processing error. HTML page, when client asks for HTML by format param or Accept header",
+					"content": jsonObject{
+						"application/json": jsonObject{"schema": ref("#/components/schemas/Error")},
+						"text/html":        jsonObject{"schema": jsonObject{"type": "string"}},
+					},
+				},
+			},
+			"securitySchemes": jsonObject{
+				"apiKey": jsonObject{"type": "apiKey", "in": "header", "name": APIKeyHeader},
+				"bearer": jsonObject{"type": "http", "scheme": "bearer", "bearerFormat": "JWT or API key"},
+			},
+			"schemas": jsonObject{
+				"Error": jsonObject{
+					"type":     "object",
+					"required": []string{"error"},
+					"properties": jsonObject{
+						"error": jsonObject{"type": "string"},
+						"code": jsonObject{
+							"type":        "string",
+							"description": "Set when origin request failed, origin response is rejected as hostile, or page origin is down",
+							"enum":        []string{OriginStatus, OriginUnreachable, OriginUnsupported, OriginHeaderTooLarge, OriginContentTooLarge, OriginBodyTooSlow, OriginDown},
+						},
+						"last_success": jsonObject{"type": "string", "format": "date-time", "description": "Last response of down page origin"},
+					},
+				},
+				"Accepted": jsonObject{
+					"type": "object",
+					"properties": jsonObject{
+						"status": jsonObject{"type": "string"},
+						"id":     jsonObject{"type": "string"},
+					},
+				},
+				"Image": jsonObject{
+					"type":     "object",
+					"required": []string{"src"},
+					"properties": jsonObject{
+						"src":        jsonObject{"type": "string", "description": "data URL"},
+						"attributes": jsonObject{"type": "object", "additionalProperties": jsonObject{"type": "string"}},
+					},
+				},
+				"Snapshot": jsonObject{
+					"type": "object",
+					"properties": jsonObject{
+						"id":          jsonObject{"type": "string"},
+						"time":        jsonObject{"type": "string", "format": "date-time"},
+						"storage_url": jsonObject{"type": "string"},
+						"images":      jsonObject{"type": "array", "items": jsonObject{"type": "string"}, "description": "SHA-256 of inlined images"},
+					},
+				},
+				"Snapshots": jsonObject{
+					"type": "object",
+					"properties": jsonObject{
+						"url":       jsonObject{"type": "string"},
+						"snapshots": jsonObject{"type": "array", "items": ref("#/components/schemas/Snapshot")},
+					},
+				},
+				"SnapshotsDiff": jsonObject{
+					"type": "object",
+					"properties": jsonObject{
+						"from":    jsonObject{"type": "string"},
+						"to":      jsonObject{"type": "string"},
+						"added":   jsonObject{"type": "array", "items": jsonObject{"type": "string"}},
+						"removed": jsonObject{"type": "array", "items": jsonObject{"type": "string"}},
+					},
+				},
+				"BuildInfo": jsonObject{
+					"type": "object",
+					"properties": jsonObject{
+						"version":    jsonObject{"type": "string"},
+						"commit":     jsonObject{"type": "string"},
+						"go_version": jsonObject{"type": "string"},
+						"decoders":   jsonObject{"type": "array", "items": jsonObject{"type": "string"}},
+						"features":   jsonObject{"type": "array", "items": jsonObject{"type": "string"}},
+						"storage":    jsonObject{"type": "string", "enum": []string{"file", "s3", "custom"}},
+					},
+				},
+				"Usage": jsonObject{
+					"type": "object",
+					"properties": jsonObject{
+						"id":       jsonObject{"type": "string"},
+						"requests": jsonObject{"type": "integer"},
+						"bytes":    jsonObject{"type": "integer"},
+						"quota": jsonObject{
+							"type": "object",
+							"properties": jsonObject{
+								"requests": jsonObject{"type": "integer"},
+								"bytes":    jsonObject{"type": "integer"},
+							},
+						},
+						"reset": jsonObject{"type": "integer", "description": "Seconds until oldest counted usage leaves window"},
+					},
+				},
+				"ImageIndex": jsonObject{
+					"type": "object",
+					"properties": jsonObject{
+						"url":   jsonObject{"type": "string"},
+						"count": jsonObject{"type": "integer"},
+						"images": jsonObject{"type": "array", "items": jsonObject{
+							"type": "object",
+							"properties": jsonObject{
+								"id":         jsonObject{"type": "string"},
+								"url":        jsonObject{"type": "string"},
+								"attributes": jsonObject{"type": "object", "additionalProperties": jsonObject{"type": "string"}},
+							},
+						}},
+					},
+				},
+				"Crawl": jsonObject{
+					"type": "object",
+					"properties": jsonObject{
+						"url": jsonObject{"type": "string"},
+						"pages": jsonObject{"type": "array", "items": jsonObject{
+							"type": "object",
+							"properties": jsonObject{
+								"url":    jsonObject{"type": "string"},
+								"depth":  jsonObject{"type": "integer"},
+								"images": jsonObject{"type": "integer"},
+								"error":  jsonObject{"type": "string"},
+							},
+						}},
+						"images": jsonObject{"type": "array", "items": jsonObject{
+							"type": "object",
+							"properties": jsonObject{
+								"url":   jsonObject{"type": "string"},
+								"pages": jsonObject{"type": "array", "items": jsonObject{"type": "string"}},
+							},
+						}},
+					},
+				},
+				"Images": jsonObject{
+					"type": "object",
+					"properties": jsonObject{
+						"url":       jsonObject{"type": "string"},
+						"count":     jsonObject{"type": "integer"},
+						"total":     jsonObject{"type": "integer", "description": "Images of page, on offset or limit param"},
+						"truncated": jsonObject{"type": "boolean"},
+						"images":    jsonObject{"type": "array", "items": ref("#/components/schemas/Image")},
+						"timings":   jsonObject{"type": "array", "items": ref("#/components/schemas/Timing")},
+					},
+				},
+				"Timing": jsonObject{
+					"type":        "object",
+					"description": "Fetch phase durations in milliseconds, on timing param",
+					"properties": jsonObject{
+						"url":         jsonObject{"type": "string"},
+						"dns_ms":      jsonObject{"type": "number"},
+						"connect_ms":  jsonObject{"type": "number"},
+						"tls_ms":      jsonObject{"type": "number"},
+						"ttfb_ms":     jsonObject{"type": "number"},
+						"transfer_ms": jsonObject{"type": "number"},
+					},
+				},
+			},
+		},
+	}
+}
+
+var openAPISpec = func() []byte {
+	spec, err := json.MarshalIndent(newOpenAPISpec(), "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	return spec
+}()
+
+// Serves OpenAPI document of service API.
+func OpenAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(openAPISpec)))
+	if r.Method == http.MethodGet {
+		w.Write(openAPISpec)
+	}
+}
@@ -0,0 +1,29 @@
+package imgserver
+
+import (
+	"encoding/json"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("OpenAPI spec", func() {
+	var spec map[string]interface{}
+	BeforeEach(func() {
+		spec = nil
+		Expect(json.Unmarshal(openAPISpec, &spec)).To(Succeed())
+	})
+	It("then describes API paths", func() {
+		Expect(spec).To(HaveKey("paths"))
+		paths := spec["paths"].(map[string]interface{})
+		Expect(paths).To(HaveKey(InlinePath))
+		Expect(paths).To(HaveKey(RootPath))
+		Expect(paths).To(HaveKey(OpenAPIPath))
+	})
+	It("then describes all supported query params", func() {
+		params := spec["components"].(map[string]interface{})["parameters"].(map[string]interface{})
+		for name := range queryParamSchema {
+			Expect(params).To(HaveKey(name))
+		}
+	})
+})
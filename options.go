@@ -0,0 +1,274 @@
+package imgserver
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Per request fetch behaviour. Can be overridden by query params of same names.
+type FetchOptions struct {
+	Timeout         time.Duration // page processing timeout, only handler timeout if 0
+	MaxImageSize    int64         // bytes, request fails on bigger image, no limit if 0
+	Concurrency     int           // max parallel image fetches, no limit if 0
+	InlineThreshold int64         // bytes, bigger images are left as absolute URL links, all inlined if 0
+	Links           bool          // images are left as absolute URL links without fetch, instead of inlined
+	Retries         int           // image fetch retries on origin server error
+	PageRetries     int           // page fetch retries on origin server or network error, within request deadline
+	PageRedirects   int           // meta refresh and canonical link hops followed before extraction, none if 0
+	Frames          bool          // images of same origin frames and iframes are merged into page images
+	Scripts         bool          // image URLs of JSON-LD and script configs are extracted too, in place of their scripts
+	DataURLs        string        // policy of data URL images of page: DataURLsKeep, DataURLsDrop or DataURLsProcess; kept if empty
+	FirstImages     int           // only first images in document order are processed, all if 0
+	Pick            int           // only Nth image in document order is processed, and returned as raw image, if not 0
+	Tolerant        bool          // failed images are replaced by placeholders, instead of failing request
+	SkipRateLimited bool          // images of origins still rate limiting after retries are left out, instead of failing request
+	CompletionOrder bool          // images are returned in fetch completion order, instead of document order
+	Sort            string        // images are sorted by fetched size, dimensions or type, document order if empty
+	Match           string        // only images with alt, title or URL matched are processed, all if empty
+	Offset          int           // images before offset in document order are skipped, but counted in total
+	Limit           int           // max images processed after offset, all if 0; rest are counted in total
+
+	// Processing budget. After any is exhausted, no more images are fetched,
+	// and already fetched are returned as truncated result. No budget if 0.
+	BudgetImages int
+	BudgetBytes  int64 // of images data
+	BudgetTime   time.Duration
+}
+
+var DefaultFetchOptions = FetchOptions{Retries: 3, PageRetries: 2}
+
+// Returns options from query params, where not passed params are taken from defaults.
+// Non zero limits fields are ceilings for both passed and default values.
+func parseFetchOptions(query url.Values, defaults, limits FetchOptions) (FetchOptions, error) {
+	opts := defaults
+	var err error
+	if opts.Timeout, err = parseDurationParam(query, "timeout", opts.Timeout); err != nil {
+		return opts, err
+	}
+	if opts.BudgetTime, err = parseDurationParam(query, "budget_time", opts.BudgetTime); err != nil {
+		return opts, err
+	}
+	if opts.BudgetBytes, err = parseSizeParam(query, "budget_bytes", opts.BudgetBytes); err != nil {
+		return opts, err
+	}
+	if param := query.Get("budget_images"); param != "" {
+		if opts.BudgetImages, err = strconv.Atoi(param); err != nil || opts.BudgetImages <= 0 {
+			return opts, NewHandlerError(400, "invalid 'budget_images' query parameter: "+param)
+		}
+	}
+	if opts.MaxImageSize, err = parseSizeParam(query, "max_image_size", opts.MaxImageSize); err != nil {
+		return opts, err
+	}
+	if opts.InlineThreshold, err = parseSizeParam(query, "inline_threshold", opts.InlineThreshold); err != nil {
+		return opts, err
+	}
+	if param := query.Get("concurrency"); param != "" {
+		if opts.Concurrency, err = strconv.Atoi(param); err != nil || opts.Concurrency <= 0 {
+			return opts, NewHandlerError(400, "invalid 'concurrency' query parameter: "+param)
+		}
+	}
+	if param := query.Get("first"); param != "" {
+		if opts.FirstImages, err = strconv.Atoi(param); err != nil || opts.FirstImages <= 0 {
+			return opts, NewHandlerError(400, "invalid 'first' query parameter: "+param)
+		}
+	}
+	if param := query.Get("offset"); param != "" {
+		if opts.Offset, err = strconv.Atoi(param); err != nil || opts.Offset < 0 {
+			return opts, NewHandlerError(400, "invalid 'offset' query parameter: "+param)
+		}
+	}
+	if param := query.Get("limit"); param != "" {
+		if opts.Limit, err = strconv.Atoi(param); err != nil || opts.Limit <= 0 {
+			return opts, NewHandlerError(400, "invalid 'limit' query parameter: "+param)
+		}
+	}
+	if param := query.Get("retries"); param != "" {
+		if opts.Retries, err = strconv.Atoi(param); err != nil || opts.Retries < 0 {
+			return opts, NewHandlerError(400, "invalid 'retries' query parameter: "+param)
+		}
+	}
+	if param := query.Get("pick"); param != "" {
+		if opts.Pick, err = strconv.Atoi(param); err != nil || opts.Pick <= 0 {
+			return opts, NewHandlerError(400, "invalid 'pick' query parameter: "+param)
+		}
+	}
+	if param := query.Get("tolerant"); param != "" {
+		if opts.Tolerant, err = strconv.ParseBool(param); err != nil {
+			return opts, NewHandlerError(400, "invalid 'tolerant' query parameter: "+param)
+		}
+	}
+	if param := query.Get("frames"); param != "" {
+		if opts.Frames, err = strconv.ParseBool(param); err != nil {
+			return opts, NewHandlerError(400, "invalid 'frames' query parameter: "+param)
+		}
+	}
+	if param := query.Get("match"); param != "" {
+		if _, err := parseImageMatch(param); err != nil {
+			return opts, &HandlerError{400, "invalid 'match' query parameter regular expression: " + param, err}
+		}
+		opts.Match = param
+	}
+	if param := query.Get("scripts"); param != "" {
+		if opts.Scripts, err = strconv.ParseBool(param); err != nil {
+			return opts, NewHandlerError(400, "invalid 'scripts' query parameter: "+param)
+		}
+	}
+	if param := query.Get("skip_rate_limited"); param != "" {
+		if opts.SkipRateLimited, err = strconv.ParseBool(param); err != nil {
+			return opts, NewHandlerError(400, "invalid 'skip_rate_limited' query parameter: "+param)
+		}
+	}
+	if param := query.Get("links"); param != "" {
+		if opts.Links, err = strconv.ParseBool(param); err != nil {
+			return opts, NewHandlerError(400, "invalid 'links' query parameter: "+param)
+		}
+	}
+	if param := query.Get("order"); param != "" {
+		if param != "document" && param != "completion" {
+			return opts, NewHandlerError(400, "invalid 'order' query parameter, expected document or completion: "+param)
+		}
+		opts.CompletionOrder = param == "completion"
+	}
+	if param := query.Get("data_urls"); param != "" {
+		switch param {
+		case DataURLsKeep, DataURLsDrop, DataURLsProcess:
+			opts.DataURLs = param
+		default:
+			return opts, NewHandlerError(400, "invalid 'data_urls' query parameter, expected "+strings.Join(dataURLPolicies, ", ")+": "+param)
+		}
+	}
+	if param := query.Get("sort"); param != "" {
+		switch param = strings.ToLower(param); param {
+		case sortPosition, sortSize, sortDimensions, sortType:
+		default:
+			return opts, NewHandlerError(400, "invalid 'sort' query parameter, expected "+strings.Join(imageSorts, ", ")+": "+param)
+		}
+		if opts.CompletionOrder && param != sortPosition {
+			return opts, NewHandlerError(400, "'sort' query parameter is not supported with completion order")
+		}
+		if opts.Links && param != sortPosition {
+			return opts, NewHandlerError(400, "'sort' query parameter is not supported with links")
+		}
+		opts.Sort = param
+	}
+	if param := query.Get("page_retries"); param != "" {
+		if opts.PageRetries, err = strconv.Atoi(param); err != nil || opts.PageRetries < 0 {
+			return opts, NewHandlerError(400, "invalid 'page_retries' query parameter: "+param)
+		}
+	}
+	if param := query.Get("page_redirects"); param != "" {
+		if opts.PageRedirects, err = strconv.Atoi(param); err != nil || opts.PageRedirects < 0 {
+			return opts, NewHandlerError(400, "invalid 'page_redirects' query parameter: "+param)
+		}
+	}
+
+	// zero is unlimited, so it is over any ceiling
+	if limits.Timeout > 0 && (opts.Timeout == 0 || opts.Timeout > limits.Timeout) {
+		if query.Get("timeout") != "" {
+			return opts, NewHandlerError(400, "'timeout' query parameter exceeds server limit "+limits.Timeout.String())
+		}
+		opts.Timeout = limits.Timeout
+	}
+	if limits.MaxImageSize > 0 && (opts.MaxImageSize == 0 || opts.MaxImageSize > limits.MaxImageSize) {
+		if query.Get("max_image_size") != "" {
+			return opts, NewHandlerError(400, "'max_image_size' query parameter exceeds server limit "+strconv.FormatInt(limits.MaxImageSize, 10))
+		}
+		opts.MaxImageSize = limits.MaxImageSize
+	}
+	if limits.InlineThreshold > 0 && (opts.InlineThreshold == 0 || opts.InlineThreshold > limits.InlineThreshold) {
+		if query.Get("inline_threshold") != "" {
+			return opts, NewHandlerError(400, "'inline_threshold' query parameter exceeds server limit "+strconv.FormatInt(limits.InlineThreshold, 10))
+		}
+		opts.InlineThreshold = limits.InlineThreshold
+	}
+	if limits.Concurrency > 0 && (opts.Concurrency == 0 || opts.Concurrency > limits.Concurrency) {
+		if query.Get("concurrency") != "" {
+			return opts, NewHandlerError(400, "'concurrency' query parameter exceeds server limit "+strconv.Itoa(limits.Concurrency))
+		}
+		opts.Concurrency = limits.Concurrency
+	}
+	if limits.FirstImages > 0 && (opts.FirstImages == 0 || opts.FirstImages > limits.FirstImages) {
+		if query.Get("first") != "" {
+			return opts, NewHandlerError(400, "'first' query parameter exceeds server limit "+strconv.Itoa(limits.FirstImages))
+		}
+		opts.FirstImages = limits.FirstImages
+	}
+	if limits.BudgetTime > 0 && (opts.BudgetTime == 0 || opts.BudgetTime > limits.BudgetTime) {
+		if query.Get("budget_time") != "" {
+			return opts, NewHandlerError(400, "'budget_time' query parameter exceeds server limit "+limits.BudgetTime.String())
+		}
+		opts.BudgetTime = limits.BudgetTime
+	}
+	if limits.BudgetBytes > 0 && (opts.BudgetBytes == 0 || opts.BudgetBytes > limits.BudgetBytes) {
+		if query.Get("budget_bytes") != "" {
+			return opts, NewHandlerError(400, "'budget_bytes' query parameter exceeds server limit "+strconv.FormatInt(limits.BudgetBytes, 10))
+		}
+		opts.BudgetBytes = limits.BudgetBytes
+	}
+	if limits.BudgetImages > 0 && (opts.BudgetImages == 0 || opts.BudgetImages > limits.BudgetImages) {
+		if query.Get("budget_images") != "" {
+			return opts, NewHandlerError(400, "'budget_images' query parameter exceeds server limit "+strconv.Itoa(limits.BudgetImages))
+		}
+		opts.BudgetImages = limits.BudgetImages
+	}
+	if limits.Retries > 0 && opts.Retries > limits.Retries {
+		if query.Get("retries") != "" {
+			return opts, NewHandlerError(400, "'retries' query parameter exceeds server limit "+strconv.Itoa(limits.Retries))
+		}
+		opts.Retries = limits.Retries
+	}
+	if limits.PageRetries > 0 && opts.PageRetries > limits.PageRetries {
+		if query.Get("page_retries") != "" {
+			return opts, NewHandlerError(400, "'page_retries' query parameter exceeds server limit "+strconv.Itoa(limits.PageRetries))
+		}
+		opts.PageRetries = limits.PageRetries
+	}
+	if limits.PageRedirects > 0 && opts.PageRedirects > limits.PageRedirects {
+		if query.Get("page_redirects") != "" {
+			return opts, NewHandlerError(400, "'page_redirects' query parameter exceeds server limit "+strconv.Itoa(limits.PageRedirects))
+		}
+		opts.PageRedirects = limits.PageRedirects
+	}
+	return opts, nil
+}
+
+func parseDurationParam(query url.Values, name string, defaultValue time.Duration) (time.Duration, error) {
+	param := query.Get(name)
+	if param == "" {
+		return defaultValue, nil
+	}
+	d, err := time.ParseDuration(param)
+	if err != nil || d <= 0 {
+		return 0, NewHandlerError(400, "invalid '"+name+"' query parameter: "+param)
+	}
+	return d, nil
+}
+
+func parseSizeParam(query url.Values, name string, defaultValue int64) (int64, error) {
+	param := query.Get(name)
+	if param == "" {
+		return defaultValue, nil
+	}
+	size, err := strconv.ParseInt(param, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, NewHandlerError(400, "invalid '"+name+"' query parameter: "+param)
+	}
+	return size, nil
+}
+
+func setFetchOptions(ctx context.Context, opts FetchOptions) context.Context {
+	return context.WithValue(ctx, ctxFetchOptionsKey, opts)
+}
+
+// returns options set for request, or DefaultFetchOptions
+func getFetchOptions(ctx context.Context) FetchOptions {
+	opts, ok := ctx.Value(ctxFetchOptionsKey).(FetchOptions)
+	if !ok {
+		return DefaultFetchOptions
+	}
+	return opts
+}
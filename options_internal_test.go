@@ -0,0 +1,75 @@
+package imgserver
+
+import (
+	"net/url"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("fetch options parse", func() {
+	var (
+		query  url.Values
+		limits FetchOptions
+		opts   FetchOptions
+		err    error
+	)
+	BeforeEach(func() {
+		query = url.Values{}
+		limits = FetchOptions{}
+	})
+	JustBeforeEach(func() {
+		opts, err = parseFetchOptions(query, DefaultFetchOptions, limits)
+	})
+
+	Context("when no params", func() {
+		It("then defaults", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opts).To(Equal(DefaultFetchOptions))
+		})
+	})
+	Context("when all params", func() {
+		BeforeEach(func() {
+			query.Set("timeout", "5s")
+			query.Set("max_image_size", "1000")
+			query.Set("concurrency", "2")
+			query.Set("inline_threshold", "100")
+			query.Set("retries", "0")
+			query.Set("page_retries", "0")
+			query.Set("offset", "50")
+			query.Set("limit", "50")
+		})
+		It("then parsed", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opts).To(Equal(FetchOptions{Timeout: 5 * time.Second, MaxImageSize: 1000, Concurrency: 2, InlineThreshold: 100, Offset: 50, Limit: 50}))
+		})
+	})
+	Context("when invalid value", func() {
+		BeforeEach(func() {
+			query.Set("concurrency", "-1")
+		})
+		It("then client error", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*HandlerError).statusCode).To(Equal(400))
+		})
+	})
+	Context("when server limits", func() {
+		BeforeEach(func() {
+			limits = FetchOptions{Timeout: time.Second, MaxImageSize: 1000, Retries: 1, PageRetries: 1}
+		})
+		It("then defaults are capped", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(opts).To(Equal(FetchOptions{Timeout: time.Second, MaxImageSize: 1000, Retries: 1, PageRetries: 1}))
+		})
+		Context("and param over limit", func() {
+			BeforeEach(func() {
+				query.Set("max_image_size", "1001")
+			})
+			It("then client error", func() {
+				Expect(err).To(HaveOccurred())
+				Expect(err.(*HandlerError).statusCode).To(Equal(400))
+			})
+		})
+	})
+})
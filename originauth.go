@@ -0,0 +1,76 @@
+package imgserver
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/context"
+)
+
+// Authorization header value of this request header is forwarded to page origin.
+const OriginAuthorizationHeader = "X-Origin-Authorization"
+
+// Credentials for requests to page origin. Images from other origins
+// are fetched without them.
+type originAuth struct {
+	origin        string // scheme://host
+	authorization string
+}
+
+// Removes userinfo from page URL, and returns credentials from it or from
+// X-Origin-Authorization header, which takes precedence. Returns nil auth if there no credentials.
+func extractOriginAuth(pageURL *url.URL, header string) (*url.URL, *originAuth) {
+	authorization := header
+	if pageURL.User != nil {
+		if header == "" {
+			password, _ := pageURL.User.Password()
+			authorization = "Basic " + base64.StdEncoding.EncodeToString([]byte(pageURL.User.Username()+":"+password))
+		}
+		stripped := *pageURL
+		stripped.User = nil
+		pageURL = &stripped
+	}
+	if authorization == "" {
+		return pageURL, nil
+	}
+	return pageURL, &originAuth{origin: urlOrigin(pageURL), authorization: authorization}
+}
+
+func urlOrigin(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// sets credentials on request to auth origin
+func (a *originAuth) apply(req *http.Request) {
+	if a == nil || urlOrigin(req.URL) != a.origin {
+		return
+	}
+	req.Header.Set("Authorization", a.authorization)
+}
+
+func setOriginAuth(ctx context.Context, auth *originAuth) context.Context {
+	return context.WithValue(ctx, ctxOriginAuthKey, auth)
+}
+
+// returns nil if no credentials passed
+func getOriginAuth(ctx context.Context) *originAuth {
+	auth, _ := ctx.Value(ctxOriginAuthKey).(*originAuth)
+	return auth
+}
+
+// returns request URL with masked url param password, for logging
+func redactRequestURL(requestURL *url.URL) string {
+	query := requestURL.Query()
+	pageURL, err := url.Parse(query.Get("url"))
+	if err != nil || pageURL.User == nil {
+		return requestURL.String()
+	}
+	if _, ok := pageURL.User.Password(); ok {
+		pageURL.User = url.UserPassword(pageURL.User.Username(), "xxxxx")
+	}
+	query.Set("url", pageURL.String())
+	res := *requestURL
+	res.RawQuery = query.Encode()
+	return res.String()
+}
@@ -0,0 +1,162 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// Code of error response, that page origin is known to be down by probes.
+const OriginDown = "origin_down"
+
+// Page origin is down, so request fails without fetch.
+type OriginDownError struct {
+	OriginError
+	LastSuccess time.Time // of last probe or page fetch, zero if origin never responded
+}
+
+// Probes frequently requested page origins in background. Requests of origins known to be down
+// are served by cached rendering, if any, or fail with OriginDown error at once,
+// instead of waiting for page fetch timeout.
+type OriginHealth struct {
+	Interval      time.Duration // between probe rounds
+	Timeout       time.Duration // of probe request
+	MinRequests   int           // page requests of origin within interval, that make it probed
+	FailThreshold int           // consecutive failed probes, that make origin down
+	MaxHosts      int           // probed origins, no limit if 0
+
+	client *http.Client
+	mu     sync.Mutex
+	hosts  map[string]*originState
+}
+
+type originState struct {
+	pageURL     string // last requested, probed by HEAD
+	requests    int    // since last probe round
+	failures    int    // consecutive failed probes
+	lastSuccess time.Time
+}
+
+func NewOriginHealth(client *http.Client) *OriginHealth {
+	return &OriginHealth{
+		Interval:      10 * time.Second,
+		Timeout:       5 * time.Second,
+		MinRequests:   3,
+		FailThreshold: 2,
+		MaxHosts:      1000,
+		client:        client,
+		hosts:         make(map[string]*originState),
+	}
+}
+
+// Probes origins every interval, until ctx is done.
+func (h *OriginHealth) Run(ctx context.Context) {
+	ticker := time.NewTicker(h.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.probe(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// counts page request of origin
+func (h *OriginHealth) requested(pageURL *url.URL) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state, ok := h.hosts[pageURL.Host]
+	if !ok {
+		if h.MaxHosts > 0 && len(h.hosts) >= h.MaxHosts {
+			return
+		}
+		state = &originState{}
+		h.hosts[pageURL.Host] = state
+	}
+	state.pageURL = pageURL.String()
+	state.requests++
+}
+
+// marks origin up, after page is fetched
+func (h *OriginHealth) succeeded(pageURL *url.URL) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if state, ok := h.hosts[pageURL.Host]; ok {
+		state.failures = 0
+		state.lastSuccess = time.Now()
+	}
+}
+
+// Returns error of origin host, if it is down, or nil.
+func (h *OriginHealth) downError(host string) *OriginDownError {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	state, ok := h.hosts[host]
+	if !ok || state.failures < h.FailThreshold {
+		return nil
+	}
+	description := "page origin is down: " + host
+	if !state.lastSuccess.IsZero() {
+		description += ", last responded at " + state.lastSuccess.UTC().Format(time.RFC3339)
+	}
+	return &OriginDownError{OriginError{OriginDown, description}, state.lastSuccess}
+}
+
+// Probes origins requested at least MinRequests times since last round, or failing ones, concurrently.
+// Other origins are forgotten.
+func (h *OriginHealth) probe(ctx context.Context) {
+	probed := make(map[string]string)
+	h.mu.Lock()
+	for host, state := range h.hosts {
+		if state.requests < h.MinRequests && state.failures == 0 {
+			delete(h.hosts, host)
+			continue
+		}
+		state.requests = 0
+		probed[host] = state.pageURL
+	}
+	h.mu.Unlock()
+	var wg sync.WaitGroup
+	for host, pageURL := range probed {
+		wg.Add(1)
+		go func(host, pageURL string) {
+			defer wg.Done()
+			ok := h.probeURL(ctx, pageURL)
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			state, tracked := h.hosts[host]
+			if !tracked {
+				return
+			}
+			if ok {
+				state.failures = 0
+				state.lastSuccess = time.Now()
+			} else {
+				state.failures++
+			}
+		}(host, pageURL)
+	}
+	wg.Wait()
+}
+
+// returns true, if origin responded without server error
+func (h *OriginHealth) probeURL(ctx context.Context, pageURL string) bool {
+	ctx, cancel := context.WithTimeout(ctx, h.Timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodHead, pageURL, nil)
+	if err != nil {
+		return false
+	}
+	resp, err := ctxhttp.Do(ctx, h.client, req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode < 500
+}
@@ -0,0 +1,88 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("origin health", func() {
+	var (
+		origin   *httptest.Server
+		down     bool
+		requests int
+		h        *ImgLogicHandler
+		ctx      context.Context
+	)
+	BeforeEach(func() {
+		down = false
+		requests = 0
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests++
+			if down {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<p>page</p>`))
+		}))
+		h = NewImgLogicHandler(http.DefaultClient)
+		h.Cache = NewRenderCache(time.Hour, 0, 10)
+		h.Health = NewOriginHealth(http.DefaultClient)
+		h.Health.MinRequests = 1
+		ctx = setLogger(context.Background(), logger.StandardLogger())
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	handle := func(path string) (*Response, error) {
+		req := httptest.NewRequest("GET", "/?url="+url.QueryEscape(origin.URL+path), nil)
+		return h.HandleLogic(ctx, req)
+	}
+	It("then down origin is not fetched, and cached rendering is returned", func() {
+		_, err := handle("/cached")
+		Expect(err).NotTo(HaveOccurred())
+		down = true
+		h.Health.probe(ctx)
+		requests = 0
+		_, err = handle("/failing")
+		Expect(err).To(HaveOccurred())
+		Expect(requests).To(BeNumerically(">", 0), "origin is down after threshold failures only")
+		h.Health.probe(ctx)
+		requests = 0
+
+		resp, err := handle("/cached")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.Header.Get(RenderCacheHeader)).To(Equal("hit"))
+		_, err = handle("/missing")
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusBadGateway))
+		Expect(requests).To(BeZero())
+
+		errResp := ErrorLogger{}.HandleError(ctx, httptest.NewRequest("GET", "/", nil), err)
+		var body map[string]string
+		Expect(json.Unmarshal(errResp.Body.Bytes(), &body)).To(Succeed())
+		Expect(body["code"]).To(Equal(OriginDown))
+		Expect(body["last_success"]).NotTo(BeEmpty())
+
+		down = false
+		h.Health.probe(ctx)
+		_, err = handle("/missing")
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("then not frequently requested origins are forgotten", func() {
+		_, err := handle("/")
+		Expect(err).NotTo(HaveOccurred())
+		h.Health.probe(ctx)
+		Expect(h.Health.hosts).To(HaveLen(1))
+		h.Health.probe(ctx)
+		Expect(h.Health.hosts).To(BeEmpty())
+	})
+})
@@ -0,0 +1,129 @@
+package imgserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Codes of rejected hostile origin responses, returned in "code" field of error response.
+const (
+	OriginHeaderTooLarge  = "origin_header_too_large"
+	OriginContentTooLarge = "origin_content_too_large"
+	OriginBodyTooSlow     = "origin_body_too_slow"
+	OriginRateLimited     = "origin_rate_limited" // image origin responded 429 after retries
+	OriginNotImage        = "origin_not_image"    // image origin responded error page instead of image
+)
+
+// Min body rate is checked after this time from body read start.
+const minBodyRateGrace = 5 * time.Second
+
+// Origin response rejected by OriginLimits.
+type OriginError struct {
+	Code        string
+	Description string
+}
+
+func (e *OriginError) Error() string {
+	return e.Description
+}
+
+// Returns handler error of origin error caused err, or nil if err is not caused by origin error.
+// Slow body is gateway timeout, other origin errors are bad gateway.
+func originHandlerError(err error) *HandlerError {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	originErr, ok := err.(*OriginError)
+	if !ok {
+		return nil
+	}
+	status := http.StatusBadGateway
+	switch originErr.Code {
+	case OriginBodyTooSlow:
+		status = http.StatusGatewayTimeout
+	case ObjectStorageDisabled:
+		status = http.StatusBadRequest
+	}
+	return &HandlerError{status, originErr.Description, originErr}
+}
+
+// Guards against hostile origin responses, no limit for zero fields.
+type OriginLimits struct {
+	MaxHeaderBytes   int64         // response header size
+	MaxContentLength int64         // declared Content-Length
+	BodyIdleTimeout  time.Duration // pause between body bytes
+	MinBodyRate      int64         // average body bytes per second
+}
+
+// Returns RoundTripper decorator, that applies limits to responses of rt.
+// Header size limit is applied only to *http.Transport, which is configured by it.
+func NewGuardedTransport(rt http.RoundTripper, limits OriginLimits) http.RoundTripper {
+	if transport, ok := rt.(*http.Transport); ok && limits.MaxHeaderBytes > 0 {
+		transport.MaxResponseHeaderBytes = limits.MaxHeaderBytes
+	}
+	return guardedTransport{rt, limits}
+}
+
+type guardedTransport struct {
+	http.RoundTripper
+	limits OriginLimits
+}
+
+func (t guardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.RoundTripper.RoundTrip(req)
+	if err != nil {
+		// http.Transport reports header limit by error message only
+		if t.limits.MaxHeaderBytes > 0 && strings.Contains(err.Error(), "server response headers exceeded") {
+			return nil, &OriginError{OriginHeaderTooLarge, fmt.Sprintf("origin response header is bigger than %v bytes", t.limits.MaxHeaderBytes)}
+		}
+		return nil, err
+	}
+	if max := t.limits.MaxContentLength; max > 0 && resp.ContentLength > max {
+		resp.Body.Close()
+		return nil, &OriginError{OriginContentTooLarge, fmt.Sprintf("origin response Content-Length %v is bigger than %v", resp.ContentLength, max)}
+	}
+	if t.limits.BodyIdleTimeout > 0 || t.limits.MinBodyRate > 0 {
+		resp.Body = &guardedBody{ReadCloser: resp.Body, limits: t.limits}
+	}
+	return resp, nil
+}
+
+// Fails reads of trickling body.
+type guardedBody struct {
+	io.ReadCloser
+	limits   OriginLimits
+	start    time.Time
+	read     int64
+	timedOut int32 // use atomically
+}
+
+func (b *guardedBody) Read(p []byte) (int, error) {
+	if b.start.IsZero() {
+		b.start = time.Now()
+	}
+	if idle := b.limits.BodyIdleTimeout; idle > 0 {
+		// close unblocks pending read
+		timer := time.AfterFunc(idle, func() {
+			atomic.StoreInt32(&b.timedOut, 1)
+			b.ReadCloser.Close()
+		})
+		defer timer.Stop()
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if atomic.LoadInt32(&b.timedOut) == 1 {
+		return n, &OriginError{OriginBodyTooSlow, fmt.Sprintf("origin response body sent no data for %v", b.limits.BodyIdleTimeout)}
+	}
+	if rate := b.limits.MinBodyRate; rate > 0 && err == nil {
+		if elapsed := time.Since(b.start); elapsed > minBodyRateGrace && float64(b.read) < float64(rate)*elapsed.Seconds() {
+			b.ReadCloser.Close()
+			return n, &OriginError{OriginBodyTooSlow, fmt.Sprintf("origin response body is slower than %v bytes per second", rate)}
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,108 @@
+package imgserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("origin limits", func() {
+	var (
+		origin  *httptest.Server
+		handler http.HandlerFunc
+		limits  OriginLimits
+		ctx     context.Context
+	)
+	BeforeEach(func() {
+		limits = OriginLimits{}
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handler(w, r)
+		}))
+	})
+	JustBeforeEach(func() {
+		client := &http.Client{Transport: NewGuardedTransport(&http.Transport{}, limits)}
+		ctx = context.WithValue(setLogger(context.Background(), logger.StandardLogger()), CtxHTTPClientKey, client)
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	expectCode := func(err error, status int, code string) {
+		Expect(err).To(HaveOccurred())
+		hErr, ok := err.(*HandlerError)
+		Expect(ok).To(BeTrue(), err.Error())
+		Expect(hErr.statusCode).To(Equal(status))
+		Expect(hErr.cause.(*OriginError).Code).To(Equal(code))
+	}
+
+	Context("when header is too large", func() {
+		BeforeEach(func() {
+			limits.MaxHeaderBytes = 1024
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-Large", strings.Repeat("a", 4096))
+			}
+		})
+		It("then bad gateway", func() {
+			_, err := cxtAwareGet(ctx, origin.URL)
+			expectCode(err, http.StatusBadGateway, OriginHeaderTooLarge)
+		})
+	})
+	Context("when declared Content-Length is too large", func() {
+		BeforeEach(func() {
+			limits.MaxContentLength = 10
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(strings.Repeat("a", 100)))
+			}
+		})
+		It("then bad gateway", func() {
+			_, err := cxtAwareGet(ctx, origin.URL)
+			expectCode(err, http.StatusBadGateway, OriginContentTooLarge)
+		})
+	})
+	Context("when body trickles", func() {
+		BeforeEach(func() {
+			limits.BodyIdleTimeout = 50 * time.Millisecond
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte("<html>"))
+				w.(http.Flusher).Flush()
+				time.Sleep(300 * time.Millisecond)
+			}
+		})
+		It("then page fetch gateway timeout", func() {
+			resp, err := cxtAwareGet(ctx, origin.URL)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = getBody(ctx, resp)
+			expectCode(err, http.StatusGatewayTimeout, OriginBodyTooSlow)
+		})
+		It("then error response has code", func() {
+			resp, err := cxtAwareGet(ctx, origin.URL)
+			Expect(err).NotTo(HaveOccurred())
+			_, err = getBody(ctx, resp)
+			errResp := ErrorLogger{}.HandleError(ctx, httptest.NewRequest("GET", "/", nil), err)
+			Expect(errResp.Body.String()).To(ContainSubstring(`"code":"` + OriginBodyTooSlow + `"`))
+		})
+	})
+	Context("when body is in limits", func() {
+		BeforeEach(func() {
+			limits = OriginLimits{1 << 20, 1 << 20, time.Second, 1}
+			handler = func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte("body"))
+			}
+		})
+		It("then body read", func() {
+			resp, err := cxtAwareGet(ctx, origin.URL)
+			Expect(err).NotTo(HaveOccurred())
+			defer resp.Body.Close()
+			body, err := ioutil.ReadAll(resp.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal("body"))
+		})
+	})
+})
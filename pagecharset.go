@@ -0,0 +1,55 @@
+package imgserver
+
+import (
+	"bytes"
+	"unicode/utf8"
+
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+)
+
+// Sources of charset, which page is decoded by. Charsets are tried in this order,
+// until page is decoded without invalid sequences, as legacy pages are often mislabeled.
+const (
+	charsetDeclared = "declared" // by Content-Type header, or by BOM or meta tag, if header has no charset
+	charsetDetected = "detected" // by BOM or meta tag, or as valid UTF-8, when declared charset is wrong
+	charsetFallback = "fallback" // windows-1252, decoding any bytes
+)
+
+const fallbackCharset = "windows-1252"
+
+// Decodes page to UTF-8 by charset fallback chain: declared charset, detected one, then windows-1252.
+// Returns decoded page, and name and source of used charset.
+func decodePage(raw []byte, contentType string) ([]byte, string, string) {
+	declared, declaredName, certain := charset.DetermineEncoding(raw, contentType)
+	if certain {
+		if decoded, ok := decodeCharset(declared, raw); ok {
+			return decoded, declaredName, charsetDeclared
+		}
+	}
+	// header charset is ignored, so charset of page itself is found
+	if detected, name, ok := charset.DetermineEncoding(raw, "text/html"); ok && name != declaredName {
+		if decoded, ok := decodeCharset(detected, raw); ok {
+			return decoded, name, charsetDetected
+		}
+	}
+	if !(certain && declaredName == "utf-8") && utf8.Valid(raw) {
+		return raw, "utf-8", charsetDetected
+	}
+	fallback, _ := charset.Lookup(fallbackCharset)
+	if decoded, err := fallback.NewDecoder().Bytes(raw); err == nil {
+		return decoded, fallbackCharset, charsetFallback
+	}
+	return raw, fallbackCharset, charsetFallback
+}
+
+// Returns page decoded by e, and false, if page has invalid sequences of e.
+// Decoder replaces them by U+FFFD, so decoded page has more of them than raw bytes.
+func decodeCharset(e encoding.Encoding, raw []byte) ([]byte, bool) {
+	decoded, err := e.NewDecoder().Bytes(raw)
+	if err != nil || !utf8.Valid(decoded) {
+		return nil, false
+	}
+	replacement := []byte(string(utf8.RuneError))
+	return decoded, bytes.Count(decoded, replacement) <= bytes.Count(raw, replacement)
+}
@@ -0,0 +1,49 @@
+package imgserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("page charset", func() {
+	decode := func(contentType, raw string) (string, string, string) {
+		decoded, name, source := decodePage([]byte(raw), contentType)
+		return string(decoded), name, source
+	}
+	It("then page is decoded by declared charset", func() {
+		decoded, name, source := decode("text/html; charset=utf-8", "café")
+		Expect(decoded).To(Equal("café"))
+		Expect(name).To(Equal("utf-8"))
+		Expect(source).To(Equal(charsetDeclared))
+	})
+	It("then UTF-8 page without declared charset is detected", func() {
+		decoded, name, source := decode("text/html", "café")
+		Expect(decoded).To(Equal("café"))
+		Expect(name).To(Equal("utf-8"))
+		Expect(source).To(Equal(charsetDetected))
+	})
+	It("then mislabeled legacy page falls back to windows-1252", func() {
+		decoded, name, source := decode("text/html; charset=utf-8", "caf\xe9")
+		Expect(decoded).To(Equal("café"))
+		Expect(name).To(Equal(fallbackCharset))
+		Expect(source).To(Equal(charsetFallback))
+	})
+	It("then used charset is recorded in debug report", func() {
+		report := &debugReport{}
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+			Body:       ioutil.NopCloser(strings.NewReader("<p>caf\xe9</p>")),
+		}
+		body, err := getBody(setDebugReport(context.Background(), report), resp)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body.String()).To(Equal("<p>café</p>"))
+		Expect(report.charset).To(Equal(fallbackCharset))
+		Expect(report.charsetSource).To(Equal(charsetFallback))
+	})
+})
@@ -0,0 +1,160 @@
+package imgserver
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of query param values.
+type paramKind int
+
+const (
+	paramString   paramKind = iota
+	paramBool               // strconv.ParseBool syntax
+	paramPositive           // integer above 0
+	paramCount              // integer, 0 or above
+	paramSize               // bytes, above 0
+	paramDuration           // Go duration syntax, above 0
+)
+
+// Declaration of query param, that param values are validated by. Params are not repeated.
+type paramSpec struct {
+	kind paramKind
+	enum []string // allowed values in lower case, any if empty
+	list bool     // value is comma separated list of enum values
+}
+
+// Query params of inline and images requests. Values are validated before request processing,
+// so every invalid param is reported at once.
+var queryParamSchema = map[string]paramSpec{
+	"url":          {kind: paramString}, // many with combine
+	"format":       {enum: []string{"html", "json", "mhtml", "zip", "page", "multipart"}},
+	"callback_url": {kind: paramString},
+	"combine":      {kind: paramBool},
+	"sig":          {kind: paramString},
+	// fetch options
+	"timeout":           {kind: paramDuration},
+	"max_image_size":    {kind: paramSize},
+	"concurrency":       {kind: paramPositive},
+	"inline_threshold":  {kind: paramSize},
+	"links":             {kind: paramBool},
+	"retries":           {kind: paramCount},
+	"page_retries":      {kind: paramCount},
+	"page_redirects":    {kind: paramCount},
+	"frames":            {kind: paramBool},
+	"scripts":           {kind: paramBool},
+	"match":             {kind: paramString},
+	"first":             {kind: paramPositive},
+	"offset":            {kind: paramCount},
+	"limit":             {kind: paramPositive},
+	"budget_images":     {kind: paramPositive},
+	"budget_bytes":      {kind: paramSize},
+	"budget_time":       {kind: paramDuration},
+	"tolerant":          {kind: paramBool},
+	"skip_rate_limited": {kind: paramBool},
+	"strict_url":        {kind: paramBool},
+	"order":             {enum: []string{"document", "completion"}},
+	"sort":              {enum: imageSorts},
+	"data_urls":         {enum: dataURLPolicies},
+	"pick":              {kind: paramPositive},
+	"store":             {enum: []string{"page", "all"}},
+	"fonts":             {kind: paramBool},
+	"strip":             {enum: pageStripKinds, list: true},
+	"render":            {enum: []string{"js"}},
+	"lowdata":           {kind: paramBool},
+	"lang":              {kind: paramString},
+	"timing":            {kind: paramBool},
+	"debug":             {kind: paramBool},
+	"stream":            {kind: paramBool},
+}
+
+// Cause of 400 error on invalid query params, listing problem of every invalid or unknown param.
+type QueryParamsError struct {
+	Problems []QueryParamProblem
+}
+
+type QueryParamProblem struct {
+	Param string `json:"param"`
+	Error string `json:"error"` // without param value, as it may be secret
+}
+
+func (e *QueryParamsError) Error() string {
+	problems := make([]string, len(e.Problems))
+	for i, problem := range e.Problems {
+		problems[i] = fmt.Sprintf("'%s' %s", problem.Param, problem.Error)
+	}
+	return strings.Join(problems, "; ")
+}
+
+// Validates query params by queryParamSchema. Returns 400 HandlerError with QueryParamsError cause,
+// listing every problem by param name.
+func validateQuery(query url.Values) error {
+	var problems []QueryParamProblem
+	combine, _ := strconv.ParseBool(query.Get("combine"))
+	for name, values := range query {
+		spec, ok := queryParamSchema[name]
+		if !ok {
+			problems = append(problems, QueryParamProblem{name, "is not supported"})
+			continue
+		}
+		if len(values) > 1 && !(name == "url" && combine) {
+			problems = append(problems, QueryParamProblem{name, "is repeated"})
+			continue
+		}
+		for _, value := range values {
+			if problem := spec.check(value); problem != "" {
+				problems = append(problems, QueryParamProblem{name, problem})
+				break
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Slice(problems, func(i, j int) bool { return problems[i].Param < problems[j].Param })
+	err := &QueryParamsError{problems}
+	return &HandlerError{400, "invalid query parameters: " + err.Error(), err}
+}
+
+// returns problem of value, or empty string if it is valid
+func (s paramSpec) check(value string) string {
+	if s.list {
+		for _, item := range strings.Split(value, ",") {
+			if problem := (paramSpec{kind: s.kind, enum: s.enum}).check(item); problem != "" {
+				return "expected comma separated list of " + strings.Join(s.enum, ", ")
+			}
+		}
+		return ""
+	}
+	if len(s.enum) > 0 {
+		for _, allowed := range s.enum {
+			if strings.ToLower(value) == allowed {
+				return ""
+			}
+		}
+		return "expected one of " + strings.Join(s.enum, ", ")
+	}
+	switch s.kind {
+	case paramBool:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return "expected boolean"
+		}
+	case paramPositive, paramSize:
+		if n, err := strconv.ParseInt(value, 10, 64); err != nil || n <= 0 {
+			return "expected positive integer"
+		}
+	case paramCount:
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return "expected non negative integer"
+		}
+	case paramDuration:
+		if d, err := time.ParseDuration(value); err != nil || d <= 0 {
+			return "expected positive duration, like 10s"
+		}
+	}
+	return ""
+}
@@ -0,0 +1,53 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("query param schema", func() {
+	validate := func(rawQuery string) error {
+		query, err := url.ParseQuery(rawQuery)
+		Expect(err).NotTo(HaveOccurred())
+		return validateQuery(query)
+	}
+
+	It("then valid params pass", func() {
+		Expect(validate("url=http://example.com&timeout=10s&retries=0&tolerant=true&format=JSON")).To(Succeed())
+	})
+	It("then every problem is listed by param name", func() {
+		err := validate("url=http://example.com&timeout=-1s&qwerty=1&tolerant=yes&order=random&pick=0")
+		Expect(err).To(HaveOccurred())
+		hErr := err.(*HandlerError)
+		Expect(hErr.statusCode).To(Equal(400))
+		var params []string
+		for _, problem := range hErr.cause.(*QueryParamsError).Problems {
+			params = append(params, problem.Param)
+		}
+		Expect(params).To(Equal([]string{"order", "pick", "qwerty", "timeout", "tolerant"}))
+	})
+	It("then repeated url is allowed only with combine", func() {
+		Expect(validate("url=http://a.example&url=http://b.example")).NotTo(Succeed())
+		Expect(validate("url=http://a.example&url=http://b.example&combine=true")).To(Succeed())
+	})
+	It("then error response lists problems", func() {
+		ctx := setLogger(context.Background(), logger.StandardLogger())
+		resp := ErrorLogger{}.HandleError(ctx, httptest.NewRequest("GET", "/", nil), validate("first=x&retries=-1"))
+		Expect(resp.StatusCode).To(Equal(400))
+		var body struct {
+			Error  string              `json:"error"`
+			Params []QueryParamProblem `json:"params"`
+		}
+		Expect(json.Unmarshal(resp.Body.Bytes(), &body)).To(Succeed())
+		Expect(body.Params).To(Equal([]QueryParamProblem{
+			{"first", "expected positive integer"},
+			{"retries", "expected non negative integer"},
+		}))
+	})
+})
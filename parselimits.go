@@ -0,0 +1,155 @@
+package imgserver
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+// Codes of rejected pathological pages, returned in "code" field of error response.
+const (
+	PageTooLarge          = "page_too_large"
+	PageTokenTooLarge     = "page_token_too_large"
+	PageTooManyAttributes = "page_too_many_attributes"
+	PageParseStalled      = "page_parse_stalled"
+	PageBodyTooLarge      = "page_body_too_large"
+)
+
+// Guards of page fetch and tokenizer against crafted pages, no limit for zero fields.
+// Tokenizer builds no tree, so nesting depth costs nothing, and is not limited.
+type ParseLimits struct {
+	MaxPageSize     int64         // bytes of fetched page body, before charset decode
+	MaxDocumentSize int64         // bytes of tokenized page
+	MaxTokenSize    int           // bytes of single token, like tag with attributes or text
+	MaxAttributes   int           // of single tag
+	StallTimeout    time.Duration // parse fails, if no token is parsed during it
+}
+
+var DefaultParseLimits = ParseLimits{
+	MaxPageSize:     8 << 20,
+	MaxDocumentSize: 32 << 20,
+	MaxTokenSize:    1 << 20,
+	MaxAttributes:   512,
+	StallTimeout:    5 * time.Second,
+}
+
+func setParseLimits(ctx context.Context, limits ParseLimits) context.Context {
+	return context.WithValue(ctx, ctxParseLimitsKey, limits)
+}
+
+// returns limits set for request, or DefaultParseLimits
+func getParseLimits(ctx context.Context) ParseLimits {
+	limits, ok := ctx.Value(ctxParseLimitsKey).(ParseLimits)
+	if !ok {
+		return DefaultParseLimits
+	}
+	return limits
+}
+
+// Pathological page is bad gateway, as it is origin response.
+func pageLimitError(code string, description string) *HandlerError {
+	return &HandlerError{http.StatusBadGateway, description, &OriginError{code, description}}
+}
+
+// Page body is too large for server, like request entity of 413 Request Entity Too Large.
+func pageBodyTooLargeError(max int64) *HandlerError {
+	description := "page body is bigger than " + strconv.FormatInt(max, 10) + " bytes"
+	return &HandlerError{http.StatusRequestEntityTooLarge, description, &OriginError{PageBodyTooLarge, description}}
+}
+
+// Returns limit error for tokenizer error, or err as is.
+func tokenizerError(err error, limits ParseLimits) error {
+	if err == html.ErrBufferExceeded {
+		return pageLimitError(PageTokenTooLarge, "page has token bigger than "+strconv.Itoa(limits.MaxTokenSize)+" bytes")
+	}
+	return err
+}
+
+// Fails reads after max bytes.
+type documentLimitReader struct {
+	r    io.Reader
+	max  int64
+	left int64
+}
+
+func newDocumentLimitReader(r io.Reader, max int64) *documentLimitReader {
+	return &documentLimitReader{r, max, max}
+}
+
+func (r *documentLimitReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > r.left+1 {
+		p = p[:r.left+1]
+	}
+	n, err := r.r.Read(p)
+	r.left -= int64(n)
+	if r.left < 0 {
+		return n, pageLimitError(PageTooLarge, "page is bigger than "+strconv.FormatInt(r.max, 10)+" bytes")
+	}
+	return n, err
+}
+
+// Fails parse, if parser makes no progress for timeout, but is not waiting for receiver.
+// Parser can't be interrupted in the middle of token, but result of stalled parse is not awaited.
+// Nil watchdog does nothing.
+type parseWatchdog struct {
+	tokens  int64 // parsed, used atomically
+	waiting int32 // 1 while parser waits for receiver, used atomically
+	done    chan struct{}
+}
+
+func startParseWatchdog(ctx context.Context, timeout time.Duration, errc chan<- error) *parseWatchdog {
+	w := &parseWatchdog{done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(timeout)
+		defer ticker.Stop()
+		last := int64(-1)
+		for {
+			select {
+			case <-ticker.C:
+			case <-w.done:
+				return
+			case <-ctx.Done():
+				return
+			}
+			tokens := atomic.LoadInt64(&w.tokens)
+			if tokens == last && atomic.LoadInt32(&w.waiting) == 0 {
+				select {
+				case errc <- pageLimitError(PageParseStalled, "page parse made no progress for "+timeout.String()):
+				case <-w.done:
+				case <-ctx.Done():
+				}
+				return
+			}
+			last = tokens
+		}
+	}()
+	return w
+}
+
+func (w *parseWatchdog) token() {
+	if w != nil {
+		atomic.AddInt64(&w.tokens, 1)
+	}
+}
+
+func (w *parseWatchdog) setWaiting(waiting bool) {
+	if w == nil {
+		return
+	}
+	var v int32
+	if waiting {
+		v = 1
+	}
+	atomic.StoreInt32(&w.waiting, v)
+}
+
+func (w *parseWatchdog) stop() {
+	if w != nil {
+		close(w.done)
+	}
+}
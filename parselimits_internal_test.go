@@ -0,0 +1,93 @@
+package imgserver
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("parse limits", func() {
+	parse := func(limits ParseLimits, r io.Reader) ([]imgTag, error) {
+		ctx, cancel := context.WithCancel(setParseLimits(context.Background(), limits))
+		defer cancel()
+		imgc, errc := imageParserImp{imgTokenParserFunc(parseImgToken)}.parseImage(ctx, r)
+		var res []imgTag
+		for {
+			select {
+			case img, ok := <-imgc:
+				if !ok {
+					return res, nil
+				}
+				res = append(res, img)
+			case err := <-errc:
+				return res, err
+			}
+		}
+	}
+	expectCode := func(err error, code string) {
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).cause.(*OriginError).Code).To(Equal(code))
+	}
+	page := `<p class="a"><img src="a.png"></p><img src="b.png">`
+
+	It("then page within limits parsed", func() {
+		images, err := parse(DefaultParseLimits, strings.NewReader(page))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(images).To(HaveLen(2))
+	})
+	It("then too large page fails", func() {
+		_, err := parse(ParseLimits{MaxDocumentSize: 20}, strings.NewReader(page))
+		expectCode(err, PageTooLarge)
+		_, err = parse(ParseLimits{MaxDocumentSize: int64(len(page))}, strings.NewReader(page))
+		Expect(err).NotTo(HaveOccurred())
+	})
+	It("then too large token fails", func() {
+		_, err := parse(ParseLimits{MaxTokenSize: 64}, strings.NewReader(`<img src="`+strings.Repeat("a", 100)+`">`))
+		expectCode(err, PageTokenTooLarge)
+	})
+	It("then tag with too many attributes fails", func() {
+		_, err := parse(ParseLimits{MaxAttributes: 2}, strings.NewReader(`<div a="1" b="2" c="3"></div>`))
+		expectCode(err, PageTooManyAttributes)
+	})
+	It("then stalled parse fails", func() {
+		r, w := io.Pipe()
+		defer w.Close()
+		go w.Write([]byte(`<img src="a.png"><im`))
+		_, err := parse(ParseLimits{StallTimeout: 20 * time.Millisecond}, r)
+		expectCode(err, PageParseStalled)
+	})
+	It("then too large page body fails with code", func() {
+		getPage := func(limits ParseLimits, contentLength int64) error {
+			resp := &http.Response{
+				StatusCode:    http.StatusOK,
+				Header:        http.Header{"Content-Type": {"text/html"}},
+				ContentLength: contentLength,
+				Body:          ioutil.NopCloser(strings.NewReader(page)),
+			}
+			ctx := setParseLimits(context.Background(), limits)
+			_, err := getBody(ctx, resp)
+			return err
+		}
+		err := getPage(ParseLimits{MaxPageSize: 20}, -1)
+		expectCode(err, PageBodyTooLarge)
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusRequestEntityTooLarge))
+		err = getPage(ParseLimits{MaxPageSize: 20}, int64(len(page)))
+		expectCode(err, PageBodyTooLarge)
+		err = getPage(ParseLimits{MaxPageSize: int64(len(page))}, int64(len(page)))
+		Expect(err).NotTo(HaveOccurred())
+		err = getPage(ParseLimits{}, -1)
+		Expect(err).NotTo(HaveOccurred())
+		err = getPage(ParseLimits{MaxPageSize: 20}, -1)
+		errResp := ErrorLogger{}.HandleError(setLogger(context.Background(), logger.StandardLogger()), httptest.NewRequest("GET", "/", nil), err)
+		Expect(errResp.StatusCode).To(Equal(http.StatusRequestEntityTooLarge))
+		Expect(errResp.Body.String()).To(ContainSubstring(`"code":"` + PageBodyTooLarge + `"`))
+	})
+})
@@ -0,0 +1,423 @@
+package imgserver
+
+import (
+	"container/heap"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const AdminPipelinePath = "/admin/pipeline"
+
+// Stages of image extraction pipeline, in order. Every stage runs in own goroutines,
+// and passes images to next one by channel.
+const (
+	StageParse    = "parse"    // page tokenized to img tags
+	StageResolve  = "resolve"  // sources chosen by client hints, and resolved to absolute URLs
+	StageFetch    = "fetch"    // images fetched, earlier in document first
+	StageEncode   = "encode"   // fetched images encoded to data URLs
+	StageAssemble = "assemble" // results collected within processing budgets
+)
+
+var pipelineStages = []string{StageParse, StageResolve, StageFetch, StageEncode, StageAssemble}
+
+// Settings and metrics of image extraction pipeline stages.
+// Fetch concurrency is per request, by concurrency param. Nil pipeline has default settings.
+type Pipeline struct {
+	EncodeConcurrency int // parallel encodings per page, GOMAXPROCS if 0
+
+	mu    sync.Mutex
+	stats map[string]*StageStats
+}
+
+// Totals of single pipeline stage.
+type StageStats struct {
+	Stage    string  `json:"stage"`
+	Items    int64   `json:"items"`       // images passed stage
+	Errors   int64   `json:"errors"`      // failed extractions
+	Duration float64 `json:"duration_ms"` // total, of whole parses and assemblies, and of every item for other stages
+}
+
+func NewPipeline() *Pipeline {
+	p := &Pipeline{stats: make(map[string]*StageStats)}
+	for _, stage := range pipelineStages {
+		p.stats[stage] = &StageStats{Stage: stage}
+	}
+	return p
+}
+
+// Returns stage stats in pipeline order.
+func (p *Pipeline) Stats() []StageStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	res := make([]StageStats, 0, len(pipelineStages))
+	for _, stage := range pipelineStages {
+		res = append(res, *p.stats[stage])
+	}
+	return res
+}
+
+func (p *Pipeline) record(stage string, items int, start time.Time, err error) {
+	if p == nil {
+		return
+	}
+	duration := float64(time.Since(start)) / float64(time.Millisecond)
+	p.mu.Lock()
+	stat := p.stats[stage]
+	stat.Items += int64(items)
+	if err != nil {
+		stat.Errors++
+	}
+	stat.Duration += duration
+	p.mu.Unlock()
+}
+
+func (p *Pipeline) encodeConcurrency() int {
+	if p == nil || p.EncodeConcurrency <= 0 {
+		return runtime.GOMAXPROCS(0)
+	}
+	return p.EncodeConcurrency
+}
+
+// Group of stage goroutines, like errgroup with context: first error of goroutine cancels
+// group context, and is returned by wait, after every goroutine is finished.
+type stageGroup struct {
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	errOnce sync.Once
+	err     error
+}
+
+func newStageGroup(ctx context.Context) (*stageGroup, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	return &stageGroup{cancel: cancel}, ctx
+}
+
+func (g *stageGroup) goStage(stage func() error) {
+	g.wg.Add(1)
+	done := goroutines.start(goroutineStage)
+	go func() {
+		defer g.wg.Done()
+		defer done()
+		if err := stage(); err != nil {
+			g.errOnce.Do(func() {
+				g.err = err
+				g.cancel()
+			})
+		}
+	}()
+}
+
+// Waits for every goroutine, and returns first error. Can be called many times.
+func (g *stageGroup) wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
+
+// Single extraction run. Every stage owns its output channel and closes it when finished,
+// failed or canceled; canceled stages return context error, so canceled run never looks complete.
+type pipelineRun struct {
+	*stageGroup
+	ctx      context.Context // canceled on first stage error, or when extraction returns
+	pipeline *Pipeline
+
+	truncated bool // set by resolve stage, read after encode stage output is closed
+	total     int  // images of whole parsed document, set like truncated; 0 if parse is stopped
+}
+
+func newPipelineRun(ctx context.Context, pipeline *Pipeline) *pipelineRun {
+	group, ctx := newStageGroup(ctx)
+	return &pipelineRun{stageGroup: group, ctx: ctx, pipeline: pipeline}
+}
+
+// stops stages, when result is not needed anymore
+func (run *pipelineRun) stop() {
+	run.cancel()
+}
+
+// returns context error if run is canceled
+func (run *pipelineRun) send(out chan<- pendingFetch, item pendingFetch) error {
+	select {
+	case out <- item:
+		return nil
+	case <-run.ctx.Done():
+		return run.ctx.Err()
+	}
+}
+
+// Chooses sources of parsed images, and resolves them to fetched URLs.
+// Images not needing fetch, like data URLs and tolerant mode placeholders, are passed with empty URL.
+// Stops parse when images limits are reached.
+func (run *pipelineRun) resolveStage(parsed <-chan imgTag, parseErrs <-chan error, cancelParse func(), out chan<- pendingFetch) error {
+	defer close(out)
+	log := getLocalLogger(run.ctx, "resolveStage")
+	pageURL := getURLParam(run.ctx).String()
+	folderURL := *getFolderURL(*getPageURL(run.ctx))
+	opts := getFetchOptions(run.ctx)
+	hints := getClientHints(run.ctx)
+	report := getDebugReport(run.ctx)
+	observer := getObserver(run.ctx)
+	// validated by fetch options parse
+	match, _ := parseImageMatch(opts.Match)
+	parseStart := time.Now()
+	position := 0
+	stopParse := func() {
+		cancelParse()
+		parsed = nil
+		parseErrs = nil
+	}
+	for parsed != nil {
+		var img imgTag
+		var ok bool
+		select {
+		case img, ok = <-parsed:
+		case err := <-parseErrs:
+			log.Debug("parse finished with error")
+			run.pipeline.record(StageParse, position, parseStart, err)
+			getPhaseTimings(run.ctx).add(phaseParse, parseStart)
+			return err
+		case <-run.ctx.Done():
+			return run.ctx.Err()
+		}
+		if !ok {
+			log.Debug("parse finished succesfuly")
+			run.total = position
+			break
+		}
+		start := time.Now()
+		chosen, src := chooseSrc(img, hints)
+		if match != nil && !match(chosen, resolvedURL(src, folderURL)) {
+			// not matched images are left out before limits, so limits are of matched ones
+			log.Debug("img not matched")
+			continue
+		}
+		position++
+		debug := report.discover(position, img, src)
+		img = chosen
+		if position <= opts.Offset || opts.Limit > 0 && position > opts.Offset+opts.Limit {
+			// parse goes on, so total is counted
+			debug.set(outcomeSkipped, "out of offset and limit")
+			continue
+		}
+		if opts.BudgetImages > 0 && position-opts.Offset > opts.BudgetImages {
+			log.WithField("images", opts.BudgetImages).Info("images budget exhausted")
+			debug.set(outcomeSkipped, "images budget exhausted")
+			run.truncated = true
+			stopParse()
+			break
+		}
+		if opts.FirstImages > 0 && position >= opts.FirstImages {
+			log.WithField("first", opts.FirstImages).Debug("images limit reached, stop parse")
+			stopParse()
+		}
+		if opts.Pick > 0 {
+			if position < opts.Pick {
+				debug.set(outcomeSkipped, "not picked")
+				continue
+			}
+			log.WithField("pick", opts.Pick).Debug("picked image parsed, stop parse")
+			stopParse()
+		}
+		item := pendingFetch{position, img, "", debug}
+		if strings.HasPrefix(src, "data:") {
+			log.Debug("img with data URL parsed")
+			processed, ok, err := applyDataURLPolicy(run.ctx, img, src)
+			switch {
+			case err != nil:
+				debug.set(outcomeFailed, err.Error())
+				if !opts.Tolerant {
+					run.pipeline.record(StageResolve, 0, start, err)
+					return err
+				}
+				item.img = placeholderImage(run.ctx, img, "", err)
+			case !ok:
+				log.Debug("data URL img dropped")
+				debug.set(outcomeSkipped, "data URL is bigger than max image size")
+				continue
+			default:
+				debug.set(outcomeData, "")
+				item.img = processed
+			}
+		} else if imgURL, err := getImgURL(src, folderURL); err != nil {
+			debug.set(outcomeFailed, err.Error())
+			if !opts.Tolerant {
+				run.pipeline.record(StageResolve, 0, start, err)
+				return err
+			}
+			item.img = placeholderImage(run.ctx, img, src, err)
+		} else {
+			imgURL = getCanonicalizer(run.ctx).fetchString(imgURL)
+			if debug != nil {
+				debug.URL = imgURL
+			}
+			observer.ImageDiscovered(run.ctx, ImageEvent{PageURL: pageURL, URL: imgURL})
+			if opts.Links {
+				debug.set(outcomeLinked, "links mode")
+				item.img = img.withSrc(imgURL)
+				getEarlyHints(run.ctx).add(imgURL)
+			} else {
+				item.url = imgURL
+			}
+		}
+		run.pipeline.record(StageResolve, 1, start, nil)
+		if err := run.send(out, item); err != nil {
+			return err
+		}
+	}
+	run.pipeline.record(StageParse, position, parseStart, nil)
+	getPhaseTimings(run.ctx).add(phaseParse, parseStart)
+	getEarlyHints(run.ctx).flush()
+	return nil
+}
+
+type fetchDone struct {
+	item pendingFetch
+	err  error
+}
+
+// Fetches resolved images, at most opts.Concurrency at time, earlier in document first.
+// Fetched images are raw, unless fetcher returns data URLs.
+// Fetches in flight are awaited by run wait.
+func (run *pipelineRun) fetchStage(fetcher imageFetcher, in <-chan pendingFetch, out chan<- pendingFetch) error {
+	defer close(out)
+	defer getPhaseTimings(run.ctx).add(phaseImages, time.Now())
+	log := getLocalLogger(run.ctx, "fetchStage")
+	opts := getFetchOptions(run.ctx)
+	fetchCtx := setRawImages(run.ctx)
+	queue := &fetchQueue{} // resolved images waiting for fetch slot
+	fetching := 0
+	donec := make(chan fetchDone)
+	for in != nil || fetching > 0 || queue.Len() > 0 {
+		for queue.Len() > 0 && (opts.Concurrency <= 0 || fetching < opts.Concurrency) {
+			next := heap.Pop(queue).(pendingFetch)
+			fetching++
+			log.Debug("Async fetching image")
+			run.fetch(setDebugImage(fetchCtx, next.debug), fetcher, next, donec)
+		}
+		select {
+		case item, ok := <-in:
+			if !ok {
+				in = nil
+				continue
+			}
+			if item.url == "" {
+				// nothing to fetch
+				if err := run.send(out, item); err != nil {
+					return err
+				}
+				continue
+			}
+			heap.Push(queue, item)
+		case done := <-donec:
+			fetching--
+			if done.err == errImageSkipped {
+				log.Debug("img skipped")
+				continue
+			}
+			if done.err != nil {
+				log.Debug("error on img fetch")
+				return done.err
+			}
+			log.Debug("img fetched")
+			if err := run.send(out, done.item); err != nil {
+				return err
+			}
+		case <-run.ctx.Done():
+			return run.ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Starts fetch of item, and sends its result to donec, unless run is canceled.
+// Fetch is awaited by run wait.
+func (run *pipelineRun) fetch(ctx context.Context, fetcher imageFetcher, item pendingFetch, donec chan<- fetchDone) {
+	start := time.Now()
+	run.wg.Add(1)
+	fetcher.fetchImage(ctx, item.img, item.url, func(img imgTag, err error) {
+		defer run.wg.Done()
+		done := fetchDone{err: err}
+		if err == nil {
+			done.item = item
+			done.item.img = img
+		}
+		run.pipeline.record(StageFetch, 1, start, err)
+		select {
+		case donec <- done:
+		case <-run.ctx.Done():
+			// fetch stage is finished
+		}
+	})
+}
+
+// Encodes raw fetched images to data URLs by opts.EncodeConcurrency workers.
+// Images stay raw if request is in raw images mode.
+func (run *pipelineRun) encodeStage(in <-chan pendingFetch, out chan<- pendingFetch) error {
+	defer close(out)
+	raw := isRawImages(run.ctx)
+	var workers sync.WaitGroup
+	for i := 0; i < run.pipeline.encodeConcurrency(); i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for {
+				var item pendingFetch
+				var ok bool
+				select {
+				case item, ok = <-in:
+				case <-run.ctx.Done():
+					return
+				}
+				if !ok {
+					return
+				}
+				if item.img.raw != nil && !raw {
+					start := time.Now()
+					encoded := item.img.withSrc(encodeDataURL(item.img.raw.contentType, item.img.raw.data))
+					if item.debug != nil {
+						item.debug.EncodedBytes = len(encoded.src())
+					}
+					item.img = encoded
+					run.pipeline.record(StageEncode, 1, start, nil)
+				}
+				if run.send(out, item) != nil {
+					return
+				}
+			}
+		}()
+	}
+	workers.Wait()
+	return run.ctx.Err()
+}
+
+// Admin API of pipeline stats: GET AdminPipelinePath returns stage stats JSON.
+type PipelineAdminHandler struct {
+	Log      Logger
+	Pipeline *Pipeline
+	Token    string // disabled if empty
+}
+
+func (h PipelineAdminHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	log := SetEmitter(h.Log, "PipelineAdminHandler")
+	if h.Token == "" || !checkBearerToken(req, h.Token) {
+		writeResponse(log, w, req, NewErrorResponse(http.StatusUnauthorized, "invalid admin token"))
+		return
+	}
+	if !(req.Method == http.MethodGet || req.Method == http.MethodHead) {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := NewResponse()
+	resp.StatusCode = http.StatusOK
+	resp.Header.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp.Body).Encode(h.Pipeline.Stats()); err != nil {
+		resp = NewInternalErrorResponse()
+	}
+	writeResponse(log, w, req, resp)
+}
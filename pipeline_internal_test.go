@@ -0,0 +1,165 @@
+package imgserver
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("extraction pipeline", func() {
+	var (
+		ctx      context.Context
+		pipeline *Pipeline
+		failURL  string
+		active   int64 // goroutines before test
+	)
+	BeforeEach(func() {
+		active = goroutines.total()
+		pageURL, _ := url.Parse("http://example.com/page")
+		ctx = context.WithValue(setLogger(context.Background(), log.StandardLogger()), ctxURLParamKey, pageURL)
+		ctx = setFetchOptions(ctx, FetchOptions{})
+		pipeline = NewPipeline()
+		failURL = ""
+	})
+	AfterEach(func() {
+		// goroutines leaked by other tests may finish meanwhile
+		Eventually(goroutines.total).Should(BeNumerically("<=", active), "leaked goroutines: %v", goroutines.snapshot())
+	})
+	extract := func(ctx context.Context) (*extraction, error) {
+		fetcher := imageFetcherFunc(func(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+			Expect(isRawImages(ctx)).To(BeTrue())
+			if imgURL == failURL {
+				go result(imgTag{}, errors.New("fetch failed"))
+				return
+			}
+			go result(img.withRaw(imgURL, "image/gif", []byte("GIF")), nil)
+		})
+		extractor := imgExtractorImp{imageParserImp{imgTokenParserFunc(parseImgToken)}, fetcher, pipeline}
+		return extractor.extractImages(ctx, bytes.NewBufferString(`<img src="/1.gif"><img src="data:image/gif;base64,R0lG"><img src="/2.gif">`))
+	}
+	stats := func() map[string]StageStats {
+		res := make(map[string]StageStats)
+		for _, stat := range pipeline.Stats() {
+			res[stat.Stage] = stat
+		}
+		return res
+	}
+	It("then fetched images encoded and stages measured", func() {
+		res, err := extract(ctx)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.images).To(HaveLen(3))
+		for _, img := range res.images {
+			Expect(img.src()).To(Equal("data:image/gif;base64,R0lG"))
+		}
+		Expect(stats()[StageParse].Items).To(BeEquivalentTo(3))
+		Expect(stats()[StageResolve].Items).To(BeEquivalentTo(3))
+		Expect(stats()[StageFetch].Items).To(BeEquivalentTo(2))
+		Expect(stats()[StageEncode].Items).To(BeEquivalentTo(2))
+		Expect(stats()[StageAssemble].Items).To(BeEquivalentTo(3))
+	})
+	It("then images kept raw in raw images mode", func() {
+		res, err := extract(setRawImages(ctx))
+		Expect(err).NotTo(HaveOccurred())
+		raw := 0
+		for _, img := range res.images {
+			if img.raw != nil {
+				raw++
+			}
+		}
+		Expect(raw).To(Equal(2))
+		Expect(stats()[StageEncode].Items).To(BeZero())
+	})
+	It("then fetch error fails extraction", func() {
+		failURL = "http://example.com/2.gif"
+		_, err := extract(ctx)
+		Expect(err).To(MatchError("fetch failed"))
+		Expect(stats()[StageFetch].Errors).To(BeEquivalentTo(1))
+		Expect(stats()[StageAssemble].Errors).To(BeEquivalentTo(1))
+	})
+	Context("when fetches are blocked until canceled", func() {
+		var (
+			running   int32
+			canceled  int32
+			extractor imgExtractorImp
+		)
+		BeforeEach(func() {
+			running, canceled = 0, 0
+			fetcher := imageFetcherFunc(func(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+				atomic.AddInt32(&running, 1)
+				go func() {
+					err := errors.New("fetch failed")
+					for imgURL == failURL && atomic.LoadInt32(&running) < 3 {
+						// fails, when other fetches are started
+						time.Sleep(time.Millisecond)
+					}
+					if imgURL != failURL {
+						<-ctx.Done()
+						atomic.AddInt32(&canceled, 1)
+						err = ctx.Err()
+					}
+					atomic.AddInt32(&running, -1)
+					result(imgTag{}, err)
+				}()
+			})
+			extractor = imgExtractorImp{imageParserImp{imgTokenParserFunc(parseImgToken)}, fetcher, pipeline}
+		})
+		page := func() *bytes.Buffer {
+			return bytes.NewBufferString(`<img src="/1.gif"><img src="/2.gif"><img src="/3.gif">`)
+		}
+		It("then fetch error cancels other fetches before return", func() {
+			failURL = "http://example.com/2.gif"
+			_, err := extractor.extractImages(ctx, page())
+			Expect(err).To(MatchError("fetch failed"))
+			Expect(atomic.LoadInt32(&running)).To(BeZero())
+			Expect(atomic.LoadInt32(&canceled)).To(BeEquivalentTo(2))
+		})
+		It("then parent cancel fails extraction", func() {
+			ctx, cancel := context.WithCancel(ctx)
+			time.AfterFunc(10*time.Millisecond, cancel)
+			_, err := extractor.extractImages(ctx, page())
+			Expect(err).To(Equal(context.Canceled))
+			Expect(atomic.LoadInt32(&running)).To(BeZero())
+		})
+		It("then time budget stops fetches before return", func() {
+			ctx := setFetchOptions(ctx, FetchOptions{BudgetTime: 10 * time.Millisecond})
+			res, err := extractor.extractImages(ctx, page())
+			Expect(err).NotTo(HaveOccurred())
+			Expect(res.truncated).To(BeTrue())
+			Expect(atomic.LoadInt32(&running)).To(BeZero())
+			Expect(atomic.LoadInt32(&canceled)).To(BeEquivalentTo(3))
+		})
+	})
+	It("then images out of offset and limit are counted, but not fetched", func() {
+		res, err := extract(setFetchOptions(ctx, FetchOptions{Offset: 1, Limit: 1}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.images).To(HaveLen(1))
+		Expect(res.total).To(Equal(3))
+		Expect(stats()[StageFetch].Items).To(BeZero())
+		res, err = extract(setFetchOptions(ctx, FetchOptions{Offset: 2, Limit: 5}))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.images).To(HaveLen(1))
+		Expect(res.total).To(Equal(3))
+		Expect(stats()[StageFetch].Items).To(BeEquivalentTo(1))
+	})
+	It("then stats require admin token", func() {
+		h := PipelineAdminHandler{log.StandardLogger(), pipeline, "secret"}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", AdminPipelinePath, nil))
+		Expect(rec.Code).To(Equal(http.StatusUnauthorized))
+		req := httptest.NewRequest("GET", AdminPipelinePath, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Body.String()).To(ContainSubstring(`"stage":"encode"`))
+	})
+})
@@ -0,0 +1,86 @@
+package imgserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"html"
+	"strconv"
+
+	"golang.org/x/net/context"
+)
+
+// Look of placeholders of failed images. Size of placeholder is taken from
+// image width and height attributes, when they are set.
+type PlaceholderStyle struct {
+	Width  int
+	Height int
+	Color  string // CSS color of background, text is dark gray
+}
+
+var DefaultPlaceholderStyle = PlaceholderStyle{300, 150, "#eeeeee"}
+
+// placeholder text longer than this is shortened
+const placeholderTextLength = 60
+
+func setPlaceholderStyle(ctx context.Context, style PlaceholderStyle) context.Context {
+	return context.WithValue(ctx, ctxPlaceholderKey, style)
+}
+
+// returns style set for request, or DefaultPlaceholderStyle
+func getPlaceholderStyle(ctx context.Context) PlaceholderStyle {
+	style, ok := ctx.Value(ctxPlaceholderKey).(PlaceholderStyle)
+	if !ok {
+		return DefaultPlaceholderStyle
+	}
+	return style
+}
+
+// Returns copy of img with src replaced by inline SVG placeholder, showing failed image URL,
+// and fetch error as title.
+func placeholderImage(ctx context.Context, img imgTag, imgURL string, fetchErr error) imgTag {
+	style := getPlaceholderStyle(ctx)
+	width, height := style.Width, style.Height
+	for _, attr := range img.attr {
+		if size, err := strconv.Atoi(attr.Val); err == nil && size > 0 {
+			switch attr.Key {
+			case "width":
+				width = size
+			case "height":
+				height = size
+			}
+		}
+	}
+	text := imgURL
+	if len(text) > placeholderTextLength {
+		text = text[:placeholderTextLength-3] + "..."
+	}
+	title := "image fetch failed"
+	if fetchErr != nil {
+		title = fetchErr.Error()
+	}
+	svg := &bytes.Buffer{}
+	fmt.Fprintf(svg, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d">`, width, height, width, height)
+	fmt.Fprintf(svg, `<title>%s</title>`, html.EscapeString(title))
+	fmt.Fprintf(svg, `<rect width="100%%" height="100%%" fill="%s"/>`, html.EscapeString(style.Color))
+	fmt.Fprintf(svg, `<text x="50%%" y="50%%" fill="#555555" font-family="sans-serif" font-size="12" text-anchor="middle" dominant-baseline="middle">%s</text>`, html.EscapeString(text))
+	svg.WriteString(`</svg>`)
+	return img.withSrc("data:image/svg+xml;base64," + base64.StdEncoding.EncodeToString(svg.Bytes()))
+}
+
+// imageFetcher decorator, that responds placeholder images on fetch errors.
+type placeholderImageFetcher struct {
+	fetcher imageFetcher
+}
+
+func (f placeholderImageFetcher) fetchImage(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+	f.fetcher.fetchImage(ctx, img, imgURL, func(res imgTag, err error) {
+		if err == nil || ctx.Err() != nil || err == errImageSkipped {
+			// fetched, or processing is finished and result is not used, or image is left out
+			result(res, err)
+			return
+		}
+		getLocalLogger(ctx, "placeholderFetcher").WithField("url", imgURL).Info("image replaced by placeholder: ", err)
+		result(placeholderImage(ctx, img, imgURL, err), nil)
+	})
+}
@@ -0,0 +1,75 @@
+package imgserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+// returns SVG of placeholder data URL
+func placeholderSVG(img imgTag) string {
+	const prefix = "data:image/svg+xml;base64,"
+	Expect(img.src()).To(HavePrefix(prefix))
+	svg, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(img.src(), prefix))
+	Expect(err).NotTo(HaveOccurred())
+	return string(svg)
+}
+
+var _ = Describe("placeholder", func() {
+	ctx := setPlaceholderStyle(context.Background(), PlaceholderStyle{100, 50, "red"})
+	It("then has style size and failed URL", func() {
+		img := imgTag{0, []html.Attribute{{Key: "src", Val: "http://example.com/a.png"}}, nil}
+		svg := placeholderSVG(placeholderImage(ctx, img, img.src(), errors.New(`status <404>`)))
+		Expect(svg).To(ContainSubstring(`width="100" height="50"`))
+		Expect(svg).To(ContainSubstring(`fill="red"`))
+		Expect(svg).To(ContainSubstring(">http://example.com/a.png</text>"))
+		Expect(svg).To(ContainSubstring("<title>status &lt;404&gt;</title>"))
+	})
+	It("then has image attributes size", func() {
+		img := imgTag{0, []html.Attribute{{Key: "src", Val: "/a.png"}, {Key: "width", Val: "20"}, {Key: "height", Val: "auto"}}, nil}
+		res := placeholderImage(ctx, img, img.src(), nil)
+		Expect(placeholderSVG(res)).To(ContainSubstring(`width="20" height="50"`))
+		Expect(res.attr[1]).To(Equal(img.attr[1]))
+	})
+	It("then long URL shortened", func() {
+		img := imgTag{0, []html.Attribute{{Key: "src", Val: "http://example.com/" + strings.Repeat("a", 100)}}, nil}
+		Expect(placeholderSVG(placeholderImage(ctx, img, img.src(), nil))).To(ContainSubstring("...</text>"))
+	})
+})
+
+var _ = Describe("tolerant extraction", func() {
+	It("then failed images replaced by placeholders", func() {
+		fetcher := imageFetcherFunc(func(ctx context.Context, img imgTag, imgURL string, result fetchCallback) {
+			go func() {
+				if strings.HasSuffix(imgURL, "2.png") {
+					result(imgTag{}, NewHandlerError(400, "not found"))
+					return
+				}
+				result(img.withSrc("data:image/png;base64,"), nil)
+			}()
+		})
+		pageURL, _ := url.Parse("http://example.com/page")
+		ctx := context.WithValue(setLogger(context.Background(), log.StandardLogger()), ctxURLParamKey, pageURL)
+		ctx = setFetchOptions(ctx, FetchOptions{Tolerant: true})
+		extractor := imgExtractorImp{imageParserImp{imgTokenParserFunc(parseImgToken)}, fetcher, nil}
+		res, err := extractor.extractImages(ctx, bytes.NewBufferString(`<img src="/1.png"><img src="/2.png">`))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.images).To(HaveLen(2))
+		var placeholders int
+		for _, img := range res.images {
+			if strings.HasPrefix(img.src(), "data:image/svg+xml") {
+				placeholders++
+				Expect(placeholderSVG(img)).To(ContainSubstring("http://example.com/2.png"))
+			}
+		}
+		Expect(placeholders).To(Equal(1))
+	})
+})
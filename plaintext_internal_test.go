@@ -0,0 +1,41 @@
+package imgserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("text/plain page", func() {
+	get := func(ctx context.Context, page string) (string, error) {
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+			Body:       ioutil.NopCloser(strings.NewReader(page)),
+		}
+		body, err := getBody(ctx, resp)
+		if err != nil {
+			return "", err
+		}
+		return body.String(), nil
+	}
+	It("then it is rejected by default", func() {
+		_, err := get(context.Background(), `<html><img src="a.png"></html>`)
+		Expect(err).To(HaveOccurred())
+		Expect(errorCode(err.(*HandlerError))).To(Equal(OriginUnsupported))
+	})
+	It("then page sniffed as HTML is parsed in lenient mode", func() {
+		body, err := get(setSniffPlainText(context.Background()), "\n<!DOCTYPE html><img src=\"a.png\">")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(ContainSubstring(`<img src="a.png">`))
+	})
+	It("then plain text is rejected in lenient mode", func() {
+		_, err := get(setSniffPlainText(context.Background()), `see <img src="a.png">`)
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusBadGateway))
+	})
+})
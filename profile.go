@@ -0,0 +1,149 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// Named configuration of requests of some team, selected by API key or Host header.
+type Profile struct {
+	Name         string
+	Options      FetchOptions // defaults of not passed fetch option params
+	MaxOptions   FetchOptions // ceilings of fetch options, no ceiling for zero fields
+	AllowedHosts []string     // allowed page hosts, "*.example.com" allows subdomains, any if empty
+	Format       string       // format when neither format param nor Accept passed
+	CacheControl string       // Cache-Control header of responses, not set if empty
+	NoMetaCache  bool         // don't cache response statistics for HEAD requests
+}
+
+// profile in profiles file
+type profileConfig struct {
+	APIKeys      []string          `json:"api_keys"`
+	Hosts        []string          `json:"hosts"`
+	Options      map[string]string `json:"options"` // fetch option query params
+	MaxOptions   map[string]string `json:"max_options"`
+	AllowedHosts []string          `json:"allowed_hosts"`
+	Format       string            `json:"format"`
+	CacheControl string            `json:"cache_control"`
+	NoMetaCache  bool              `json:"no_meta_cache"`
+}
+
+type Profiles struct {
+	byAPIKey map[string]*Profile
+	byHost   map[string]*Profile
+}
+
+// Loads profiles from JSON file of form:
+//
+//	{"<name>": {"api_keys": [...], "hosts": [...], "options": {"timeout": "10s"}, "max_options": {...},
+//	"allowed_hosts": [...], "format": "json", "cache_control": "max-age=3600", "no_meta_cache": false}}
+//
+// Options have fetch option query params names and values.
+func LoadProfiles(path string) (*Profiles, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseProfiles(data)
+}
+
+func ParseProfiles(data []byte) (*Profiles, error) {
+	var configs map[string]profileConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	res := &Profiles{make(map[string]*Profile), make(map[string]*Profile)}
+	for name, config := range configs {
+		profile, err := newProfile(name, config)
+		if err != nil {
+			return nil, errors.New("profile " + name + ": " + err.Error())
+		}
+		for _, key := range config.APIKeys {
+			res.byAPIKey[key] = profile
+		}
+		for _, host := range config.Hosts {
+			res.byHost[strings.ToLower(host)] = profile
+		}
+	}
+	return res, nil
+}
+
+func newProfile(name string, config profileConfig) (*Profile, error) {
+	profile := &Profile{
+		Name:         name,
+		AllowedHosts: config.AllowedHosts,
+		Format:       strings.ToLower(config.Format),
+		CacheControl: config.CacheControl,
+		NoMetaCache:  config.NoMetaCache,
+	}
+	if _, ok := formatMediaTypes[outputFormat(profile.Format)]; profile.Format != "" && !ok {
+		return nil, errors.New("unsupported format: " + config.Format)
+	}
+	var err error
+	if profile.Options, err = parseFetchOptions(configValues(config.Options), DefaultFetchOptions, FetchOptions{}); err != nil {
+		return nil, err
+	}
+	if profile.MaxOptions, err = parseFetchOptions(configValues(config.MaxOptions), FetchOptions{}, FetchOptions{}); err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+func configValues(m map[string]string) url.Values {
+	res := make(url.Values, len(m))
+	for k, v := range m {
+		res.Set(k, v)
+	}
+	return res
+}
+
+// API key profile takes precedence over Host one. Returns nil if there is no matching profile.
+func (p *Profiles) lookup(apiKeyID string, host string) *Profile {
+	if profile, ok := p.byAPIKey[apiKeyID]; ok && apiKeyID != "" {
+		return profile
+	}
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	return p.byHost[strings.ToLower(host)]
+}
+
+func (p *Profile) hostAllowed(host string) bool {
+	if len(p.AllowedHosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	for _, allowed := range p.AllowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Handler decorator, that sets request profile in context.
+// Should be wrapped by AuthHandler, to match profiles by API key.
+type ProfileHandler struct {
+	Handler
+	Profiles *Profiles
+}
+
+func (h ProfileHandler) ServeHTTPC(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if profile := h.Profiles.lookup(getAPIKeyID(ctx), req.Host); profile != nil {
+		ctx = context.WithValue(ctx, ctxProfileKey, profile)
+	}
+	h.Handler.ServeHTTPC(ctx, w, req)
+}
+
+// returns nil if request has no profile
+func getProfile(ctx context.Context) *Profile {
+	profile, _ := ctx.Value(ctxProfileKey).(*Profile)
+	return profile
+}
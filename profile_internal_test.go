@@ -0,0 +1,52 @@
+package imgserver
+
+import (
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("profiles", func() {
+	const config = `{
+		"team": {
+			"api_keys": ["team"],
+			"hosts": ["team.imgserver.local"],
+			"options": {"timeout": "10s", "concurrency": "4"},
+			"max_options": {"timeout": "20s"},
+			"allowed_hosts": ["example.com", "*.example.org"],
+			"format": "json"
+		},
+		"public": {"hosts": ["imgserver.local"]}
+	}`
+	var profiles *Profiles
+	BeforeEach(func() {
+		var err error
+		profiles, err = ParseProfiles([]byte(config))
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	It("then options parsed", func() {
+		profile := profiles.lookup("team", "")
+		Expect(profile.Name).To(Equal("team"))
+		Expect(profile.Options).To(Equal(FetchOptions{Timeout: 10 * time.Second, Concurrency: 4, Retries: DefaultFetchOptions.Retries, PageRetries: DefaultFetchOptions.PageRetries}))
+		Expect(profile.MaxOptions).To(Equal(FetchOptions{Timeout: 20 * time.Second}))
+		Expect(profile.Format).To(Equal("json"))
+	})
+	It("then API key profile takes precedence over host", func() {
+		Expect(profiles.lookup("team", "imgserver.local:8888").Name).To(Equal("team"))
+		Expect(profiles.lookup("other", "imgserver.local:8888").Name).To(Equal("public"))
+		Expect(profiles.lookup("", "unknown.local")).To(BeNil())
+	})
+	It("then page host allowlist applied", func() {
+		profile := profiles.lookup("team", "")
+		Expect(profile.hostAllowed("example.com")).To(BeTrue())
+		Expect(profile.hostAllowed("img.example.org")).To(BeTrue())
+		Expect(profile.hostAllowed("example.net")).To(BeFalse())
+		Expect(profiles.lookup("", "imgserver.local").hostAllowed("example.net")).To(BeTrue())
+	})
+	It("then invalid format rejected", func() {
+		_, err := ParseProfiles([]byte(`{"bad": {"format": "gif"}}`))
+		Expect(err).To(HaveOccurred())
+	})
+})
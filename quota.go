@@ -0,0 +1,163 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Path of usage report of requesting API key.
+const UsagePath = "/" + APIVersion + "/usage"
+
+// Quota headers of responses to API keys with quota.
+const (
+	RateLimitLimitHeader     = "X-RateLimit-Limit"
+	RateLimitRemainingHeader = "X-RateLimit-Remaining"
+	RateLimitResetHeader     = "X-RateLimit-Reset" // seconds until oldest counted usage leaves window
+	BytesRemainingHeader     = "X-Imgserver-Bytes-Remaining"
+)
+
+// Usage is counted in rolling window of QuotaWindow, by hour slots.
+const (
+	QuotaWindow = 24 * time.Hour
+	quotaSlot   = time.Hour
+	quotaSlots  = int(QuotaWindow / quotaSlot)
+)
+
+// Requests and response body bytes allowed to API key within QuotaWindow, no quota for zero fields.
+// Quota is soft: bytes are counted after response, so last allowed response can exceed it.
+type Quota struct {
+	Requests int64 `json:"requests,omitempty"`
+	Bytes    int64 `json:"bytes,omitempty"`
+}
+
+func (q Quota) isZero() bool {
+	return q.Requests == 0 && q.Bytes == 0
+}
+
+// Usage of API key within QuotaWindow.
+type QuotaUsage struct {
+	ID       string `json:"id"`
+	Requests int64  `json:"requests"`
+	Bytes    int64  `json:"bytes"`
+	Quota    Quota  `json:"quota"`
+	Reset    int64  `json:"reset"` // seconds until oldest counted usage leaves window
+}
+
+// returns true if usage reached quota
+func (u QuotaUsage) exceeded() bool {
+	return (u.Quota.Requests > 0 && u.Requests >= u.Quota.Requests) || (u.Quota.Bytes > 0 && u.Bytes >= u.Quota.Bytes)
+}
+
+// sets quota headers, counting current request
+func (u QuotaUsage) setHeaders(header http.Header) {
+	if u.Quota.Requests > 0 {
+		remaining := u.Quota.Requests - u.Requests
+		if remaining < 0 {
+			remaining = 0
+		}
+		header.Set(RateLimitLimitHeader, strconv.FormatInt(u.Quota.Requests, 10))
+		header.Set(RateLimitRemainingHeader, strconv.FormatInt(remaining, 10))
+	}
+	if u.Quota.Bytes > 0 {
+		remaining := u.Quota.Bytes - u.Bytes
+		if remaining < 0 {
+			remaining = 0
+		}
+		header.Set(BytesRemainingHeader, strconv.FormatInt(remaining, 10))
+	}
+	header.Set(RateLimitResetHeader, strconv.FormatInt(u.Reset, 10))
+}
+
+type usageSlot struct {
+	index    int64 // slot number since Unix epoch
+	requests int64
+	bytes    int64
+}
+
+// Usage counters of rolling window.
+type usageWindow struct {
+	mu    sync.Mutex
+	slots [quotaSlots]usageSlot
+}
+
+func (w *usageWindow) add(now time.Time, requests, bytes int64) {
+	index := now.UnixNano() / int64(quotaSlot)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	slot := &w.slots[index%int64(quotaSlots)]
+	if slot.index != index {
+		*slot = usageSlot{index: index}
+	}
+	slot.requests += requests
+	slot.bytes += bytes
+}
+
+// returns usage within window, and seconds until oldest counted slot leaves it
+func (w *usageWindow) total(now time.Time) (requests, bytes, reset int64) {
+	index := now.UnixNano() / int64(quotaSlot)
+	oldest, used := index, false
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, slot := range w.slots {
+		if slot.index <= index-int64(quotaSlots) || slot.index > index {
+			continue
+		}
+		requests += slot.requests
+		bytes += slot.bytes
+		if (slot.requests > 0 || slot.bytes > 0) && slot.index <= oldest {
+			oldest, used = slot.index, true
+		}
+	}
+	if !used {
+		return 0, 0, 0
+	}
+	leaves := time.Unix(0, (oldest+int64(quotaSlots))*int64(quotaSlot))
+	return requests, bytes, int64((leaves.Sub(now) + time.Second - 1) / time.Second)
+}
+
+// Counts bytes of response body.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Returns usage within QuotaWindow of every configured key, and of recently seen JWT subjects.
+func (h *AuthHandler) QuotaUsage() []QuotaUsage {
+	keys := h.keys()
+	now := time.Now()
+	res := make([]QuotaUsage, len(keys))
+	for i, key := range keys {
+		res[i] = key.quotaUsage(now)
+	}
+	return res
+}
+
+func (key *apiKeyState) quotaUsage(now time.Time) QuotaUsage {
+	requests, bytes, reset := key.usage.total(now)
+	return QuotaUsage{key.ID, requests, bytes, key.Quota, reset}
+}
+
+func writeQuotaUsage(log Logger, w http.ResponseWriter, req *http.Request, usage QuotaUsage) {
+	resp := NewResponse()
+	resp.StatusCode = http.StatusOK
+	resp.Header.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp.Body).Encode(usage); err != nil {
+		resp = NewInternalErrorResponse()
+	}
+	writeResponse(log, w, req, resp)
+}
@@ -0,0 +1,99 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("usage window", func() {
+	start := time.Unix(1000*3600, 0)
+	It("then usage counted within window", func() {
+		w := &usageWindow{}
+		w.add(start, 1, 100)
+		w.add(start.Add(2*time.Hour), 1, 50)
+		requests, bytes, reset := w.total(start.Add(23 * time.Hour))
+		Expect(requests).To(BeEquivalentTo(2))
+		Expect(bytes).To(BeEquivalentTo(150))
+		Expect(reset).To(BeEquivalentTo(3600))
+
+		requests, bytes, _ = w.total(start.Add(25 * time.Hour))
+		Expect(requests).To(BeEquivalentTo(1))
+		Expect(bytes).To(BeEquivalentTo(50))
+
+		requests, bytes, reset = w.total(start.Add(48 * time.Hour))
+		Expect(requests).To(BeZero())
+		Expect(bytes).To(BeZero())
+		Expect(reset).To(BeZero())
+	})
+	It("then reused slot reset", func() {
+		w := &usageWindow{}
+		w.add(start, 5, 0)
+		w.add(start.Add(QuotaWindow), 1, 0)
+		requests, _, _ := w.total(start.Add(QuotaWindow))
+		Expect(requests).To(BeEquivalentTo(1))
+	})
+})
+
+var _ = Describe("quota", func() {
+	var (
+		handler *AuthHandler
+		body    string
+	)
+	BeforeEach(func() {
+		body = "response"
+		inner := handlerFunc(func(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(200)
+			w.Write([]byte(body))
+		})
+		handler = NewAuthHandler(inner, logger.StandardLogger(), []APIKey{
+			{ID: "requests", Secret: "requestssecret", Quota: Quota{Requests: 2}},
+			{ID: "bytes", Secret: "bytessecret", Quota: Quota{Bytes: 10}},
+		}, nil)
+	})
+	serve := func(secret, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set(APIKeyHeader, secret)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTPC(context.Background(), rec, req)
+		return rec
+	}
+
+	It("then requests over quota rejected", func() {
+		rec := serve("requestssecret", "/?url=http://example.com")
+		Expect(rec.Code).To(Equal(200))
+		Expect(rec.Header().Get(RateLimitLimitHeader)).To(Equal("2"))
+		Expect(rec.Header().Get(RateLimitRemainingHeader)).To(Equal("1"))
+		Expect(serve("requestssecret", "/?url=http://example.com").Header().Get(RateLimitRemainingHeader)).To(Equal("0"))
+
+		rec = serve("requestssecret", "/?url=http://example.com")
+		Expect(rec.Code).To(Equal(http.StatusTooManyRequests))
+		Expect(rec.Header().Get("Retry-After")).NotTo(BeEmpty())
+		Expect(rec.Header().Get(RateLimitRemainingHeader)).To(Equal("0"))
+	})
+	It("then responses over bytes quota rejected", func() {
+		rec := serve("bytessecret", "/?url=http://example.com")
+		Expect(rec.Code).To(Equal(200))
+		Expect(rec.Header().Get(BytesRemainingHeader)).To(Equal("10"))
+		Expect(serve("bytessecret", "/?url=http://example.com").Code).To(Equal(200))
+		Expect(serve("bytessecret", "/?url=http://example.com").Code).To(Equal(http.StatusTooManyRequests))
+	})
+	It("then usage of key reported", func() {
+		serve("requestssecret", "/?url=http://example.com")
+		rec := serve("requestssecret", UsagePath)
+		Expect(rec.Code).To(Equal(200))
+		var usage QuotaUsage
+		Expect(json.Unmarshal(rec.Body.Bytes(), &usage)).To(Succeed())
+		Expect(usage.ID).To(Equal("requests"))
+		Expect(usage.Requests).To(BeEquivalentTo(1))
+		Expect(usage.Bytes).To(BeEquivalentTo(len(body)))
+		Expect(usage.Quota).To(Equal(Quota{Requests: 2}))
+		Expect(handler.QuotaUsage()).To(HaveLen(2))
+	})
+})
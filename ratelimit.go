@@ -0,0 +1,131 @@
+package imgserver
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Token bucket rate limiter. Bucket of burst size is refilled with rate tokens per second,
+// every allowed event takes one token.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Keyed token buckets, like ones of API keys or origin hosts. Limiter shared by replicas,
+// like RedisRateLimiter, makes limits global, instead of per process.
+type RateLimiter interface {
+	// Takes token of key bucket, which is refilled with rate tokens per second up to burst.
+	// Returns false, if bucket is empty. Error means limiter is unavailable.
+	Allow(key string, rate float64, burst int) (bool, error)
+}
+
+// Max buckets of LocalRateLimiter, after which refilled ones are dropped.
+const maxLocalBuckets = 10000
+
+// Rate limiter of in process buckets.
+type LocalRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func NewLocalRateLimiter() *LocalRateLimiter {
+	return &LocalRateLimiter{buckets: make(map[string]*tokenBucket)}
+}
+
+func (l *LocalRateLimiter) Allow(key string, rate float64, burst int) (bool, error) {
+	l.mu.Lock()
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxLocalBuckets {
+			l.dropRefilled()
+		}
+		bucket = newTokenBucket(rate, burst)
+		l.buckets[key] = bucket
+	}
+	l.mu.Unlock()
+	return bucket.allow(), nil
+}
+
+// drops buckets, that are full again, as new ones are the same
+func (l *LocalRateLimiter) dropRefilled() {
+	now := time.Now()
+	for key, b := range l.buckets {
+		b.mu.Lock()
+		full := b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.burst
+		b.mu.Unlock()
+		if full {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Returns RoundTripper decorator, that waits for token of request host bucket of limiter,
+// so origins are requested at most rate times per second with burst, by all limiter users.
+// Requests are not limited, if limiter fails.
+func NewOriginRateLimitTransport(rt http.RoundTripper, log Logger, limiter RateLimiter, rate float64, burst int) http.RoundTripper {
+	return originRateLimitTransport{rt, SetEmitter(log, "OriginRateLimit"), limiter, rate, burst}
+}
+
+type originRateLimitTransport struct {
+	http.RoundTripper
+	log     Logger
+	limiter RateLimiter
+	rate    float64
+	burst   int
+}
+
+func (t originRateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// token is refilled in 1/rate, so polling is not more frequent
+	wait := time.Duration(float64(time.Second) / t.rate)
+	for {
+		allowed, err := t.limiter.Allow("origin:"+req.URL.Host, t.rate, t.burst)
+		if err != nil {
+			t.log.WithField("host", req.URL.Host).Warn("rate limiter error: ", err)
+			break
+		}
+		if allowed {
+			break
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,121 @@
+package imgserver
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+// Serves RESP commands on listener by reply, which gets command args.
+func serveTestRedis(l net.Listener, reply func(args []string) string) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			r := bufio.NewReader(conn)
+			for {
+				line, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				n, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+				args := make([]string, n)
+				for i := range args {
+					line, _ := r.ReadString('\n')
+					size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+					arg := make([]byte, size+2)
+					if _, err := io.ReadFull(r, arg); err != nil {
+						return
+					}
+					args[i] = string(arg[:size])
+				}
+				conn.Write([]byte(reply(args)))
+			}
+		}()
+	}
+}
+
+type rateLimiterFunc func(key string, rate float64, burst int) (bool, error)
+
+func (f rateLimiterFunc) Allow(key string, rate float64, burst int) (bool, error) {
+	return f(key, rate, burst)
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+var _ = Describe("rate limiters", func() {
+	It("then local buckets are separate per key", func() {
+		limiter := NewLocalRateLimiter()
+		Expect(limiter.Allow("a", 0.001, 2)).To(BeTrue())
+		Expect(limiter.Allow("a", 0.001, 2)).To(BeTrue())
+		Expect(limiter.Allow("a", 0.001, 2)).To(BeFalse())
+		Expect(limiter.Allow("b", 0.001, 2)).To(BeTrue())
+	})
+	It("then Redis script is loaded by EVAL, when it is not cached", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		defer l.Close()
+		commands := make(chan []string, 10)
+		go serveTestRedis(l, func(args []string) string {
+			commands <- args
+			switch args[0] {
+			case "AUTH":
+				return "+OK\r\n"
+			case "EVALSHA":
+				return "-NOSCRIPT No matching script\r\n"
+			}
+			return ":0\r\n"
+		})
+		limiter := NewRedisRateLimiter(l.Addr().String())
+		limiter.Password = "secret"
+		Expect(limiter.Allow("apikey:team", 2, 5)).To(BeFalse())
+		Expect(<-commands).To(Equal([]string{"AUTH", "secret"}))
+		evalSHA := <-commands
+		Expect(evalSHA[:5]).To(Equal([]string{"EVALSHA", redisTokenBucketSHA, "1", "imgserver:ratelimit:apikey:team", "2"}))
+		Expect((<-commands)[0]).To(Equal("EVAL"))
+	})
+	It("then Redis limiter fails, when Redis is unavailable", func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).NotTo(HaveOccurred())
+		addr := l.Addr().String()
+		l.Close()
+		_, err = NewRedisRateLimiter(addr).Allow("origin:example.com", 1, 1)
+		Expect(err).To(HaveOccurred())
+	})
+	It("then origin requests wait for token until request is canceled", func() {
+		var allowed bool
+		limiter := rateLimiterFunc(func(key string, rate float64, burst int) (bool, error) {
+			Expect(key).To(Equal("origin:example.com"))
+			return allowed, nil
+		})
+		rt := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			return &http.Response{StatusCode: 200}, nil
+		})
+		transport := NewOriginRateLimitTransport(rt, logger.StandardLogger(), limiter, 100, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req, _ := http.NewRequest("GET", "http://example.com/img.png", nil)
+		_, err := transport.RoundTrip(req.WithContext(ctx))
+		Expect(err).To(Equal(context.DeadlineExceeded))
+		allowed = true
+		resp, err := transport.RoundTrip(req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(resp.StatusCode).To(Equal(200))
+	})
+})
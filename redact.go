@@ -0,0 +1,112 @@
+package imgserver
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Replaces masked URL parts.
+const redactedValue = "REDACTED"
+
+// Query params masked by default, as commonly carrying credentials or signatures.
+var DefaultRedactedParams = []string{
+	"token", "access_token", "id_token", "auth", "key", "api_key", "apikey",
+	"secret", "password", "sig", "signature", "session", "sid",
+	"x-amz-signature", "x-amz-credential", "x-amz-security-token", "x-goog-signature", "x-goog-credential",
+}
+
+// trailing punctuation is not counted as URL part
+var urlInText = regexp.MustCompile(`(?i)\b[a-z][a-z0-9+.\-]*://[^\s"'<>]*[^\s"'<>.,:;!?)]`)
+
+// Masks secrets of URLs in log entries and error messages:
+// userinfo passwords, and values of sensitive query params, or of all params if AllQuery.
+type URLRedactor struct {
+	Params   map[string]bool // lower case names of masked query params
+	AllQuery bool
+}
+
+func NewURLRedactor(params []string, allQuery bool) *URLRedactor {
+	r := &URLRedactor{Params: make(map[string]bool), AllQuery: allQuery}
+	for _, param := range params {
+		if param = strings.TrimSpace(param); param != "" {
+			r.Params[strings.ToLower(param)] = true
+		}
+	}
+	return r
+}
+
+// Returns URL with secrets masked. Not URL strings are returned as is. Nil redactor masks nothing.
+func (r *URLRedactor) RedactURL(rawURL string) string {
+	if r == nil {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme == "" {
+		return rawURL
+	}
+	changed := false
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redactedValue)
+		changed = true
+	}
+	if u.RawQuery != "" {
+		pairs := strings.Split(u.RawQuery, "&")
+		for i, pair := range pairs {
+			name := pair
+			if eq := strings.IndexByte(pair, '='); eq >= 0 {
+				name = pair[:eq]
+			}
+			if unescaped, err := url.QueryUnescape(name); err == nil {
+				name = unescaped
+			}
+			if r.AllQuery || r.Params[strings.ToLower(name)] {
+				pairs[i] = url.QueryEscape(name) + "=" + redactedValue
+				changed = true
+			}
+		}
+		u.RawQuery = strings.Join(pairs, "&")
+	}
+	if !changed {
+		// keep original form
+		return rawURL
+	}
+	return u.String()
+}
+
+// Returns text with secrets of every URL in it masked.
+func (r *URLRedactor) Redact(text string) string {
+	if r == nil || !strings.Contains(text, "://") {
+		return text
+	}
+	return urlInText.ReplaceAllStringFunc(text, r.RedactURL)
+}
+
+// Logrus hook, that redacts URLs in messages and fields of entries.
+type RedactionHook struct {
+	Redactor *URLRedactor
+}
+
+func (h RedactionHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.PanicLevel, logrus.FatalLevel, logrus.ErrorLevel, logrus.WarnLevel, logrus.InfoLevel, logrus.DebugLevel}
+}
+
+func (h RedactionHook) Fire(entry *logrus.Entry) error {
+	entry.Message = h.Redactor.Redact(entry.Message)
+	// fields map is shared with parent entries, that may be used concurrently, so it is replaced
+	data := make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch value.(type) {
+		case string, error, fmt.Stringer:
+			if text := fmt.Sprint(value); strings.Contains(text, "://") {
+				value = h.Redactor.Redact(text)
+			}
+		}
+		data[key] = value
+	}
+	entry.Data = data
+	return nil
+}
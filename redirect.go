@@ -0,0 +1,108 @@
+package imgserver
+
+import (
+	"bytes"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// Max delay of followed meta refresh, in seconds. Refreshes with longer delay are
+// reloads of page with content, not interstitials.
+const maxMetaRefreshDelay = 5
+
+// Returns URL that page redirects to by meta refresh, or by canonical link to another page,
+// or nil. Only head of page is tokenized; refresh is preferred over canonical link.
+func pageRedirect(page []byte, pageURL *url.URL) *url.URL {
+	var canonical string
+	tokenizer := html.NewTokenizer(bytes.NewReader(page))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return redirectURL(canonical, pageURL)
+		case html.EndTagToken:
+			if name, _ := tokenizer.TagName(); string(name) == "head" {
+				return redirectURL(canonical, pageURL)
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			switch token.Data {
+			case "body":
+				return redirectURL(canonical, pageURL)
+			case "meta":
+				if !strings.EqualFold(tokenAttr(token, "http-equiv"), "refresh") {
+					continue
+				}
+				if target, ok := parseMetaRefresh(tokenAttr(token, "content")); ok {
+					if res := redirectURL(target, pageURL); res != nil {
+						return res
+					}
+				}
+			case "link":
+				if canonical == "" && hasLinkRel(tokenAttr(token, "rel"), "canonical") {
+					canonical = tokenAttr(token, "href")
+				}
+			}
+		}
+	}
+}
+
+// Parses meta refresh content like `0; url='/next'`. Returns false for refreshes
+// without URL, or with delay over maxMetaRefreshDelay.
+func parseMetaRefresh(content string) (string, bool) {
+	i := strings.IndexAny(content, ";,")
+	if i < 0 {
+		return "", false
+	}
+	delay, err := strconv.ParseFloat(strings.TrimSpace(content[:i]), 64)
+	if err != nil || delay < 0 || delay > maxMetaRefreshDelay {
+		return "", false
+	}
+	target := strings.TrimSpace(content[i+1:])
+	if len(target) >= 3 && strings.EqualFold(target[:3], "url") {
+		rest := strings.TrimSpace(target[3:])
+		if strings.HasPrefix(rest, "=") {
+			target = strings.TrimSpace(rest[1:])
+		}
+	}
+	target = strings.Trim(target, `'"`)
+	return target, target != ""
+}
+
+// returns absolute http(s) URL of ref without fragment, or nil if it is invalid or is page URL
+func redirectURL(ref string, pageURL *url.URL) *url.URL {
+	if ref == "" {
+		return nil
+	}
+	target, err := pageURL.Parse(strings.TrimSpace(ref))
+	if err != nil || !(target.Scheme == "http" || target.Scheme == "https") || target.Host == "" {
+		return nil
+	}
+	target.Fragment = ""
+	page := *pageURL
+	page.Fragment = ""
+	if target.String() == page.String() {
+		return nil
+	}
+	return target
+}
+
+func tokenAttr(token html.Token, key string) string {
+	for _, attr := range token.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+func hasLinkRel(rel, value string) bool {
+	for _, r := range strings.Fields(rel) {
+		if strings.EqualFold(r, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("page redirects", func() {
+	pageURL, _ := url.Parse("http://example.com/a/page#top")
+	redirect := func(page string) string {
+		target := pageRedirect([]byte(page), pageURL)
+		if target == nil {
+			return ""
+		}
+		return target.String()
+	}
+	It("then meta refresh is followed", func() {
+		Expect(redirect(`<meta http-equiv="refresh" content="0; url='/next'">`)).To(Equal("http://example.com/next"))
+		Expect(redirect(`<meta http-equiv="Refresh" content="1;URL=other">`)).To(Equal("http://example.com/a/other"))
+		Expect(redirect(`<meta http-equiv="refresh" content="0, https://example.org/">`)).To(Equal("https://example.org/"))
+	})
+	It("then reload and slow refresh are not followed", func() {
+		Expect(redirect(`<meta http-equiv="refresh" content="30">`)).To(BeEmpty())
+		Expect(redirect(`<meta http-equiv="refresh" content="60; url=/next">`)).To(BeEmpty())
+		Expect(redirect(`<meta http-equiv="refresh" content="0; url=javascript:alert(1)">`)).To(BeEmpty())
+	})
+	It("then canonical link to another page is followed, after refresh", func() {
+		Expect(redirect(`<link rel="canonical" href="/canonical">`)).To(Equal("http://example.com/canonical"))
+		Expect(redirect(`<link rel="canonical" href="/canonical"><meta http-equiv="refresh" content="0; url=/next">`)).
+			To(Equal("http://example.com/next"))
+		Expect(redirect(`<link rel="canonical" href="http://example.com/a/page">`)).To(BeEmpty())
+	})
+	It("then links in body are ignored", func() {
+		Expect(redirect(`<head></head><body><link rel="canonical" href="/canonical">`)).To(BeEmpty())
+		Expect(redirect(`<img src="a.png">`)).To(BeEmpty())
+	})
+	It("then page fetch follows redirects", func() {
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			switch r.URL.Path {
+			case "/short":
+				w.Write([]byte(`<meta http-equiv="refresh" content="0; url=/interstitial">`))
+			case "/interstitial":
+				w.Write([]byte(`<link rel="canonical" href="/article/"><p>wait`))
+			case "/loop":
+				w.Write([]byte(`<link rel="canonical" href="/loop2">`))
+			case "/loop2":
+				w.Write([]byte(`<link rel="canonical" href="/loop">`))
+			default:
+				w.Write([]byte(`<img src="a.png">`))
+			}
+		}))
+		defer origin.Close()
+		fetch := func(path string, redirects int) (string, string) {
+			pageURL, _ := url.Parse(origin.URL + path)
+			ctx := newImgLogicContext(setLogger(context.Background(), logger.StandardLogger()), http.DefaultClient, pageURL)
+			ctx = setFetchOptions(ctx, FetchOptions{PageRedirects: redirects})
+			body, _, fetchedURL, err := NewImgLogicHandler(http.DefaultClient).fetchPage(ctx, 0)
+			Expect(err).NotTo(HaveOccurred())
+			// url param is of requested page
+			Expect(pageURL.Path).To(Equal(path))
+			return fetchedURL.Path, body.String()
+		}
+		path, body := fetch("/short", 5)
+		Expect(path).To(Equal("/article/"))
+		Expect(body).To(Equal(`<img src="a.png">`))
+		path, _ = fetch("/short", 1)
+		Expect(path).To(Equal("/interstitial"))
+		path, _ = fetch("/short", 0)
+		Expect(path).To(Equal("/short"))
+		path, _ = fetch("/loop", 5)
+		Expect(path).To(Equal("/loop2"))
+	})
+	It("then redirect to host not allowed by profile is rejected", func() {
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<meta http-equiv="refresh" content="0; url=http://169.254.169.254/latest/">`))
+		}))
+		defer origin.Close()
+		pageURL, _ := url.Parse(origin.URL + "/")
+		ctx := context.WithValue(setLogger(context.Background(), logger.StandardLogger()), ctxProfileKey, &Profile{AllowedHosts: []string{pageURL.Hostname()}})
+		ctx = setFetchOptions(newImgLogicContext(ctx, http.DefaultClient, pageURL), FetchOptions{PageRedirects: 1})
+		_, _, _, err := NewImgLogicHandler(http.DefaultClient).fetchPage(ctx, 0)
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusForbidden))
+	})
+})
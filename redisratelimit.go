@@ -0,0 +1,206 @@
+package imgserver
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Token bucket of KEYS[1] refilled by ARGV rate and burst at ARGV now, in seconds.
+// Bucket expires, when it is refilled, so idle keys take no memory.
+const redisTokenBucketScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'ts')
+local tokens = tonumber(state[1]) or burst
+local ts = tonumber(state[2]) or now
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+local allowed = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+end
+redis.call('HMSET', KEYS[1], 'tokens', tostring(tokens), 'ts', tostring(now))
+redis.call('EXPIRE', KEYS[1], math.ceil(burst / rate) + 1)
+return allowed
+`
+
+var redisTokenBucketSHA = func() string {
+	sum := sha1.Sum([]byte(redisTokenBucketScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// Rate limiter of buckets in Redis, shared by server replicas. Bucket is taken atomically
+// by Lua script, and refilled by clock of requesting replica, so replica clocks should be synchronized.
+type RedisRateLimiter struct {
+	Addr     string // host:port
+	Password string // no AUTH if empty
+	DB       int
+	Prefix   string        // of bucket keys
+	Timeout  time.Duration // of connect and command, no timeout if 0
+
+	idle chan *redisConn
+}
+
+func NewRedisRateLimiter(addr string) *RedisRateLimiter {
+	return &RedisRateLimiter{
+		Addr:    addr,
+		Prefix:  "imgserver:ratelimit:",
+		Timeout: time.Second,
+		idle:    make(chan *redisConn, 16),
+	}
+}
+
+func (l *RedisRateLimiter) Allow(key string, rate float64, burst int) (bool, error) {
+	if burst < 1 {
+		burst = 1
+	}
+	args := []string{
+		"1", l.Prefix + key,
+		strconv.FormatFloat(rate, 'f', -1, 64),
+		strconv.Itoa(burst),
+		strconv.FormatFloat(float64(time.Now().UnixNano())/1e9, 'f', 6, 64),
+	}
+	reply, err := l.do(append([]string{"EVALSHA", redisTokenBucketSHA}, args...)...)
+	if redisErr, ok := err.(redisError); ok && strings.HasPrefix(string(redisErr), "NOSCRIPT") {
+		// script is cached by EVAL
+		reply, err = l.do(append([]string{"EVAL", redisTokenBucketScript}, args...)...)
+	}
+	if err != nil {
+		return false, err
+	}
+	allowed, ok := reply.(int64)
+	if !ok {
+		return false, fmt.Errorf("unexpected redis reply: %v", reply)
+	}
+	return allowed == 1, nil
+}
+
+// Runs command on pooled connection. Connections are dropped on network errors.
+func (l *RedisRateLimiter) do(args ...string) (interface{}, error) {
+	conn, err := l.conn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.do(l.Timeout, args...)
+	if _, ok := err.(redisError); err != nil && !ok {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case l.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+func (l *RedisRateLimiter) conn() (*redisConn, error) {
+	select {
+	case conn := <-l.idle:
+		return conn, nil
+	default:
+	}
+	netConn, err := net.DialTimeout("tcp", l.Addr, l.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{netConn, bufio.NewReader(netConn)}
+	if l.Password != "" {
+		if _, err := conn.do(l.Timeout, "AUTH", l.Password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis auth error: %v", err)
+		}
+	}
+	if l.DB != 0 {
+		if _, err := conn.do(l.Timeout, "SELECT", strconv.Itoa(l.DB)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis select error: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+// Error reply of Redis server. Connection stays usable after it.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// Connection speaking RESP protocol. Only replies of integer, string and error types,
+// and arrays of them, are supported.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *redisConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	if timeout > 0 {
+		c.SetDeadline(time.Now().Add(timeout))
+	}
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, "\r\n"...)
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, arg...)
+		buf = append(buf, "\r\n"...)
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+	return c.readReply()
+}
+
+func (c *redisConn) readReply() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("invalid redis reply line")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, redisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line)
+		if err != nil || size < 0 {
+			// nil bulk string
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		res := make([]interface{}, size)
+		for i := range res {
+			if res[i], err = c.readReply(); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply type %q", kind)
+}
@@ -0,0 +1,118 @@
+package imgserver
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+var (
+	// CSS image-set() function, possibly vendor prefixed, with url() candidates nested
+	cssImageSet = regexp.MustCompile(`(?i)(?:-webkit-)?image-set\(((?:[^()]|\([^()]*\))*)\)`)
+	// quoted string candidate of image-set()
+	cssImageSetString = regexp.MustCompile(`(^|,)\s*(['"])([^'"]+)(['"])`)
+	// image-set() candidate resolution, like 2x or 192dpi
+	cssResolution = regexp.MustCompile(`^(\d+(?:\.\d+)?)(x|dppx|dpi)$`)
+	// paths of image files, that image map areas can link
+	imageFileURL = regexp.MustCompile(`(?i)\.(png|jpe?g|gif|webp|avif|svg|bmp)([?#].*)?$`)
+)
+
+// Returns img tag of image referenced by not img tag: area of image map linking image file,
+// like full size of thumbnail region, or element styled by CSS image-set(), which candidates
+// are srcset chosen by client hints like img srcset. Returns false for tags referencing no image.
+func relatedImage(token html.Token) (imgTag, bool) {
+	if token.DataAtom == atom.Area {
+		href := strings.TrimSpace(tokenAttr(token, "href"))
+		if href == "" || !imageFileURL.MatchString(href) {
+			return imgTag{}, false
+		}
+		img := imgTag{0, []html.Attribute{{Key: "src", Val: href}}, nil}
+		if alt := tokenAttr(token, "alt"); alt != "" {
+			img.attr = append(img.attr, html.Attribute{Key: "alt", Val: alt})
+		}
+		return img, true
+	}
+	style := tokenAttr(token, "style")
+	if style == "" {
+		return imgTag{}, false
+	}
+	match := cssImageSet.FindStringSubmatch(style)
+	if match == nil {
+		return imgTag{}, false
+	}
+	candidates := parseImageSet(match[1])
+	if len(candidates) == 0 {
+		return imgTag{}, false
+	}
+	src := candidates[0]
+	srcset := make([]string, len(candidates))
+	for i, c := range candidates {
+		if c.x == 1 {
+			src = c
+		}
+		srcset[i] = c.url + " " + strconv.FormatFloat(c.x, 'f', -1, 64) + "x"
+	}
+	return imgTag{0, []html.Attribute{
+		{Key: "src", Val: src.url},
+		{Key: "srcset", Val: strings.Join(srcset, ", ")},
+	}, nil}, true
+}
+
+// Parses image-set() arguments, like `url(a.png) 1x, "b.png" 2x`, to density candidates.
+// Candidates are separated by commas, so data URLs are not supported.
+func parseImageSet(args string) []srcsetCandidate {
+	var res []srcsetCandidate
+	for _, item := range strings.Split(args, ",") {
+		item = strings.TrimSpace(item)
+		var ref, rest string
+		switch {
+		case strings.HasPrefix(strings.ToLower(item), "url("):
+			end := strings.IndexByte(item, ')')
+			if end < 0 {
+				continue
+			}
+			ref, rest = item[len("url("):end], item[end+1:]
+		case strings.HasPrefix(item, `"`) || strings.HasPrefix(item, "'"):
+			end := strings.IndexByte(item[1:], item[0])
+			if end < 0 {
+				continue
+			}
+			ref, rest = item[:end+2], item[end+2:]
+		default:
+			continue
+		}
+		ref = strings.Trim(strings.TrimSpace(ref), `'"`)
+		if ref == "" || strings.HasPrefix(ref, "data:") {
+			continue
+		}
+		candidate := srcsetCandidate{url: ref, x: 1}
+		for _, field := range strings.Fields(rest) {
+			m := cssResolution.FindStringSubmatch(strings.ToLower(field))
+			if m == nil {
+				// like type("image/avif") of candidate format
+				continue
+			}
+			x, _ := strconv.ParseFloat(m[1], 64)
+			if m[2] == "dpi" {
+				x /= 96
+			}
+			if x > 0 {
+				candidate.x = x
+			}
+		}
+		res = append(res, candidate)
+	}
+	return res
+}
+
+// returns CSS with quoted image-set() candidates wrapped to url(), so they are handled like other references
+func imageSetURLs(css string) string {
+	return cssImageSet.ReplaceAllStringFunc(css, func(imageSet string) string {
+		open := strings.IndexByte(imageSet, '(')
+		args := cssImageSetString.ReplaceAllString(imageSet[open+1:len(imageSet)-1], `$1 url($2$3$4)`)
+		return imageSet[:open+1] + args + ")"
+	})
+}
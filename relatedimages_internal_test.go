@@ -0,0 +1,51 @@
+package imgserver
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+var _ = Describe("related images", func() {
+	// returns empty string, if tag references no image
+	related := func(tag string) string {
+		z := html.NewTokenizer(strings.NewReader(tag))
+		z.Next()
+		img, ok := relatedImage(z.Token())
+		if !ok {
+			return ""
+		}
+		return img.token().String()
+	}
+	It("then image map area linking image is image", func() {
+		Expect(related(`<area shape="rect" href="full/1.jpg?v=2" alt="Region">`)).To(Equal(`<img src="full/1.jpg?v=2" alt="Region">`))
+		Expect(related(`<area shape="rect" href="/page.html">`)).To(BeEmpty())
+	})
+	It("then image-set candidates are srcset", func() {
+		Expect(related(`<div style="background-image: -webkit-image-set(url('a.png') 1x, url(&quot;a@2x.png&quot;) 2x)">`)).
+			To(Equal(`<img src="a.png" srcset="a.png 1x, a@2x.png 2x">`))
+		Expect(related(`<div style="background: image-set(&quot;b@2x.webp&quot; type(&quot;image/webp&quot;) 2x, &quot;b.png&quot; 96dpi)">`)).
+			To(Equal(`<img src="b.png" srcset="b@2x.webp 2x, b.png 1x">`))
+		Expect(related(`<div style="background: url(a.png)">`)).To(BeEmpty())
+		Expect(related(`<div>`)).To(BeEmpty())
+	})
+	It("then quoted image-set candidates are wrapped to url", func() {
+		Expect(imageSetURLs(`a { background: image-set("a.png" 1x, url(b.png) 2x); color: red }`)).
+			To(Equal(`a { background: image-set( url("a.png") 1x, url(b.png) 2x); color: red }`))
+	})
+	It("then related images are parsed in document order", func() {
+		page := `<img src="map.png" usemap="#m"><map name="m"><area href="big.png"></map><p style="background: image-set('c.png' 1x)">`
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		imgc, errc := imageParserImp{imgTokenParserFunc(parseImgToken)}.parseImage(ctx, strings.NewReader(page))
+		var srcs []string
+		for img := range imgc {
+			srcs = append(srcs, img.src())
+		}
+		Expect(errc).NotTo(Receive())
+		Expect(srcs).To(Equal([]string{"map.png", "big.png", "c.png"}))
+	})
+})
@@ -0,0 +1,363 @@
+package imgserver
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+type outputFormat string
+
+// supported response formats
+const (
+	formatHTML  outputFormat = "html"
+	formatJSON  outputFormat = "json"
+	formatMHTML outputFormat = "mhtml"
+	formatZIP   outputFormat = "zip"
+	formatPage  outputFormat = "page" // whole page saved as single file
+	// images as binary parts, without base64 encoding
+	formatMultipart outputFormat = "multipart"
+)
+
+const defaultFormat = formatHTML
+
+// media types accepted in Accept header for every format
+var formatMediaTypes = map[outputFormat][]string{
+	formatHTML:      {"text/html", "application/xhtml+xml"},
+	formatJSON:      {"application/json"},
+	formatMHTML:     {"multipart/related", "application/x-mimearchive", "message/rfc822"},
+	formatZIP:       {"application/zip"},
+	formatPage:      nil, // only by format param
+	formatMultipart: {"multipart/mixed"},
+}
+
+// format query param takes precedence over Accept header
+func negotiateFormat(req *http.Request, defaultFormat outputFormat) (outputFormat, error) {
+	if param := req.URL.Query().Get("format"); param != "" {
+		format := outputFormat(strings.ToLower(param))
+		if _, ok := formatMediaTypes[format]; !ok {
+			return "", NewHandlerError(400, "unsupported format: "+param)
+		}
+		return format, nil
+	}
+	accept := strings.TrimSpace(req.Header.Get("Accept"))
+	if accept == "" {
+		return defaultFormat, nil
+	}
+	for _, mediaType := range parseAccept(accept) {
+		if mediaType == "*/*" || mediaType == "text/*" {
+			return defaultFormat, nil
+		}
+		for format, mediaTypes := range formatMediaTypes {
+			for _, mt := range mediaTypes {
+				if mt == mediaType {
+					return format, nil
+				}
+			}
+		}
+	}
+	return "", NewHandlerError(http.StatusNotAcceptable, "no acceptable format, supported: html, json, mhtml, zip, page, multipart")
+}
+
+// returns media types from Accept header ordered by q-value, q=0 types dropped
+func parseAccept(accept string) []string {
+	type acceptItem struct {
+		mediaType string
+		q         float64
+	}
+	var items []acceptItem
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qParam, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(qParam, 64); err != nil {
+				continue
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		items = append(items, acceptItem{mediaType, q})
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].q > items[j].q })
+	res := make([]string, len(items))
+	for i, item := range items {
+		res[i] = item.mediaType
+	}
+	return res
+}
+
+func renderResponse(ctx context.Context, format outputFormat, extracted *extraction) (*Response, error) {
+	images := extracted.images
+	resp := NewResponse()
+	resp.StatusCode = http.StatusOK
+	// same URL may be rendered differently
+	resp.Header.Set("Vary", responseVary(ctx))
+	resp.Header.Set("Accept-CH", ClientHintsHeaders)
+	var err error
+	switch format {
+	case formatHTML:
+		resp.Header.Set("Content-Type", "text/html;charset=utf-8")
+		resp.Body, err = formImagesHTML(ctx, images)
+	case formatJSON:
+		resp.Header.Set("Content-Type", "application/json")
+		err = formImagesJSON(ctx, extracted, resp.Body)
+	case formatMHTML:
+		var contentType string
+		contentType, err = formImagesMHTML(ctx, images, resp.Body)
+		resp.Header.Set("Content-Type", contentType)
+	case formatZIP:
+		resp.Header.Set("Content-Type", "application/zip")
+		resp.Header.Set("Content-Disposition", `attachment; filename="images.zip"`)
+		err = formImagesZIP(ctx, images, resp.Body)
+	case formatMultipart:
+		var contentType string
+		contentType, err = formImagesMultipart(ctx, images, resp.Body)
+		resp.Header.Set("Content-Type", contentType)
+	default:
+		return nil, errors.New("unexpected format: " + string(format))
+	}
+	if err != nil {
+		return nil, err
+	}
+	var imagesBytes int
+	for _, img := range images {
+		imagesBytes += img.inlineSize()
+	}
+	resp.Header.Set(ImageCountHeader, strconv.Itoa(len(images)))
+	resp.Header.Set(ImagesBytesHeader, strconv.Itoa(imagesBytes))
+	if extracted.truncated {
+		resp.Header.Set(TruncatedHeader, "true")
+	}
+	if total := pagedTotal(ctx, extracted); total > 0 {
+		resp.Header.Set(TotalImagesHeader, strconv.Itoa(total))
+	}
+	return resp, nil
+}
+
+// Returns picked image of extraction as raw image, downloadable as attachment named by its URL.
+func pickedImageResponse(ctx context.Context, extracted *extraction, pick int) (*Response, error) {
+	if len(extracted.images) == 0 {
+		return nil, NewHandlerError(http.StatusNotFound, fmt.Sprintf("page has no image %v", pick))
+	}
+	img := extracted.images[0]
+	if !img.isInlined() {
+		return nil, NewHandlerError(http.StatusBadGateway, "picked image is not fetched: "+img.src())
+	}
+	contentType, data, err := img.inlineData()
+	if err != nil {
+		return nil, err
+	}
+	name := "image"
+	if u, err := url.Parse(extracted.pickedURL); err == nil && extracted.pickedURL != "" {
+		if base := path.Base(u.Path); base != "." && base != "/" {
+			name = base
+		}
+	}
+	if path.Ext(name) == "" {
+		name += mediaTypeExt(contentType)
+	}
+	resp := NewResponse()
+	resp.StatusCode = http.StatusOK
+	resp.Header.Set("Vary", responseVary(ctx))
+	resp.Header.Set("Accept-CH", ClientHintsHeaders)
+	resp.Header.Set("Content-Type", contentType)
+	resp.Header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name}))
+	resp.Header.Set(ImageCountHeader, "1")
+	resp.Header.Set(ImagesBytesHeader, strconv.Itoa(len(data)))
+	resp.Body.Write(data)
+	return resp, nil
+}
+
+type jsonImage struct {
+	Src        string            `json:"src"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+// Returns total images of paginated extraction, or 0 if it is not paginated, or total is unknown.
+func pagedTotal(ctx context.Context, extracted *extraction) int {
+	if opts := getFetchOptions(ctx); opts.Offset == 0 && opts.Limit == 0 {
+		return 0
+	}
+	return extracted.total
+}
+
+func formImagesJSON(ctx context.Context, extracted *extraction, buf *bytes.Buffer) error {
+	images := extracted.images
+	res := struct {
+		URL       string      `json:"url"`
+		Count     int         `json:"count"`
+		Total     int         `json:"total,omitempty"`
+		Truncated bool        `json:"truncated,omitempty"`
+		Images    []jsonImage `json:"images"`
+		Timings   []URLTiming `json:"timings,omitempty"`
+	}{getURLParam(ctx).String(), len(images), pagedTotal(ctx, extracted), extracted.truncated, make([]jsonImage, 0, len(images)), nil}
+	if timings := getFetchTimings(ctx); timings != nil {
+		res.Timings = timings.list()
+	}
+	for _, img := range images {
+		jsonImg := jsonImage{Src: img.src()}
+		for i, attr := range img.attr {
+			if i == img.srcIndex {
+				continue
+			}
+			if jsonImg.Attributes == nil {
+				jsonImg.Attributes = make(map[string]string)
+			}
+			jsonImg.Attributes[attr.Key] = attr.Val
+		}
+		res.Images = append(res.Images, jsonImg)
+	}
+	return json.NewEncoder(buf).Encode(res)
+}
+
+// writes multipart/related MHTML archive to buf and returns its content type
+func formImagesMHTML(ctx context.Context, images []imgTag, buf *bytes.Buffer) (string, error) {
+	mw := multipart.NewWriter(buf)
+	if err := writeCIDPage(ctx, mw, images); err != nil {
+		return "", err
+	}
+	for i, img := range images {
+		if !img.isInlined() {
+			continue
+		}
+		contentType, data, err := img.inlineData()
+		if err != nil {
+			return "", err
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Type", contentType)
+		header.Set("Content-Transfer-Encoding", "base64")
+		header.Set("Content-ID", fmt.Sprintf("<image%03d@imgserver>", i))
+		w, err := mw.CreatePart(header)
+		if err != nil {
+			return "", err
+		}
+		// RFC 2045 limits encoded lines to 76 characters
+		encoded := base64.StdEncoding.EncodeToString(data)
+		for len(encoded) > 76 {
+			fmt.Fprint(w, encoded[:76], "\r\n")
+			encoded = encoded[76:]
+		}
+		fmt.Fprint(w, encoded, "\r\n")
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf(`multipart/related; type="text/html"; boundary="%s"`, mw.Boundary()), nil
+}
+
+// writes first multipart part: HTML page of images, referencing inlined ones by Content-ID of their parts
+func writeCIDPage(ctx context.Context, mw *multipart.Writer, images []imgTag) error {
+	refs := make([]imgTag, len(images))
+	for i, img := range images {
+		if !img.isInlined() {
+			// not inlined image link
+			refs[i] = img
+			continue
+		}
+		refs[i] = img.withSrc(fmt.Sprintf("cid:image%03d@imgserver", i))
+	}
+	page, err := formImagesHTML(ctx, refs)
+	if err != nil {
+		return err
+	}
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", "text/html; charset=utf-8")
+	header.Set("Content-Location", getURLParam(ctx).String())
+	w, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	_, err = page.WriteTo(w)
+	buffers.put(page)
+	return err
+}
+
+// writes zip archive with index.html and images folder to buf
+func formImagesZIP(ctx context.Context, images []imgTag, buf *bytes.Buffer) error {
+	zw := zip.NewWriter(buf)
+	files := make([]imgTag, len(images))
+	for i, img := range images {
+		if !img.isInlined() {
+			// not inlined image link
+			files[i] = img
+			continue
+		}
+		contentType, data, err := img.inlineData()
+		if err != nil {
+			return err
+		}
+		name := fmt.Sprintf("images/%03d%s", i, mediaTypeExt(contentType))
+		w, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+		files[i] = img.withSrc(name)
+	}
+	page, err := formImagesHTML(ctx, files)
+	if err != nil {
+		return err
+	}
+	defer buffers.put(page)
+	w, err := zw.Create("index.html")
+	if err != nil {
+		return err
+	}
+	if _, err = page.WriteTo(w); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// returns file extension of media type, .img for unknown
+func mediaTypeExt(mediaType string) string {
+	if exts, _ := mime.ExtensionsByType(mediaType); len(exts) != 0 {
+		return exts[0]
+	}
+	return ".img"
+}
+
+// returns content type and decoded data of base64 data URL
+func splitDataURL(dataURL string) (string, []byte, error) {
+	if !strings.HasPrefix(dataURL, "data:") {
+		return "", nil, errors.New("not a data URL")
+	}
+	comma := strings.IndexByte(dataURL, ',')
+	if comma < 0 {
+		return "", nil, errors.New("invalid data URL: no data")
+	}
+	meta, payload := dataURL[len("data:"):comma], dataURL[comma+1:]
+	if !strings.HasSuffix(meta, ";base64") {
+		data, err := url.PathUnescape(payload)
+		if err != nil {
+			return "", nil, err
+		}
+		return meta, []byte(data), nil
+	}
+	data, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", nil, err
+	}
+	return strings.TrimSuffix(meta, ";base64"), data, nil
+}
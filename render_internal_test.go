@@ -0,0 +1,94 @@
+package imgserver
+
+import (
+	"net/http"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("output format negotiation", func() {
+	var (
+		rawURL string
+		accept string
+		format outputFormat
+		err    error
+	)
+	BeforeEach(func() {
+		rawURL = "http://localhost:8888/v1/inline?url=https%3A%2F%2Fgolang.org%2Fdoc%2F"
+		accept = ""
+	})
+	JustBeforeEach(func() {
+		req, reqErr := http.NewRequest("GET", rawURL, nil)
+		Expect(reqErr).NotTo(HaveOccurred())
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		format, err = negotiateFormat(req, defaultFormat)
+	})
+
+	Context("when no format param and Accept header", func() {
+		It("then html", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(format).To(Equal(formatHTML))
+		})
+	})
+	Context("when format param", func() {
+		BeforeEach(func() {
+			rawURL += "&format=zip"
+			accept = "application/json"
+		})
+		It("then param wins Accept header", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(format).To(Equal(formatZIP))
+		})
+	})
+	Context("when unsupported format param", func() {
+		BeforeEach(func() {
+			rawURL += "&format=pdf"
+		})
+		It("then error", func() {
+			Expect(err).To(HaveOccurred())
+		})
+	})
+	Context("when Accept header has q-values", func() {
+		BeforeEach(func() {
+			accept = "text/html;q=0.5, application/json"
+		})
+		It("then most preferred format", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(format).To(Equal(formatJSON))
+		})
+	})
+	Context("when browser Accept header", func() {
+		BeforeEach(func() {
+			accept = "image/webp,*/*;q=0.8"
+		})
+		It("then html", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(format).To(Equal(formatHTML))
+		})
+	})
+	Context("when nothing acceptable", func() {
+		BeforeEach(func() {
+			accept = "application/pdf"
+		})
+		It("then not acceptable error", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusNotAcceptable))
+		})
+	})
+})
+
+var _ = Describe("data URL split", func() {
+	It("decodes base64 data URL", func() {
+		contentType, data, err := splitDataURL("data:image/gif;base64,R0lG")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(contentType).To(Equal("image/gif"))
+		Expect(data).To(Equal([]byte("GIF")))
+	})
+	It("fails on not data URL", func() {
+		_, _, err := splitDataURL("http://golang.org/doc/gopher.png")
+		Expect(err).To(HaveOccurred())
+	})
+})
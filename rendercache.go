@@ -0,0 +1,202 @@
+package imgserver
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Render cache status of response: hit, stale or miss.
+const RenderCacheHeader = "X-Imgserver-Cache"
+
+// Caches rendered responses by render key. Stale responses are served within MaxStale
+// after they expire, while single background refresh renders them again.
+type RenderCache struct {
+	TTL            time.Duration // freshness of responses, bounded by their Cache-Control max-age
+	MaxStale       time.Duration // no stale serving if 0
+	MaxEntries     int
+	RefreshTimeout time.Duration // of background refresh, no timeout if 0
+
+	mu         sync.Mutex
+	entries    map[string]renderCacheEntry
+	refreshing map[string]bool
+}
+
+type renderCacheEntry struct {
+	statusCode int
+	header     http.Header
+	body       []byte
+	stored     time.Time
+	expires    time.Time
+}
+
+func NewRenderCache(ttl, maxStale time.Duration, maxEntries int) *RenderCache {
+	return &RenderCache{
+		TTL:            ttl,
+		MaxStale:       maxStale,
+		MaxEntries:     maxEntries,
+		RefreshTimeout: time.Minute,
+		entries:        make(map[string]renderCacheEntry),
+		refreshing:     make(map[string]bool),
+	}
+}
+
+// Returns copy of cached response, or nil. Refresh is true if response is stale,
+// and caller should refresh it; refresh of key is started only once until put or refreshFailed.
+func (c *RenderCache) get(key string) (resp *Response, refresh bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	now := time.Now()
+	status := "hit"
+	if now.After(entry.expires) {
+		if now.After(entry.expires.Add(c.MaxStale)) {
+			delete(c.entries, key)
+			return nil, false
+		}
+		status = "stale"
+		refresh = !c.refreshing[key]
+		c.refreshing[key] = true
+	}
+	return entry.response(status, now), refresh
+}
+
+// Returns copy of cached response, stale or not, or nil. It is served, when origin is down,
+// so it is marked by Warning header, and not refreshed.
+func (c *RenderCache) lastCopy(key string) *Response {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	now := time.Now()
+	if !now.After(entry.expires) {
+		return entry.response("hit", now)
+	}
+	resp := entry.response("stale", now)
+	resp.Header.Set("Warning", `111 - "Revalidation Failed"`)
+	return resp
+}
+
+func (entry renderCacheEntry) response(status string, now time.Time) *Response {
+	resp := NewResponseBuilder(entry.statusCode).Headers(entry.header).Body(append([]byte(nil), entry.body...)).Build()
+	resp.Header.Set(RenderCacheHeader, status)
+	// downstream caches see stale response as stale
+	resp.Header.Set("Age", strconv.FormatInt(int64(now.Sub(entry.stored)/time.Second), 10))
+	return resp
+}
+
+// Caches response, if its Cache-Control allows shared caching.
+func (c *RenderCache) put(key string, resp *Response) {
+	ttl := c.TTL
+	directives := parseCacheControl(resp.Header)
+	for _, name := range []string{"no-store", "no-cache", "private"} {
+		if _, ok := directives[name]; ok {
+			ttl = 0
+		}
+	}
+	if arg, ok := directives["max-age"]; ok {
+		if seconds, err := strconv.ParseInt(arg, 10, 64); err == nil && time.Duration(seconds)*time.Second < ttl {
+			ttl = time.Duration(seconds) * time.Second
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.refreshing, key)
+	if ttl <= 0 || resp.StatusCode != http.StatusOK || resp.IsStreamed() {
+		delete(c.entries, key)
+		return
+	}
+	if _, ok := c.entries[key]; !ok && c.MaxEntries > 0 && len(c.entries) >= c.MaxEntries {
+		c.evict()
+	}
+	now := time.Now()
+	c.entries[key] = renderCacheEntry{resp.StatusCode, cloneHeader(resp.Header), append([]byte(nil), resp.Body.Bytes()...), now, now.Add(ttl)}
+}
+
+// makes next get of stale key start refresh again
+func (c *RenderCache) refreshFailed(key string) {
+	c.mu.Lock()
+	delete(c.refreshing, key)
+	c.mu.Unlock()
+}
+
+// removes expired entries, or entry expiring first if there is no expired
+func (c *RenderCache) evict() {
+	now := time.Now()
+	oldest := ""
+	for key, entry := range c.entries {
+		if now.After(entry.expires.Add(c.MaxStale)) {
+			delete(c.entries, key)
+			continue
+		}
+		if oldest == "" || entry.expires.Before(c.entries[oldest].expires) {
+			oldest = key
+		}
+	}
+	if len(c.entries) >= c.MaxEntries && oldest != "" {
+		delete(c.entries, oldest)
+	}
+}
+
+// Returns cached response of origin, which is down, or its error if there is none.
+func (h *ImgLogicHandler) originDownResponse(ctx context.Context, key string, useCache bool, downErr *OriginDownError) (*Response, error) {
+	if useCache {
+		if cached := h.Cache.lastCopy(key); cached != nil {
+			getLocalLogger(ctx, "HandleLogic").Info("origin is down, response from render cache")
+			return cached, nil
+		}
+	}
+	return nil, &HandlerError{http.StatusBadGateway, downErr.Description, downErr}
+}
+
+// Returns not modified response of conditional request, which page is revalidated in pageCtx,
+// or cached response, which is refreshed in background if it is stale. Returns nil on cache miss.
+func (h *ImgLogicHandler) cachedResponse(ctx, pageCtx context.Context, req *http.Request, key string) *Response {
+	if conditions := pageConditions(req); conditions != nil {
+		if resp := h.notModified(pageCtx, key, conditions); resp != nil {
+			return resp
+		}
+	}
+	cached, refresh := h.Cache.get(key)
+	if cached == nil {
+		return nil
+	}
+	getLocalLogger(ctx, "HandleLogic").WithField("status", cached.Header.Get(RenderCacheHeader)).Debug("response from render cache")
+	if refresh {
+		go h.refreshCached(ctx, req, key)
+	}
+	return cached
+}
+
+// Renders stale response again in background, with request context values, but not its cancellation.
+func (h *ImgLogicHandler) refreshCached(ctx context.Context, req *http.Request, key string) {
+	log := getLocalLogger(ctx, "refreshCached")
+	ctx = context.WithValue(detachedContext{ctx}, ctxCacheRefreshKey, true)
+	if h.Cache.RefreshTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.Cache.RefreshTimeout)
+		defer cancel()
+	}
+	refreshReq := *req
+	refreshReq.Header = cloneHeader(req.Header)
+	if _, err := h.HandleLogic(ctx, &refreshReq); err != nil {
+		h.Cache.refreshFailed(key)
+		log.Warn("stale response refresh error: ", err)
+		return
+	}
+	log.Debug("stale response refreshed")
+}
+
+// returns true in background refresh of cached response
+func isCacheRefresh(ctx context.Context) bool {
+	refresh, _ := ctx.Value(ctxCacheRefreshKey).(bool)
+	return refresh
+}
@@ -0,0 +1,79 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("render cache", func() {
+	var (
+		origin       *httptest.Server
+		requests     int32
+		cacheControl string
+		handler      *ImgLogicHandler
+	)
+	BeforeEach(func() {
+		atomic.StoreInt32(&requests, 0)
+		cacheControl = ""
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.Header().Set("Content-Type", "text/html")
+			if cacheControl != "" {
+				w.Header().Set("Cache-Control", cacheControl)
+			}
+			w.Write([]byte("<html></html>"))
+		}))
+		handler = NewImgLogicHandler(http.DefaultClient)
+		handler.MaxCacheAge = time.Hour
+		handler.Cache = NewRenderCache(50*time.Millisecond, time.Hour, 10)
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	get := func() string {
+		req := httptest.NewRequest("GET", "/?url="+url.QueryEscape(origin.URL), nil)
+		resp, err := handler.HandleLogic(setLogger(context.Background(), logger.StandardLogger()), req)
+		Expect(err).NotTo(HaveOccurred())
+		return resp.Header.Get(RenderCacheHeader)
+	}
+
+	It("then fresh response served from cache", func() {
+		Expect(get()).To(Equal("miss"))
+		Expect(get()).To(Equal("hit"))
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(1))
+	})
+	It("then stale response served while refreshed", func() {
+		Expect(get()).To(Equal("miss"))
+		time.Sleep(60 * time.Millisecond)
+		Expect(get()).To(Equal("stale"))
+		Eventually(func() int32 { return atomic.LoadInt32(&requests) }).Should(BeEquivalentTo(2))
+		Eventually(get).Should(Equal("hit"))
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(2))
+	})
+	It("then not cacheable page response not cached", func() {
+		cacheControl = "no-store"
+		Expect(get()).To(Equal("miss"))
+		Expect(get()).To(Equal("miss"))
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(2))
+	})
+	It("then cache bounded", func() {
+		cache := NewRenderCache(time.Hour, 0, 2)
+		for _, key := range []string{"a", "b", "c"} {
+			resp := NewResponse()
+			resp.StatusCode = http.StatusOK
+			cache.put(key, resp)
+		}
+		Expect(cache.entries).To(HaveLen(2))
+		resp, refresh := cache.get("c")
+		Expect(resp).NotTo(BeNil())
+		Expect(refresh).To(BeFalse())
+	})
+})
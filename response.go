@@ -0,0 +1,114 @@
+package imgserver
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Builds Response, which should not be changed after Build. Body is buffered or streamed:
+// streamed body is read only while response is written, so its first bytes are sent
+// before it is formed whole.
+type ResponseBuilder struct {
+	resp Response
+}
+
+func NewResponseBuilder(statusCode int) *ResponseBuilder {
+	return &ResponseBuilder{Response{StatusCode: statusCode, Header: make(http.Header), Body: &bytes.Buffer{}}}
+}
+
+// Sets header value, replacing previous ones.
+func (b *ResponseBuilder) Header(key, value string) *ResponseBuilder {
+	b.resp.Header.Set(key, value)
+	return b
+}
+
+// Adds copy of every header value.
+func (b *ResponseBuilder) Headers(header http.Header) *ResponseBuilder {
+	for key, values := range header {
+		for _, value := range values {
+			b.resp.Header.Add(key, value)
+		}
+	}
+	return b
+}
+
+// Sets buffered body of data, data is not copied.
+func (b *ResponseBuilder) Body(data []byte) *ResponseBuilder {
+	b.resp.Body = bytes.NewBuffer(data)
+	b.resp.stream = nil
+	return b
+}
+
+// Sets streamed body of length bytes, or of unknown length, if it is negative.
+// Body is closed after write, if it is io.Closer.
+func (b *ResponseBuilder) Stream(body io.Reader, length int64) *ResponseBuilder {
+	b.resp.Body = &bytes.Buffer{}
+	b.resp.stream = body
+	if length >= 0 {
+		b.resp.Header.Set("Content-Length", strconv.FormatInt(length, 10))
+	}
+	return b
+}
+
+// Declares trailers of names, which values are taken from trailer after body is written.
+// Streamed body producer sets them before body EOF.
+func (b *ResponseBuilder) Trailer(trailer http.Header, names ...string) *ResponseBuilder {
+	b.resp.trailer = trailer
+	b.resp.trailerNames = names
+	return b
+}
+
+func (b *ResponseBuilder) Build() *Response {
+	resp := b.resp
+	return &resp
+}
+
+// Returns true, if body is streamed, so Body buffer is empty.
+func (r *Response) IsStreamed() bool {
+	return r.stream != nil
+}
+
+// Returns length of body, known from Content-Length header or buffered body, or -1.
+func (r *Response) ContentLength() int64 {
+	if length, err := strconv.ParseInt(r.Header.Get("Content-Length"), 10, 64); err == nil {
+		return length
+	}
+	if r.stream != nil {
+		return -1
+	}
+	return int64(r.Body.Len())
+}
+
+// Reads streamed body into Body buffer, for decorators, that need whole body.
+// Buffered responses are kept as is.
+func (r *Response) Buffer() error {
+	if r.stream == nil {
+		return nil
+	}
+	stream := r.stream
+	r.stream = nil
+	defer closeReader(stream)
+	_, err := r.Body.ReadFrom(stream)
+	return err
+}
+
+// Writes body to w, streamed body is closed then. Streamed body parts are flushed,
+// as soon as they are read, if w is http.Flusher.
+func (r *Response) WriteBody(w io.Writer) (int64, error) {
+	if r.stream == nil {
+		return r.Body.WriteTo(w)
+	}
+	defer closeReader(r.stream)
+	if f, ok := w.(http.Flusher); ok {
+		w = flushWriter{w, f}
+	}
+	return io.Copy(w, r.stream)
+}
+
+func closeReader(r io.Reader) {
+	if closer, ok := r.(io.Closer); ok {
+		closer.Close()
+	}
+}
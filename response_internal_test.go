@@ -0,0 +1,58 @@
+package imgserver
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+type closeRecorder struct {
+	*strings.Reader
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+var _ = Describe("response builder", func() {
+	It("then buffered body has length", func() {
+		resp := NewResponseBuilder(200).Header("Content-Type", "text/plain").Body([]byte("hello")).Build()
+		Expect(resp.IsStreamed()).To(BeFalse())
+		Expect(resp.ContentLength()).To(Equal(int64(5)))
+		rec := httptest.NewRecorder()
+		writeResponse(logger.StandardLogger(), rec, httptest.NewRequest("GET", "/", nil), resp)
+		Expect(rec.Header().Get("Content-Length")).To(Equal("5"))
+		Expect(rec.Body.String()).To(Equal("hello"))
+	})
+	It("then streamed body of unknown length is written without Content-Length and closed", func() {
+		body := &closeRecorder{Reader: strings.NewReader("streamed")}
+		resp := NewResponseBuilder(200).Stream(body, -1).Build()
+		Expect(resp.ContentLength()).To(Equal(int64(-1)))
+		rec := httptest.NewRecorder()
+		writeResponse(logger.StandardLogger(), rec, httptest.NewRequest("GET", "/", nil), resp)
+		Expect(rec.Header().Get("Content-Length")).To(BeEmpty())
+		Expect(rec.Body.String()).To(Equal("streamed"))
+		Expect(body.closed).To(BeTrue())
+	})
+	It("then streamed body is closed unread on HEAD", func() {
+		body := &closeRecorder{Reader: strings.NewReader("streamed")}
+		rec := httptest.NewRecorder()
+		writeResponse(logger.StandardLogger(), rec, httptest.NewRequest("HEAD", "/", nil), NewResponseBuilder(200).Stream(body, 8).Build())
+		Expect(rec.Header().Get("Content-Length")).To(Equal("8"))
+		Expect(rec.Body.Len()).To(BeZero())
+		Expect(body.closed).To(BeTrue())
+	})
+	It("then streamed body is buffered for decorators", func() {
+		resp := NewResponseBuilder(200).Stream(ioutil.NopCloser(strings.NewReader("data")), -1).Build()
+		Expect(resp.Buffer()).To(Succeed())
+		Expect(resp.IsStreamed()).To(BeFalse())
+		Expect(resp.Body.String()).To(Equal("data"))
+		Expect(resp.ContentLength()).To(Equal(int64(4)))
+	})
+})
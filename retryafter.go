@@ -0,0 +1,76 @@
+package imgserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Wait before retry of rate limited image, when origin sent no valid Retry-After.
+const defaultRetryAfter = time.Second
+
+// Sent by fetchers instead of image, that should be left out of result.
+var errImageSkipped = errors.New("image skipped")
+
+// Returns wait requested by Retry-After header value, in seconds or HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if wait := date.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// Returns wait before retry of rate limited response, and false if retry can't be made before ctx deadline.
+func rateLimitRetryWait(ctx context.Context, resp *http.Response) (time.Duration, bool) {
+	now := time.Now()
+	wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), now)
+	if !ok {
+		wait = defaultRetryAfter
+	}
+	if deadline, ok := ctx.Deadline(); ok && now.Add(wait).After(deadline) {
+		return wait, false
+	}
+	return wait, true
+}
+
+// Origin still rate limiting after retries is bad gateway, not client error.
+func rateLimitedError(imgURL string, attempts int) *HandlerError {
+	description := fmt.Sprintf("image origin is rate limiting after %v attempts: %v", attempts, imgURL)
+	return &HandlerError{http.StatusBadGateway, description, &OriginError{OriginRateLimited, description}}
+}
+
+func isRateLimitedError(err error) bool {
+	if hErr, ok := err.(*HandlerError); ok {
+		originErr, ok := hErr.cause.(*OriginError)
+		return ok && originErr.Code == OriginRateLimited
+	}
+	return false
+}
+
+// sleeps, returning false if ctx is done before
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,87 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+var _ = Describe("rate limited image origin", func() {
+	var (
+		origin     *httptest.Server
+		limited    int32 // responses with 429 before image
+		retryAfter string
+		requests   int32
+	)
+	BeforeEach(func() {
+		limited, retryAfter, requests = 0, "0", 0
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if atomic.AddInt32(&requests, 1) <= atomic.LoadInt32(&limited) {
+				w.Header().Set("Retry-After", retryAfter)
+				w.WriteHeader(http.StatusTooManyRequests)
+				return
+			}
+			w.Header().Set("Content-Type", "image/gif")
+			w.Write([]byte("GIF"))
+		}))
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	fetch := func(ctx context.Context, opts FetchOptions) (imgTag, error) {
+		ctx = context.WithValue(setLogger(ctx, log.StandardLogger()), CtxHTTPClientKey, http.DefaultClient)
+		ctx = setFetchOptions(ctx, opts)
+		fetcher := backoffImageFetcher{&sync.Mutex{}, nil}
+		res := <-startFetch(ctx, fetcher, imgTag{0, []html.Attribute{{Key: "src", Val: "a.gif"}}, nil}, origin.URL+"/a.gif")
+		return res.img, res.err
+	}
+
+	It("then Retry-After is parsed", func() {
+		now := time.Now()
+		wait, ok := parseRetryAfter("120", now)
+		Expect(ok).To(BeTrue())
+		Expect(wait).To(Equal(2 * time.Minute))
+		wait, ok = parseRetryAfter(now.Add(time.Hour).UTC().Format(http.TimeFormat), now)
+		Expect(ok).To(BeTrue())
+		Expect(wait).To(BeNumerically("~", time.Hour, time.Second))
+		_, ok = parseRetryAfter("soon", now)
+		Expect(ok).To(BeFalse())
+	})
+	It("then image fetched after Retry-After", func() {
+		limited = 2
+		_, err := fetch(context.Background(), FetchOptions{Retries: 3})
+		Expect(err).NotTo(HaveOccurred())
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(3))
+	})
+	It("then sustained 429 is bad gateway", func() {
+		limited = 10
+		_, err := fetch(context.Background(), FetchOptions{Retries: 1})
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusBadGateway))
+		Expect(isRateLimitedError(err)).To(BeTrue())
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(2))
+	})
+	It("then no retry after request deadline", func() {
+		limited, retryAfter = 10, "60"
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		start := time.Now()
+		_, err := fetch(ctx, FetchOptions{Retries: 3})
+		Expect(isRateLimitedError(err)).To(BeTrue())
+		Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+		Expect(atomic.LoadInt32(&requests)).To(BeEquivalentTo(1))
+	})
+	It("then rate limited image skipped", func() {
+		limited = 10
+		_, err := fetch(context.Background(), FetchOptions{SkipRateLimited: true})
+		Expect(err).To(Equal(errImageSkipped))
+	})
+})
@@ -0,0 +1,226 @@
+package imgserver
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+// Policy of origin HTML taken to rendered output: passed through img attributes, and whole
+// documents of saved page and email rewrites, as server re-hosts them on its own origin.
+// Allowed elements are kept, dropped elements are removed with content, and other elements
+// are unwrapped, keeping their content. Not allowed attributes, event handlers, and URL attributes
+// of not allowed schemes are removed. Nil policy keeps HTML as is.
+type SanitizePolicy struct {
+	Elements     map[string]bool // kept elements
+	DropElements map[string]bool // removed with content, like script
+	Attributes   map[string]bool // kept attributes of kept elements
+	URLSchemes   map[string]bool // of URL attributes, relative URLs are kept; data URLs only of images and fonts
+	Styles       bool            // style elements and attributes are kept, unless CSS can run scripts or load other resources
+}
+
+func newNameSet(names string) map[string]bool {
+	res := make(map[string]bool)
+	for _, name := range strings.Fields(names) {
+		res[name] = true
+	}
+	return res
+}
+
+// Policy of content pages: text formatting, tables, links and images are kept.
+var RelaxedSanitizePolicy = &SanitizePolicy{
+	Elements: newNameSet(`html head body title meta style div span p br hr a img picture source figure figcaption
+		h1 h2 h3 h4 h5 h6 ul ol li dl dt dd table thead tbody tfoot tr th td caption colgroup col
+		em strong b i u s small big sub sup mark blockquote q cite pre code kbd samp var abbr time
+		section article header footer nav main aside address details summary center font`),
+	DropElements: newNameSet("script noembed template iframe frame frameset object embed applet svg math base"),
+	Attributes: newNameSet(`id class title lang dir alt src srcset sizes media width height href name
+		colspan rowspan align valign border cellpadding cellspacing bgcolor color face size
+		longdesc cite datetime start reversed charset content style`),
+	URLSchemes: newNameSet("http https mailto data"),
+	Styles:     true,
+}
+
+// Policy of image galleries: only page structure, images and links are kept, without styles.
+var StrictSanitizePolicy = &SanitizePolicy{
+	Elements:     newNameSet("html head body title meta div span p br section article h1 h2 h3 h4 h5 h6 a img figure figcaption ul ol li"),
+	DropElements: newNameSet("script style noembed template iframe frame frameset object embed applet svg math base"),
+	Attributes:   newNameSet("alt src srcset width height href title charset longdesc"),
+	URLSchemes:   newNameSet("http https data"),
+}
+
+// Policies by names of --sanitize flag.
+var SanitizePolicies = map[string]*SanitizePolicy{
+	"relaxed": RelaxedSanitizePolicy,
+	"strict":  StrictSanitizePolicy,
+	"none":    nil,
+}
+
+// attributes of URL values
+var urlAttributes = newNameSet("href src longdesc cite poster action formaction background xlink:href")
+
+// CSS that can run scripts, or make other requests, in old or current browsers
+var unsafeCSS = regexp.MustCompile(`(?i)expression\s*\(|javascript:|vbscript:|behavior\s*:|-moz-binding|@import`)
+
+func setSanitizePolicy(ctx context.Context, p *SanitizePolicy) context.Context {
+	return context.WithValue(ctx, ctxSanitizePolicyKey, p)
+}
+
+// returns nil if HTML is not sanitized
+func getSanitizePolicy(ctx context.Context) *SanitizePolicy {
+	p, _ := ctx.Value(ctxSanitizePolicyKey).(*SanitizePolicy)
+	return p
+}
+
+// Returns img with passed through attributes sanitized. Src is kept, as it is only fetched and replaced.
+func (p *SanitizePolicy) sanitizeImg(img imgTag) imgTag {
+	if p == nil {
+		return img
+	}
+	res := imgTag{-1, make([]html.Attribute, 0, len(img.attr)), img.raw}
+	for i, attr := range img.attr {
+		if i == img.srcIndex {
+			res.srcIndex = len(res.attr)
+			res.attr = append(res.attr, attr)
+			continue
+		}
+		if val, ok := p.attr(attr); ok {
+			attr.Val = val
+			res.attr = append(res.attr, attr)
+		}
+	}
+	return res
+}
+
+// returns sanitized attribute value, or false if attribute is removed
+func (p *SanitizePolicy) attr(attr html.Attribute) (string, bool) {
+	key := strings.ToLower(attr.Key)
+	switch {
+	case strings.HasPrefix(key, "on") || !p.Attributes[key]:
+		return "", false
+	case key == "style":
+		return attr.Val, p.safeCSS(attr.Val)
+	case key == "srcset":
+		for _, c := range parseSrcset(attr.Val) {
+			if !p.safeURL(c.url) {
+				return "", false
+			}
+		}
+	case urlAttributes[key]:
+		return attr.Val, p.safeURL(attr.Val)
+	}
+	return attr.Val, true
+}
+
+func (p *SanitizePolicy) safeURL(val string) bool {
+	val = strings.TrimSpace(val)
+	i := strings.IndexAny(val, ":/?#")
+	if i < 0 || val[i] != ':' {
+		// relative
+		return true
+	}
+	scheme := strings.ToLower(val[:i])
+	if !p.URLSchemes[scheme] {
+		return false
+	}
+	if scheme == "data" {
+		mediaType := strings.ToLower(val[i+1:])
+		return strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "font/") ||
+			strings.HasPrefix(mediaType, "application/font") || strings.HasPrefix(mediaType, "application/x-font")
+	}
+	return true
+}
+
+func (p *SanitizePolicy) safeCSS(css string) bool {
+	if !p.Styles || unsafeCSS.MatchString(css) {
+		return false
+	}
+	for _, m := range cssURL.FindAllStringSubmatch(imageSetURLs(css), -1) {
+		if !p.safeURL(m[2]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Returns sanitized document. Page buffer is put back to pool, unless policy is nil and it is returned as is.
+// Comments are removed, as conditional comments can hold markup, and text is escaped again.
+func (p *SanitizePolicy) sanitizeDocument(page *bytes.Buffer) *bytes.Buffer {
+	if p == nil {
+		return page
+	}
+	buf := buffers.get()
+	buf.Grow(page.Len())
+	tokenizer := html.NewTokenizer(bytes.NewReader(page.Bytes()))
+	dropping, depth := "", 0 // dropped element and its nesting
+	inStyle := false
+	for {
+		tokenType := tokenizer.Next()
+		switch tokenType {
+		case html.ErrorToken:
+			buffers.put(page)
+			return buf
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if dropping != "" {
+				if tokenType == html.StartTagToken && token.Data == dropping {
+					depth++
+				}
+				continue
+			}
+			if p.DropElements[token.Data] || (token.Data == "style" && !p.Styles) {
+				if tokenType == html.StartTagToken && !voidElements[token.Data] {
+					dropping, depth = token.Data, 1
+				}
+				continue
+			}
+			if !p.Elements[token.Data] {
+				continue
+			}
+			attrs := token.Attr[:0]
+			for _, attr := range token.Attr {
+				if val, ok := p.attr(attr); ok {
+					attr.Val = val
+					attrs = append(attrs, attr)
+				}
+			}
+			token.Attr = attrs
+			inStyle = token.Data == "style" && tokenType == html.StartTagToken
+			buf.WriteString(token.String())
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			if dropping != "" {
+				if string(name) == dropping {
+					if depth--; depth == 0 {
+						dropping = ""
+					}
+				}
+				continue
+			}
+			inStyle = false
+			if p.Elements[string(name)] {
+				buf.Write(tokenizer.Raw())
+			}
+		case html.TextToken:
+			if dropping != "" {
+				continue
+			}
+			if inStyle {
+				if css := tokenizer.Raw(); p.safeCSS(string(css)) {
+					buf.Write(css)
+				}
+				continue
+			}
+			// raw text of unwrapped elements, like textarea, can hold markup
+			buf.WriteString(html.EscapeString(string(tokenizer.Text())))
+		case html.DoctypeToken:
+			buf.Write(tokenizer.Raw())
+		}
+	}
+}
+
+// elements without end tag
+var voidElements = newNameSet("area base br col embed hr img input link meta param source track wbr")
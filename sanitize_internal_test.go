@@ -0,0 +1,52 @@
+package imgserver
+
+import (
+	"bytes"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/html"
+)
+
+var _ = Describe("sanitize policy", func() {
+	sanitize := func(p *SanitizePolicy, page string) string {
+		return p.sanitizeDocument(bytes.NewBufferString(page)).String()
+	}
+	It("then scripts and frames are removed with content", func() {
+		Expect(sanitize(RelaxedSanitizePolicy, `<p>a<script>document.write("<b>")</script><iframe src="/x"><p>in</p><iframe></iframe></iframe>b</p>`)).
+			To(Equal(`<p>ab</p>`))
+	})
+	It("then event handlers and unsafe URLs are removed", func() {
+		Expect(sanitize(RelaxedSanitizePolicy, `<a href="javascript:alert(1)" onclick="x()" class="c">l</a><a href="/rel">r</a><a href="data:text/html,x">d</a>`)).
+			To(Equal(`<a class="c">l</a><a href="/rel">r</a><a>d</a>`))
+		Expect(sanitize(RelaxedSanitizePolicy, `<img src="data:image/png;base64,AA" alt="a">`)).To(Equal(`<img src="data:image/png;base64,AA" alt="a">`))
+	})
+	It("then unknown elements are unwrapped, with raw text escaped", func() {
+		Expect(sanitize(RelaxedSanitizePolicy, `<form action="/steal"><input name="p"><textarea><script>x()</script></textarea></form><!-- c -->`)).
+			To(Equal(`&lt;script&gt;x()&lt;/script&gt;`))
+	})
+	It("then scriptable CSS is removed", func() {
+		Expect(sanitize(RelaxedSanitizePolicy, `<style>p{color:red}</style><style>@import "x.css";</style><p style="width:expression(alert(1))">`)).
+			To(Equal(`<style>p{color:red}</style><style></style><p>`))
+		Expect(sanitize(RelaxedSanitizePolicy, `<div style="background:url(javascript:x)">`)).To(Equal(`<div>`))
+	})
+	It("then strict policy removes styles", func() {
+		Expect(sanitize(StrictSanitizePolicy, `<style>p{}</style><table><tr><td><img src="a.png" style="float:left">`)).
+			To(Equal(`<img src="a.png">`))
+	})
+	It("then nil policy keeps document", func() {
+		Expect(sanitize(nil, `<script>x()</script>`)).To(Equal(`<script>x()</script>`))
+	})
+	It("then image attributes are sanitized, with src kept", func() {
+		img := imgTag{1, []html.Attribute{
+			{Key: "alt", Val: "a"},
+			{Key: "src", Val: "a.png"},
+			{Key: "longdesc", Val: "javascript:x()"},
+			{Key: "style", Val: "behavior:url(x.htc)"},
+			{Key: "width", Val: "10"},
+		}, nil}
+		res := StrictSanitizePolicy.sanitizeImg(img)
+		Expect(res.token().String()).To(Equal(`<img alt="a" src="a.png" width="10">`))
+		Expect(res.src()).To(Equal("a.png"))
+	})
+})
@@ -0,0 +1,98 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+var (
+	// quoted string literal of image file path or URL, like lazy loader config "data-src": "\/img\/a@2x.jpg"
+	scriptImageLiteral = regexp.MustCompile(`(?i)(["'])((?:https?:)?[^"'\s<>(){}]*/[^"'\s<>(){}]*\.(?:png|jpe?g|gif|webp|avif|svg|bmp)(?:\?[^"'\s<>]*)?)(["'])`)
+	// JSON-LD properties, which values are images or ImageObjects
+	jsonLDImageKeys = map[string]bool{"image": true, "thumbnailUrl": true, "contentUrl": true, "logo": true}
+)
+
+// Max images taken of single script, so generated configs can't flood request with images.
+const maxScriptImages = 20
+
+// Returns img tags of image URLs in script text: "image", "thumbnailUrl", "contentUrl" and "logo"
+// properties of application/ld+json scripts, which are canonical images of structured data,
+// and quoted image file URLs of other scripts, like lazy loaders and gallery configs.
+func scriptImages(scriptType string, text []byte) []imgTag {
+	var srcs, alts []string
+	seen := map[string]bool{}
+	add := func(src, alt string) {
+		src = strings.TrimSpace(src)
+		if src == "" || strings.HasPrefix(src, "data:") || seen[src] || len(srcs) == maxScriptImages {
+			return
+		}
+		seen[src] = true
+		srcs = append(srcs, src)
+		alts = append(alts, alt)
+	}
+	if strings.ToLower(strings.TrimSpace(scriptType)) == "application/ld+json" {
+		var doc interface{}
+		if json.Unmarshal(text, &doc) != nil {
+			// invalid structured data is ignored, like by search engines
+			return nil
+		}
+		jsonLDImages(doc, false, add)
+	} else {
+		for _, m := range scriptImageLiteral.FindAllSubmatch(text, -1) {
+			if string(m[1]) == string(m[3]) {
+				add(strings.Replace(string(m[2]), `\/`, "/", -1), "")
+			}
+		}
+	}
+	res := make([]imgTag, len(srcs))
+	for i, src := range srcs {
+		res[i] = imgTag{0, []html.Attribute{{Key: "src", Val: src}}, nil}
+		if alts[i] != "" {
+			res[i].attr = append(res[i].attr, html.Attribute{Key: "alt", Val: alts[i]})
+		}
+	}
+	return res
+}
+
+// Walks JSON-LD value, and adds images of image properties. Value of image property is URL,
+// ImageObject with url or contentUrl, or list of them. Nested nodes, like @graph items, are walked too.
+func jsonLDImages(v interface{}, isImage bool, add func(src, alt string)) {
+	switch v := v.(type) {
+	case string:
+		if isImage {
+			add(v, "")
+		}
+	case []interface{}:
+		for _, item := range v {
+			jsonLDImages(item, isImage, add)
+		}
+	case map[string]interface{}:
+		if isImage {
+			alt, _ := v["caption"].(string)
+			if alt == "" {
+				alt, _ = v["name"].(string)
+			}
+			for _, key := range []string{"contentUrl", "url"} {
+				if src, ok := v[key].(string); ok {
+					add(src, alt)
+					break
+				}
+			}
+		}
+		// sorted, as images have no document order
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			if !isImage || key != "contentUrl" && key != "url" {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			jsonLDImages(v[key], jsonLDImageKeys[key], add)
+		}
+	}
+}
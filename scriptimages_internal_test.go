@@ -0,0 +1,51 @@
+package imgserver
+
+import (
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("script images", func() {
+	tags := func(scriptType, text string) []string {
+		var res []string
+		for _, img := range scriptImages(scriptType, []byte(text)) {
+			res = append(res, img.token().String())
+		}
+		return res
+	}
+	It("then JSON-LD image properties are images", func() {
+		Expect(tags("application/ld+json", `{"@graph": [
+			{"@type": "Article", "image": ["https://cdn.test/a@2x.jpg", "https://cdn.test/a.jpg"]},
+			{"@type": "Product", "image": {"@type": "ImageObject", "url": "/p.webp", "caption": "Product"}, "url": "/product.html"},
+			{"@type": "VideoObject", "thumbnailUrl": "data:image/png;base64,AA==", "logo": "https://cdn.test/a.jpg"}
+		]}`)).To(Equal([]string{
+			`<img src="https://cdn.test/a@2x.jpg">`,
+			`<img src="https://cdn.test/a.jpg">`,
+			`<img src="/p.webp" alt="Product">`,
+		}))
+		Expect(tags("application/ld+json", `{"image": `)).To(BeEmpty())
+	})
+	It("then quoted image URLs of script configs are images", func() {
+		Expect(tags("", `lazy.init({"data-src": "https:\/\/cdn.test\/big.jpg?w=2000", thumb: '/t.png', name: "a.png", bad: "/x.png'})`)).
+			To(Equal([]string{`<img src="https://cdn.test/big.jpg?w=2000">`, `<img src="/t.png">`}))
+	})
+	It("then script images are parsed in place of scripts, only if enabled", func() {
+		page := `<img src="a.png"><script type="application/ld+json">{"image": "b.png"}</script><script></script><img src="c.png">`
+		parse := func(scripts bool) []string {
+			ctx, cancel := context.WithCancel(setFetchOptions(context.Background(), FetchOptions{Scripts: scripts}))
+			defer cancel()
+			imgc, errc := imageParserImp{imgTokenParserFunc(parseImgToken)}.parseImage(ctx, strings.NewReader(page))
+			var srcs []string
+			for img := range imgc {
+				srcs = append(srcs, img.src())
+			}
+			Expect(errc).NotTo(Receive())
+			return srcs
+		}
+		Expect(parse(true)).To(Equal([]string{"a.png", "b.png", "c.png"}))
+		Expect(parse(false)).To(Equal([]string{"a.png", "c.png"}))
+	})
+})
@@ -0,0 +1,171 @@
+package imgserver
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Max reports sent to Sentry at once, more are dropped, so Sentry outage doesn't pile up goroutines.
+const maxSentryInFlight = 16
+
+// Reports errors as Sentry events, by store API of project DSN.
+type SentryReporter struct {
+	Log         Logger
+	Client      *http.Client
+	Environment string
+	Release     string
+
+	storeURL string
+	auth     string // X-Sentry-Auth header value
+	inFlight chan struct{}
+}
+
+// DSN is like https://<key>@sentry.example.com/<project>.
+func NewSentryReporter(log Logger, dsn string) (*SentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	projectIndex := strings.LastIndex(u.Path, "/")
+	if u.User == nil || u.Host == "" || projectIndex < 0 || u.Path[projectIndex+1:] == "" {
+		return nil, errors.New("invalid Sentry DSN, expected https://<key>@<host>/<project>")
+	}
+	auth := "Sentry sentry_version=7, sentry_client=imgserver/1.0, sentry_key=" + u.User.Username()
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	storeURL := fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, u.Path[:projectIndex], u.Path[projectIndex+1:])
+	return &SentryReporter{
+		Log:      log,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+		storeURL: storeURL,
+		auth:     auth,
+		inFlight: make(chan struct{}, maxSentryInFlight),
+	}, nil
+}
+
+type sentryFrame struct {
+	Function string `json:"function"`
+	Filename string `json:"filename"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type sentryException struct {
+	Type       string                   `json:"type"`
+	Value      string                   `json:"value"`
+	Stacktrace map[string][]sentryFrame `json:"stacktrace,omitempty"`
+}
+
+type sentryEvent struct {
+	EventID     string                       `json:"event_id"`
+	Timestamp   string                       `json:"timestamp"`
+	Level       string                       `json:"level"`
+	Logger      string                       `json:"logger"`
+	Platform    string                       `json:"platform"`
+	Message     string                       `json:"message"`
+	Environment string                       `json:"environment,omitempty"`
+	Release     string                       `json:"release,omitempty"`
+	Tags        map[string]string            `json:"tags"`
+	Request     map[string]string            `json:"request,omitempty"`
+	Exception   map[string][]sentryException `json:"exception"`
+}
+
+// Sends report in background.
+func (r *SentryReporter) Report(ctx context.Context, report ErrorReport) {
+	event := r.event(report)
+	select {
+	case r.inFlight <- struct{}{}:
+	default:
+		r.Log.Warn("too many Sentry reports in flight, report dropped")
+		return
+	}
+	go func() {
+		defer func() { <-r.inFlight }()
+		if err := r.send(event); err != nil {
+			r.Log.Warn("Sentry report error: ", err)
+		}
+	}()
+}
+
+func (r *SentryReporter) event(report ErrorReport) sentryEvent {
+	id := make([]byte, 16)
+	rand.Read(id)
+	event := sentryEvent{
+		EventID:     hex.EncodeToString(id),
+		Timestamp:   time.Now().UTC().Format("2006-01-02T15:04:05"),
+		Level:       "error",
+		Logger:      "imgserver",
+		Platform:    "go",
+		Environment: r.Environment,
+		Release:     r.Release,
+		Tags:        map[string]string{"status_code": strconv.Itoa(report.StatusCode)},
+	}
+	if report.URL != "" {
+		event.Request = map[string]string{"method": report.Method, "url": report.URL}
+	}
+	// oldest exception first, and stack is of outermost error
+	var exceptions []sentryException
+	for i := len(report.Causes) - 1; i >= 0; i-- {
+		exceptions = append(exceptions, sentryException{Type: report.Causes[i].Type, Value: report.Causes[i].Message})
+	}
+	if len(exceptions) > 0 {
+		event.Message = report.Causes[0].Message
+		exceptions[len(exceptions)-1].Stacktrace = map[string][]sentryFrame{"frames": sentryFrames(report.Stack)}
+	}
+	event.Exception = map[string][]sentryException{"values": exceptions}
+	return event
+}
+
+// returns frames of stack, caller first, as Sentry expects
+func sentryFrames(stack []uintptr) []sentryFrame {
+	var frames []sentryFrame
+	callers := runtime.CallersFrames(stack)
+	for {
+		frame, more := callers.Next()
+		frames = append([]sentryFrame{{
+			Function: frame.Function,
+			Filename: frame.File,
+			Lineno:   frame.Line,
+			InApp:    strings.Contains(frame.Function, "imgserver"),
+		}}, frames...)
+		if !more {
+			break
+		}
+	}
+	return frames
+}
+
+func (r *SentryReporter) send(event sentryEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", r.storeURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Sentry responded %v", resp.StatusCode)
+	}
+	return nil
+}
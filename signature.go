@@ -0,0 +1,81 @@
+package imgserver
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/context"
+)
+
+// LogicHandler decorator, that rejects requests without valid url param signature.
+// Signature passed in sig query param, and computed by SignURL with shared secret,
+// so only secret holders can make deployment fetch pages. Signature of request with
+// callback_url covers it too, see SignQuery.
+type SignedURLLogicHandler struct {
+	LogicHandler
+	Secret []byte
+}
+
+func NewSignedURLLogicHandler(h LogicHandler, secret []byte) *SignedURLLogicHandler {
+	return &SignedURLLogicHandler{h, secret}
+}
+
+func (h *SignedURLLogicHandler) HandleLogic(ctx context.Context, req *http.Request) (*Response, error) {
+	query := req.URL.Query()
+	sig := query.Get("sig")
+	if sig == "" {
+		return nil, NewHandlerError(http.StatusForbidden, "request should be signed by 'sig' query parameter")
+	}
+	// every url param of combine is signed, not only first one
+	if !checkURLSignature(h.Secret, signaturePayload(query), sig) {
+		getLocalLogger(ctx, "SignedURLLogicHandler").Info("invalid url signature")
+		return nil, NewHandlerError(http.StatusForbidden, "invalid 'sig' query parameter")
+	}
+	return h.LogicHandler.HandleLogic(ctx, req)
+}
+
+// Query params signed with url ones, so replayed signed link can't post results to other callback.
+var signedParams = []string{"callback_url"}
+
+// returns url params joined by new lines, followed by name=value lines of passed signed params
+func signaturePayload(query url.Values) string {
+	payload := strings.Join(query["url"], "\n")
+	for _, name := range signedParams {
+		for _, value := range query[name] {
+			payload += "\n" + name + "=" + value
+		}
+	}
+	return payload
+}
+
+// Returns sig query param value of request query: of its url params, and callback_url if passed.
+// It is value of SignURL or SignURLs for queries without callback_url.
+func SignQuery(secret []byte, query url.Values) string {
+	return SignURL(secret, signaturePayload(query))
+}
+
+// Returns sig query param value of url query param values, joined by new lines, of combine request.
+func SignURLs(secret []byte, pageURLs []string) string {
+	return SignURL(secret, strings.Join(pageURLs, "\n"))
+}
+
+// Returns sig query param value for url query param value.
+func SignURL(secret []byte, pageURL string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(pageURL))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func checkURLSignature(secret []byte, pageURL string, sig string) bool {
+	expected, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(pageURL))
+	return hmac.Equal(expected, mac.Sum(nil))
+}
@@ -0,0 +1,114 @@
+package imgserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("signed URL logic handler", func() {
+	const pageURL = "https://golang.org/doc/"
+	var (
+		secret  = []byte("secret")
+		handler *SignedURLLogicHandler
+		sig     string
+		extra   string // combined url param
+		hook    string // callback_url param
+		resp    *Response
+		err     error
+	)
+	BeforeEach(func() {
+		extra, hook = "", ""
+		handler = NewSignedURLLogicHandler(logicHandlerFunc(func(ctx context.Context, req *http.Request) (*Response, error) {
+			return &Response{StatusCode: 200, Header: http.Header{}, Body: &bytes.Buffer{}}, nil
+		}), secret)
+	})
+	JustBeforeEach(func() {
+		rawURL := "http://localhost:8888/?url=" + url.QueryEscape(pageURL)
+		if extra != "" {
+			rawURL += "&combine=true&url=" + url.QueryEscape(extra)
+		}
+		if hook != "" {
+			rawURL += "&callback_url=" + url.QueryEscape(hook)
+		}
+		if sig != "" {
+			rawURL += "&sig=" + sig
+		}
+		req, reqErr := http.NewRequest("GET", rawURL, nil)
+		Expect(reqErr).NotTo(HaveOccurred())
+		resp, err = handler.HandleLogic(setLogger(context.Background(), logger.StandardLogger()), req)
+	})
+
+	Context("when valid signature", func() {
+		BeforeEach(func() {
+			sig = SignURL(secret, pageURL)
+		})
+		It("then passed", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(200))
+		})
+	})
+	Context("when no signature", func() {
+		BeforeEach(func() {
+			sig = ""
+		})
+		It("then forbidden", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusForbidden))
+		})
+	})
+	Context("when signature of another URL", func() {
+		BeforeEach(func() {
+			sig = SignURL(secret, "https://golang.org/")
+		})
+		It("then forbidden", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusForbidden))
+		})
+	})
+	Context("when unsigned url is combined with signed one", func() {
+		BeforeEach(func() {
+			sig = SignURL(secret, pageURL)
+			extra = "http://169.254.169.254/"
+		})
+		It("then forbidden", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusForbidden))
+		})
+	})
+	Context("when all combined urls are signed", func() {
+		BeforeEach(func() {
+			extra = "https://golang.org/"
+			sig = SignURLs(secret, []string{pageURL, extra})
+		})
+		It("then passed", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(200))
+		})
+	})
+	Context("when callback_url is added to signed url", func() {
+		BeforeEach(func() {
+			sig = SignURL(secret, pageURL)
+			hook = "http://attacker.example.com/hook"
+		})
+		It("then forbidden", func() {
+			Expect(err).To(HaveOccurred())
+			Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusForbidden))
+		})
+	})
+	Context("when callback_url is signed", func() {
+		BeforeEach(func() {
+			hook = "https://example.com/hook"
+			sig = SignQuery(secret, url.Values{"url": {pageURL}, "callback_url": {hook}})
+		})
+		It("then passed", func() {
+			Expect(err).NotTo(HaveOccurred())
+			Expect(resp.StatusCode).To(Equal(200))
+		})
+	})
+})
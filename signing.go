@@ -0,0 +1,63 @@
+package imgserver
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Signs outbound origin request before it is sent, like AWS SigV4 or internal auth schemes do,
+// so images of private storage can be fetched. Signer chooses requests it signs by URL, and
+// leaves others as is. Request copy is passed, so its URL and headers can be changed.
+type RequestSigner interface {
+	SignRequest(req *http.Request) error
+}
+
+type RequestSignerFunc func(req *http.Request) error
+
+func (f RequestSignerFunc) SignRequest(req *http.Request) error {
+	return f(req)
+}
+
+// Returns RoundTripper decorator, that passes requests to rt signed by signers in order.
+// Every request is signed after all headers, like origin Authorization, are set,
+// and redirect requests are signed by their own URLs.
+func NewSigningTransport(rt http.RoundTripper, signers ...RequestSigner) http.RoundTripper {
+	if len(signers) == 0 {
+		return rt
+	}
+	return signingTransport{rt, signers}
+}
+
+type signingTransport struct {
+	http.RoundTripper
+	signers []RequestSigner
+}
+
+func (t signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTripper should not modify request
+	signed := *req
+	signed.Header = cloneHeader(req.Header)
+	signedURL := *req.URL
+	signed.URL = &signedURL
+	for _, signer := range t.signers {
+		if err := signer.SignRequest(&signed); err != nil {
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, fmt.Errorf("request signing error: %v", err)
+		}
+	}
+	return t.RoundTripper.RoundTrip(&signed)
+}
+
+// Signs origin requests of handler by signers, without replacing its client or fetcher.
+// Client of request context, if set by upper handler, is used as is.
+func (h *ImgLogicHandler) EnableRequestSigning(signers ...RequestSigner) {
+	client := *h.client
+	if client.Transport == nil {
+		client.Transport = http.DefaultTransport
+	}
+	client.Transport = NewSigningTransport(client.Transport, signers...)
+	h.client = &client
+	h.enabled = append(h.enabled, "request_signing")
+}
@@ -0,0 +1,62 @@
+package imgserver
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("request signing", func() {
+	var (
+		origin    *httptest.Server
+		signature string
+	)
+	BeforeEach(func() {
+		signature = ""
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/redirect" {
+				http.Redirect(w, r, "/signed", http.StatusFound)
+				return
+			}
+			signature = r.Header.Get("X-Signature")
+		}))
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	signer := RequestSignerFunc(func(req *http.Request) error {
+		if req.URL.Path == "/fail" {
+			return errors.New("no credentials")
+		}
+		req.Header.Set("X-Signature", req.Header.Get("Authorization")+"|"+req.URL.Path)
+		return nil
+	})
+
+	It("then request is signed after headers are set, and passed request is not changed", func() {
+		client := &http.Client{Transport: NewSigningTransport(http.DefaultTransport, signer)}
+		req, err := http.NewRequest("GET", origin.URL+"/signed", nil)
+		Expect(err).NotTo(HaveOccurred())
+		req.Header.Set("Authorization", "Bearer t")
+		resp, err := client.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(signature).To(Equal("Bearer t|/signed"))
+		Expect(req.Header.Get("X-Signature")).To(BeEmpty())
+	})
+	It("then redirect is signed by its URL", func() {
+		h := NewImgLogicHandler(&http.Client{})
+		h.EnableRequestSigning(signer)
+		resp, err := h.client.Get(origin.URL + "/redirect")
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(signature).To(Equal("|/signed"))
+	})
+	It("then signing error fails request", func() {
+		client := &http.Client{Transport: NewSigningTransport(http.DefaultTransport, signer)}
+		_, err := client.Get(origin.URL + "/fail")
+		Expect(err).To(MatchError(ContainSubstring("no credentials")))
+	})
+})
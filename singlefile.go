@@ -0,0 +1,370 @@
+package imgserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+// attributes made absolute in saved page
+var pageURLAttributes = map[string]bool{
+	"href":   true,
+	"src":    true,
+	"action": true,
+	"poster": true,
+}
+
+var (
+	cssFontFace = regexp.MustCompile(`(?i)@font-face\s*\{[^}]*\}`)
+	cssImport   = regexp.MustCompile(`@import\s+(?:url\(\s*)?['"]?([^'")\s;]+)['"]?\s*\)?[^;]*;`)
+	cssURL      = regexp.MustCompile(`url\(\s*(['"]?)([^'")]+)(['"]?)\s*\)`)
+	fontURL     = regexp.MustCompile(`(?i)\.(woff2?|ttf|otf|eot)([?#].*)?$`)
+)
+
+// max depth of inlined CSS @import chains
+const maxCSSImportDepth = 3
+
+type pageSaver struct {
+	fetcher     imageFetcher
+	inlineFonts bool
+	strip       pageStrip
+	maxSize     int64
+	resources   map[string]string // resource URL -> data URL, for resources referenced many times
+}
+
+// Kinds of resources removed from saved page by strip param, so page is static snapshot
+// making no requests, where only inlined images remain embedded.
+var pageStripKinds = []string{"scripts", "css", "frames", "fonts"}
+
+type pageStrip struct {
+	Scripts bool // script elements, event handler attributes and javascript: URLs
+	CSS     bool // stylesheet links and @import rules, inline styles are kept
+	Frames  bool // iframe, frame, object and embed elements, with content
+	Fonts   bool // @font-face rules and font preload links
+}
+
+// parses comma separated strip param, of pageStripKinds
+func parsePageStrip(param string) (pageStrip, error) {
+	var strip pageStrip
+	if param == "" {
+		return strip, nil
+	}
+	for _, kind := range strings.Split(param, ",") {
+		switch strings.ToLower(strings.TrimSpace(kind)) {
+		case "scripts":
+			strip.Scripts = true
+		case "css":
+			strip.CSS = true
+		case "frames":
+			strip.Frames = true
+		case "fonts":
+			strip.Fonts = true
+		default:
+			return strip, NewHandlerError(400, "invalid 'strip' query parameter, expected list of "+strings.Join(pageStripKinds, ", ")+": "+param)
+		}
+	}
+	return strip, nil
+}
+
+// returns true for stripped element
+func (strip pageStrip) element(token html.Token) bool {
+	switch token.Data {
+	case "script":
+		return strip.Scripts
+	case "iframe", "frame", "frameset", "object", "embed", "applet":
+		return strip.Frames
+	case "link":
+		rel := strings.ToLower(tokenAttr(token, "rel"))
+		as := strings.ToLower(tokenAttr(token, "as"))
+		return (strip.CSS && (hasLinkRel(rel, "stylesheet") || as == "style")) || (strip.Fonts && as == "font")
+	}
+	return false
+}
+
+// returns true for stripped attribute
+func (strip pageStrip) attr(attr html.Attribute) bool {
+	if !strip.Scripts {
+		return false
+	}
+	return strings.HasPrefix(attr.Key, "on") ||
+		(pageURLAttributes[attr.Key] && strings.HasPrefix(strings.ToLower(strings.TrimSpace(attr.Val)), "javascript:"))
+}
+
+// Saves page as single self-contained HTML file, like "Save Page" tools do:
+// img tags, stylesheets, images referenced by CSS, and fonts if inlineFonts, are inlined as data URLs,
+// other links are made absolute. Not fetched resources are left as absolute links.
+func savePage(ctx context.Context, fetcher imageFetcher, page io.Reader, pageURL *url.URL, inlineFonts bool, strip pageStrip) (*Response, error) {
+	log := getLocalLogger(ctx, "savePage")
+	s := &pageSaver{fetcher, inlineFonts, strip, getFetchOptions(ctx).MaxImageSize, make(map[string]string)}
+	type chunk struct {
+		data      string
+		img       imgTag
+		tokenType html.TokenType
+		fetched   <-chan fetchResult // not nil if img is fetched
+	}
+	var chunks []*chunk
+	base := pageURL
+	inStyle := false
+	dropping, depth := "", 0 // stripped element and its nesting
+	tokenizer := html.NewTokenizer(page)
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			if err := tokenizer.Err(); err != io.EOF {
+				return nil, &HandlerError{400, "invalid HTML", err}
+			}
+			break
+		}
+		if dropping != "" {
+			if name, _ := tokenizer.TagName(); string(name) == dropping {
+				switch tokenType {
+				case html.StartTagToken:
+					depth++
+				case html.EndTagToken:
+					if depth--; depth == 0 {
+						dropping = ""
+					}
+				}
+			}
+			continue
+		}
+		raw := string(tokenizer.Raw())
+		switch tokenType {
+		case html.TextToken:
+			if inStyle {
+				raw = s.inlineCSS(ctx, raw, base, 0)
+			}
+			chunks = append(chunks, &chunk{data: raw})
+			continue
+		case html.EndTagToken:
+			inStyle = false
+			chunks = append(chunks, &chunk{data: raw})
+			continue
+		case html.StartTagToken, html.SelfClosingTagToken:
+		default:
+			chunks = append(chunks, &chunk{data: raw})
+			continue
+		}
+		token := tokenizer.Token()
+		if strip.element(token) {
+			if tokenType == html.StartTagToken && !voidElements[token.Data] {
+				dropping, depth = token.Data, 1
+			}
+			continue
+		}
+		if strip.Scripts {
+			attrs := token.Attr[:0]
+			for _, attr := range token.Attr {
+				if !strip.attr(attr) {
+					attrs = append(attrs, attr)
+				}
+			}
+			token.Attr = attrs
+		}
+		inStyle = token.Data == "style" && tokenType == html.StartTagToken
+		if token.Data == "base" {
+			for _, attr := range token.Attr {
+				if attr.Key == "href" {
+					if u, err := base.Parse(attr.Val); err == nil {
+						base = u
+					}
+				}
+			}
+			// links are absolute already
+			continue
+		}
+		stylesheet := false
+		for i := range token.Attr {
+			attr := &token.Attr[i]
+			switch {
+			case pageURLAttributes[attr.Key]:
+				val := strings.TrimSpace(attr.Val)
+				if strings.HasPrefix(val, "data:") || strings.HasPrefix(val, "#") {
+					// in page links are kept
+					continue
+				}
+				if u, err := base.Parse(val); err == nil {
+					attr.Val = u.String()
+				}
+			case attr.Key == "style":
+				attr.Val = s.inlineCSS(ctx, attr.Val, base, 0)
+			case attr.Key == "rel":
+				stylesheet = strings.Contains(strings.ToLower(attr.Val), "stylesheet")
+			}
+		}
+		switch token.Data {
+		case "link":
+			if stylesheet {
+				if style, ok := s.styleToken(ctx, token); ok {
+					chunks = append(chunks, &chunk{data: style})
+					continue
+				}
+			}
+		case "img":
+			img := imgTag{-1, withoutAttr(token.Attr, "srcset"), nil}
+			for i, attr := range img.attr {
+				if attr.Key == "src" {
+					img.srcIndex = i
+				}
+			}
+			if img.srcIndex >= 0 && !img.isDataURL() {
+				c := &chunk{img: img, tokenType: tokenType}
+				c.fetched = startFetch(ctx, s.fetcher, c.img, c.img.src())
+				chunks = append(chunks, c)
+				continue
+			}
+		}
+		chunks = append(chunks, &chunk{data: token.String()})
+	}
+
+	buf := &bytes.Buffer{}
+	var images []imgTag
+	for _, c := range chunks {
+		if c.fetched == nil {
+			buf.WriteString(c.data)
+			continue
+		}
+		switch res := <-c.fetched; {
+		case res.err == nil:
+			c.img = res.img
+			if res.img.isDataURL() {
+				images = append(images, res.img)
+			}
+		case getFetchOptions(ctx).Tolerant:
+			log.WithField("src", c.img.src()).Info("image replaced by placeholder: ", res.err)
+			c.img = placeholderImage(ctx, c.img, c.img.src(), res.err)
+		default:
+			log.WithField("src", c.img.src()).Warn("image is left as link: ", res.err)
+		}
+		token := c.img.token()
+		token.Type = c.tokenType
+		buf.WriteString(token.String())
+	}
+	var imagesBytes int
+	for _, img := range images {
+		imagesBytes += dataURLDataSize(img.src())
+	}
+	resp := NewResponse()
+	resp.StatusCode = http.StatusOK
+	resp.Header.Set("Vary", responseVary(ctx))
+	resp.Header.Set("Accept-CH", ClientHintsHeaders)
+	resp.Header.Set("Content-Type", "text/html;charset=utf-8")
+	resp.Header.Set(ImageCountHeader, strconv.Itoa(len(images)))
+	resp.Header.Set(ImagesBytesHeader, strconv.Itoa(imagesBytes))
+	resp.Body = getSanitizePolicy(ctx).sanitizeDocument(buf)
+	return resp, nil
+}
+
+// returns style tag with fetched stylesheet of link token
+func (s *pageSaver) styleToken(ctx context.Context, link html.Token) (string, bool) {
+	var href, media string
+	for _, attr := range link.Attr {
+		switch attr.Key {
+		case "href":
+			href = attr.Val
+		case "media":
+			media = attr.Val
+		}
+	}
+	sheetURL, err := url.Parse(href)
+	if err != nil || href == "" {
+		return "", false
+	}
+	_, data, err := fetchResource(ctx, href, s.maxSize)
+	if err != nil {
+		getLocalLogger(ctx, "savePage").WithField("href", href).Warn("stylesheet is left as link: ", err)
+		return "", false
+	}
+	style := html.Token{Type: html.StartTagToken, Data: "style"}
+	if media != "" {
+		style.Attr = []html.Attribute{{Key: "media", Val: media}}
+	}
+	// closing sequence would end style element early
+	css := strings.Replace(s.inlineCSS(ctx, string(data), sheetURL, 0), "</style", `<\/style`, -1)
+	return style.String() + css + "</style>", true
+}
+
+// returns CSS with imports inlined, and url() references replaced by data URLs
+func (s *pageSaver) inlineCSS(ctx context.Context, css string, base *url.URL, depth int) string {
+	if s.strip.Fonts {
+		css = cssFontFace.ReplaceAllString(css, "")
+	}
+	if s.strip.CSS {
+		css = cssImport.ReplaceAllString(css, "")
+	} else if depth < maxCSSImportDepth {
+		css = cssImport.ReplaceAllStringFunc(css, func(rule string) string {
+			importURL, err := base.Parse(cssImport.FindStringSubmatch(rule)[1])
+			if err != nil {
+				return rule
+			}
+			_, data, err := fetchResource(ctx, importURL.String(), s.maxSize)
+			if err != nil {
+				return "@import url(" + importURL.String() + ");"
+			}
+			return s.inlineCSS(ctx, string(data), importURL, depth+1)
+		})
+	}
+	return cssURL.ReplaceAllStringFunc(imageSetURLs(css), func(ref string) string {
+		src := cssURL.FindStringSubmatch(ref)[2]
+		if strings.HasPrefix(src, "data:") || strings.HasPrefix(src, "#") {
+			return ref
+		}
+		u, err := base.Parse(strings.TrimSpace(src))
+		if err != nil {
+			return ref
+		}
+		absolute := u.String()
+		if fontURL.MatchString(u.Path) && !s.inlineFonts {
+			return `url("` + absolute + `")`
+		}
+		dataURL, ok := s.resources[absolute]
+		if !ok {
+			contentType, data, err := fetchResource(ctx, absolute, s.maxSize)
+			if err != nil {
+				return `url("` + absolute + `")`
+			}
+			dataURL = "data:" + strings.Replace(contentType, " ", "", -1) + ";base64," + base64.StdEncoding.EncodeToString(data)
+			s.resources[absolute] = dataURL
+		}
+		return `url("` + dataURL + `")`
+	})
+}
+
+// fetches resource, failing if it is bigger than maxSize
+func fetchResource(ctx context.Context, resourceURL string, maxSize int64) (string, []byte, error) {
+	resp, err := cxtAwareGet(ctx, resourceURL)
+	if err != nil {
+		return "", nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", nil, originStatusError("can't fetch page resource: "+resourceURL, resp.StatusCode)
+	}
+	data, err := readImageBody(resp, resourceURL, maxSize)
+	if err != nil {
+		return "", nil, err
+	}
+	contentType := strings.TrimSpace(resp.Header.Get("Content-Type"))
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+	return contentType, data, nil
+}
+
+func withoutAttr(attrs []html.Attribute, key string) []html.Attribute {
+	res := make([]html.Attribute, 0, len(attrs))
+	for _, attr := range attrs {
+		if attr.Key != key {
+			res = append(res, attr)
+		}
+	}
+	return res
+}
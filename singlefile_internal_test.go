@@ -0,0 +1,76 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("single file page", func() {
+	var origin *httptest.Server
+	BeforeEach(func() {
+		resources := map[string][2]string{
+			"/css/main.css":  {"text/css", `@import "extra.css"; body { background: url(../bg.png) } @font-face { src: url(/font.woff2) }`},
+			"/css/extra.css": {"text/css", `p { background: url('/bg.png') }`},
+			"/bg.png":        {"image/png", "bg"},
+			"/img.png":       {"image/png", "img"},
+			"/font.woff2":    {"font/woff2", "font"},
+		}
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res, ok := resources[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", res[0])
+			w.Write([]byte(res[1]))
+		}))
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+	save := func(page string, fonts bool, strip pageStrip) string {
+		pageURL, _ := url.Parse(origin.URL + "/page/index.html")
+		ctx := newImgLogicContext(setLogger(context.Background(), logger.StandardLogger()), http.DefaultClient, pageURL)
+		resp, err := savePage(ctx, imageFetcherFunc(fetchImage), strings.NewReader(page), pageURL, fonts, strip)
+		Expect(err).NotTo(HaveOccurred())
+		return resp.Body.String()
+	}
+
+	It("then stylesheets and images inlined", func() {
+		res := save(`<link rel="stylesheet" href="/css/main.css"><a href="other.html">x</a><a href="#top">top</a>`+
+			`<img src="../img.png" srcset="big.png 2x"><img src="/missing.png">`, false, pageStrip{})
+		Expect(res).To(Equal(`<style>p { background: url("data:image/png;base64,Ymc=") } ` +
+			`body { background: url("data:image/png;base64,Ymc=") } @font-face { src: url("` + origin.URL + `/font.woff2") }</style>` +
+			`<a href="` + origin.URL + `/page/other.html">x</a><a href="#top">top</a>` +
+			`<img src="data:image/png;base64,aW1n">` +
+			`<img src="` + origin.URL + `/missing.png">`))
+	})
+	It("then fonts inlined on demand", func() {
+		res := save(`<style>@font-face { src: url("/font.woff2") }</style><div style="background: url(/bg.png)"></div>`, true, pageStrip{})
+		Expect(res).To(Equal(`<style>@font-face { src: url("data:font/woff2;base64,Zm9udA==") }</style>` +
+			`<div style="background: url(&#34;data:image/png;base64,Ymc=&#34;)"></div>`))
+	})
+	It("then scripts and frames stripped on demand", func() {
+		res := save(`<script src="/a.js"></script><script>document.write("<p>")</script><iframe src="/f">no frames</iframe>`+
+			`<object data="/o"><object data="/p"></object><p>in</p></object>`+
+			`<a href="javascript:x()" onclick="y()">l</a><embed src="/e.swf"><img src="/img.png" onload="z()">`, false, pageStrip{Scripts: true, Frames: true})
+		Expect(res).To(Equal(`<a>l</a><img src="data:image/png;base64,aW1n">`))
+	})
+	It("then css and fonts stripped on demand", func() {
+		res := save(`<link rel="stylesheet" href="/css/main.css"><link rel="preload" as="font" href="/font.woff2">`+
+			`<style>@import "/css/extra.css"; @font-face { src: url("/font.woff2") } p { color: red }</style>`, true, pageStrip{CSS: true, Fonts: true})
+		Expect(res).To(Equal(`<style>  p { color: red }</style>`))
+	})
+	It("then strip param parsed", func() {
+		Expect(parsePageStrip("scripts, CSS,fonts")).To(Equal(pageStrip{Scripts: true, CSS: true, Fonts: true}))
+		_, err := parsePageStrip("scripts,images")
+		Expect(err).To(HaveOccurred())
+	})
+})
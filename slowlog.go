@@ -0,0 +1,129 @@
+package imgserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// Phases of request processing, that slow requests are broken down by.
+const (
+	phasePageFetch = "page_fetch" // page fetch and decode
+	phaseParse     = "parse"      // page tokenized to img tags
+	phaseImages    = "images"     // from first to last image fetch
+	phaseRender    = "render"     // response formed from images
+)
+
+var requestPhases = []string{phasePageFetch, phaseParse, phaseImages, phaseRender}
+
+// Upper bounds of request duration histogram buckets, in seconds.
+var requestDurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Durations of request phases.
+type phaseTimings struct {
+	mu        sync.Mutex
+	durations map[string]time.Duration
+}
+
+func setPhaseTimings(ctx context.Context, timings *phaseTimings) context.Context {
+	return context.WithValue(ctx, ctxPhaseTimingsKey, timings)
+}
+
+// returns nil if phases are not timed
+func getPhaseTimings(ctx context.Context) *phaseTimings {
+	timings, _ := ctx.Value(ctxPhaseTimingsKey).(*phaseTimings)
+	return timings
+}
+
+// adds time since start to phase, does nothing for nil timings
+func (t *phaseTimings) add(phase string, start time.Time) {
+	if t == nil {
+		return
+	}
+	d := time.Since(start)
+	t.mu.Lock()
+	t.durations[phase] += d
+	t.mu.Unlock()
+}
+
+func (t *phaseTimings) fields() logger.Fields {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fields := logger.Fields{}
+	for _, phase := range requestPhases {
+		fields[phase+"_ms"] = float64(t.durations[phase]) / float64(time.Millisecond)
+	}
+	return fields
+}
+
+// Cumulative histogram of request durations, in Prometheus histogram semantics.
+type durationHistogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []int64 // per bucket, not cumulative
+	count   int64
+	sum     float64
+}
+
+func newDurationHistogram(buckets []float64) *durationHistogram {
+	return &durationHistogram{buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+func (h *durationHistogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.buckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// Durations of requests, passed SlowRequestHandler.
+var requestDurations = newDurationHistogram(requestDurationBuckets)
+
+func writeRequestMetrics(w io.Writer, h *durationHistogram) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprint(w, "# HELP imgserver_request_duration_seconds Request processing duration.\n# TYPE imgserver_request_duration_seconds histogram\n")
+	var cumulative int64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "imgserver_request_duration_seconds_bucket{le=\"%v\"} %v\n", bound, cumulative)
+	}
+	fmt.Fprintf(w, "imgserver_request_duration_seconds_bucket{le=\"+Inf\"} %v\n", h.count)
+	fmt.Fprintf(w, "imgserver_request_duration_seconds_sum %v\n", h.sum)
+	fmt.Fprintf(w, "imgserver_request_duration_seconds_count %v\n", h.count)
+}
+
+// Handler decorator, that observes request durations in histogram, and logs requests
+// slower than Threshold at Warn level, with durations of page fetch, parse, images fetch and render.
+type SlowRequestHandler struct {
+	Handler
+	Log       Logger
+	Threshold time.Duration // slow requests are not logged if 0
+}
+
+func (h SlowRequestHandler) ServeHTTPC(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	timings := &phaseTimings{durations: make(map[string]time.Duration)}
+	h.Handler.ServeHTTPC(setPhaseTimings(ctx, timings), w, req)
+	duration := time.Since(start)
+	requestDurations.observe(duration)
+	if h.Threshold > 0 && duration > h.Threshold {
+		SetEmitter(h.Log, "SlowRequestHandler").WithFields(timings.fields()).WithFields(logger.Fields{
+			"url":      redactRequestURL(req.URL),
+			"method":   req.Method,
+			"total_ms": float64(duration) / float64(time.Millisecond),
+		}).Warn("slow request")
+	}
+}
@@ -0,0 +1,51 @@
+package imgserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("slow request logging", func() {
+	It("then histogram buckets are cumulative", func() {
+		h := newDurationHistogram([]float64{0.1, 1})
+		h.observe(50 * time.Millisecond)
+		h.observe(500 * time.Millisecond)
+		h.observe(5 * time.Second)
+		buf := &bytes.Buffer{}
+		writeRequestMetrics(buf, h)
+		Expect(buf.String()).To(ContainSubstring(`imgserver_request_duration_seconds_bucket{le="0.1"} 1`))
+		Expect(buf.String()).To(ContainSubstring(`imgserver_request_duration_seconds_bucket{le="1"} 2`))
+		Expect(buf.String()).To(ContainSubstring(`imgserver_request_duration_seconds_bucket{le="+Inf"} 3`))
+		Expect(buf.String()).To(ContainSubstring(`imgserver_request_duration_seconds_count 3`))
+	})
+	It("then slow request is logged with phases", func() {
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(30 * time.Millisecond)
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte(`<img src="data:image/gif;base64,R0lG">`))
+		}))
+		defer origin.Close()
+		out := &bytes.Buffer{}
+		log := logger.New()
+		log.Out = out
+		h := SlowRequestHandler{
+			&ImgHandler{Log: log, LogicHandler: NewImgLogicHandler(http.DefaultClient), ErrorHandler: ErrorLogger{}},
+			log,
+			10 * time.Millisecond,
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTPC(context.Background(), rec, httptest.NewRequest("GET", "/?url="+url.QueryEscape(origin.URL), nil))
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(out.String()).To(ContainSubstring("slow request"))
+		Expect(out.String()).To(ContainSubstring("page_fetch_ms"))
+		Expect(out.String()).To(ContainSubstring("render_ms"))
+	})
+})
@@ -0,0 +1,247 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	SnapshotsPath     = "/" + APIVersion + "/snapshots"
+	SnapshotsDiffPath = SnapshotsPath + "/diff"
+	SnapshotIDHeader  = "X-Imgserver-Snapshot-Id"
+)
+
+// Stored page rendering.
+type Snapshot struct {
+	ID         string    `json:"id"` // timestamp like 20161012153045.123
+	Time       time.Time `json:"time"`
+	StorageURL string    `json:"storage_url"`
+	Images     []string  `json:"images"` // content hashes of inlined images
+}
+
+// Index of stored snapshots by page URL.
+type SnapshotArchive struct {
+	Log       Logger
+	MaxPerURL int           // older snapshots are dropped, no limit if 0
+	MaxAge    time.Duration // older snapshots are dropped, no limit if 0
+	Path      string        // file index is persisted to, not persisted if empty
+
+	mu        sync.Mutex
+	snapshots map[string][]Snapshot // page URL -> snapshots ordered by time
+}
+
+// Returns archive with index loaded from path, if it is not empty and file exists.
+func NewSnapshotArchive(log Logger, maxPerURL int, maxAge time.Duration, path string) (*SnapshotArchive, error) {
+	a := &SnapshotArchive{
+		Log:       log,
+		MaxPerURL: maxPerURL,
+		MaxAge:    maxAge,
+		Path:      path,
+		snapshots: make(map[string][]Snapshot),
+	}
+	if path == "" {
+		return a, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.snapshots); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *SnapshotArchive) add(pageURL string, storageURL string, images []imgTag) Snapshot {
+	a.mu.Lock()
+	snapshots := a.snapshots[pageURL]
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	if n := len(snapshots); n > 0 && !now.After(snapshots[n-1].Time) {
+		// ids are unique and ordered
+		now = snapshots[n-1].Time.Add(time.Millisecond)
+	}
+	snapshot := Snapshot{
+		ID:         now.Format("20060102150405.000"),
+		Time:       now,
+		StorageURL: storageURL,
+		Images:     imageHashes(images),
+	}
+	snapshots = append(snapshots, snapshot)
+	if a.MaxPerURL > 0 && len(snapshots) > a.MaxPerURL {
+		snapshots = append([]Snapshot(nil), snapshots[len(snapshots)-a.MaxPerURL:]...)
+	}
+	a.snapshots[pageURL] = snapshots
+	a.mu.Unlock()
+	a.persist()
+	return snapshot
+}
+
+// returns not expired page snapshots ordered by time
+func (a *SnapshotArchive) List(pageURL string) []Snapshot {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	snapshots := a.snapshots[pageURL]
+	if a.MaxAge > 0 {
+		deadline := time.Now().Add(-a.MaxAge)
+		i := sort.Search(len(snapshots), func(i int) bool { return snapshots[i].Time.After(deadline) })
+		snapshots = snapshots[i:]
+		a.snapshots[pageURL] = snapshots
+	}
+	return append([]Snapshot(nil), snapshots...)
+}
+
+func (a *SnapshotArchive) Get(pageURL string, id string) (Snapshot, bool) {
+	for _, snapshot := range a.List(pageURL) {
+		if snapshot.ID == id {
+			return snapshot, true
+		}
+	}
+	return Snapshot{}, false
+}
+
+func (a *SnapshotArchive) persist() {
+	if a.Path == "" {
+		return
+	}
+	a.mu.Lock()
+	data, err := json.Marshal(a.snapshots)
+	a.mu.Unlock()
+	if err == nil {
+		tmp := a.Path + ".tmp"
+		if err = ioutil.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, a.Path)
+		}
+	}
+	if err != nil {
+		SetEmitter(a.Log, "SnapshotArchive").Error("snapshot index persist error: ", err)
+	}
+}
+
+func imageHashes(images []imgTag) []string {
+	res := make([]string, 0, len(images))
+	for _, img := range images {
+		if !img.isInlined() {
+			continue
+		}
+		if _, data, err := img.inlineData(); err == nil {
+			res = append(res, sha256Hex(data))
+		}
+	}
+	return res
+}
+
+// Serves snapshots API:
+// SnapshotsPath?url= lists page snapshots, SnapshotsPath?url=&id= redirects to snapshot storage URL,
+// SnapshotsDiffPath?url=&from=&to= compares image sets of two snapshots.
+type SnapshotLogicHandler struct {
+	Archive   *SnapshotArchive
+	Canonical *URLCanonicalizer // same as of ImgLogicHandler storing snapshots
+}
+
+func (h SnapshotLogicHandler) HandleLogic(ctx context.Context, req *http.Request) (*Response, error) {
+	query := req.URL.Query()
+	if query.Get("url") == "" {
+		return nil, NewHandlerError(400, "no 'url' query parameter")
+	}
+	pageURL, err := h.pageURL(query)
+	if err != nil {
+		return nil, err
+	}
+	if req.URL.Path == SnapshotsDiffPath {
+		return h.diff(pageURL, query.Get("from"), query.Get("to"))
+	}
+	if id := query.Get("id"); id != "" {
+		snapshot, ok := h.Archive.Get(pageURL, id)
+		if !ok {
+			return nil, NewHandlerError(http.StatusNotFound, "no snapshot "+id)
+		}
+		resp := NewResponse()
+		resp.StatusCode = http.StatusFound
+		resp.Header.Set("Location", snapshot.StorageURL)
+		return resp, nil
+	}
+	return jsonResponse(struct {
+		URL       string     `json:"url"`
+		Snapshots []Snapshot `json:"snapshots"`
+	}{pageURL, h.Archive.List(pageURL)})
+}
+
+// Returns archive key of url param, normalized as by ImgLogicHandler storing snapshot.
+func (h SnapshotLogicHandler) pageURL(query url.Values) (string, error) {
+	params := url.Values{"url": query["url"]}
+	if strict, ok := query["strict_url"]; ok {
+		params["strict_url"] = strict
+	}
+	pageURL, err := extractURLParam(&url.URL{RawQuery: params.Encode()})
+	if err != nil {
+		return "", err
+	}
+	pageURL, _ = extractOriginAuth(pageURL, "")
+	return h.Canonical.canonical(pageURL).String(), nil
+}
+
+func (h SnapshotLogicHandler) diff(pageURL, fromID, toID string) (*Response, error) {
+	from, ok := h.Archive.Get(pageURL, fromID)
+	if !ok {
+		return nil, NewHandlerError(http.StatusNotFound, "no 'from' snapshot "+fromID)
+	}
+	to, ok := h.Archive.Get(pageURL, toID)
+	if !ok {
+		return nil, NewHandlerError(http.StatusNotFound, "no 'to' snapshot "+toID)
+	}
+	added, removed := diffSets(from.Images, to.Images)
+	return jsonResponse(struct {
+		From    string   `json:"from"`
+		To      string   `json:"to"`
+		Added   []string `json:"added"`
+		Removed []string `json:"removed"`
+	}{from.ID, to.ID, added, removed})
+}
+
+// returns elements of b not in a, and of a not in b
+func diffSets(a, b []string) (added, removed []string) {
+	inA := make(map[string]bool, len(a))
+	for _, s := range a {
+		inA[s] = true
+	}
+	inB := make(map[string]bool, len(b))
+	for _, s := range b {
+		inB[s] = true
+		if !inA[s] {
+			added = append(added, s)
+		}
+	}
+	for _, s := range a {
+		if !inB[s] {
+			removed = append(removed, s)
+		}
+	}
+	if added == nil {
+		added = []string{}
+	}
+	if removed == nil {
+		removed = []string{}
+	}
+	return
+}
+
+func jsonResponse(v interface{}) (*Response, error) {
+	resp := NewResponse()
+	resp.StatusCode = http.StatusOK
+	resp.Header.Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp.Body).Encode(v); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,53 @@
+package imgserver
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+// Bodies sniffed as text, that are declared as decodable image, are checked by decode only from this size,
+// as shorter ones are too small for reliable sniffing.
+const minSniffedTextSize = 64
+
+// Returns content type of fetched image data, declared by origin as contentType.
+// Data declared as not image is sniffed, as some origins serve images with wrong types.
+// Data declared as image is origin error, if it is HTML page, XML document or text,
+// as origins often serve error pages for missing images with 200 status.
+func sniffImage(imgURL string, contentType string, data []byte) (string, error) {
+	sniffed := http.DetectContentType(data)
+	if !strings.HasPrefix(contentType, "image") {
+		if strings.HasPrefix(sniffed, "image/") {
+			return sniffed, nil
+		}
+		if contentType == "" {
+			return "", NewHandlerError(400, "no content-type on image: "+imgURL)
+		}
+		return "", NewHandlerError(400, "not image content-type on image: "+imgURL)
+	}
+	if len(data) == 0 {
+		return "", notImageError(imgURL, "empty body")
+	}
+	if strings.HasPrefix(contentType, "image/svg") {
+		if !bytes.Contains(data, []byte("<svg")) {
+			return "", notImageError(imgURL, "no svg element")
+		}
+		return contentType, nil
+	}
+	switch {
+	case strings.HasPrefix(sniffed, "text/html"):
+		return "", notImageError(imgURL, "HTML page")
+	case strings.HasPrefix(sniffed, "text/xml"):
+		return "", notImageError(imgURL, "XML document")
+	case strings.HasPrefix(sniffed, "text/") && len(data) >= minSniffedTextSize && canDecodeImage(contentType):
+		if _, _, ok := imageDimensions(contentType, data); !ok {
+			return "", notImageError(imgURL, "text")
+		}
+	}
+	return contentType, nil
+}
+
+func notImageError(imgURL string, what string) *HandlerError {
+	description := "origin responded " + what + " instead of image: " + imgURL
+	return &HandlerError{http.StatusBadGateway, description, &OriginError{OriginNotImage, description}}
+}
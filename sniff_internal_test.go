@@ -0,0 +1,44 @@
+package imgserver
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("image sniffing", func() {
+	var pngData []byte
+	BeforeEach(func() {
+		buf := &bytes.Buffer{}
+		Expect(png.Encode(buf, image.NewGray(image.Rect(0, 0, 4, 4)))).To(Succeed())
+		pngData = buf.Bytes()
+	})
+	expectNotImage := func(contentType string, data string) {
+		_, err := sniffImage("http://example.com/a.png", contentType, []byte(data))
+		Expect(err).To(HaveOccurred())
+		Expect(err.(*HandlerError).statusCode).To(Equal(http.StatusBadGateway))
+		Expect(err.(*HandlerError).cause.(*OriginError).Code).To(Equal(OriginNotImage))
+	}
+	It("then image passed", func() {
+		Expect(sniffImage("a.png", "image/png", pngData)).To(Equal("image/png"))
+		Expect(sniffImage("a.png", "image/png", []byte("img"))).To(Equal("image/png"))
+		Expect(sniffImage("a.svg", "image/svg+xml", []byte(`<!-- logo --><svg xmlns="http://www.w3.org/2000/svg"/>`))).To(Equal("image/svg+xml"))
+	})
+	It("then image served as page detected", func() {
+		Expect(sniffImage("a.png", "text/html", pngData)).To(Equal("image/png"))
+		_, err := sniffImage("a.png", "text/html", []byte("<html></html>"))
+		Expect(err.(*HandlerError).statusCode).To(Equal(400))
+	})
+	It("then error page served as image is origin error", func() {
+		expectNotImage("image/png", "<!DOCTYPE html><html><body>Not Found</body></html>")
+		expectNotImage("image/jpeg", `<?xml version="1.0"?><Error><Code>NoSuchKey</Code></Error>`)
+		expectNotImage("image/gif", "")
+		expectNotImage("image/svg+xml", "<html></html>")
+		expectNotImage("image/png", `{"error": "image not found", "status": 404, "path": "`+strings.Repeat("a", 64)+`"}`)
+	})
+})
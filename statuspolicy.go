@@ -0,0 +1,85 @@
+package imgserver
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Codes of failed origin requests, returned in "code" field of error response.
+// Their responses are 502 Bad Gateway by default, so clients can tell origin problems
+// from their own mistakes, which are 400 Bad Request.
+const (
+	OriginStatus      = "origin_status"      // origin responded status other than 200
+	OriginUnreachable = "origin_unreachable" // origin connection or request failed
+	OriginUnsupported = "origin_unsupported" // page has unsupported content type
+)
+
+// Response status codes by error code, overriding default ones, like 424 Failed Dependency
+// for origin_status. Timeouts are always 504 Gateway Timeout, query param errors are 400 Bad Request.
+type StatusPolicy map[string]int
+
+// Parses policy of comma separated code=status pairs, like "origin_status=424,origin_unreachable=503".
+func ParseStatusPolicy(policy string) (StatusPolicy, error) {
+	res := StatusPolicy{}
+	for _, pair := range strings.Split(policy, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid status mapping %q, expected code=status", pair)
+		}
+		status, err := strconv.Atoi(parts[1])
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("invalid status of %q, expected 4xx or 5xx code", pair)
+		}
+		res[parts[0]] = status
+	}
+	return res, nil
+}
+
+// returns response status of handler error by its code
+func (p StatusPolicy) status(err *HandlerError) int {
+	if code := errorCode(err); code != "" && p[code] != 0 {
+		return p[code]
+	}
+	return err.statusCode
+}
+
+// returns code of origin error caused handler error, or empty string
+func errorCode(err *HandlerError) string {
+	switch cause := err.cause.(type) {
+	case *OriginError:
+		return cause.Code
+	case *OriginDownError:
+		return cause.Code
+	}
+	return ""
+}
+
+// Returns bad gateway error, with origin error of code. Origin error is described by err, if it is not nil,
+// so its details are logged, but not responded.
+func originFailure(code, description string, err error) *HandlerError {
+	originErr := &OriginError{code, description}
+	if err != nil {
+		originErr.Description = err.Error()
+	}
+	return &HandlerError{http.StatusBadGateway, description, originErr}
+}
+
+// Returns error of failed origin request: gateway timeout, if err is network timeout, like of
+// client or dialer timeout, otherwise bad gateway with origin_unreachable code.
+func originUnreachable(description string, err error) *HandlerError {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return &HandlerError{http.StatusGatewayTimeout, description + ": timeout", err}
+	}
+	return originFailure(OriginUnreachable, description, err)
+}
+
+// Returns error of unexpected origin response status.
+func originStatusError(description string, status int) *HandlerError {
+	return originFailure(OriginStatus, description+": expected status code 200 but found "+strconv.Itoa(status), nil)
+}
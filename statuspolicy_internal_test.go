@@ -0,0 +1,57 @@
+package imgserver
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("status policy", func() {
+	It("then origin failures are bad gateway with code", func() {
+		err := originStatusError("Can't get requested page", 404)
+		Expect(err.statusCode).To(Equal(502))
+		Expect(errorCode(err)).To(Equal(OriginStatus))
+		Expect(err.description).To(ContainSubstring("found 404"))
+		err = originFailure(OriginUnreachable, "Can't get requested page", errors.New("connection refused"))
+		Expect(err.description).To(Equal("Can't get requested page"))
+		Expect(err.cause.Error()).To(Equal("connection refused"))
+	})
+	It("then origin request timeouts are gateway timeout", func() {
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(100 * time.Millisecond)
+		}))
+		defer origin.Close()
+		_, err := (&http.Client{Timeout: 10 * time.Millisecond}).Get(origin.URL)
+		Expect(err).To(HaveOccurred())
+		ctx := context.Background()
+		hErr := originPageError(ctx, err)
+		Expect(hErr.statusCode).To(Equal(http.StatusGatewayTimeout))
+		Expect(errorCode(hErr)).To(BeEmpty())
+		hErr = originPageError(ctx, errors.New("connection refused"))
+		Expect(hErr.statusCode).To(Equal(http.StatusBadGateway))
+		Expect(errorCode(hErr)).To(Equal(OriginUnreachable))
+	})
+	It("then policy overrides statuses of codes", func() {
+		policy, err := ParseStatusPolicy("origin_status=424, origin_unreachable=503")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(policy).To(Equal(StatusPolicy{OriginStatus: 424, OriginUnreachable: 503}))
+		ctx := setLogger(context.Background(), logger.StandardLogger())
+		resp := ErrorLogger{Statuses: policy}.HandleError(ctx, httptest.NewRequest("GET", "/", nil), originStatusError("page", 404))
+		Expect(resp.StatusCode).To(Equal(424))
+		Expect(resp.Body.String()).To(ContainSubstring(OriginStatus))
+		resp = ErrorLogger{Statuses: policy}.HandleError(ctx, httptest.NewRequest("GET", "/", nil), NewHandlerError(400, "bad"))
+		Expect(resp.StatusCode).To(Equal(400))
+	})
+	It("then invalid policy is rejected", func() {
+		_, err := ParseStatusPolicy("origin_status")
+		Expect(err).To(HaveOccurred())
+		_, err = ParseStatusPolicy("origin_status=200")
+		Expect(err).To(HaveOccurred())
+	})
+})
@@ -0,0 +1,176 @@
+package imgserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/context/ctxhttp"
+)
+
+// Header with storage URL of stored rendered page.
+const StorageURLHeader = "X-Imgserver-Storage-Url"
+
+// Object storage of rendered results.
+type Storage interface {
+	// stores object and returns its URL
+	Put(ctx context.Context, key string, contentType string, data []byte) (string, error)
+}
+
+type StorageFunc func(ctx context.Context, key string, contentType string, data []byte) (string, error)
+
+func (f StorageFunc) Put(ctx context.Context, key string, contentType string, data []byte) (string, error) {
+	return f(ctx, key, contentType, data)
+}
+
+// Stores objects in local directory, served by BaseURL.
+type FileStorage struct {
+	Dir     string
+	BaseURL string
+}
+
+func (s FileStorage) Put(ctx context.Context, key string, contentType string, data []byte) (string, error) {
+	path := filepath.Join(s.Dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return "", err
+	}
+	return strings.TrimRight(s.BaseURL, "/") + "/" + key, nil
+}
+
+// Stores objects in S3 compatible storage by AWS Signature V4 signed PUT requests.
+// Google Cloud Storage can be used by https://storage.googleapis.com endpoint and HMAC keys.
+type S3Storage struct {
+	Client    *http.Client
+	Endpoint  string // like https://s3.amazonaws.com
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	PublicURL string // base URL of returned object URLs, Endpoint/Bucket if empty
+}
+
+func (s *S3Storage) Put(ctx context.Context, key string, contentType string, data []byte) (string, error) {
+	objectURL := strings.TrimRight(s.Endpoint, "/") + "/" + s.Bucket + "/" + key
+	req, err := http.NewRequest("PUT", objectURL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", contentType)
+	signAWSV4(req, sha256Hex(data), s.Region, s.AccessKey, s.SecretKey, time.Now().UTC())
+	resp, err := ctxhttp.Do(ctx, s.Client, req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		return "", fmt.Errorf("storage put status %v: %s", resp.StatusCode, body)
+	}
+	if s.PublicURL != "" {
+		return strings.TrimRight(s.PublicURL, "/") + "/" + key, nil
+	}
+	return objectURL, nil
+}
+
+// Sets AWS Signature V4 headers of S3 request. Content-Type is signed, if it is set.
+func signAWSV4(req *http.Request, payloadHash string, region string, accessKey string, secretKey string, now time.Time) {
+	const algorithm = "AWS4-HMAC-SHA256"
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if contentType := req.Header.Get("Content-Type"); contentType != "" {
+		signedHeaders = "content-type;" + signedHeaders
+		canonicalHeaders = "content-type:" + contentType + "\n" + canonicalHeaders
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := algorithm + "\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", algorithm+" Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// content addressed key, so same results are stored once
+func storageKey(prefix string, contentType string, data []byte) string {
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	return prefix + "/" + sha256Hex(data) + mediaTypeExt(mediaType)
+}
+
+// Stores response of url param page with its images if storeImages, and sets its storage URL header.
+// Stored response is indexed as page snapshot, if snapshots are enabled.
+func (h *ImgLogicHandler) storeResponse(ctx context.Context, urlParam *url.URL, response *Response, extracted *extraction, storeImages bool) error {
+	storageURL, err := storeResult(ctx, h.Storage, response, extracted.images, storeImages)
+	if err != nil {
+		return &HandlerError{http.StatusBadGateway, "result store error", err}
+	}
+	getLocalLogger(ctx, "HandleLogic").WithField("storageURL", storageURL).Debug("result stored")
+	response.Header.Set(StorageURLHeader, storageURL)
+	if h.Snapshots != nil {
+		snapshot := h.Snapshots.add(h.Canonical.canonical(urlParam).String(), storageURL, extracted.images)
+		response.Header.Set(SnapshotIDHeader, snapshot.ID)
+	}
+	return nil
+}
+
+// Stores rendered page, and inlined images if storeImages. Returns page URL.
+func storeResult(ctx context.Context, storage Storage, resp *Response, images []imgTag, storeImages bool) (string, error) {
+	if storeImages {
+		for _, img := range images {
+			if !img.isInlined() {
+				continue
+			}
+			contentType, data, err := img.inlineData()
+			if err != nil {
+				return "", err
+			}
+			if _, err := storage.Put(ctx, storageKey("images", contentType, data), contentType, data); err != nil {
+				return "", err
+			}
+		}
+	}
+	contentType := resp.Header.Get("Content-Type")
+	data := resp.Body.Bytes()
+	return storage.Put(ctx, storageKey("pages", contentType, data), contentType, data)
+}
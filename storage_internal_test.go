@@ -0,0 +1,80 @@
+package imgserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+	"golang.org/x/net/html"
+)
+
+var _ = Describe("storage", func() {
+	It("then file storage stores by content address", func() {
+		dir, err := ioutil.TempDir("", "storage")
+		Expect(err).NotTo(HaveOccurred())
+		defer os.RemoveAll(dir)
+		storage := FileStorage{dir, "http://static.example.com/"}
+		resp := NewResponse()
+		resp.Header.Set("Content-Type", "application/json")
+		resp.Body.WriteString(`{"count":0}`)
+
+		storageURL, err := storeResult(context.Background(), storage, resp, nil, false)
+		Expect(err).NotTo(HaveOccurred())
+		key := storageKey("pages", "application/json", []byte(`{"count":0}`))
+		Expect(storageURL).To(Equal("http://static.example.com/" + key))
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(key)))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(data)).To(Equal(`{"count":0}`))
+	})
+
+	It("then S3 storage sends signed PUT", func() {
+		var got *http.Request
+		var body []byte
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			got = req
+			body, _ = ioutil.ReadAll(req.Body)
+		}))
+		defer server.Close()
+		storage := &S3Storage{
+			Client:    http.DefaultClient,
+			Endpoint:  server.URL,
+			Region:    "us-east-1",
+			Bucket:    "results",
+			AccessKey: "AKID",
+			SecretKey: "secret",
+		}
+		storageURL, err := storage.Put(context.Background(), "pages/abc.html", "text/html", []byte("<html></html>"))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(storageURL).To(Equal(server.URL + "/results/pages/abc.html"))
+		Expect(got.Method).To(Equal("PUT"))
+		Expect(got.URL.Path).To(Equal("/results/pages/abc.html"))
+		Expect(body).To(Equal([]byte("<html></html>")))
+		Expect(got.Header.Get("X-Amz-Content-Sha256")).To(Equal(sha256Hex(body)))
+		Expect(strings.HasPrefix(got.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/")).To(BeTrue())
+	})
+
+	It("then inlined images stored", func() {
+		var keys []string
+		storage := StorageFunc(func(ctx context.Context, key string, contentType string, data []byte) (string, error) {
+			keys = append(keys, key)
+			return "http://storage/" + key, nil
+		})
+		resp := &Response{StatusCode: 200, Header: http.Header{"Content-Type": {"text/html"}}, Body: bytes.NewBufferString("<html></html>")}
+		images := []imgTag{
+			{0, []html.Attribute{{Key: "src", Val: "data:image/png;base64,AAAA"}}, nil},
+			{0, []html.Attribute{{Key: "src", Val: "http://example.com/big.png"}}, nil},
+		}
+		_, err := storeResult(context.Background(), storage, resp, images, true)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(HaveLen(2))
+		Expect(keys[0]).To(HavePrefix("images/"))
+		Expect(keys[1]).To(HavePrefix("pages/"))
+	})
+})
@@ -0,0 +1,103 @@
+package imgserver
+
+import (
+	"bytes"
+	"html"
+	"io"
+	"net/http"
+	"strconv"
+
+	"golang.org/x/net/context"
+)
+
+// Trailer of streamed response, set when extraction failed after images are sent.
+// Streamed gallery ends with error paragraph then too.
+const StreamErrorTrailer = "X-Imgserver-Error"
+
+// Trailers of streamed response with final statistics, sent after body.
+var streamTrailers = []string{ImageCountHeader, ImagesBytesHeader, TruncatedHeader, TotalImagesHeader, StreamErrorTrailer}
+
+// Receives every result image, as soon as it is assembled.
+type imageSink func(img imgTag) error
+
+func setImageSink(ctx context.Context, sink imageSink) context.Context {
+	return context.WithValue(ctx, ctxImageSinkKey, sink)
+}
+
+// returns nil if images are not streamed
+func getImageSink(ctx context.Context) imageSink {
+	sink, _ := ctx.Value(ctxImageSinkKey).(imageSink)
+	return sink
+}
+
+// Returns HTML gallery response, which status and headers are written at once, and images are streamed
+// in completion order while they are extracted from page body. Statistics are sent in trailers.
+// Extraction runs until body is read whole or closed, then cancel is called.
+func (h *ImgLogicHandler) streamImages(ctx context.Context, cancel context.CancelFunc, body *bytes.Buffer) *Response {
+	pr, pw := io.Pipe()
+	trailer := make(http.Header)
+	resp := NewResponseBuilder(http.StatusOK).
+		Header("Content-Type", "text/html;charset=utf-8").
+		Header("Vary", responseVary(ctx)).
+		Header("Accept-CH", ClientHintsHeaders).
+		Stream(pr, -1).
+		Trailer(trailer, streamTrailers...).
+		Build()
+	done := goroutines.start(goroutineStage)
+	go func() {
+		defer done()
+		defer cancel()
+		log := getLocalLogger(ctx, "streamImages")
+		var images, imagesBytes int
+		// client gone, so extraction is canceled
+		write := func(s string) error {
+			_, err := io.WriteString(pw, s)
+			if err != nil {
+				cancel()
+			}
+			return err
+		}
+		write("<html>\n<head>\n<title>imgserv</title>\n</head>\n<body>\n")
+		sinkCtx := setImageSink(ctx, func(img imgTag) error {
+			images++
+			imagesBytes += img.inlineSize()
+			return write(img.token().String() + "\n")
+		})
+		extracted, err := h.imgExtractor.extractImages(sinkCtx, body)
+		if err != nil {
+			description := "internal error"
+			if ctx.Err() == context.DeadlineExceeded {
+				description = "timeout"
+			} else if handlerErr, ok := err.(*HandlerError); ok {
+				description = handlerErr.description
+			}
+			log.Info("streamed extraction failed: ", err)
+			trailer.Set(StreamErrorTrailer, description)
+			write("<p class=\"error\">" + html.EscapeString(description) + "</p>\n")
+		} else {
+			if extracted.truncated {
+				trailer.Set(TruncatedHeader, "true")
+			}
+			if total := pagedTotal(ctx, extracted); total > 0 {
+				trailer.Set(TotalImagesHeader, strconv.Itoa(total))
+			}
+		}
+		trailer.Set(ImageCountHeader, strconv.Itoa(images))
+		trailer.Set(ImagesBytesHeader, strconv.Itoa(imagesBytes))
+		write("</body>\n</html>")
+		pw.Close()
+	}()
+	return resp
+}
+
+// Writer, that flushes every write, so streamed body parts are sent at once.
+type flushWriter struct {
+	w io.Writer
+	f http.Flusher
+}
+
+func (w flushWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.f.Flush()
+	return n, err
+}
@@ -0,0 +1,91 @@
+package imgserver
+
+import (
+	"bufio"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("streamed response", func() {
+	var (
+		origin  *httptest.Server
+		server  *httptest.Server
+		release chan struct{}
+	)
+	BeforeEach(func() {
+		release = make(chan struct{})
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/":
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte(`<img src="fast.png"><img src="slow.png">`))
+			case "/slow.png":
+				<-release
+				fallthrough
+			default:
+				w.Header().Set("Content-Type", "image/png")
+				w.Write([]byte("png"))
+			}
+		}))
+		server = httptest.NewServer(ContextAdaptor{
+			Handler: &ImgHandler{
+				Log:          logger.StandardLogger(),
+				LogicHandler: NewImgLogicHandler(http.DefaultClient),
+				ErrorHandler: ErrorLogger{},
+			},
+			Ctx: context.Background(),
+		})
+	})
+	AfterEach(func() {
+		server.Close()
+		origin.Close()
+	})
+	get := func(params string) (*http.Response, error) {
+		return http.Get(server.URL + "/?url=" + url.QueryEscape(origin.URL+"/") + params)
+	}
+	It("then headers and fetched images are sent before slow image, and statistics in trailers", func() {
+		resp, err := get("&stream=true")
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(200))
+		Expect(resp.Header.Get("Content-Length")).To(BeEmpty())
+		r := bufio.NewReader(resp.Body)
+		var line string
+		for !strings.HasPrefix(line, "<img") {
+			line, err = r.ReadString('\n')
+			Expect(err).NotTo(HaveOccurred())
+		}
+		Expect(line).To(ContainSubstring("data:image/png"))
+		close(release)
+		rest, err := ioutil.ReadAll(r)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(rest)).To(HaveSuffix("</html>"))
+		Expect(resp.Trailer.Get(ImageCountHeader)).To(Equal("2"))
+		Expect(resp.Trailer.Get(ImagesBytesHeader)).NotTo(BeEmpty())
+	})
+	It("then stream is rejected with other formats", func() {
+		close(release)
+		resp, err := get("&stream=true&format=json")
+		Expect(err).NotTo(HaveOccurred())
+		resp.Body.Close()
+		Expect(resp.StatusCode).To(Equal(400))
+	})
+	It("then failure after headers is in trailer", func() {
+		resp, err := get("&stream=true&timeout=200ms")
+		Expect(err).NotTo(HaveOccurred())
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(string(body)).To(ContainSubstring(`<p class="error">`))
+		Expect(resp.Trailer.Get(StreamErrorTrailer)).To(Equal("timeout"))
+		close(release)
+	})
+})
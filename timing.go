@@ -0,0 +1,160 @@
+package imgserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Per fetch timing breakdown, returned with timing param.
+const TimingHeader = "X-Imgserver-Timing"
+
+// Outbound fetch phase durations in milliseconds. Phases not happened are zero,
+// as DNS lookup of IP host, or connect and TLS handshake on reused connection.
+type FetchTiming struct {
+	DNS      float64 `json:"dns_ms"`
+	Connect  float64 `json:"connect_ms"`
+	TLS      float64 `json:"tls_ms"`
+	TTFB     float64 `json:"ttfb_ms"`     // from request start to first response byte
+	Transfer float64 `json:"transfer_ms"` // from first response byte to body close
+}
+
+// times of single fetch phases, set by httptrace hooks
+type fetchTrace struct {
+	url   string
+	mu    sync.Mutex
+	start time.Time
+	dns, dnsDone,
+	connect, connectDone,
+	tls, tlsDone,
+	firstByte, done time.Time
+}
+
+func newFetchTrace(ctx context.Context, url string) (context.Context, *fetchTrace) {
+	t := &fetchTrace{url: url, start: time.Now()}
+	set := func(field *time.Time) {
+		t.mu.Lock()
+		*field = time.Now()
+		t.mu.Unlock()
+	}
+	// start of first attempt is kept, as dialer may try several addresses
+	once := func(field *time.Time) {
+		t.mu.Lock()
+		if field.IsZero() {
+			*field = time.Now()
+		}
+		t.mu.Unlock()
+	}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart:             func(httptrace.DNSStartInfo) { once(&t.dns) },
+		DNSDone:              func(httptrace.DNSDoneInfo) { set(&t.dnsDone) },
+		ConnectStart:         func(string, string) { once(&t.connect) },
+		ConnectDone:          func(string, string, error) { set(&t.connectDone) },
+		TLSHandshakeStart:    func() { once(&t.tls) },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { set(&t.tlsDone) },
+		GotFirstResponseByte: func() { set(&t.firstByte) },
+	})
+	return ctx, t
+}
+
+// Returns phase durations. Transfer of not closed body lasts until now.
+func (t *fetchTrace) timing() FetchTiming {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	phase := func(start, end time.Time) float64 {
+		if start.IsZero() || end.IsZero() {
+			return 0
+		}
+		return float64(end.Sub(start)) / float64(time.Millisecond)
+	}
+	done := t.done
+	if done.IsZero() {
+		done = time.Now()
+	}
+	return FetchTiming{
+		DNS:      phase(t.dns, t.dnsDone),
+		Connect:  phase(t.connect, t.connectDone),
+		TLS:      phase(t.tls, t.tlsDone),
+		TTFB:     phase(t.start, t.firstByte),
+		Transfer: phase(t.firstByte, done),
+	}
+}
+
+// makes body close end transfer phase
+func (t *fetchTrace) traceBody(resp *http.Response) {
+	resp.Body = &tracedBody{resp.Body, t}
+}
+
+type tracedBody struct {
+	io.ReadCloser
+	trace *fetchTrace
+}
+
+func (b *tracedBody) Close() error {
+	b.trace.mu.Lock()
+	if b.trace.done.IsZero() {
+		b.trace.done = time.Now()
+	}
+	b.trace.mu.Unlock()
+	return b.ReadCloser.Close()
+}
+
+// Fetch timing with fetched URL.
+type URLTiming struct {
+	URL string `json:"url"`
+	FetchTiming
+}
+
+// traces of all fetches made for request, collected when timing param is set
+type fetchTimings struct {
+	mu     sync.Mutex
+	traces []*fetchTrace
+}
+
+func setFetchTimings(ctx context.Context, timings *fetchTimings) context.Context {
+	return context.WithValue(ctx, ctxFetchTimingsKey, timings)
+}
+
+// returns nil if timings are not collected
+func getFetchTimings(ctx context.Context) *fetchTimings {
+	timings, _ := ctx.Value(ctxFetchTimingsKey).(*fetchTimings)
+	return timings
+}
+
+func (ts *fetchTimings) add(t *fetchTrace) {
+	if ts == nil {
+		return
+	}
+	ts.mu.Lock()
+	ts.traces = append(ts.traces, t)
+	ts.mu.Unlock()
+}
+
+// returns timings in fetch start order
+func (ts *fetchTimings) list() []URLTiming {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	res := make([]URLTiming, len(ts.traces))
+	for i, t := range ts.traces {
+		res[i] = URLTiming{t.url, t.timing()}
+	}
+	return res
+}
+
+// Formats timings as TimingHeader value: comma separated
+// url="<url>";dns=<ms>;connect=<ms>;tls=<ms>;ttfb=<ms>;transfer=<ms> items.
+func formatTimingHeader(timings []URLTiming) string {
+	items := make([]string, len(timings))
+	for i, t := range timings {
+		items[i] = fmt.Sprintf("url=%q;dns=%.1f;connect=%.1f;tls=%.1f;ttfb=%.1f;transfer=%.1f",
+			t.URL, t.DNS, t.Connect, t.TLS, t.TTFB, t.Transfer)
+	}
+	return strings.Join(items, ", ")
+}
@@ -0,0 +1,79 @@
+package imgserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("fetch timing", func() {
+	var (
+		origin  *httptest.Server
+		timings *fetchTimings
+		records []AuditRecord
+		ctx     context.Context
+	)
+	BeforeEach(func() {
+		origin = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(20 * time.Millisecond)
+			w.Header().Set("Content-Type", "image/png")
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+			w.Write([]byte("img"))
+		}))
+		timings, records = &fetchTimings{}, nil
+		client := &http.Client{Transport: &http.Transport{}} // no connections kept from other tests
+		ctx = context.WithValue(context.Background(), CtxHTTPClientKey, client)
+		ctx = setFetchTimings(ctx, timings)
+		ctx = context.WithValue(ctx, ctxAuditorKey, &auditor{sink: AuditSinkFunc(func(rec AuditRecord) {
+			records = append(records, rec)
+		})})
+	})
+	AfterEach(func() {
+		origin.Close()
+	})
+
+	It("then phases recorded", func() {
+		resp, err := cxtAwareGet(ctx, origin.URL+"/img.png")
+		Expect(err).NotTo(HaveOccurred())
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		list := timings.list()
+		Expect(list).To(HaveLen(1))
+		t := list[0]
+		Expect(t.URL).To(Equal(origin.URL + "/img.png"))
+		Expect(t.DNS).To(BeZero()) // IP host
+		Expect(t.Connect).To(BeNumerically(">", 0))
+		Expect(t.TLS).To(BeZero())
+		Expect(t.TTFB).To(BeNumerically(">=", 20))
+		Expect(t.Transfer).To(BeNumerically(">=", 20))
+		// transfer ended on close
+		Expect(timings.list()[0].Transfer).To(Equal(t.Transfer))
+
+		Expect(records).To(HaveLen(1))
+		Expect(records[0].Timing).NotTo(BeNil())
+		Expect(records[0].Timing.TTFB).To(BeNumerically(">=", 20))
+	})
+	It("then failed fetch recorded", func() {
+		origin.Close()
+		_, err := cxtAwareGet(ctx, origin.URL+"/img.png")
+		Expect(err).To(HaveOccurred())
+		Expect(timings.list()).To(HaveLen(1))
+		Expect(timings.list()[0].TTFB).To(BeZero())
+		Expect(records[0].Error).NotTo(BeEmpty())
+	})
+	It("then header formatted", func() {
+		header := formatTimingHeader([]URLTiming{
+			{"http://a/1.png", FetchTiming{DNS: 1, Connect: 2, TLS: 3, TTFB: 10.25, Transfer: 5}},
+			{"http://a/2.png", FetchTiming{TTFB: 1}},
+		})
+		Expect(header).To(Equal(`url="http://a/1.png";dns=1.0;connect=2.0;tls=3.0;ttfb=10.2;transfer=5.0, ` +
+			`url="http://a/2.png";dns=0.0;connect=0.0;tls=0.0;ttfb=1.0;transfer=0.0`))
+	})
+})
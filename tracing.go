@@ -0,0 +1,56 @@
+package imgserver
+
+import (
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+// Distributed tracing headers of W3C Trace Context and Zipkin B3 formats,
+// that are propagated from incoming request to origin fetches.
+var traceHeaders = []string{
+	"Traceparent",
+	"Tracestate",
+	"B3",
+	"X-B3-Traceid",
+	"X-B3-Spanid",
+	"X-B3-Parentspanid",
+	"X-B3-Sampled",
+	"X-B3-Flags",
+}
+
+// Max length of propagated header value, longer ones are not propagated.
+const maxTraceHeaderLength = 512
+
+// Returns tracing headers of request, or nil if there is none.
+func requestTraceHeaders(req *http.Request) http.Header {
+	var res http.Header
+	for _, name := range traceHeaders {
+		value := req.Header.Get(name)
+		if value == "" || len(value) > maxTraceHeaderLength {
+			continue
+		}
+		if res == nil {
+			res = make(http.Header)
+		}
+		res.Set(name, value)
+	}
+	return res
+}
+
+// Makes origin fetches of request carry its tracing headers, so traces connect across imgserver hop.
+// Fetches shared by coalesced requests and cached images carry headers of request that made them.
+func setTraceHeaders(ctx context.Context, header http.Header) context.Context {
+	if header == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, ctxTraceHeadersKey, header)
+}
+
+// sets tracing headers of ctx to origin request
+func applyTraceHeaders(ctx context.Context, req *http.Request) {
+	header, _ := ctx.Value(ctxTraceHeadersKey).(http.Header)
+	for name, values := range header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+}
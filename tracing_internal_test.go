@@ -0,0 +1,61 @@
+package imgserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("trace headers", func() {
+	It("then tracing headers of request are sent with page and image fetches", func() {
+		var traced []string
+		origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			traced = append(traced, r.URL.Path+" "+r.Header.Get("Traceparent")+" "+r.Header.Get("X-B3-Sampled"))
+			if r.URL.Path == "/" {
+				w.Header().Set("Content-Type", "text/html")
+				w.Write([]byte(`<img src="a.png">`))
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("png"))
+		}))
+		defer origin.Close()
+		handle := func(propagate bool) {
+			traced = nil
+			handler := ContextAdaptor{
+				Handler: &ImgHandler{
+					Log:            logger.StandardLogger(),
+					LogicHandler:   NewImgLogicHandler(http.DefaultClient),
+					ErrorHandler:   ErrorLogger{},
+					PropagateTrace: propagate,
+				},
+				Ctx: context.Background(),
+			}
+			req := httptest.NewRequest("GET", "/?url="+url.QueryEscape(origin.URL+"/"), nil)
+			req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+			req.Header.Set("X-B3-Sampled", "1")
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			Expect(rec.Code).To(Equal(http.StatusOK))
+		}
+		handle(true)
+		Expect(traced).To(ConsistOf(
+			"/ 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 1",
+			"/a.png 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01 1",
+		))
+		handle(false)
+		Expect(traced).To(ConsistOf("/  ", "/a.png  "))
+	})
+	It("then only tracing headers are propagated", func() {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("B3", "80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1")
+		req.Header.Set("Cookie", "session=1")
+		Expect(requestTraceHeaders(req)).To(Equal(http.Header{"B3": {"80f198ee56343ba864fe8b2a57d3eff7-e457b5a2e4d86bd1-1"}}))
+		Expect(requestTraceHeaders(httptest.NewRequest("GET", "/", nil))).To(BeNil())
+	})
+})
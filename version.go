@@ -0,0 +1,85 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+)
+
+const VersionPath = "/version"
+
+// Commit of build, set by -ldflags "-X github.com/Skipor/imgserver.BuildCommit=<commit>".
+var BuildCommit = "unknown"
+
+// Build and features of binary, so operators and bug reporters see what it supports.
+type BuildInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	GoVersion string   `json:"go_version"`
+	Decoders  []string `json:"decoders"` // decoded image media types, webp and avif are enabled by build tags
+	Features  []string `json:"features"` // enabled optional features of handler, like headless or render_cache
+	Storage   string   `json:"storage,omitempty"`
+}
+
+// Returns build info of binary version, with optional features enabled in h.
+func NewBuildInfo(version string, h *ImgLogicHandler) BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    BuildCommit,
+		GoVersion: runtime.Version(),
+		Decoders:  []string{},
+		Features:  append([]string{}, h.enabled...),
+	}
+	for mediaType, decoded := range decodedImageTypes {
+		if decoded {
+			info.Decoders = append(info.Decoders, mediaType)
+		}
+	}
+	sort.Strings(info.Decoders)
+	optional := []struct {
+		name    string
+		enabled bool
+	}{
+		{"headless", h.Renderer != nil},
+		{"render_cache", h.Cache != nil},
+		{"snapshots", h.Snapshots != nil},
+		{"canonical_urls", h.Canonical != nil},
+		{"http_fallback", h.HTTPFallback},
+	}
+	for _, feature := range optional {
+		if feature.enabled {
+			info.Features = append(info.Features, feature.name)
+		}
+	}
+	sort.Strings(info.Features)
+	switch h.Storage.(type) {
+	case nil:
+	case FileStorage:
+		info.Storage = "file"
+	case *S3Storage:
+		info.Storage = "s3"
+	default:
+		info.Storage = "custom"
+	}
+	return info
+}
+
+// Serves build info as JSON.
+type VersionHandler struct {
+	Info BuildInfo
+}
+
+func (h VersionHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !(r.Method == http.MethodGet || r.Method == http.MethodHead) {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	data, _ := json.Marshal(h.Info)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	if r.Method == http.MethodGet {
+		w.Write(data)
+	}
+}
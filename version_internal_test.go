@@ -0,0 +1,31 @@
+package imgserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("version", func() {
+	It("then enabled features are reported", func() {
+		h := NewImgLogicHandler(http.DefaultClient)
+		h.Cache = NewRenderCache(time.Minute, 0, 10)
+		h.Storage = FileStorage{}
+		h.EnableImageCoalescing()
+		w := httptest.NewRecorder()
+		VersionHandler{NewBuildInfo("1.0", h)}.ServeHTTP(w, httptest.NewRequest("GET", VersionPath, nil))
+		Expect(w.Header().Get("Content-Type")).To(Equal("application/json"))
+		var info BuildInfo
+		Expect(json.Unmarshal(w.Body.Bytes(), &info)).To(Succeed())
+		Expect(info.Version).To(Equal("1.0"))
+		Expect(info.GoVersion).To(Equal(runtime.Version()))
+		Expect(info.Decoders).To(ContainElement("image/png"))
+		Expect(info.Features).To(Equal([]string{"image_coalescing", "render_cache"}))
+		Expect(info.Storage).To(Equal("file"))
+	})
+})
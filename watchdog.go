@@ -0,0 +1,78 @@
+package imgserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	"golang.org/x/net/context"
+)
+
+// Default stuck request limit, in request timeouts.
+const DefaultWatchdogFactor = 3
+
+// Max size of goroutine stacks dump, bigger dumps are truncated.
+const maxStacksDump = 1 << 20
+
+// Requests force canceled by watchdog.
+var stuckRequests int64
+
+// Handler decorator, that detects requests running longer than Factor timeouts.
+// Such requests should have been finished by timeout already, so they show cancellation bugs:
+// their contexts are force canceled, goroutine stacks are dumped to log at error level,
+// and imgserver_stuck_requests_total metric is incremented.
+type WatchdogHandler struct {
+	Handler
+	Log     Logger
+	Timeout time.Duration // request timeout, watchdog disabled if 0
+	Factor  int           // DefaultWatchdogFactor if 0
+}
+
+func (h WatchdogHandler) ServeHTTPC(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	if h.Timeout <= 0 {
+		h.Handler.ServeHTTPC(ctx, w, req)
+		return
+	}
+	factor := h.Factor
+	if factor <= 0 {
+		factor = DefaultWatchdogFactor
+	}
+	limit := time.Duration(factor) * h.Timeout
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	start := time.Now()
+	timer := time.AfterFunc(limit, func() {
+		atomic.AddInt64(&stuckRequests, 1)
+		// dump before cancel, so stacks show where request is stuck
+		SetEmitter(h.Log, "WatchdogHandler").WithFields(logger.Fields{
+			"url":        redactRequestURL(req.URL),
+			"method":     req.Method,
+			"running_ms": float64(time.Since(start)) / float64(time.Millisecond),
+			"goroutines": runtime.NumGoroutine(),
+		}).Error("stuck request canceled, goroutine stacks:\n", dumpStacks())
+		cancel()
+	})
+	defer timer.Stop()
+	h.Handler.ServeHTTPC(ctx, w, req)
+}
+
+// returns stacks of all goroutines
+func dumpStacks() string {
+	buf := make([]byte, 64<<10)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) || len(buf) >= maxStacksDump {
+			return string(buf[:n])
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+}
+
+func writeWatchdogMetrics(w io.Writer) {
+	fmt.Fprint(w, "# HELP imgserver_stuck_requests_total Requests force canceled by watchdog.\n# TYPE imgserver_stuck_requests_total counter\n")
+	fmt.Fprintf(w, "imgserver_stuck_requests_total %v\n", atomic.LoadInt64(&stuckRequests))
+}
@@ -0,0 +1,60 @@
+package imgserver
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+
+	logger "github.com/Sirupsen/logrus"
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+type stuckHandler struct {
+	canceled chan struct{}
+}
+
+func (h stuckHandler) ServeHTTPC(ctx context.Context, w http.ResponseWriter, req *http.Request) {
+	// ignores timeout, but not cancel
+	<-ctx.Done()
+	close(h.canceled)
+}
+
+var _ = Describe("watchdog", func() {
+	It("then stuck request is canceled, and stacks are logged", func() {
+		out := &bytes.Buffer{}
+		log := logger.New()
+		log.Out = out
+		stuck := atomic.LoadInt64(&stuckRequests)
+		inner := stuckHandler{make(chan struct{})}
+		h := WatchdogHandler{inner, log, 10 * time.Millisecond, 2}
+		h.ServeHTTPC(context.Background(), httptest.NewRecorder(), httptest.NewRequest("GET", "/?url=http://example.com", nil))
+		Eventually(inner.canceled).Should(BeClosed())
+		Expect(atomic.LoadInt64(&stuckRequests)).To(Equal(stuck + 1))
+		Expect(out.String()).To(ContainSubstring("stuck request canceled"))
+		Expect(out.String()).To(ContainSubstring("goroutine"))
+		buf := &bytes.Buffer{}
+		writeWatchdogMetrics(buf)
+		Expect(buf.String()).To(ContainSubstring("imgserver_stuck_requests_total"))
+	})
+	It("then finished request is not canceled", func() {
+		out := &bytes.Buffer{}
+		log := logger.New()
+		log.Out = out
+		stuck := atomic.LoadInt64(&stuckRequests)
+		h := WatchdogHandler{&ImgHandler{Log: log, LogicHandler: logicHandlerFunc(func(ctx context.Context, req *http.Request) (*Response, error) {
+			resp := NewResponse()
+			resp.StatusCode = http.StatusOK
+			return resp, nil
+		})}, log, 10 * time.Millisecond, 0}
+		rec := httptest.NewRecorder()
+		h.ServeHTTPC(context.Background(), rec, httptest.NewRequest("GET", "/", nil))
+		time.Sleep(50 * time.Millisecond)
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(atomic.LoadInt64(&stuckRequests)).To(Equal(stuck))
+		Expect(out.String()).To(BeEmpty())
+	})
+})
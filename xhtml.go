@@ -0,0 +1,50 @@
+package imgserver
+
+import (
+	"bytes"
+	"mime"
+	"regexp"
+)
+
+// XHTML media types, parsed by HTML tokenizer as text/html pages.
+var xhtmlMediaTypes = map[string]bool{
+	"application/xhtml+xml":         true,
+	"application/vnd.wap.xhtml+xml": true,
+}
+
+var (
+	utf8BOM      = []byte("\xef\xbb\xbf")
+	xmlDeclRegex = regexp.MustCompile(`^\s*<\?xml\s[^>]*?\?>`)
+	xmlEncoding  = regexp.MustCompile(`\sencoding\s*=\s*["']([A-Za-z0-9._:-]+)["']`)
+)
+
+// Returns content type of XHTML page with charset of its XML declaration, like <?xml version="1.0" encoding="ISO-8859-1"?>,
+// if content type has no charset. Pages with BOM are decoded by it, and content type is returned as is.
+func xhtmlContentType(raw []byte, contentType string) string {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["charset"] != "" {
+		return contentType
+	}
+	decl := xmlDeclRegex.Find(raw)
+	if decl == nil {
+		return contentType
+	}
+	m := xmlEncoding.FindSubmatch(decl)
+	if m == nil {
+		return contentType
+	}
+	params["charset"] = string(m[1])
+	return mime.FormatMediaType(mediaType, params)
+}
+
+// Returns decoded page without BOM, and without XML declaration of XHTML page,
+// as processing instructions are tokenized as bogus HTML comments.
+func trimPrologue(page []byte, xhtml bool) []byte {
+	page = bytes.TrimPrefix(page, utf8BOM)
+	if xhtml {
+		if decl := xmlDeclRegex.Find(page); decl != nil {
+			page = bytes.TrimLeft(page[len(decl):], " \t\r\n")
+		}
+	}
+	return page
+}
@@ -0,0 +1,43 @@
+package imgserver
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("XHTML page", func() {
+	get := func(contentType, page string) (string, error) {
+		resp := &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": {contentType}},
+			Body:       ioutil.NopCloser(strings.NewReader(page)),
+		}
+		body, err := getBody(context.Background(), resp)
+		if err != nil {
+			return "", err
+		}
+		return body.String(), nil
+	}
+	It("then XML declaration is stripped", func() {
+		body, err := get("application/xhtml+xml", "\xef\xbb\xbf<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n<html><img src=\"a.png\"/></html>")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(Equal(`<html><img src="a.png"/></html>`))
+	})
+	It("then charset of XML declaration is used", func() {
+		body, err := get("application/xhtml+xml", "<?xml version='1.0' encoding='ISO-8859-1'?><p>caf\xe9</p>")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(Equal("<p>café</p>"))
+		Expect(xhtmlContentType([]byte("<?xml version='1.0' encoding='ISO-8859-1'?>"), "application/xhtml+xml; charset=utf-8")).
+			To(Equal("application/xhtml+xml; charset=utf-8"))
+	})
+	It("then BOM of HTML page is stripped, and declaration is kept", func() {
+		body, err := get("text/html; charset=utf-8", "\xef\xbb\xbf<?xml version=\"1.0\"?><p>")
+		Expect(err).NotTo(HaveOccurred())
+		Expect(body).To(Equal(`<?xml version="1.0"?><p>`))
+	})
+})